@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// aclRight is a set of things a policy lets an identity do to keys
+type aclRight int
+
+const (
+	aclRead         aclRight = 1 << iota // rlock, runlock and renew a read lock
+	aclWrite                             // lock, unlock and the other primitives built on locks
+	aclUnlockOthers                      // release locks other identities hold
+	aclList                              // list, watch and look at locks
+)
+
+var aclRightNames = map[string]aclRight{
+	"read":          aclRead,
+	"write":         aclWrite,
+	"unlock-others": aclUnlockOthers,
+	"list":          aclList,
+}
+
+// aclRoutes is the right each endpoint needs on the keys it names, a
+// request allowed any of them passes. endpoints not listed name no key
+var aclRoutes = map[string]aclRight{
+	"/lock":            aclWrite,
+	"/unlock":          aclWrite,
+	"/rlock":           aclRead,
+	"/runlock":         aclRead,
+	"/lock-multi":      aclWrite,
+	"/upgrade":         aclWrite,
+	"/downgrade":       aclWrite,
+	"/mlock":           aclWrite,
+	"/munlock":         aclWrite,
+	"/renew":           aclRead | aclWrite,
+	"/transfer":        aclRead | aclWrite,
+	"/hold":            aclWrite,
+	"/intent":          aclWrite,
+	"/intent/cancel":   aclWrite,
+	"/cond/wait":       aclWrite,
+	"/cond/signal":     aclWrite,
+	"/cond/broadcast":  aclWrite,
+	"/elect":           aclWrite,
+	"/elect/renew":     aclWrite,
+	"/elect/resign":    aclWrite,
+	"/barrier/enter":   aclWrite,
+	"/force-unlock":    aclUnlockOthers,
+	"/cancel":          aclWrite,
+	"/watch":           aclList,
+	"/ws":              aclList,
+	"/events":          aclList,
+	"/fence":           aclList,
+	"/version":         aclList,
+	"/kv/put":          aclWrite,
+	"/kv/delete":       aclWrite,
+	"/kv/get":          aclRead | aclList,
+	"/counter/incr":    aclWrite,
+	"/counter/get":     aclRead | aclList,
+	"/locks":           aclList,
+	"/status":          aclList,
+	"/queue":           aclList,
+	"/stats/holdtimes": aclList,
+	"/stats/keys":      aclList,
+	"/elect/leader":    aclList,
+	"/barrier/wait":    aclList,
+}
+
+// aclRule grants identity, or every caller for "*", rights on the keys
+// starting with prefix, or on key alone if exact
+type aclRule struct {
+	identity string
+	rights   aclRight
+	prefix   string
+	exact    bool
+}
+
+// covers reports whether the rule applies to key, or with prefix set to
+// every key starting with key
+func (rule aclRule) covers(key string, prefix bool) bool {
+	if rule.exact {
+		return !prefix && key == rule.prefix
+	}
+	return strings.HasPrefix(key, rule.prefix)
+}
+
+type aclPolicy struct {
+	rules []aclRule
+}
+
+// acl is the policy loaded from -acl, nil lets every authenticated caller
+// use every key its permissions allow. a config reload may swap it
+var acl atomic.Pointer[aclPolicy]
+
+// loadACL reads a policy file with one "IDENTITY RIGHT[,RIGHT...] PATTERN..."
+// rule per line. IDENTITY is a caller name (an api key name, certificate
+// identity or JWT subject) or * for every caller, RIGHT is read, write,
+// unlock-others or list and a PATTERN is a key, a prefix ending in * or *
+// for every key. blank lines and lines starting with # are ignored
+func loadACL(path string) (*aclPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	policy := &aclPolicy{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: want IDENTITY RIGHTS PATTERN...", path, line)
+		}
+		var rights aclRight
+		for _, name := range strings.Split(fields[1], ",") {
+			right, ok := aclRightNames[name]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown right %q", path, line, name)
+			}
+			rights |= right
+		}
+		for _, pattern := range fields[2:] {
+			rule := aclRule{identity: fields[0], rights: rights}
+			if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+				rule.prefix = prefix
+			} else {
+				rule.prefix, rule.exact = pattern, true
+			}
+			policy.rules = append(policy.rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// allows reports whether some rule for caller grants one of rights on key
+func (policy *aclPolicy) allows(caller string, rights aclRight, key string, prefix bool) bool {
+	for _, rule := range policy.rules {
+		if (rule.identity == caller || rule.identity == "*") && rule.rights&rights != 0 && rule.covers(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclRoute returns the endpoint r was sent to without its /v1/ns/NS or /v1
+// prefix
+func aclRoute(r *http.Request) string {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/v1/ns/")
+	if !ok {
+		if route, ok := strings.CutPrefix(r.URL.Path, "/v1"); ok && aclRoutes[route] != 0 &&
+			(!strings.HasPrefix(route, "/kv/") || ownKV(r)) {
+			return route
+		}
+		return r.URL.Path
+	}
+	_, route, _ := strings.Cut(rest, "/")
+	return "/" + route
+}
+
+// aclAllows checks the keys r names against the policy: key= values,
+// prefix= values and the election or barrier names. unlocking or
+// transferring a lock another identity holds takes unlock-others as well.
+// admins are not subject to the policy
+func aclAllows(p principal, r *http.Request) bool {
+	policy := acl.Load()
+	if policy == nil || p.perms&permAdmin != 0 {
+		return true
+	}
+	route := aclRoute(r)
+	query := r.URL.Query()
+	if key, ok := strings.CutPrefix(route, "/v1/kv/"); ok {
+		rights := aclWrite
+		if r.Method == http.MethodGet {
+			rights = aclList
+		}
+		_, recurse := query["recurse"]
+		return policy.allows(p.name, rights, key, recurse)
+	}
+	rights, ok := aclRoutes[route]
+	if !ok {
+		return true
+	}
+	var keys []string
+	keys = append(keys, query["key"]...)
+	if group := query.Get("group"); len(group) != 0 {
+		keys = append(keys, electPrefix+group)
+	}
+	if name := query.Get("name"); len(name) != 0 {
+		keys = append(keys, name)
+	}
+	ns := requestNamespace(r)
+	for _, key := range keys {
+		if !keyAllowed(p, rights, scopeKey(ns, key)) {
+			return false
+		}
+	}
+	prefixes := query["prefix"]
+	for _, glob := range query["match"] {
+		prefixes = append(prefixes, globPrefix(glob))
+	}
+	if rights == aclList && len(keys) == 0 && len(prefixes) == 0 {
+		// listing everything
+		prefixes = []string{""}
+	}
+	for _, prefix := range prefixes {
+		if !policy.allows(p.name, rights, prefix, true) {
+			return false
+		}
+	}
+	if route == "/unlock" || route == "/runlock" || route == "/munlock" || route == "/transfer" {
+		if path, ok := scopedParam(r, query.Get("key")); ok {
+			return releaseAllowed(p, path, query.Get("lock-id"))
+		}
+	}
+	return true
+}
+
+// aclPermits checks a key r names outside its query, e.g. in the body,
+// against the policy
+func aclPermits(r *http.Request, rights aclRight, key string) bool {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return keyAllowed(p, rights, scopeKey(requestNamespace(r), key))
+}
+
+// keyAllowed is the check every listener, http, resp or protobuf, makes of
+// a key a request names: whether p may use the namespace of path and the
+// policy grants it one of rights on the key. admins are not subject to
+// the policy
+func keyAllowed(p principal, rights aclRight, path string) bool {
+	ns, key := splitKey(path)
+	if !p.mayUse(ns) {
+		return false
+	}
+	policy := acl.Load()
+	return policy == nil || p.perms&permAdmin != 0 || policy.allows(p.name, rights, key, false)
+}
+
+// releaseAllowed reports whether p may release lockID on path, which takes
+// unlock-others when another identity holds it
+func releaseAllowed(p principal, path, lockID string) bool {
+	policy := acl.Load()
+	if policy == nil || p.perms&permAdmin != 0 {
+		return true
+	}
+	if holder, held := lockPrincipal(path, lockID); held && holder != p.name {
+		return policy.allows(p.name, aclUnlockOthers, clientKey(path), false)
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// confineKey sets up an api key tokA whose acl rules only cover a/*
+func confineKey(t *testing.T) {
+	t.Helper()
+	setAuth(&apiKeys{keys: map[[sha256.Size]byte]principal{
+		sha256.Sum256([]byte("tokenA")): {name: "tokA", perms: permFull},
+	}})
+	acl.Store(&aclPolicy{rules: []aclRule{{identity: "tokA", rights: aclRead | aclWrite | aclList, prefix: "a/"}}})
+	t.Cleanup(func() {
+		setAuth(nil)
+		acl.Store(nil)
+		forceUnlock("a/x", "test")
+		forceUnlock("b/x", "test")
+	})
+}
+
+func TestACLHTTP(t *testing.T) {
+	confineKey(t)
+	handler := requirePerm(permWrite, lockHandler)
+	for key, want := range map[string]int{"b/x": http.StatusForbidden, "a/x": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/lock?key="+key, nil)
+		r.Header.Set("X-Api-Key", "tokenA")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != want {
+			t.Errorf("lock %s: got %d, want %d", key, w.Code, want)
+		}
+	}
+}
+
+func TestACLWebsocket(t *testing.T) {
+	confineKey(t)
+	r := httptest.NewRequest(http.MethodGet, "/ws?key=b/x", nil)
+	r.Header.Set("X-Api-Key", "tokenA")
+	w := httptest.NewRecorder()
+	requirePerm(permRead, wsHandler)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("ws on b/x: got %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestACLRESP(t *testing.T) {
+	confineKey(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveRESPConn(server)
+	in := bufio.NewReader(client)
+	send := func(args ...string) string {
+		t.Helper()
+		fmt.Fprintf(client, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(client, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		line, err := in.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(line)
+	}
+	if got := send("AUTH", "tokenA"); got != "+OK" {
+		t.Fatalf("AUTH: %s", got)
+	}
+	for _, args := range [][]string{
+		{"SET", "b/x", "v", "NX", "PX", "60000"},
+		{"GET", "b/x"},
+		{"DEL", "b/x"},
+	} {
+		if got := send(args...); !strings.HasPrefix(got, "-NOPERM") {
+			t.Errorf("%s b/x: got %s, want NOPERM", args[0], got)
+		}
+	}
+	if got := send("SET", "a/x", "v", "NX", "PX", "60000"); got != "+OK" {
+		t.Errorf("SET a/x: got %s", got)
+	}
+	if l, _, _ := lockStatus("b/x"); l.state != 0 {
+		t.Error("b/x was locked")
+	}
+}
+
+func TestACLProto(t *testing.T) {
+	confineKey(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveProtoConn(server)
+	in := bufio.NewReader(client)
+	call := func(id uint64, call int, key string) (ok bool, code string) {
+		t.Helper()
+		msg := protoString(protoVarint(nil, 1, id), call, string(protoString(nil, 1, key)))
+		if _, err := client.Write(append(binary.AppendUvarint(nil, uint64(len(msg))), msg...)); err != nil {
+			t.Fatal(err)
+		}
+		size, err := binary.ReadUvarint(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(in, frame); err != nil {
+			t.Fatal(err)
+		}
+		fields, _ := protoDecode(frame)
+		for _, f := range fields {
+			switch f.num {
+			case 2:
+				ok = f.v == 1
+			case 6:
+				code = string(f.b)
+			}
+		}
+		return ok, code
+	}
+	if ok, code := call(1, protoAuth, "tokenA"); !ok {
+		t.Fatalf("auth: %s", code)
+	}
+	if ok, code := call(2, protoLock, "b/x"); ok || code != errForbidden.code {
+		t.Errorf("lock b/x: ok %v code %q, want %q", ok, code, errForbidden.code)
+	}
+	if ok, code := call(3, protoLock, "a/x"); !ok {
+		t.Errorf("lock a/x: %s", code)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+)
+
+// adminAuth checks the callers of the -admin-listen port: the -admin-api-keys
+// keys if given, the client port's credentials otherwise
+var adminAuth authSlot
+
+var errReload = failure{code: "reload_failed", status: http.StatusInternalServerError}
+
+// reloadHandler answers POST /admin/reload by re-reading the config file
+// and the credential files as a SIGHUP does
+func reloadHandler(reload func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err := reload(); err != nil {
+			f := errReload
+			f.text = err.Error()
+			replyFailure(w, r, f)
+			return
+		}
+		replySuccess(w, r)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// granted, released, expired, upgraded, downgraded, force-released,
+	// hold-limited or overheld
+	Event     string `json:"event"`
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Mode      string `json:"mode"`
+	LockID    string `json:"lockId"`
+	// the caller that took the lock
+	Principal string `json:"principal,omitempty"`
+	Owner     string `json:"owner,omitempty"`
+	Session   string `json:"session,omitempty"`
+	Txn       string `json:"txn,omitempty"`
+	// the admin that force released the lock
+	By string `json:"by,omitempty"`
+	// hex sha256 of the previous line, so an edited or deleted record
+	// breaks the chain
+	Prev string `json:"prev"`
+}
+
+// auditLog is the append-only trail of who held which key when, separate
+// from the wal which forgets released locks on compaction. a nil *auditLog
+// records nothing. lock order is shard mutex before auditLog.mu
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// hash of the last line written
+	prev string
+}
+
+// audit is the log in use, nil if auditing is disabled. it is set once at
+// startup after the wal has been replayed
+var audit *auditLog
+
+// openAudit opens the audit log at path for appending, continuing the hash
+// chain of the records already in it
+func openAudit(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	err := a.scan(func(line []byte) bool {
+		sum := sha256.Sum256(line)
+		a.prev = hex.EncodeToString(sum[:])
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if a.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// scan calls fn with every line of the log until it returns false
+func (a *auditLog) scan(fn func(line []byte) bool) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if !fn(scanner.Bytes()) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// record appends an event of lockID on the stored key to the log and syncs
+// it, by is the admin behind a force release
+func (a *auditLog) record(event, key string, state int, lockID string, h *holder, by string) {
+	if a == nil || h == nil {
+		return
+	}
+	ns, clientKey := splitKey(key)
+	rec := auditRecord{Time: time.Now().UTC(), Event: event, Namespace: ns, Key: clientKey, Mode: stateName(state),
+		LockID: lockID, Principal: h.principal, Owner: h.owner, Session: h.session, Txn: h.txn, By: by}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rec.Prev = a.prev
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = a.f.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = a.f.Sync()
+	}
+	if err != nil {
+		slog.Error("audit write failed", "err", err)
+		return
+	}
+	sum := sha256.Sum256(line)
+	a.prev = hex.EncodeToString(sum[:])
+}
+
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+// auditHandler answers the latest limit records of the request's namespace
+// matching key=, prefix=, since= and until= (RFC 3339 times), oldest first,
+// one json object per line
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if audit == nil {
+		replyFailure(w, r, errNoAudit)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if stringLimit := query.Get("limit"); len(stringLimit) != 0 {
+		var err error
+		limit, err = strconv.Atoi(stringLimit)
+		if err != nil || limit <= 0 {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		limit = min(limit, maxListLimit)
+	}
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := query.Get(name); len(v) != 0 {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				replyFailure(w, r, errBadRequest)
+				return
+			}
+		}
+	}
+	ns := requestNamespace(r)
+	_, filterKey := query["key"]
+	key, prefix := query.Get("key"), query.Get("prefix")
+
+	var lines []string
+	err := audit.scan(func(line []byte) bool {
+		var rec auditRecord
+		if json.Unmarshal(line, &rec) != nil || rec.Namespace != ns {
+			return true
+		}
+		if filterKey && rec.Key != key || !strings.HasPrefix(rec.Key, prefix) {
+			return true
+		}
+		if !since.IsZero() && rec.Time.Before(since) {
+			return true
+		}
+		if !until.IsZero() && !rec.Time.Before(until) {
+			return false
+		}
+		if lines = append(lines, string(line)); len(lines) > limit {
+			lines = lines[1:]
+		}
+		return true
+	})
+	if err != nil {
+		slog.Error("audit read failed", "err", err)
+		replyFailure(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	for _, line := range lines {
+		w.Write([]byte(line + "\n"))
+	}
+}
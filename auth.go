@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// permission is a set of operations a caller may perform
+type permission int
+
+const (
+	permRead  permission = 1 << iota // rlock and runlock
+	permWrite                        // lock and unlock
+	permAdmin                        // force-unlock
+
+	permFull = permRead | permWrite
+)
+
+// principal is an authenticated caller
+type principal struct {
+	name  string
+	perms permission
+	// the /v1/ns/ namespaces the caller is confined to, nil for every
+	// namespace and the flat routes
+	namespaces []string
+}
+
+// mayUse reports whether p may send requests to namespace ns
+func (p principal) mayUse(ns string) bool {
+	return p.namespaces == nil || (len(ns) != 0 && slices.Contains(p.namespaces, ns))
+}
+
+// authenticator identifies the caller of a request, it returns false if the
+// request carries no valid credentials
+type authenticator interface {
+	authenticate(r *http.Request) (principal, bool)
+}
+
+// authSlot holds the authenticator in use, nil lets every request through.
+// a config reload may swap it
+type authSlot struct {
+	sync.RWMutex
+	current authenticator
+}
+
+func (s *authSlot) get() authenticator {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.current
+}
+
+func (s *authSlot) set(a authenticator) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.current = a
+}
+
+// auth checks the callers of the client port
+var auth authSlot
+
+func currentAuth() authenticator {
+	return auth.get()
+}
+
+func setAuth(a authenticator) {
+	auth.set(a)
+}
+
+type principalKey struct{}
+
+// callerName returns the name of the authenticated caller of r, empty if
+// authentication is disabled
+func callerName(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p.name
+}
+
+// requirePerm only runs handler for callers of the client port holding perm
+func requirePerm(perm permission, handler http.HandlerFunc) http.HandlerFunc {
+	return auth.require(perm, handler)
+}
+
+// require only runs handler for callers s authenticates holding perm
+func (s *authSlot) require(perm permission, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := s.get()
+		if a == nil {
+			handler(w, r)
+			return
+		}
+		p, ok := a.authenticate(r)
+		if !ok {
+			replyFailure(w, r, errUnauthorized)
+			return
+		}
+		if p.perms&perm != perm || !p.mayUse(requestNamespace(r)) || !aclAllows(p, r) {
+			replyFailure(w, r, errForbidden)
+			return
+		}
+		noteCaller(r, p.name)
+		handler(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// apiKeys authenticates requests by a static token sent as
+// "Authorization: Bearer TOKEN", "X-API-Key: TOKEN" or ?token=TOKEN
+type apiKeys struct {
+	// sha256 of the token -> principal, so lookups don't compare secrets
+	keys map[[sha256.Size]byte]principal
+}
+
+// loadAPIKeys reads a key file with one "TOKEN read|full|admin [NAME [NAMESPACE...]]"
+// entry per line, a key listing namespaces may only use those. blank
+// lines and lines starting with # are ignored
+func loadAPIKeys(path string) (*apiKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &apiKeys{keys: map[[sha256.Size]byte]principal{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want TOKEN PERMISSION [NAME [NAMESPACE...]]", path, line)
+		}
+		perms, ok := parsePermission(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown permission %q", path, line, fields[1])
+		}
+		name := fmt.Sprintf("key%d", line)
+		if len(fields) >= 3 {
+			name = fields[2]
+		}
+		scope, err := parseNamespaces(fields[min(3, len(fields)):])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		a.keys[sha256.Sum256([]byte(fields[0]))] = principal{name: name, perms: perms, namespaces: scope}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parsePermission reads read, full or admin
+func parsePermission(s string) (permission, bool) {
+	switch s {
+	case "read":
+		return permRead, true
+	case "full":
+		return permFull, true
+	case "admin":
+		return permFull | permAdmin, true
+	}
+	return 0, false
+}
+
+// parseNamespaces checks the namespaces a credential is confined to, nil
+// for none
+func parseNamespaces(names []string) ([]string, error) {
+	var scope []string
+	for _, ns := range names {
+		if !nsPattern.MatchString(ns) {
+			return nil, fmt.Errorf("bad namespace %q", ns)
+		}
+		scope = append(scope, ns)
+	}
+	return scope, nil
+}
+
+// authenticators accepts a request any one of them accepts, the first
+// match names the caller
+type authenticators []authenticator
+
+func (as authenticators) authenticate(r *http.Request) (principal, bool) {
+	for _, a := range as {
+		if p, ok := a.authenticate(r); ok {
+			return p, true
+		}
+	}
+	return principal{}, false
+}
+
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	if h := r.Header.Get("X-API-Key"); len(h) != 0 {
+		return h
+	}
+	// consul clients send their acl token here
+	if h := r.Header.Get("X-Consul-Token"); len(h) != 0 {
+		return h
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (a *apiKeys) authenticate(r *http.Request) (principal, bool) {
+	token := requestToken(r)
+	if len(token) == 0 {
+		return principal{}, false
+	}
+	p, ok := a.keys[sha256.Sum256([]byte(token))]
+	return p, ok
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultHoldHint is the hold time assumed before any lock was released
+const defaultHoldHint = time.Second
+
+// maxRetryHint bounds the Retry-After hints
+const maxRetryHint = 5 * time.Minute
+
+// typicalHold is the mean time the locks on path were held, over every key
+// if path is empty or none of its locks was released yet
+func typicalHold(path string) time.Duration {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	h := metrics.keyHoldTimes[path]
+	if len(path) == 0 || h == nil || h.count == 0 {
+		h = newHistogram(holdBuckets)
+		for _, mode := range metrics.holdTimes {
+			h.merge(mode)
+		}
+	}
+	if h.count == 0 {
+		return defaultHoldHint
+	}
+	return time.Duration(h.sum / float64(h.count) * float64(time.Second))
+}
+
+// freeIn estimates how long until path is free: what its newest holder
+// likely holds it for still, judging by the typical hold and its lease,
+// and a typical hold for every request queued ahead
+func freeIn(path string, now time.Time) time.Duration {
+	remaining, typical, queued := holdLeft(path, now)
+	return remaining + time.Duration(queued)*typical
+}
+
+// holdLeft is what the newest holder of path likely holds it for still,
+// along with the typical hold of path and how many requests are queued
+func holdLeft(path string, now time.Time) (remaining, typical time.Duration, queued int) {
+	l, queued, _ := lockStatus(path)
+	typical = typicalHold(path)
+	remaining = typical / 4
+	if len(l.holders) != 0 {
+		newest := l.holders[len(l.holders)-1]
+		remaining = max(typical-now.Sub(newest.acquired), remaining)
+		var lease time.Time
+		for _, h := range l.holders {
+			if h.expiry.IsZero() {
+				lease = time.Time{}
+				break
+			}
+			if h.expiry.After(lease) {
+				lease = h.expiry
+			}
+		}
+		if !lease.IsZero() {
+			remaining = min(remaining, max(lease.Sub(now), 0))
+		}
+	}
+	return remaining, typical, queued
+}
+
+// jitter spreads d over half to one and a half times itself, so clients
+// refused together do not come back together
+func jitter(d time.Duration) time.Duration {
+	return min(d/2+rand.N(d+1), maxRetryHint)
+}
+
+// retryHint is when a request refused for paths should try again
+func retryHint(paths ...string) time.Duration {
+	d, _ := waitEstimate(paths...)
+	return jitter(d)
+}
+
+// waitEstimate is how long a request refused for paths would likely wait
+// for them if it queued now, before any jitter, and the place it would
+// take in the longest of their queues, 1 for the front
+func waitEstimate(paths ...string) (time.Duration, int) {
+	now := time.Now()
+	var d time.Duration
+	position := 1
+	for _, path := range paths {
+		remaining, typical, queued := holdLeft(path, now)
+		d = max(d, remaining+time.Duration(queued)*typical)
+		position = max(position, queued+1)
+	}
+	return d, position
+}
+
+// setRetryAfter tells the client to come back after d, in the whole
+// seconds of Retry-After and the milliseconds of Retry-After-Ms
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	w.Header().Set("Retry-After-Ms", strconv.FormatInt(d.Milliseconds(), 10))
+}
+
+// replyFull answers a request refused by a lock quota with 429 and a hint
+// of a typical hold, the time it takes some lock to be given back
+func replyFull(w http.ResponseWriter, r *http.Request, f failure) {
+	setRetryAfter(w, jitter(typicalHold("")))
+	replyFailure(w, r, f)
+}
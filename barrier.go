@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// barrier is one round of a barrier: parties participants enter and it
+// trips once the last one has, waking everyone waiting. the next to enter
+// starts a new round
+type barrier struct {
+	parties int
+	arrived int
+	// identifies the round, generations only ever increase
+	generation int64
+	// closed when the round trips
+	tripped chan struct{}
+}
+
+// barriers holds the rounds still waiting for parties by namespace scoped
+// name, a round is dropped once it trips. barriers are not in the wal
+var barriers = struct {
+	sync.Mutex
+	m          map[string]*barrier
+	generation int64
+}{m: map[string]*barrier{}}
+
+var errParties = failure{code: "parties", text: "barrier is waiting for another number of parties", status: http.StatusConflict}
+
+// barrierState is the JSON body of the barrier endpoints
+type barrierState struct {
+	Status     string `json:"status"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+	Arrived    int    `json:"arrived,omitempty"`
+	Parties    int    `json:"parties,omitempty"`
+}
+
+// enterBarrier counts one more arrival at the current round of name,
+// tripping it if that was the last party. it returns the round
+func enterBarrier(name string, parties int) (*barrier, int, bool) {
+	barriers.Lock()
+	defer barriers.Unlock()
+
+	b := barriers.m[name]
+	if b == nil {
+		barriers.generation++
+		b = &barrier{parties: parties, generation: barriers.generation, tripped: make(chan struct{})}
+		barriers.m[name] = b
+	} else if b.parties != parties {
+		return nil, 0, false
+	}
+	b.arrived++
+	arrived := b.arrived
+	if b.arrived == b.parties {
+		close(b.tripped)
+		delete(barriers.m, name)
+	}
+	return b, arrived, true
+}
+
+// leaveBarrier takes back an arrival of a round that gave up waiting,
+// false if the round tripped meanwhile
+func leaveBarrier(name string, b *barrier) bool {
+	barriers.Lock()
+	defer barriers.Unlock()
+
+	if barriers.m[name] != b {
+		return false
+	}
+	b.arrived--
+	if b.arrived == 0 {
+		delete(barriers.m, name)
+	}
+	return true
+}
+
+// awaitBarrier blocks until round b trips, wait passes or the request goes
+func awaitBarrier(r *http.Request, b *barrier, wait time.Duration) bool {
+	if wait <= 0 {
+		select {
+		case <-b.tripped:
+			return true
+		default:
+			return false
+		}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-b.tripped:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+func replyBarrier(w http.ResponseWriter, r *http.Request, state barrierState) {
+	if state.Status == "retry" {
+		w.WriteHeader(http.StatusConflict)
+	}
+	noteReply(r, state.Status, "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, state)
+		return
+	}
+	fmt.Fprintf(w, "%s %d\n", state.Status, state.Generation)
+}
+
+// barrierEnterHandler answers POST /barrier/enter?name=B&parties=N: the
+// caller arrives at the current round of B, which trips once N callers
+// have. the reply is success if it tripped and retry otherwise, with the
+// round's generation to pass to /barrier/wait. with wait=DURATION it blocks
+// until the round trips, leaving it again if wait passes first
+func barrierEnterHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	name, ok := scopedParam(r, query.Get("name"))
+	parties, err := strconv.Atoi(query.Get("parties"))
+	wait, waitOK := durationParam(query, "wait")
+	if !ok || len(query.Get("name")) == 0 || err != nil || parties <= 0 || !waitOK {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if draining.Load() {
+		replyFailure(w, r, errDraining)
+		return
+	}
+	holdOpen(w, wait)
+	b, arrived, ok := enterBarrier(name, parties)
+	if !ok {
+		replyFailure(w, r, errParties)
+		return
+	}
+	state := barrierState{Status: "retry", Name: clientKey(name), Generation: b.generation, Arrived: arrived, Parties: parties}
+	if awaitBarrier(r, b, wait) {
+		state.Status = "success"
+	} else if wait > 0 && leaveBarrier(name, b) {
+		state.Arrived = 0
+	} else if wait > 0 {
+		state.Status = "success"
+	}
+	replyBarrier(w, r, state)
+}
+
+// barrierWaitHandler answers GET /barrier/wait?name=B&generation=G&wait=DURATION,
+// success once round G of B has tripped and retry if wait passes first
+func barrierWaitHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	name, ok := scopedParam(r, query.Get("name"))
+	generation, err := strconv.ParseInt(query.Get("generation"), 10, 64)
+	wait, waitOK := durationParam(query, "wait")
+	if !ok || len(query.Get("name")) == 0 || err != nil || generation <= 0 || !waitOK {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if wait == 0 {
+		wait = defaultWatchWait
+	}
+	holdOpen(w, wait)
+	state := barrierState{Status: "success", Name: clientKey(name), Generation: generation}
+
+	barriers.Lock()
+	b, latest := barriers.m[name], barriers.generation
+	barriers.Unlock()
+	// an older round has tripped, a newer one can't be waited for yet
+	if b == nil || b.generation != generation {
+		if generation > latest {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		replyBarrier(w, r, state)
+		return
+	}
+	state.Parties = b.parties
+	if !awaitBarrier(r, b, wait) {
+		state.Status = "retry"
+	}
+	replyBarrier(w, r, state)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchResult is what one bench worker saw
+type benchResult struct {
+	granted, contended, failed int
+	// latency of each acquire and release request
+	acquire, release []time.Duration
+	// first error, nil if every request was answered
+	err error
+}
+
+// benchWorker drives the lock requests of one bench connection
+type benchWorker struct {
+	client     *http.Client
+	base       string
+	token      string
+	keys       func() string
+	readRatio  float64
+	hold, wait time.Duration
+	rand       *rand.Rand
+}
+
+// post sends a request and returns the status and trimmed body
+func (b *benchWorker) post(endpoint string, query url.Values) (int, string, error) {
+	req, err := http.NewRequest(http.MethodPost, b.base+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(b.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, strings.TrimSpace(string(body)), err
+}
+
+// op takes a lock on a key drawn from the distribution, holds it and
+// releases it again
+func (b *benchWorker) op(res *benchResult) {
+	lock, unlock := "/lock", "/unlock"
+	if b.rand.Float64() < b.readRatio {
+		lock, unlock = "/rlock", "/runlock"
+	}
+	query := url.Values{"key": {b.keys()}}
+	if b.wait > 0 {
+		query.Set("wait", b.wait.String())
+	}
+	fail := func(err error) {
+		res.failed++
+		if res.err == nil {
+			res.err = err
+		}
+	}
+	start := time.Now()
+	status, body, err := b.post(lock, query)
+	res.acquire = append(res.acquire, time.Since(start))
+	switch {
+	case err != nil:
+		fail(err)
+		return
+	case status == http.StatusOK:
+		res.granted++
+	case body == "retry":
+		res.contended++
+		return
+	default:
+		fail(fmt.Errorf("%s answered %d: %s", lock, status, body))
+		return
+	}
+	time.Sleep(b.hold)
+	query.Del("wait")
+	query.Set("lock-id", body)
+	start = time.Now()
+	status, body, err = b.post(unlock, query)
+	res.release = append(res.release, time.Since(start))
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("%s answered %d: %s", unlock, status, body)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// percentiles formats the p50, p90, p99 and largest of sorted latencies
+func percentiles(sorted []time.Duration) string {
+	if len(sorted) == 0 {
+		return "none"
+	}
+	at := func(q float64) time.Duration {
+		return sorted[min(int(q*float64(len(sorted))), len(sorted)-1)].Round(time.Microsecond)
+	}
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s", at(0.5), at(0.9), at(0.99), at(1))
+}
+
+// benchMain runs "lockServer bench": it drives the server at -server with
+// -c workers locking and unlocking keys for -duration and prints the
+// throughput and latency percentiles. it returns the exit status
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8090", "lock server to drive")
+	token := fs.String("token", "", "api key or bearer token to send")
+	ns := fs.String("ns", "", "lock keys of this /v1/ns/ namespace")
+	concurrency := fs.Int("c", 16, "requests in flight at once")
+	duration := fs.Duration("duration", 10*time.Second, "how long to run")
+	requests := fs.Int("n", 0, "stop after this many lock attempts, 0 runs for -duration")
+	keyCount := fs.Int("keys", 1000, "number of distinct keys")
+	dist := fs.String("dist", "uniform", "key distribution: uniform or zipf")
+	skew := fs.Float64("zipf-s", 1.1, "zipf exponent, larger values concentrate on fewer keys, must be above 1")
+	readRatio := fs.Float64("reads", 0, "fraction of attempts that take read locks, 0 to 1")
+	hold := fs.Duration("hold", 0, "hold each granted lock this long before unlocking")
+	wait := fs.Duration("wait", 0, "queue this long for held keys instead of counting them as contended")
+	prefix := fs.String("prefix", "bench/", "prepended to the key numbers")
+	fs.Parse(args)
+	if *concurrency <= 0 || *keyCount <= 0 || *readRatio < 0 || *readRatio > 1 || (*dist == "zipf" && *skew <= 1) ||
+		(*dist != "uniform" && *dist != "zipf") || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+	base := strings.TrimRight(*server, "/")
+	if len(*ns) != 0 {
+		base += "/v1/ns/" + url.PathEscape(*ns)
+	} else {
+		base += "/v1"
+	}
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency}}
+
+	deadline := time.Now().Add(*duration)
+	var attempts atomic.Int64
+	results := make([]benchResult, *concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+		keys := func() string { return fmt.Sprintf("%s%d", *prefix, r.Intn(*keyCount)) }
+		if *dist == "zipf" {
+			zipf := rand.NewZipf(r, *skew, 1, uint64(*keyCount-1))
+			keys = func() string { return fmt.Sprintf("%s%d", *prefix, zipf.Uint64()) }
+		}
+		w := &benchWorker{client: client, base: base, token: *token, keys: keys, readRatio: *readRatio, hold: *hold, wait: *wait, rand: r}
+		wg.Add(1)
+		go func(res *benchResult) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if *requests > 0 && attempts.Add(1) > int64(*requests) {
+					return
+				}
+				w.op(res)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var total benchResult
+	for _, res := range results {
+		total.granted += res.granted
+		total.contended += res.contended
+		total.failed += res.failed
+		total.acquire = append(total.acquire, res.acquire...)
+		total.release = append(total.release, res.release...)
+		if total.err == nil {
+			total.err = res.err
+		}
+	}
+	slices.Sort(total.acquire)
+	slices.Sort(total.release)
+	ops := len(total.acquire)
+	fmt.Printf("%d workers, %d %s keys, %.0f%% reads, %s\n", *concurrency, *keyCount, *dist, *readRatio*100, elapsed.Round(time.Millisecond))
+	fmt.Printf("attempts  %d (%.1f/s)\n", ops, float64(ops)/elapsed.Seconds())
+	fmt.Printf("granted   %d (%.1f/s)\n", total.granted, float64(total.granted)/elapsed.Seconds())
+	fmt.Printf("contended %d\n", total.contended)
+	fmt.Printf("failed    %d\n", total.failed)
+	fmt.Printf("acquire   %s\n", percentiles(total.acquire))
+	fmt.Printf("release   %s\n", percentiles(total.release))
+	if total.err != nil {
+		fmt.Fprintln(os.Stderr, "first error:", total.err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// longest ticket= accepted
+const maxTicket = 256
+
+var (
+	errTicketInUse = failure{code: "ticket_in_use", text: "another request is waiting with this ticket", status: http.StatusConflict}
+	errNoTicket    = failure{code: "no_ticket", text: "no request is waiting with this ticket", status: http.StatusNotFound}
+	errCancelled   = failure{code: "cancelled", text: "the request was cancelled", status: http.StatusConflict}
+)
+
+// waitingTicket is a blocking lock request sent with ticket=ID, which
+// /cancel can withdraw from the queue before it is granted
+type waitingTicket struct {
+	cancel context.CancelFunc
+	// who sent the request, empty without authentication
+	principal string
+	// set by /cancel, with tickets held
+	cancelled bool
+}
+
+// tickets holds the blocking requests waiting with a ticket by key and
+// ticket. they are not in the wal, a restart drops the waiters anyway
+var tickets = struct {
+	sync.Mutex
+	m map[string]*waitingTicket
+}{m: map[string]*waitingTicket{}}
+
+// ticketKey is where the request waiting on path with ticket is kept,
+// path already holding the namespace
+func ticketKey(path, ticket string) string {
+	return path + "\x00" + ticket
+}
+
+// waitWithTicket registers a blocking request of principal on path under
+// ticket and returns the context it waits with, cancelled by /cancel, and
+// done to call once the wait is over, which reports whether it was
+// cancelled
+func waitWithTicket(ctx context.Context, path, ticket, principal string) (_ context.Context, done func() bool, ok bool) {
+	key := ticketKey(path, ticket)
+	tickets.Lock()
+	defer tickets.Unlock()
+
+	if tickets.m[key] != nil {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t := &waitingTicket{cancel: cancel, principal: principal}
+	tickets.m[key] = t
+	return ctx, func() bool {
+		tickets.Lock()
+		defer tickets.Unlock()
+
+		delete(tickets.m, key)
+		cancel()
+		return t.cancelled
+	}, true
+}
+
+// cancelTicket withdraws the request waiting on path with ticket for p,
+// who must have sent it or be an admin, and returns why it could not
+func cancelTicket(path, ticket string, p principal) (failure, bool) {
+	tickets.Lock()
+	defer tickets.Unlock()
+
+	t := tickets.m[ticketKey(path, ticket)]
+	switch {
+	case t == nil || t.cancelled:
+		return errNoTicket, false
+	case t.principal != p.name && p.perms&permAdmin == 0:
+		return errForbidden, false
+	}
+	t.cancelled = true
+	t.cancel()
+	return failure{}, true
+}
+
+// cancelHandler answers POST /cancel?key=PATH&ticket=ID by withdrawing the
+// lock or rlock request blocked on PATH that was sent with ticket=ID, by
+// the caller unless it is an admin. the request is answered with code
+// cancelled, and if it was granted a moment
+// before its lock is released again, so a client that gave up never ends
+// up holding a lock nobody will release
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	ticket := query.Get("ticket")
+	if !ok || len(ticket) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	if f, ok := cancelTicket(path, ticket, p); !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	replySuccess(w, r)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCancelTicket(t *testing.T) {
+	for _, tc := range []struct {
+		by   principal
+		want failure
+	}{
+		{principal{name: "bob", perms: permFull}, errForbidden},
+		{principal{name: "admin", perms: permFull | permAdmin}, failure{}},
+		{principal{name: "alice", perms: permWrite}, failure{}},
+	} {
+		ctx, done, ok := waitWithTicket(context.Background(), "cancel/x", "t1", "alice")
+		if !ok {
+			t.Fatal("ticket t1 in use")
+		}
+		if f, _ := cancelTicket("cancel/x", "t1", tc.by); f != tc.want {
+			t.Errorf("cancel by %s: %q, want %q", tc.by.name, f.code, tc.want.code)
+		}
+		if cancelled := ctx.Err() != nil; cancelled != (tc.want == failure{}) {
+			t.Errorf("cancel by %s: request cancelled %v", tc.by.name, cancelled)
+		}
+		done()
+	}
+	if f, _ := cancelTicket("cancel/x", "t1", principal{name: "alice"}); f != errNoTicket {
+		t.Errorf("cancel of a ticket nobody waits with: %q", f.code)
+	}
+}
@@ -0,0 +1,361 @@
+// Package client is a Go client for the lock server HTTP api. It hides the
+// plain text protocol ("retry", "failure", "success", lock ids) behind
+// typed calls and retries contended acquisitions with jittered exponential
+// backoff, honouring the server's Retry-After hints.
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrLocked is returned when a lock could not be acquired before the
+// retries ran out.
+var ErrLocked = errors.New("lockserver: key is locked")
+
+// ErrNotHeld is returned by Unlock, RUnlock and Renew when the server does not
+// know the key and lock id pair.
+var ErrNotHeld = errors.New("lockserver: lock not held")
+
+// ErrBadRequest is returned when the server rejects the request itself.
+var ErrBadRequest = errors.New("lockserver: bad request")
+
+// ErrUnavailable is returned when the server answers that it can't serve
+// the request right now, because it is shutting down or its leader can't
+// be reached. Acquisitions retry it like a contended key.
+var ErrUnavailable = errors.New("lockserver: server unavailable")
+
+// ErrRateLimited is returned when the server answers 429 because the
+// caller is over its rate limit or a lock quota is full. Acquisitions
+// retry it after the server's Retry-After hint, however long that is.
+var ErrRateLimited = errors.New("lockserver: rate limited")
+
+// deadlineSlack is the time left before the deadline for the answer to an
+// AcquireWithDeadline request waiting on the server to come back in
+const deadlineSlack = 100 * time.Millisecond
+
+// Client talks to a lock server, or to one of several that stand in for
+// each other.
+type Client struct {
+	// BaseURL is the server address, e.g. http://localhost:8090
+	BaseURL string
+	// Endpoints are more servers tried in turn when the one in use fails,
+	// followers or standbys of the same leader or nodes of a partitioned
+	// cluster
+	Endpoints []string
+	// HealthInterval is how often every endpoint's /readyz is checked, 0
+	// disables the checks. They run from the first request until Close
+	HealthInterval time.Duration
+	// HTTPClient is used for every request, one pooling up to 64 idle
+	// connections per server if nil
+	HTTPClient *http.Client
+	// Token is sent as a bearer token if the server requires an api key
+	Token string
+	// MaxRetries bounds how many times an acquisition is retried while the
+	// key is contended, the server unavailable, unreachable or rate
+	// limiting the caller, a negative value retries until the context is
+	// done
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the exponential delay between retries
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter spreads each backoff delay by up to this fraction either way,
+	// so clients refused together don't come back together. The server's
+	// Retry-After hints are jittered already and taken as they are
+	Jitter float64
+
+	pool pool
+}
+
+// New returns a client for the server at baseURL with default retry settings.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		MaxRetries: 10,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: time.Second,
+		Jitter:     0.2,
+	}
+}
+
+// Lock takes the write lock on key and returns its lock id. It retries
+// while the key is held by someone else.
+func (c *Client) Lock(ctx context.Context, key string) (string, error) {
+	return c.acquire(ctx, "/lock", url.Values{"key": {key}}, c.MaxRetries)
+}
+
+// RLock takes a read lock on key and returns its lock id. It retries while
+// the key is write locked.
+func (c *Client) RLock(ctx context.Context, key string) (string, error) {
+	return c.acquire(ctx, "/rlock", url.Values{"key": {key}}, c.MaxRetries)
+}
+
+// TryLock takes the write lock on key if it is free and returns its lock
+// id, ErrLocked if someone else holds it. It does not retry.
+func (c *Client) TryLock(ctx context.Context, key string) (string, error) {
+	return c.acquire(ctx, "/lock", url.Values{"key": {key}}, 0)
+}
+
+// TryRLock takes a read lock on key unless it is write locked, in which
+// case it returns ErrLocked. It does not retry.
+func (c *Client) TryRLock(ctx context.Context, key string) (string, error) {
+	return c.acquire(ctx, "/rlock", url.Values{"key": {key}}, 0)
+}
+
+// AcquireWithDeadline takes the write lock on key, waiting for it on the
+// server until just before the deadline of ctx rather than polling. It
+// gives up with ErrLocked while there is still time for the last answer
+// to arrive, so a grant is never lost to a request cut off by the
+// deadline. Without a deadline it retries until ctx is done.
+func (c *Client) AcquireWithDeadline(ctx context.Context, key string) (string, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return c.acquire(ctx, "/lock", url.Values{"key": {key}}, -1)
+	}
+	header := http.Header{"Idempotency-Key": {newIdempotencyKey()}}
+	var last error
+	for {
+		left := time.Until(deadline) - deadlineSlack
+		if left <= 0 {
+			if last != nil {
+				return "", last
+			}
+			return "", ErrLocked
+		}
+		body, hint, err := c.postWith(ctx, "/lock", url.Values{"key": {key}, "wait": {left.String()}}, header)
+		id, done, err := acquired(body, err)
+		if done {
+			return id, err
+		}
+		last = err
+		// the server waits less than asked if it caps wait=, or refused
+		// straight away
+		delay := min(max(hint, c.MinBackoff), time.Until(deadline)-deadlineSlack)
+		if !sleep(ctx, delay) {
+			return "", ctx.Err()
+		}
+	}
+}
+
+// Unlock releases the write lock id on key.
+func (c *Client) Unlock(ctx context.Context, key string, id string) error {
+	return c.release(ctx, "/unlock", key, id)
+}
+
+// RUnlock releases the read lock id on key.
+func (c *Client) RUnlock(ctx context.Context, key string, id string) error {
+	return c.release(ctx, "/runlock", key, id)
+}
+
+// Renew extends the lease of lock id on key to ttl from now.
+func (c *Client) Renew(ctx context.Context, key string, id string, ttl time.Duration) error {
+	return c.expectSuccess(ctx, "/renew", url.Values{"key": {key}, "lock-id": {id}, "ttl": {ttl.String()}})
+}
+
+// Transfer hands the lock id on key to owner, who gets the returned lock
+// id for it. No other client can take key in between.
+func (c *Client) Transfer(ctx context.Context, key string, id string, owner string) (string, error) {
+	body, _, err := c.post(ctx, "/transfer", url.Values{"key": {key}, "lock-id": {id}, "to-owner": {owner}})
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case body == "failure" || strings.HasPrefix(body, "failure "):
+		return "", ErrNotHeld
+	case len(body) == 0 || strings.ContainsAny(body, " \n"):
+		return "", fmt.Errorf("lockserver: unexpected response %q", body)
+	}
+	return body, nil
+}
+
+// acquire posts query to endpoint until the lock is granted, retrying a
+// contended key or an unavailable server up to retries times or, if it is
+// negative, until ctx is done. every attempt carries the same
+// Idempotency-Key, so one retried after its answer was lost on the way is
+// answered the lock granted the first time
+func (c *Client) acquire(ctx context.Context, endpoint string, query url.Values, retries int) (string, error) {
+	header := http.Header{"Idempotency-Key": {newIdempotencyKey()}}
+	backoff := c.MinBackoff
+	for attempt := 0; ; attempt++ {
+		body, hint, err := c.postWith(ctx, endpoint, query, header)
+		id, done, err := acquired(body, err)
+		if done {
+			return id, err
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if retries >= 0 && attempt >= retries {
+			if err != nil {
+				return "", err
+			}
+			return "", ErrLocked
+		}
+		// the server's hint of when the key frees up, within our bounds.
+		// a rate limit is waited out in full, asking sooner is refused
+		// again
+		delay := c.jittered(backoff)
+		switch {
+		case errors.Is(err, ErrRateLimited):
+			delay = max(hint, delay)
+		case hint > 0:
+			delay = min(max(hint, c.MinBackoff), c.MaxBackoff)
+		}
+		if !sleep(ctx, delay) {
+			return "", ctx.Err()
+		}
+		backoff *= 2
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+// acquired reads the answer to a lock request. done is false if it is
+// worth retrying: the key was contended, err is nil then, or the server
+// was unavailable, unreachable or rate limiting
+func acquired(body string, err error) (id string, done bool, _ error) {
+	switch {
+	case transient(err) || errors.Is(err, ErrRateLimited):
+		return "", false, err
+	case err != nil:
+		return "", true, err
+	case body == "retry":
+		return "", false, nil
+	case body == "failure" || strings.HasPrefix(body, "failure "):
+		return "", true, ErrBadRequest
+	case len(body) == 0 || strings.ContainsAny(body, " \n"):
+		return "", true, fmt.Errorf("lockserver: unexpected response %q", body)
+	}
+	return body, true, nil
+}
+
+// transient tells whether err is worth retrying, an unavailable server or
+// a connection that failed
+func transient(err error) bool {
+	var urlErr *url.Error
+	return errors.Is(err, ErrUnavailable) || (errors.As(err, &urlErr) && urlErr.Op != "parse")
+}
+
+// jittered spreads d by up to c.Jitter of it either way
+func (c *Client) jittered(d time.Duration) time.Duration {
+	if c.Jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + c.Jitter*(2*mathrand.Float64()-1)))
+}
+
+// sleep waits for d, false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// newIdempotencyKey returns a random key naming one acquisition
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (c *Client) release(ctx context.Context, endpoint, key string, id string) error {
+	return c.expectSuccess(ctx, endpoint, url.Values{"key": {key}, "lock-id": {id}})
+}
+
+// expectSuccess posts to an endpoint answering "success" or "failure"
+func (c *Client) expectSuccess(ctx context.Context, endpoint string, query url.Values) error {
+	body, _, err := c.post(ctx, endpoint, query)
+	if err != nil {
+		return err
+	}
+	switch body {
+	case "success":
+		return nil
+	case "failure":
+		return ErrNotHeld
+	default:
+		return fmt.Errorf("lockserver: unexpected response %q", body)
+	}
+}
+
+// post sends a POST to endpoint with query and returns the trimmed body
+// and the Retry-After hint of a refused request, 0 if it had none
+func (c *Client) post(ctx context.Context, endpoint string, query url.Values) (string, time.Duration, error) {
+	return c.postWith(ctx, endpoint, query, nil)
+}
+
+// postWith is post sending header as well. a 502, 503 or 504 answer is
+// ErrUnavailable, it and a failed connection are tried on each of the
+// other endpoints in turn. a 429 answer is ErrRateLimited, the server is
+// up and is not left for another
+func (c *Client) postWith(ctx context.Context, endpoint string, query url.Values, header http.Header) (body string, hint time.Duration, err error) {
+	for range c.endpoints() {
+		u := c.target()
+		body, hint, err = c.postTo(ctx, u, endpoint, query, header)
+		if ctx.Err() != nil || !transient(err) {
+			return body, hint, err
+		}
+		c.markDown(u)
+	}
+	return body, hint, err
+}
+
+// postTo sends the request of postWith to the server at base
+func (c *Client) postTo(ctx context.Context, base, endpoint string, query url.Values, header http.Header) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+"/v1"+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if len(c.Token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.pool.http.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return "", retryAfter(resp.Header), ErrUnavailable
+	case http.StatusTooManyRequests:
+		c.markUp(base, resp.Header)
+		return "", retryAfter(resp.Header), ErrRateLimited
+	}
+	c.markUp(base, resp.Header)
+	return strings.TrimSpace(string(b)), retryAfter(resp.Header), nil
+}
+
+// retryAfter reads the Retry-After-Ms header, or the whole seconds of
+// Retry-After
+func retryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseInt(header.Get("Retry-After-Ms"), 10, 64); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	if s, err := strconv.Atoi(header.Get("Retry-After")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scripted is a server answering the requests made to it with answers in
+// turn, the last one over and over, and recording what they carried
+type scripted struct {
+	mu      sync.Mutex
+	answers []func(w http.ResponseWriter)
+	keys    []string
+}
+
+func (s *scripted) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	answer := s.answers[min(len(s.keys), len(s.answers)-1)]
+	s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+	s.mu.Unlock()
+	answer(w)
+}
+
+// attempts is how many requests s was sent
+func (s *scripted) attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// answer replies status with body and the header name set to value, if
+// name is not empty
+func answer(status int, body, name, value string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		if len(name) != 0 {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body + "\n"))
+	}
+}
+
+// serve starts s and returns a client for it with quick retries
+func serve(t *testing.T, s *scripted) *Client {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	c := New(srv.URL)
+	c.MinBackoff, c.MaxBackoff = time.Millisecond, 5*time.Millisecond
+	t.Cleanup(c.Close)
+	return c
+}
+
+var (
+	contended = answer(http.StatusConflict, "retry", "", "")
+	granted   = answer(http.StatusOK, "0123abcd", "", "")
+)
+
+func TestLockRetriesContended(t *testing.T) {
+	s := &scripted{answers: []func(http.ResponseWriter){contended, contended, granted}}
+	id, err := serve(t, s).Lock(context.Background(), "k")
+	if err != nil || id != "0123abcd" {
+		t.Fatalf("Lock: %q %v", id, err)
+	}
+	if s.attempts() != 3 {
+		t.Errorf("%d attempts, want 3", s.attempts())
+	}
+	if len(s.keys[0]) == 0 || s.keys[0] != s.keys[1] || s.keys[1] != s.keys[2] {
+		t.Errorf("retries carried idempotency keys %q, want one and the same", s.keys)
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	s := &scripted{answers: []func(http.ResponseWriter){contended}}
+	if _, err := serve(t, s).TryLock(context.Background(), "k"); !errors.Is(err, ErrLocked) {
+		t.Errorf("TryLock on a held key: %v, want ErrLocked", err)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("TryLock made %d attempts", s.attempts())
+	}
+}
+
+func TestLockRetriesRunOut(t *testing.T) {
+	s := &scripted{answers: []func(http.ResponseWriter){contended}}
+	c := serve(t, s)
+	c.MaxRetries = 2
+	if _, err := c.Lock(context.Background(), "k"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Lock: %v, want ErrLocked", err)
+	}
+	if s.attempts() != 3 {
+		t.Errorf("%d attempts, want 3", s.attempts())
+	}
+}
+
+func TestLockRateLimited(t *testing.T) {
+	limited := answer(http.StatusTooManyRequests, "failure rate_limited", "Retry-After-Ms", "60")
+	s := &scripted{answers: []func(http.ResponseWriter){limited, granted}}
+	start := time.Now()
+	id, err := serve(t, s).Lock(context.Background(), "k")
+	if err != nil || id != "0123abcd" {
+		t.Fatalf("Lock after a 429: %q %v", id, err)
+	}
+	// the hint is honoured past MaxBackoff
+	if waited := time.Since(start); waited < 60*time.Millisecond {
+		t.Errorf("retried after %v, before the 60ms hint", waited)
+	}
+
+	s = &scripted{answers: []func(http.ResponseWriter){answer(http.StatusTooManyRequests, "failure quota", "", "")}}
+	c := serve(t, s)
+	c.MaxRetries = 1
+	if _, err := c.Lock(context.Background(), "k"); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Lock refused with 429 throughout: %v, want ErrRateLimited", err)
+	}
+}
+
+func TestLockFailsOver(t *testing.T) {
+	down := &scripted{answers: []func(http.ResponseWriter){answer(http.StatusServiceUnavailable, "failure draining", "", "")}}
+	up := &scripted{answers: []func(http.ResponseWriter){granted}}
+	c := serve(t, down)
+	srv := httptest.NewServer(up)
+	t.Cleanup(srv.Close)
+	c.Endpoints = []string{srv.URL}
+	if id, err := c.Lock(context.Background(), "k"); err != nil || id != "0123abcd" {
+		t.Fatalf("Lock: %q %v", id, err)
+	}
+	if down.attempts() != 1 || up.attempts() != 1 {
+		t.Errorf("%d attempts on the server down, %d on the one up, want 1 each", down.attempts(), up.attempts())
+	}
+}
+
+func TestAcquireWithDeadline(t *testing.T) {
+	s := &scripted{answers: []func(http.ResponseWriter){contended}}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := serve(t, s).AcquireWithDeadline(ctx, "k"); !errors.Is(err, ErrLocked) {
+		t.Errorf("AcquireWithDeadline: %v, want ErrLocked", err)
+	}
+	if ctx.Err() != nil {
+		t.Error("AcquireWithDeadline gave up after its deadline")
+	}
+}
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Mutex is a sync.Locker backed by the write lock of a key on the server,
+// so code written against a local mutex can take a distributed one. Like a
+// sync.RWMutex it also has read locks and an RLocker. Locks taken with a
+// ttl are renewed every third of it for as long as they are held, a
+// process that dies without unlocking frees the key once the lease runs
+// out.
+type Mutex struct {
+	client *Client
+	key    string
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	write *hold
+	reads []*hold
+}
+
+// hold is one lock id the Mutex holds and the goroutine renewing it
+type hold struct {
+	id string
+	// closed to stop the renewal, done once it stopped
+	stop, done chan struct{}
+	// closed if the server no longer knows the lock
+	lost chan struct{}
+}
+
+// NewMutex returns a Mutex on key. Its locks have a lease of ttl, renewed
+// while they are held, or none if ttl is 0.
+func (c *Client) NewMutex(key string, ttl time.Duration) *Mutex {
+	return &Mutex{client: c, key: key, ttl: ttl}
+}
+
+// Lock takes the write lock, waiting for as long as someone else holds
+// it. It panics if the server can't be reached or refuses the request,
+// LockContext returns those errors instead.
+func (m *Mutex) Lock() {
+	if err := m.LockContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// LockContext takes the write lock, waiting for as long as someone else
+// holds it or until ctx is done.
+func (m *Mutex) LockContext(ctx context.Context) error {
+	h, err := m.take(ctx, "/lock", -1)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.write = h
+	m.mu.Unlock()
+	return nil
+}
+
+// TryLock takes the write lock if it is free and reports whether it did,
+// like sync.Mutex's it does not wait.
+func (m *Mutex) TryLock() bool {
+	h, err := m.take(context.Background(), "/lock", 0)
+	if err != nil {
+		return false
+	}
+	m.mu.Lock()
+	m.write = h
+	m.mu.Unlock()
+	return true
+}
+
+// Unlock releases the write lock. It panics if the Mutex is not write
+// locked. The release is best effort, the lease frees the key if the
+// server can't be reached; UnlockContext returns the error instead.
+func (m *Mutex) Unlock() {
+	m.UnlockContext(context.Background())
+}
+
+// UnlockContext releases the write lock like Unlock and returns the error
+// of the release, ErrNotHeld if the lease ran out meanwhile.
+func (m *Mutex) UnlockContext(ctx context.Context) error {
+	m.mu.Lock()
+	h := m.write
+	m.write = nil
+	m.mu.Unlock()
+	if h == nil {
+		panic("lockserver: unlock of unlocked Mutex")
+	}
+	h.end()
+	return m.client.Unlock(ctx, m.key, h.id)
+}
+
+// RLock takes a read lock, waiting for as long as the key is write
+// locked. It panics if the server can't be reached or refuses the
+// request, RLockContext returns those errors instead.
+func (m *Mutex) RLock() {
+	if err := m.RLockContext(context.Background()); err != nil {
+		panic(err)
+	}
+}
+
+// TryRLock takes a read lock unless the key is write locked and reports
+// whether it did.
+func (m *Mutex) TryRLock() bool {
+	h, err := m.take(context.Background(), "/rlock", 0)
+	if err != nil {
+		return false
+	}
+	m.mu.Lock()
+	m.reads = append(m.reads, h)
+	m.mu.Unlock()
+	return true
+}
+
+// RLockContext takes a read lock, waiting for as long as the key is write
+// locked or until ctx is done.
+func (m *Mutex) RLockContext(ctx context.Context) error {
+	h, err := m.take(ctx, "/rlock", -1)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.reads = append(m.reads, h)
+	m.mu.Unlock()
+	return nil
+}
+
+// RUnlock releases one of the read locks. It panics if the Mutex is not
+// read locked.
+func (m *Mutex) RUnlock() {
+	m.mu.Lock()
+	if len(m.reads) == 0 {
+		m.mu.Unlock()
+		panic("lockserver: RUnlock of unlocked Mutex")
+	}
+	h := m.reads[len(m.reads)-1]
+	m.reads = m.reads[:len(m.reads)-1]
+	m.mu.Unlock()
+	h.end()
+	m.client.RUnlock(context.Background(), m.key, h.id)
+}
+
+// RLocker returns a sync.Locker taking and releasing read locks of m.
+func (m *Mutex) RLocker() sync.Locker {
+	return (*rlocker)(m)
+}
+
+type rlocker Mutex
+
+func (r *rlocker) Lock()   { (*Mutex)(r).RLock() }
+func (r *rlocker) Unlock() { (*Mutex)(r).RUnlock() }
+
+// Lost returns a channel closed once the server no longer knows the write
+// lock, because its lease ran out before a renewal got through. It is nil
+// while the Mutex is not write locked.
+func (m *Mutex) Lost() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.write == nil {
+		return nil
+	}
+	return m.write.lost
+}
+
+// take acquires a lock on the key through endpoint, retrying up to
+// retries times or, if it is negative, until it is granted, and starts
+// renewing it
+func (m *Mutex) take(ctx context.Context, endpoint string, retries int) (*hold, error) {
+	query := url.Values{"key": {m.key}}
+	if m.ttl > 0 {
+		query.Set("ttl", m.ttl.String())
+	}
+	id, err := m.client.acquire(ctx, endpoint, query, retries)
+	if err != nil {
+		return nil, err
+	}
+	h := &hold{id: id, stop: make(chan struct{}), done: make(chan struct{}), lost: make(chan struct{})}
+	if m.ttl <= 0 {
+		close(h.done)
+		return h, nil
+	}
+	go m.renew(h)
+	return h, nil
+}
+
+// renew extends the lease of h every third of the ttl until it is asked to
+// stop or the server no longer knows the lock. a renewal that fails
+// otherwise is tried again next time, while the lease still runs
+func (m *Mutex) renew(h *hold) {
+	defer close(h.done)
+	ticker := time.NewTicker(m.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), m.ttl/3)
+		err := m.client.Renew(ctx, m.key, h.id, m.ttl)
+		cancel()
+		if errors.Is(err, ErrNotHeld) {
+			close(h.lost)
+			return
+		}
+	}
+}
+
+// end stops renewing h
+func (h *hold) end() {
+	close(h.stop)
+	<-h.done
+}
@@ -0,0 +1,182 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LeaderHeader is sent by a server that defers to a leader, a follower or
+// a deposed leader, with the leader's base url. The client sends its
+// requests there directly once it has seen it.
+const LeaderHeader = "Lockserver-Leader"
+
+// how long an endpoint that failed is passed over before it is tried again
+// without a health check saying it is back
+const downFor = 10 * time.Second
+
+// pool is the state a Client keeps across requests: its connections, which
+// endpoints are down and who leads
+type pool struct {
+	once sync.Once
+	http *http.Client
+
+	mu sync.Mutex
+	// index into endpoints of the one in use
+	current int
+	// when each failing endpoint went down
+	down map[string]time.Time
+	// base url of the leader as the servers tell it, empty if unknown
+	leader string
+	// closes the health checks
+	stop chan struct{}
+}
+
+// NewCluster returns a client for the servers at baseURLs, which sends its
+// requests to one of them and moves on to the next when it fails. It
+// health checks them every five seconds until Close is called.
+func NewCluster(baseURLs ...string) *Client {
+	c := New(baseURLs[0])
+	for _, u := range baseURLs[1:] {
+		c.Endpoints = append(c.Endpoints, strings.TrimRight(u, "/"))
+	}
+	c.HealthInterval = 5 * time.Second
+	return c
+}
+
+// Close stops the health checks of c and closes its idle connections.
+func (c *Client) Close() {
+	c.start()
+	c.pool.mu.Lock()
+	if c.pool.stop != nil {
+		close(c.pool.stop)
+		c.pool.stop = nil
+	}
+	c.pool.mu.Unlock()
+	c.pool.http.CloseIdleConnections()
+}
+
+// endpoints returns BaseURL followed by the other Endpoints
+func (c *Client) endpoints() []string {
+	eps := []string{c.BaseURL}
+	for _, u := range c.Endpoints {
+		if u != c.BaseURL {
+			eps = append(eps, u)
+		}
+	}
+	return eps
+}
+
+// start sets up the connection pool and health checks on first use
+func (c *Client) start() {
+	c.pool.once.Do(func() {
+		c.pool.http = c.HTTPClient
+		if c.pool.http == nil {
+			// the default transport keeps two idle connections per server,
+			// too few for a client taking locks from many goroutines
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.MaxIdleConnsPerHost = 64
+			c.pool.http = &http.Client{Transport: transport}
+		}
+		c.pool.down = map[string]time.Time{}
+		if c.HealthInterval > 0 {
+			c.pool.stop = make(chan struct{})
+			go c.healthCheck(c.HealthInterval, c.pool.stop)
+		}
+	})
+}
+
+// target returns the endpoint the next request goes to: the leader if it
+// is known and up, else the one in use unless it is down, else the first
+// one up after it. if every endpoint is down the one in use is tried
+func (c *Client) target() string {
+	c.start()
+	eps := c.endpoints()
+	now := time.Now()
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	up := func(u string) bool {
+		at, ok := c.pool.down[u]
+		return !ok || now.Sub(at) >= downFor
+	}
+	if len(c.pool.leader) != 0 && up(c.pool.leader) {
+		return c.pool.leader
+	}
+	for i := range eps {
+		if j := (c.pool.current + i) % len(eps); up(eps[j]) {
+			c.pool.current = j
+			return eps[j]
+		}
+	}
+	return eps[c.pool.current%len(eps)]
+}
+
+// markDown passes over u for a while, and forgets it as the leader
+func (c *Client) markDown(u string) {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	c.pool.down[u] = time.Now()
+	if c.pool.leader == u {
+		c.pool.leader = ""
+	}
+}
+
+// markUp takes u back, learning the leader from the LeaderHeader of its
+// answer if it has one
+func (c *Client) markUp(u string, header http.Header) {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	delete(c.pool.down, u)
+	c.learnLeaderLocked(u, header)
+}
+
+// learnLeaderLocked takes the leader u names in header, if any. caller
+// must hold c.pool.mu
+func (c *Client) learnLeaderLocked(u string, header http.Header) {
+	if leader := strings.TrimRight(header.Get(LeaderHeader), "/"); len(leader) != 0 && leader != u {
+		c.pool.leader = leader
+	}
+}
+
+// healthCheck asks every endpoint's /readyz each interval until stop is
+// closed, marking those that don't answer ready down
+func (c *Client) healthCheck(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, u := range c.endpoints() {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u+"/readyz", nil)
+			if err != nil {
+				cancel()
+				continue
+			}
+			resp, err := c.pool.http.Do(req)
+			cancel()
+			if err != nil {
+				c.markDown(u)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				c.markUp(u, resp.Header)
+				continue
+			}
+			c.markDown(u)
+			// a deposed leader is not ready but names the new one
+			c.pool.mu.Lock()
+			c.learnLeaderLocked(u, resp.Header)
+			c.pool.mu.Unlock()
+		}
+	}
+}
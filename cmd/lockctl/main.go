@@ -0,0 +1,337 @@
+// lockctl is a command line client for the lock server, for shell scripts
+// and CI jobs that need coarse-grained coordination:
+//
+//	id=$(lockctl lock -wait 10m -ttl 30m deploy) || exit 1
+//	./deploy.sh
+//	lockctl unlock deploy "$id"
+//
+// usage: lockctl [-server URL] [-token TOKEN] [-ns NAMESPACE] COMMAND [flags] ARGS
+//
+// the exit status is 0 on success, 1 if the key is held by someone else
+// (lock, rlock), not held (unlock, force-unlock) or unlocked (status), and
+// 2 for any other error
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errNo is the answer "no" to a command, exit status 1
+var errNo = errors.New("no")
+
+// server is the lock server the commands talk to
+type server struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// call sends a request to endpoint and returns the status, the trimmed body
+// and the response headers
+func (s *server) call(method, endpoint string, query url.Values) (int, string, http.Header, error) {
+	req, err := http.NewRequest(method, s.baseURL+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if len(s.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b)), resp.Header, nil
+}
+
+// serverError turns a reply the command did not expect into an error
+func serverError(status int, body string) error {
+	return fmt.Errorf("server answered %d: %s", status, body)
+}
+
+type command struct {
+	usage string
+	run   func(s *server, args []string) error
+}
+
+var commands = map[string]command{
+	"lock":         {"lock [-ttl D] [-wait D] [-owner O] [-session S] [-if-version N] KEY", func(s *server, args []string) error { return lockCmd(s, "/lock", args) }},
+	"rlock":        {"rlock [-ttl D] [-wait D] [-session S] KEY", func(s *server, args []string) error { return lockCmd(s, "/rlock", args) }},
+	"unlock":       {"unlock [-read] KEY LOCKID", unlockCmd},
+	"status":       {"status KEY", statusCmd},
+	"version":      {"version KEY", versionCmd},
+	"list":         {"list [-prefix P] [-match GLOB]", listCmd},
+	"force-unlock": {"force-unlock KEY", forceUnlockCmd},
+	"steal":        {"steal [-ttl D] [-owner O] KEY TOKEN", stealCmd},
+	"transfer":     {"transfer KEY LOCKID OWNER", transferCmd},
+}
+
+// lockCmd takes a lock and prints its lock id
+func lockCmd(s *server, endpoint string, args []string) error {
+	fs := flag.NewFlagSet(endpoint[1:], flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "release the lock after this long, 0 holds it until unlocked")
+	wait := fs.Duration("wait", 0, "block this long for the key to free up, 0 fails straight away")
+	owner := fs.String("owner", "", "reentrant owner identity")
+	session := fs.String("session", "", "bind the lock to this session")
+	var ifVersion *int64
+	if endpoint == "/lock" {
+		ifVersion = fs.Int64("if-version", -1, "only lock the key if it is still at this version, -1 for any")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	query := url.Values{"key": {fs.Arg(0)}}
+	if ifVersion != nil && *ifVersion >= 0 {
+		query.Set("if-version", strconv.FormatInt(*ifVersion, 10))
+	}
+	if *ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	if *wait > 0 {
+		query.Set("wait", wait.String())
+	}
+	if len(*owner) != 0 {
+		query.Set("owner", *owner)
+	}
+	if len(*session) != 0 {
+		query.Set("session", *session)
+	}
+	status, body, _, err := s.call(http.MethodPost, endpoint, query)
+	if err != nil {
+		return err
+	}
+	switch {
+	case status == http.StatusOK:
+		fmt.Println(body)
+		return nil
+	case body == "retry", strings.HasPrefix(body, "failure key was written"):
+		return errNo
+	}
+	return serverError(status, body)
+}
+
+// versionCmd prints the version of a key
+func versionCmd(s *server, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	status, body, _, err := s.call(http.MethodGet, "/version", url.Values{"key": {args[0]}})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return serverError(status, body)
+	}
+	fmt.Println(body)
+	return nil
+}
+
+func unlockCmd(s *server, args []string) error {
+	fs := flag.NewFlagSet("unlock", flag.ExitOnError)
+	read := fs.Bool("read", false, "the lock id is a read lock")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	endpoint := "/unlock"
+	if *read {
+		endpoint = "/runlock"
+	}
+	return expectSuccess(s, endpoint, url.Values{"key": {fs.Arg(0)}, "lock-id": {fs.Arg(1)}})
+}
+
+func forceUnlockCmd(s *server, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	return expectSuccess(s, "/force-unlock", url.Values{"key": {args[0]}})
+}
+
+// transferCmd hands a lock to another owner and prints the lock id it
+// holds it by
+func transferCmd(s *server, args []string) error {
+	if len(args) != 3 {
+		return errUsage
+	}
+	status, body, _, err := s.call(http.MethodPost, "/transfer", url.Values{"key": {args[0]}, "lock-id": {args[1]}, "to-owner": {args[2]}})
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		fmt.Println(body)
+		return nil
+	case http.StatusNotFound:
+		return errNo
+	}
+	return serverError(status, body)
+}
+
+// stealCmd takes the write lock with fencing token TOKEN over and prints
+// the new lock id and fencing token
+func stealCmd(s *server, args []string) error {
+	fs := flag.NewFlagSet("steal", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "release the lock after this long, 0 holds it until unlocked")
+	owner := fs.String("owner", "", "reentrant owner identity")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	query := url.Values{"key": {fs.Arg(0)}, "force-token": {fs.Arg(1)}}
+	if *ttl > 0 {
+		query.Set("ttl", ttl.String())
+	}
+	if len(*owner) != 0 {
+		query.Set("owner", *owner)
+	}
+	status, body, header, err := s.call(http.MethodPost, "/steal", query)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK {
+		fmt.Println(body, header.Get("Fencing-Token"))
+		return nil
+	}
+	return serverError(status, body)
+}
+
+// expectSuccess posts to an endpoint that answers success, or 404 when the
+// lock is not held
+func expectSuccess(s *server, endpoint string, query url.Values) error {
+	status, body, _, err := s.call(http.MethodPost, endpoint, query)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNo
+	}
+	return serverError(status, body)
+}
+
+// statusCmd prints the holders of a key, one line each
+func statusCmd(s *server, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	// the key itself sorts first among the keys it prefixes
+	status, body, _, err := s.call(http.MethodGet, "/locks", url.Values{"prefix": {args[0]}, "limit": {"1"}})
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return serverError(status, body)
+	}
+	quoted := fmt.Sprintf("%q ", args[0])
+	held := false
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, quoted) {
+			fmt.Println(line)
+			held = true
+		}
+	}
+	if !held {
+		fmt.Println("unlocked")
+		return errNo
+	}
+	return nil
+}
+
+// listCmd prints every held lock, following the pages of /locks
+func listCmd(s *server, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	prefix := fs.String("prefix", "", "only keys starting with this")
+	match := fs.String("match", "", "only keys matching this glob, * and ? stop at a /")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+	query := url.Values{"prefix": {*prefix}, "limit": {"1000"}}
+	if len(*match) != 0 {
+		query.Set("match", *match)
+	}
+	for {
+		status, body, header, err := s.call(http.MethodGet, "/locks", query)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK {
+			return serverError(status, body)
+		}
+		if len(body) != 0 {
+			fmt.Println(body)
+		}
+		next := header.Get("Next-After")
+		if len(next) == 0 {
+			return nil
+		}
+		query.Set("after", next)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: lockctl [-server URL] [-token TOKEN] [-ns NAMESPACE] COMMAND [flags] ARGS\n\ncommands:\n")
+	for _, name := range []string{"lock", "rlock", "unlock", "status", "version", "list", "transfer", "force-unlock", "steal"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); len(v) != 0 {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	baseURL := flag.String("server", envOr("LOCKSERVER_URL", "http://localhost:8090"), "lock server address, $LOCKSERVER_URL")
+	token := flag.String("token", os.Getenv("LOCKSERVER_TOKEN"), "api key, $LOCKSERVER_TOKEN")
+	ns := flag.String("ns", os.Getenv("LOCKSERVER_NS"), "namespace of the keys, empty for the default one, $LOCKSERVER_NS")
+	timeout := flag.Duration("timeout", 0, "give up on a request after this long, 0 for no limit")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	s := &server{baseURL: strings.TrimRight(*baseURL, "/"), token: *token, client: &http.Client{Timeout: *timeout}}
+	if len(*ns) != 0 {
+		s.baseURL += "/v1/ns/" + url.PathEscape(*ns)
+	} else {
+		s.baseURL += "/v1"
+	}
+
+	err := cmd.run(s, flag.Args()[1:])
+	switch {
+	case err == nil:
+	case errors.Is(err, errNo):
+		os.Exit(1)
+	case errors.Is(err, errUsage):
+		fmt.Fprintf(os.Stderr, "usage: lockctl %s\n", cmd.usage)
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "lockctl:", err)
+		os.Exit(2)
+	}
+}
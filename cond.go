@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// conds are the condition variables of keys: the waiters parked on a key in
+// the order they started waiting, each woken by closing its channel. lock
+// order is conds before shard mutex
+var conds = struct {
+	sync.Mutex
+	m map[string][]chan struct{}
+}{m: map[string][]chan struct{}{}}
+
+// condRelease parks a waiter on the condition of path and then releases
+// the write lock lockID, so a signal sent right after the release can't be
+// missed. it returns the holder the lock had, nil and no waiter if lockID
+// is not the only hold of a write lock on path
+func condRelease(path, lockID string) (chan struct{}, *holder, failure, bool) {
+	conds.Lock()
+	defer conds.Unlock()
+
+	s := shardFor(path)
+	s.mu.Lock()
+	counter := s.locks[path]
+	if counter == nil || counter.state != 1 || counter.lockID[lockID] == nil {
+		s.mu.Unlock()
+		return nil, nil, errNotHeld, false
+	}
+	h := *counter.lockID[lockID]
+	s.mu.Unlock()
+	if h.holds > 1 {
+		return nil, nil, errReentrant, false
+	}
+	if !unlock(path, lockID) {
+		return nil, nil, errNotHeld, false
+	}
+	ch := make(chan struct{})
+	conds.m[path] = append(conds.m[path], ch)
+	return ch, &h, failure{}, true
+}
+
+// condForget drops a waiter that gave up, false if it was signalled
+// meanwhile
+func condForget(path string, ch chan struct{}) bool {
+	conds.Lock()
+	defer conds.Unlock()
+
+	waiters := conds.m[path]
+	i := slices.Index(waiters, ch)
+	if i < 0 {
+		return false
+	}
+	if waiters = slices.Delete(waiters, i, i+1); len(waiters) == 0 {
+		delete(conds.m, path)
+	} else {
+		conds.m[path] = waiters
+	}
+	return true
+}
+
+// condSignal wakes the longest waiting waiter on path, or every waiter if
+// all is set, and returns how many it woke
+func condSignal(path string, all bool) int {
+	conds.Lock()
+	defer conds.Unlock()
+
+	waiters := conds.m[path]
+	n := min(len(waiters), 1)
+	if all {
+		n = len(waiters)
+	}
+	for _, ch := range waiters[:n] {
+		close(ch)
+	}
+	if waiters = waiters[n:]; len(waiters) == 0 {
+		delete(conds.m, path)
+	} else {
+		conds.m[path] = waiters
+	}
+	return n
+}
+
+// condWaitHandler answers POST /cond/wait?key=PATH&lock-id=ID&wait=DURATION:
+// the holder of the write lock ID releases it and blocks until the
+// condition of PATH is signalled, then queues for the write lock again. the
+// reply is the new lock id and fencing token, or retry without the lock if
+// wait passes first. the lock is taken again with ttl= (default -ttl) and
+// the session and owner it had
+func condWaitHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	lockID := query.Get("lock-id")
+	if !ok || len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if wait == 0 {
+		wait = defaultWatchWait
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	holdOpen(w, wait)
+	deadline := time.Now().Add(wait)
+	ch, h, f, ok := condRelease(path, lockID)
+	if !ok {
+		replyFailure(w, r, f)
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	select {
+	case <-ch:
+	default:
+		if condForget(path, ch) {
+			replyRetry(w, r, path)
+			return
+		}
+	}
+	opts := lockOptions{ttl: ttl, principal: h.principal, session: h.session, owner: h.owner, addr: h.addr,
+		purpose: h.purpose, labels: h.labels}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	id, fence := waitLock(r.Context(), path, false, opts, max(time.Until(deadline), time.Millisecond))
+	if len(id) == 0 || id == deadlock {
+		replyRetry(w, r, path)
+		return
+	}
+	replyGranted(w, r, id, fence)
+}
+
+// condSignalHandler answers POST /cond/signal?key=PATH, waking the longest
+// waiting waiter on the condition of PATH, and POST /cond/broadcast?key=PATH
+// which wakes all of them. the reply counts the woken waiters. the caller
+// need not hold the lock, the woken waiters queue for it either way
+func condSignalHandler(w http.ResponseWriter, r *http.Request, all bool) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	woken := condSignal(path, all)
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Status string `json:"status"`
+			Woken  int    `json:"woken"`
+		}{"success", woken})
+		return
+	}
+	fmt.Fprintf(w, "success %d\n", woken)
+}
+
+func signalHandler(w http.ResponseWriter, r *http.Request) {
+	condSignalHandler(w, r, false)
+}
+
+func broadcastHandler(w http.ResponseWriter, r *http.Request) {
+	condSignalHandler(w, r, true)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// every flag can also be set by the environment variable LOCKSERVER_NAME
+// (upper case, - becomes _) or by a "name": value entry of the json object
+// in the -config file. the command line wins over the environment, which
+// wins over the file
+
+// reloadable names the flags a SIGHUP or POST /admin/reload picks up new
+// values for, everything else needs a restart
+var reloadable = map[string]bool{
+	"acl":               true,
+	"admin-api-keys":    true,
+	"api-keys":          true,
+	"client-certs":      true,
+	"client-quota":      true,
+	"default-ttl":       true,
+	"fair":              true,
+	"hold-limit-action": true,
+	"hold-limits":       true,
+	"key-chars":         true,
+	"log-level":         true,
+	"max-key-length":    true,
+	"max-keys":          true,
+	"max-readers":       true,
+	"namespace-quota":   true,
+	"priority-aging":    true,
+	"rate-burst":        true,
+	"rate-limit":        true,
+	"reader-limits":     true,
+	"rw-policy":         true,
+	"session-ttl":       true,
+	"ttl-defaults":      true,
+	"ttl-limits":        true,
+	"ttl-reject":        true,
+	"webhook-secret":    true,
+	"webhooks":          true,
+}
+
+// configuration tracks where the flags came from so a reload can redo it
+type configuration struct {
+	// held while reloading, a SIGHUP and /admin/reload may race
+	mu sync.Mutex
+	// flags given on the command line, never overridden
+	explicit map[string]bool
+	// the value each flag was last set to from the environment or file
+	applied map[string]string
+}
+
+func envName(flagName string) string {
+	return "LOCKSERVER_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// configPath is the config file in use, empty for none
+func (c *configuration) configPath() string {
+	if !c.explicit["config"] {
+		if path, ok := os.LookupEnv(envName("config")); ok {
+			return path
+		}
+	}
+	return flag.Lookup("config").Value.String()
+}
+
+// values returns the setting from the environment or config file of every
+// flag not given on the command line
+func (c *configuration) values() (map[string]string, error) {
+	values := map[string]string{}
+	if path := c.configPath(); len(path) != 0 {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var file map[string]any
+		if err := dec.Decode(&file); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for name, v := range file {
+			if flag.Lookup(name) == nil || name == "config" {
+				return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	for name := range c.explicit {
+		delete(values, name)
+	}
+	delete(values, "config")
+	return values, nil
+}
+
+// loadConfig fills in the flags not given on the command line from the
+// environment and the config file, it must run right after flag.Parse
+func loadConfig() (*configuration, error) {
+	c := &configuration{explicit: map[string]bool{}, applied: map[string]string{}}
+	flag.Visit(func(f *flag.Flag) { c.explicit[f.Name] = true })
+	values, err := c.values()
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range values {
+		if err := flag.Set(name, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	c.applied = values
+	return c, nil
+}
+
+// reload re-reads the config file and sets the reloadable flags not given
+// on the command line to their new value, or back to the default if the
+// setting is gone. apply then hands the flags to the server. it returns
+// the first error, the settings that could be applied are kept
+func (c *configuration) reload(apply func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values, err := c.values()
+	if err != nil {
+		slog.Error("config reload failed", "err", err)
+		return err
+	}
+	var failed error
+	flag.VisitAll(func(f *flag.Flag) {
+		if c.explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		v, ok := values[f.Name]
+		old, wasSet := c.applied[f.Name]
+		if ok == wasSet && v == old {
+			return
+		}
+		if !reloadable[f.Name] {
+			slog.Warn("config setting changed, restart to apply it", "setting", f.Name)
+			return
+		}
+		if !ok {
+			v = f.DefValue
+		}
+		if err := flag.Set(f.Name, v); err != nil {
+			slog.Error("config setting not applied", "setting", f.Name, "err", err)
+			if failed == nil {
+				failed = fmt.Errorf("%s: %w", f.Name, err)
+			}
+			return
+		}
+		if ok {
+			c.applied[f.Name] = v
+		} else {
+			delete(c.applied, f.Name)
+		}
+	})
+	if err := apply(); err != nil {
+		slog.Error("config reload failed", "err", err)
+		return err
+	}
+	if failed == nil {
+		slog.Info("config reloaded")
+	}
+	return failed
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// serverProtocols returns the protocols to serve: HTTP/1.1 always, HTTP/2
+// over TLS unless disabled and, with h2c, HTTP/2 over plain connections
+// for clients that start with the HTTP/2 preface
+func serverProtocols(http2, h2c bool) *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetHTTP2(http2)
+	p.SetUnencryptedHTTP2(http2 && h2c)
+	return p
+}
+
+// limitListener accepts at most n connections at once, Accept blocks
+// while that many are open
+type limitListener struct {
+	net.Listener
+	slots  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newLimitListener(l net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, slots: make(chan struct{}, n), closed: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+// Close also wakes an Accept waiting for a slot
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn gives its slot back on the first Close
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the consul shim answers the session and kv endpoints consul lock tooling
+// (consul lock, the api package's Lock) uses: a consul session is a lock
+// server session and a kv key acquired by one is write locked for it, so
+// the lock is released when the session is destroyed or stops renewing.
+// kv values live next to the locks in memory, they are not in the wal
+
+// consulEntry is a key of the kv store
+type consulEntry struct {
+	value       []byte
+	flags       uint64
+	createIndex uint64
+	modifyIndex uint64
+	lockIndex   uint64
+	// the session holding the key and the lockID it holds it with
+	session string
+	lockID  string
+	// the key is deleted rather than released when the session ends
+	deleteWithSession bool
+}
+
+// consul is the kv store. index counts every change, blocking queries wait
+// for it to pass theirs. lock order is consul before shard mutex
+var consul = struct {
+	sync.Mutex
+	index   uint64
+	kv      map[string]*consulEntry
+	changed chan struct{}
+	// live sessions created with Behavior "delete"
+	deleting map[string]bool
+}{kv: map[string]*consulEntry{}, changed: make(chan struct{}), deleting: map[string]bool{}}
+
+// consulBump records a change and wakes the blocking queries. caller must
+// hold the consul mutex
+func consulBump() uint64 {
+	consul.index++
+	close(consul.changed)
+	consul.changed = make(chan struct{})
+	return consul.index
+}
+
+// consulEntryOf returns the entry of key, first noticing that its lock was
+// released behind the kv store's back, by the session ending or a plain
+// unlock. caller must hold the consul mutex
+func consulEntryOf(key string) *consulEntry {
+	e := consul.kv[key]
+	if e == nil || len(e.lockID) == 0 || lockHeld(key, e.lockID) {
+		return e
+	}
+	if e.deleteWithSession {
+		delete(consul.kv, key)
+		consulBump()
+		return nil
+	}
+	e.session, e.lockID, e.deleteWithSession = "", "", false
+	e.modifyIndex = consulBump()
+	return e
+}
+
+// consulPair is the json form of a kv entry
+type consulPair struct {
+	Key         string
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Flags       uint64
+	Value       []byte
+	Session     string `json:",omitempty"`
+}
+
+func (e *consulEntry) pair(key string) consulPair {
+	return consulPair{Key: clientKey(key), CreateIndex: e.createIndex, ModifyIndex: e.modifyIndex,
+		LockIndex: e.lockIndex, Flags: e.flags, Value: e.value, Session: e.session}
+}
+
+// consulSessionCreateHandler answers PUT /v1/session/create. the body may
+// set TTL (a duration, -session-ttl if missing) and Behavior, release or
+// delete. LockDelay and health checks are ignored
+func consulSessionCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	var req struct {
+		TTL      string
+		Behavior string
+	}
+	if b, _ := io.ReadAll(io.LimitReader(r.Body, 1<<16)); len(strings.TrimSpace(string(b))) != 0 {
+		if err := json.Unmarshal(b, &req); err != nil {
+			http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := time.Duration(sessionTTL.Load())
+	if len(req.TTL) != 0 {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			http.Error(w, "Invalid TTL "+req.TTL, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Behavior != "" && req.Behavior != "release" && req.Behavior != "delete" {
+		http.Error(w, "Invalid Behavior setting '"+req.Behavior+"'", http.StatusBadRequest)
+		return
+	}
+	id, ok := createSession(ttl)
+	if !ok {
+		replyFailure(w, r, errInternal)
+		return
+	}
+	if req.Behavior == "delete" {
+		consul.Lock()
+		for old := range consul.deleting {
+			if !sessionExists(old) {
+				delete(consul.deleting, old)
+			}
+		}
+		consul.deleting[id] = true
+		consul.Unlock()
+	}
+	writeJSON(w, 0, map[string]string{"ID": id})
+}
+
+// consulSessionHandler answers PUT /v1/session/renew/ID, PUT
+// /v1/session/destroy/ID and GET /v1/session/info/ID
+func consulSessionHandler(w http.ResponseWriter, r *http.Request) {
+	op, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/session/"), "/")
+	switch op {
+	case "renew":
+		if !allowMethod(w, r, http.MethodPut) {
+			return
+		}
+		if !renewSession(id) {
+			http.Error(w, "Session id '"+id+"' not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, 0, []map[string]string{{"ID": id}})
+	case "destroy":
+		if !allowMethod(w, r, http.MethodPut) {
+			return
+		}
+		destroySession(id)
+		consul.Lock()
+		delete(consul.deleting, id)
+		consulBump()
+		consul.Unlock()
+		writeJSON(w, 0, true)
+	case "info":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		infos := []map[string]string{}
+		if sessionExists(id) {
+			infos = append(infos, map[string]string{"ID": id})
+		}
+		writeJSON(w, 0, infos)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// consulKVHandler answers GET, PUT and DELETE on /v1/kv/KEY
+func consulKVHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := scopedParam(r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		consulGet(w, r, key)
+	case http.MethodPut:
+		consulPut(w, r, key)
+	case http.MethodDelete:
+		consulDelete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		replyFailure(w, r, failure{code: "method_not_allowed", text: "only get, put and delete methods are supported",
+			status: http.StatusMethodNotAllowed})
+	}
+}
+
+// consulGet answers the entry of key, or with ?recurse every entry under
+// it. ?index=N blocks until the answer changes past index N or ?wait (5m
+// by default, at most 10m) passes
+func consulGet(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	_, recurse := query["recurse"]
+	var index uint64
+	if v := query.Get("index"); len(v) != 0 {
+		var err error
+		if index, err = strconv.ParseUint(v, 10, 64); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	wait := 5 * time.Minute
+	if v := query.Get("wait"); len(v) != 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		wait = min(d, 10*time.Minute)
+	}
+	// a lock released by its session ending changes the answer too
+	keys, prefixes := []string{key}, []string(nil)
+	if recurse {
+		keys, prefixes = nil, keys
+	}
+	holdOpen(w, wait)
+	sub := subscribe(requestNamespace(r), keys, prefixes)
+	defer func() { unsubscribe(sub) }()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		consul.Lock()
+		var pairs []consulPair
+		modified := consul.index
+		if recurse {
+			keys := []string{}
+			for k := range consul.kv {
+				if strings.HasPrefix(k, key) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if e := consulEntryOf(k); e != nil {
+					pairs = append(pairs, e.pair(k))
+				}
+			}
+		} else if e := consulEntryOf(key); e != nil {
+			pairs = append(pairs, e.pair(key))
+			modified = e.modifyIndex
+		}
+		changed := consul.changed
+		consul.Unlock()
+
+		if index == 0 || modified > index {
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(modified, 10))
+			consulReply(w, r, pairs)
+			return
+		}
+		select {
+		case <-changed:
+		case _, ok := <-sub.ch:
+			if !ok {
+				sub = subscribe(requestNamespace(r), keys, prefixes)
+			}
+		case <-timeout.C:
+			index = 0
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func consulReply(w http.ResponseWriter, r *http.Request, pairs []consulPair) {
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if _, raw := r.URL.Query()["raw"]; raw {
+		w.Write(pairs[0].Value)
+		return
+	}
+	writeJSON(w, 0, pairs)
+}
+
+// consulPut sets the value of key. ?acquire=SESSION write locks key for the
+// session first, ?release=SESSION unlocks it and ?cas=N only writes if the
+// key's ModifyIndex is N, or if it does not exist for 0
+func consulPut(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	value, err := io.ReadAll(io.LimitReader(r.Body, 512*1024))
+	if err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	var flags uint64
+	if v := query.Get("flags"); len(v) != 0 {
+		if flags, err = strconv.ParseUint(v, 10, 64); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	acquire, release := query.Get("acquire"), query.Get("release")
+	if len(acquire) != 0 && closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	if len(acquire) != 0 && !sessionExists(acquire) {
+		http.Error(w, "invalid session \""+acquire+"\"", http.StatusInternalServerError)
+		return
+	}
+
+	consul.Lock()
+	defer consul.Unlock()
+
+	e := consulEntryOf(key)
+	if v := query.Get("cas"); len(v) != 0 {
+		cas, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		if (e == nil && cas != 0) || (e != nil && e.modifyIndex != cas) {
+			writeJSON(w, 0, false)
+			return
+		}
+	}
+	switch {
+	case len(acquire) != 0:
+		if e == nil || e.session != acquire {
+			if e != nil && len(e.session) != 0 {
+				writeJSON(w, 0, false)
+				return
+			}
+			id, _ := lock(key, lockOptions{session: acquire, principal: callerName(r), addr: remoteHost(r)})
+			if len(id) == 0 {
+				writeJSON(w, 0, false)
+				return
+			}
+			if e == nil {
+				e = &consulEntry{createIndex: consul.index + 1}
+				consul.kv[key] = e
+			}
+			e.session, e.lockID, e.deleteWithSession = acquire, id, consul.deleting[acquire]
+			e.lockIndex++
+		}
+	case len(release) != 0:
+		if e == nil || e.session != release {
+			writeJSON(w, 0, false)
+			return
+		}
+		unlock(key, e.lockID)
+		e.session, e.lockID, e.deleteWithSession = "", "", false
+	case e == nil:
+		e = &consulEntry{createIndex: consul.index + 1}
+		consul.kv[key] = e
+	}
+	e.value, e.flags = value, flags
+	e.modifyIndex = consulBump()
+	writeJSON(w, 0, true)
+}
+
+// consulDelete removes key, releasing the lock on it. ?cas=N only deletes
+// if the key's ModifyIndex is N
+func consulDelete(w http.ResponseWriter, r *http.Request, key string) {
+	consul.Lock()
+	defer consul.Unlock()
+
+	e := consulEntryOf(key)
+	if v := r.URL.Query().Get("cas"); len(v) != 0 {
+		cas, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		if e == nil || e.modifyIndex != cas {
+			writeJSON(w, 0, false)
+			return
+		}
+	}
+	if e != nil {
+		if len(e.lockID) != 0 {
+			unlock(key, e.lockID)
+		}
+		delete(consul.kv, key)
+		consulBump()
+	}
+	writeJSON(w, 0, true)
+}
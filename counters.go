@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// a counter is a number kept under a key, next to if not part of the key's
+// locks: sequence numbers, quotas and the like. it starts at 0 and moves
+// only by atomic increments, each logged in the wal before it is answered.
+// a counter back at 0 is dropped, like one never incremented
+
+var errOverflow = failure{code: "overflow", text: "counter would overflow", status: http.StatusConflict}
+
+var errCounterLimit = failure{code: "counter_limit", text: "counter would pass its limit", status: http.StatusConflict}
+
+// incr adds by to the counter of path and returns its new value. with
+// bounded the increment is refused if it would take the counter above limit
+func incr(path string, by int64, bounded bool, limit int64) (int64, failure, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.counts[path]
+	switch {
+	case (by > 0 && count > math.MaxInt64-by) || (by < 0 && count < math.MinInt64-by):
+		return 0, errOverflow, false
+	case bounded && by > 0 && count+by > limit:
+		return 0, errCounterLimit, false
+	}
+	count += by
+	if err := wal.setCount(path, count); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return 0, errInternal, false
+	}
+	setCount(s, path, count)
+	return count, failure{}, true
+}
+
+// setCount sets the counter of path in s, its shard. caller must hold the
+// shard mutex
+func setCount(s *shard, path string, count int64) {
+	if count == 0 {
+		delete(s.counts, path)
+		return
+	}
+	s.counts[path] = count
+}
+
+// countOf returns the counter of path
+func countOf(path string) int64 {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counts[path]
+}
+
+// replyCount answers the value of a counter, JSON clients get {"status":
+// "success", "count": N}
+func replyCount(w http.ResponseWriter, r *http.Request, count int64) {
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success", Count: &count})
+		return
+	}
+	fmt.Fprintf(w, "%d\n", count)
+}
+
+// counterIncrHandler answers POST /counter/incr?key=PATH&by=N with the
+// counter of PATH after adding N to it, 1 by default and negative to count
+// down. max=M refuses with 409 counter_limit an increment that would take
+// the counter above M
+func counterIncrHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	by := int64(1)
+	if v := query.Get("by"); len(v) != 0 {
+		var err error
+		if by, err = strconv.ParseInt(v, 10, 64); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	var limit int64
+	bounded := query.Has("max")
+	if bounded {
+		var err error
+		if limit, err = strconv.ParseInt(query.Get("max"), 10, 64); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	if draining.Load() {
+		replyFailure(w, r, errDraining)
+		return
+	}
+	count, f, ok := incr(path, by, bounded, limit)
+	if !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	replyCount(w, r, count)
+}
+
+// counterGetHandler answers GET /counter/get?key=PATH with the counter of
+// PATH, 0 if it was never incremented
+func counterGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	replyCount(w, r, countOf(path))
+}
@@ -0,0 +1,108 @@
+package main
+
+import "sync"
+
+// deadlock is returned instead of a lockID by a blocking acquisition that
+// was aborted because waiting would never end, ids are hex so it is never
+// a real one
+const deadlock = "deadlock"
+
+// identity names who a request is made for in the waits-for graph, empty
+// for anonymous requests which can't be told apart and are left out
+func (opts lockOptions) identity() string {
+	if len(opts.owner) != 0 {
+		return "owner:" + opts.owner
+	}
+	if len(opts.session) != 0 {
+		return "session:" + opts.session
+	}
+	return ""
+}
+
+func (h *holder) identity() string {
+	return lockOptions{owner: h.owner, session: h.session}.identity()
+}
+
+// waiting is the waits-for graph: the keys each identity is parked on,
+// counted since one identity may block on a key several times over. lock
+// order is shard mutex before waiting, and no shard is locked while
+// walking the graph
+var waiting = struct {
+	sync.Mutex
+	m map[string]map[string]int
+}{m: map[string]map[string]int{}}
+
+// waitFor records that id is parked on key until the returned func is called
+func waitFor(id, key string) func() {
+	waiting.Lock()
+	defer waiting.Unlock()
+
+	if waiting.m[id] == nil {
+		waiting.m[id] = map[string]int{}
+	}
+	waiting.m[id][key]++
+	return func() {
+		waiting.Lock()
+		defer waiting.Unlock()
+
+		if waiting.m[id][key]--; waiting.m[id][key] == 0 {
+			delete(waiting.m[id], key)
+			if len(waiting.m[id]) == 0 {
+				delete(waiting.m, id)
+			}
+		}
+	}
+}
+
+// waitsOn returns the keys id is parked on
+func waitsOn(id string) []string {
+	waiting.Lock()
+	defer waiting.Unlock()
+
+	keys := make([]string, 0, len(waiting.m[id]))
+	for key := range waiting.m[id] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// holdersOf returns the identities holding key
+func holdersOf(key string) []string {
+	s := shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	if counter := s.locks[key]; counter != nil {
+		for _, h := range counter.lockID {
+			if id := h.identity(); len(id) != 0 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// deadlocked reports whether id waiting on key closes a cycle in the
+// waits-for graph: key is held by someone who, through the keys they are
+// parked on, is waiting for id. only holders of the keys themselves are
+// followed, not hierarchical conflicts or the fair queue. the graph is read
+// one shard at a time so a cycle that is breaking up as it is walked may
+// still be reported
+func deadlocked(id, key string) bool {
+	seen := map[string]bool{}
+	keys := []string{key}
+	for len(keys) != 0 {
+		key, keys = keys[len(keys)-1], keys[:len(keys)-1]
+		for _, holder := range holdersOf(key) {
+			if holder == id {
+				return true
+			}
+			if !seen[holder] {
+				seen[holder] = true
+				keys = append(keys, waitsOn(holder)...)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeadlock(t *testing.T) {
+	t.Cleanup(func() {
+		forceUnlock("dl/a", "test")
+		forceUnlock("dl/b", "test")
+	})
+	a, _ := store.lock("dl/a", lockOptions{owner: "A"})
+	b, _ := store.lock("dl/b", lockOptions{owner: "B"})
+	granted := make(chan grant, 1)
+	waitInBackground("dl/b", lockOptions{owner: "A"}, granted)
+	waitQueued(t, "dl/b", 1)
+
+	if id, _ := store.waitLock(context.Background(), "dl/a", false, lockOptions{owner: "B"}, 5*time.Second); id != deadlock {
+		t.Fatalf("B waiting on dl/a held by A, which waits on B: got %q, want deadlock", id)
+	}
+	if id, _ := lockMulti(context.Background(), []string{"dl/a"}, lockOptions{owner: "B"}, 5*time.Second); id != deadlock {
+		t.Errorf("lock-multi closing the same cycle: got %q, want deadlock", id)
+	}
+	// anonymous requests can't be told apart and just wait
+	if id, _ := store.waitLock(context.Background(), "dl/a", false, lockOptions{}, 10*time.Millisecond); len(id) != 0 {
+		t.Errorf("anonymous wait on dl/a: got %q", id)
+	}
+
+	store.unlock("dl/b", b)
+	if got := <-granted; len(got.id) == 0 || got.id == deadlock {
+		t.Errorf("A waiting on dl/b: got %q after B let go", got.id)
+	}
+	store.unlock("dl/a", a)
+}
+
+func TestNoDeadlockWithoutCycle(t *testing.T) {
+	t.Cleanup(func() { forceUnlock("dl/c", "test") })
+	c, _ := store.lock("dl/c", lockOptions{owner: "C"})
+	granted := make(chan grant, 1)
+	waitInBackground("dl/c", lockOptions{owner: "D"}, granted)
+	waitQueued(t, "dl/c", 1)
+	store.unlock("dl/c", c)
+	if got := <-granted; len(got.id) == 0 || got.id == deadlock {
+		t.Errorf("D waiting on dl/c: got %q", got.id)
+	}
+}
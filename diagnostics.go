@@ -0,0 +1,19 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// serveDiagnostics mounts the net/http/pprof profiles and the expvar
+// variables on mux for admin callers. perm checks them with the
+// credentials of the port mux serves
+func serveDiagnostics(mux *http.ServeMux, perm func(permission, http.HandlerFunc) http.HandlerFunc) {
+	mux.HandleFunc("/debug/pprof/", perm(permAdmin, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", perm(permAdmin, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", perm(permAdmin, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", perm(permAdmin, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", perm(permAdmin, pprof.Trace))
+	mux.HandleFunc("/debug/vars", perm(permAdmin, expvar.Handler().ServeHTTP))
+}
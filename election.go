@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// an election is the write lock on electPrefix + group held by the leader
+// with the candidate as its owner, so /locks, /watch and /ws show it like
+// any other lock. the fencing token of the grant is the leader's term
+const electPrefix = "elect/"
+
+// elections serializes looking for the current leader and locking, so one
+// candidate campaigning twice at once can't hold the lock twice. lock
+// order is elections before shard mutex
+var elections sync.Mutex
+
+// leader is who holds an election
+type leader struct {
+	Group     string    `json:"group"`
+	Candidate string    `json:"leader"`
+	LockID    string    `json:"lockId"`
+	Term      int64     `json:"term"`
+	Expires   time.Time `json:"expires"`
+	// authenticated caller that campaigned, empty if auth is disabled
+	principal string
+}
+
+// leaderOf returns the leader of the election on path, false while there is
+// none
+func leaderOf(path string) (leader, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.state != 1 {
+		return leader{}, false
+	}
+	for id, h := range counter.lockID {
+		return leader{Group: clientKey(path)[len(electPrefix):], Candidate: h.owner, LockID: id,
+			Term: counter.fence, Expires: h.expiry.UTC(), principal: h.principal}, true
+	}
+	return leader{}, false
+}
+
+// campaign makes candidate the leader of the election on path if it has
+// none, waiting up to wait for the leader to go. a candidate that already
+// leads under the caller's api key keeps its term and gets its lease renewed
+// to opts.ttl, the same candidate name sent with another key competes with
+// it like any other candidate
+func campaign(r *http.Request, path, candidate string, opts lockOptions, wait time.Duration) (string, int64) {
+	deadline := time.Now().Add(wait)
+	for {
+		elections.Lock()
+		var id string
+		var term int64
+		if l, ok := leaderOf(path); ok && l.Candidate == candidate && l.principal == opts.principal {
+			if renew(path, l.LockID, opts.ttl) {
+				id, term = l.LockID, l.Term
+			}
+		} else if !ok {
+			id, term = lock(path, opts)
+		}
+		elections.Unlock()
+
+		left := time.Until(deadline)
+		if len(id) != 0 || left <= 0 || closedForLocks() {
+			return id, term
+		}
+		watch(r.Context(), path, left)
+		if r.Context().Err() != nil {
+			return "", 0
+		}
+	}
+}
+
+// electionParams reads the group and the lease of an election request
+func electionParams(r *http.Request) (path string, ttl time.Duration, ok bool) {
+	query := r.URL.Query()
+	group := query.Get("group")
+	if len(group) == 0 {
+		return "", 0, false
+	}
+	if path, ok = scopedParam(r, electPrefix+group); !ok || !roomFor(path) {
+		return "", 0, false
+	}
+	ttl, ok = durationParam(query, "ttl")
+	return path, ttl, ok
+}
+
+// electHandler answers POST /elect?group=G&candidate=ID&ttl=DURATION: the
+// candidate becomes leader with a lease of ttl if the group has none, the
+// reply is the lock id to renew and resign with and the term as fencing
+// token. wait=DURATION campaigns until the leader goes or wait passes
+func electHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, ttl, ok := electionParams(r)
+	query := r.URL.Query()
+	candidate := query.Get("candidate")
+	if !ok || ttl <= 0 || len(candidate) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	opts := lockOptions{ttl: ttl, owner: candidate, principal: callerName(r), session: query.Get("session"),
+		addr: remoteHost(r)}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	holdOpen(w, wait)
+	id, term := campaign(r, path, candidate, opts, wait)
+	switch {
+	case len(id) == 0 && nsFull(requestNamespace(r)):
+		replyFull(w, r, errQuota)
+	case len(id) == 0 && clientFull(opts.quotaClient()):
+		replyFull(w, r, errClientQuota)
+	case len(id) == 0:
+		replyRetry(w, r, path)
+	default:
+		replyGranted(w, r, id, term)
+	}
+}
+
+// electRenewHandler answers POST /elect/renew?group=G&lock-id=ID&ttl=DURATION,
+// the leader must renew before its lease runs out to keep its term
+func electRenewHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, ttl, ok := electionParams(r)
+	lockID := r.URL.Query().Get("lock-id")
+	if !ok || ttl <= 0 || len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	if renew(path, lockID, ttl) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+// electResignHandler answers POST /elect/resign?group=G&lock-id=ID, the
+// leader steps down and the next candidate can win
+func electResignHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, _, ok := electionParams(r)
+	lockID := r.URL.Query().Get("lock-id")
+	if !ok || len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if unlock(path, lockID) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+// leaderHandler answers GET /elect/leader?group=G with the current leader,
+// 404 "failure no leader" if there is none. with term=N&wait=DURATION it
+// watches: the reply waits until the leadership moves on from term N, 0
+// standing for no leader, or wait passes
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path, _, ok := electionParams(r)
+	query := r.URL.Query()
+	wait, waitOK := durationParam(query, "wait")
+	var term int64
+	if t := query.Get("term"); len(t) != 0 {
+		var err error
+		if term, err = strconv.ParseInt(t, 10, 64); err != nil {
+			ok = false
+		}
+	}
+	if !ok || !waitOK {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+
+	holdOpen(w, wait)
+	sub := subscribe(requestNamespace(r), []string{path}, nil)
+	defer func() { unsubscribe(sub) }()
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	l, ok := leaderOf(path)
+	for wait > 0 && l.Term == term {
+		select {
+		case _, open := <-sub.ch:
+			if !open {
+				sub = subscribe(requestNamespace(r), []string{path}, nil)
+			}
+		case <-timeout.C:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+		l, ok = leaderOf(path)
+	}
+
+	if !ok {
+		replyFailure(w, r, errNoLeader)
+		return
+	}
+	w.Header().Set("Fencing-Token", strconv.FormatInt(l.Term, 10))
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, l)
+		return
+	}
+	fmt.Fprintf(w, "%s %d\n", l.Candidate, l.Term)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCampaignPerKey(t *testing.T) {
+	setAuth(&apiKeys{keys: map[[sha256.Size]byte]principal{
+		sha256.Sum256([]byte("tokenA")): {name: "tokA", perms: permFull},
+		sha256.Sum256([]byte("tokenB")): {name: "tokB", perms: permFull},
+	}})
+	t.Cleanup(func() {
+		setAuth(nil)
+		forceUnlock(electPrefix+"g", "test")
+	})
+	campaignAs := func(token string) (int, string) {
+		r := httptest.NewRequest(http.MethodPost, "/elect?group=g&candidate=node1&ttl=1m", nil)
+		r.Header.Set("X-Api-Key", token)
+		w := httptest.NewRecorder()
+		requirePerm(permWrite, electHandler)(w, r)
+		return w.Code, w.Body.String()
+	}
+	code, won := campaignAs("tokenA")
+	if code != http.StatusOK {
+		t.Fatalf("campaign with tokenA: %d %s", code, won)
+	}
+	if code, again := campaignAs("tokenA"); code != http.StatusOK || again != won {
+		t.Errorf("leader campaigning again: %d %q, want its lease %q renewed", code, again, won)
+	}
+	if code, body := campaignAs("tokenB"); code != http.StatusConflict {
+		t.Errorf("node1 campaigning with tokenB: %d %s, want %d", code, body, http.StatusConflict)
+	}
+	if l, ok := leaderOf(electPrefix + "g"); !ok || l.principal != "tokA" {
+		t.Errorf("leader %+v, want node1 under tokA", l)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the etcd facade answers the subset of etcd v3's grpc api that etcd lock
+// clients use, on the -grpc-listen listener: LeaseGrant, LeaseRevoke and
+// LeaseKeepAlive of the Lease service and Lock and Unlock of v3lockpb,
+// see proto/etcd_lease.proto and proto/etcd_lock.proto. a lease is a
+// session whose id holds the lease id, so leases survive a restart with
+// the wal like any session. Lock waits for the write lock on its name
+// bound to the lease's session and answers the key name/LOCKID, which
+// Unlock takes apart again. the revision of a response header is the
+// fencing token of the lock taken, or the latest one handed out
+
+// how long a Lock waits at a time, it waits again until its call ends or
+// its lease does
+const etcdLockWait = time.Hour
+
+// the errors etcd answers with, which etcd clients know by their message
+var (
+	etcdLeaseNotFound = grpcStatus{grpcNotFound, "etcdserver: requested lease not found"}
+	etcdLeaseExists   = grpcStatus{grpcFailedPrecondition, "etcdserver: lease already exists"}
+)
+
+// etcdSession is the id of the session of lease
+func etcdSession(lease int64) string {
+	return fmt.Sprintf("etcd-%016x", uint64(lease))
+}
+
+// etcdHeader is a ResponseHeader at revision, the latest fencing token
+// handed out if revision is 0
+func etcdHeader(revision int64) string {
+	if revision == 0 {
+		revision = nextFence.Load() - 1
+	}
+	var b []byte
+	b = protoVarint(b, 1, 1)
+	b = protoVarint(b, 2, 1)
+	b = protoVarint(b, 3, uint64(revision))
+	b = protoVarint(b, 4, uint64(max(epoch.Load(), 1)))
+	return string(b)
+}
+
+// etcdLeaseCaller authenticates the caller of a Lease call, which takes
+// read permission like /session/create
+func etcdLeaseCaller(r *http.Request) grpcStatus {
+	p, authed, st := grpcCaller(r)
+	if st.code != grpcOK || !authed {
+		return st
+	}
+	if p.perms&permRead == 0 || !p.mayUse("") {
+		return grpcFailure(errForbidden)
+	}
+	return grpcStatus{}
+}
+
+// etcdID is the int64 of field num of msg, false if msg is malformed
+func etcdID(msg []byte, num int) (int64, bool) {
+	fields, ok := protoDecode(msg)
+	var id int64
+	for _, f := range fields {
+		if f.num == num {
+			id = int64(f.v)
+		}
+	}
+	return id, ok
+}
+
+// etcdLeaseGrant answers LeaseGrant with a new session, of TTL seconds or
+// -session-ttl for none
+func etcdLeaseGrant(r *http.Request, msg []byte) ([]byte, grpcStatus) {
+	if st := etcdLeaseCaller(r); st.code != grpcOK {
+		return nil, st
+	}
+	seconds, ok := etcdID(msg, 1)
+	lease, _ := etcdID(msg, 2)
+	if !ok || lease < 0 {
+		return nil, grpcStatus{grpcInvalidArgument, "malformed request message"}
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if seconds <= 0 {
+		ttl = time.Duration(sessionTTL.Load())
+	}
+	for lease == 0 {
+		lease, _ = strconv.ParseInt(newID()[:15], 16, 64)
+	}
+	if sessionExists(etcdSession(lease)) {
+		return nil, etcdLeaseExists
+	}
+	if !openSession(etcdSession(lease), ttl) {
+		return nil, grpcFailure(errInternal)
+	}
+	out := protoString(nil, 1, etcdHeader(0))
+	out = protoVarint(out, 2, uint64(lease))
+	return protoVarint(out, 3, uint64(max(ttl/time.Second, 1))), grpcStatus{}
+}
+
+// etcdLeaseRevoke answers LeaseRevoke by destroying the lease's session,
+// releasing the locks taken with it
+func etcdLeaseRevoke(r *http.Request, msg []byte) ([]byte, grpcStatus) {
+	if st := etcdLeaseCaller(r); st.code != grpcOK {
+		return nil, st
+	}
+	lease, ok := etcdID(msg, 1)
+	if !ok {
+		return nil, grpcStatus{grpcInvalidArgument, "malformed request message"}
+	}
+	if !destroySession(etcdSession(lease)) {
+		return nil, etcdLeaseNotFound
+	}
+	return protoString(nil, 1, etcdHeader(0)), grpcStatus{}
+}
+
+// etcdKeepAlive answers the LeaseKeepAlive stream, renewing the session
+// of the lease of each request on it. a lease gone is answered with TTL 0
+// as etcd does
+func etcdKeepAlive(w http.ResponseWriter, r *http.Request) {
+	if st := etcdLeaseCaller(r); st.code != grpcOK {
+		endGRPC(w, st)
+		return
+	}
+	// the client waits for the headers before it streams
+	w.WriteHeader(http.StatusOK)
+	http.NewResponseController(w).Flush()
+	for {
+		msg, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			break
+		}
+		lease, ok := etcdID(msg, 1)
+		if err != nil || !ok {
+			if r.Context().Err() != nil {
+				return
+			}
+			endGRPC(w, grpcStatus{grpcInvalidArgument, "malformed request message"})
+			return
+		}
+		var seconds int64
+		if ttl, ok := sessionLease(etcdSession(lease)); ok && renewSession(etcdSession(lease)) {
+			seconds = int64(max(ttl/time.Second, 1))
+		}
+		out := protoString(nil, 1, etcdHeader(0))
+		out = protoVarint(out, 2, uint64(lease))
+		if writeGRPCMessage(w, protoVarint(out, 3, uint64(seconds))) != nil {
+			return
+		}
+	}
+	endGRPC(w, grpcStatus{})
+}
+
+// etcdLock answers Lock with the write lock on its name for the session
+// of its lease, waiting for as long as the call lasts
+func etcdLock(r *http.Request, msg []byte) ([]byte, grpcStatus) {
+	p, authed, st := grpcCaller(r)
+	if st.code != grpcOK {
+		return nil, st
+	}
+	fields, ok := protoDecode(msg)
+	var name string
+	var lease int64
+	for _, f := range fields {
+		switch f.num {
+		case 1:
+			name = string(f.b)
+		case 2:
+			lease = int64(f.v)
+		}
+	}
+	if !ok || len(name) == 0 {
+		return nil, grpcStatus{grpcInvalidArgument, "malformed request message"}
+	}
+	c := &protoConn{ctx: r.Context(), host: remoteHost(r)}
+	if f, _ := c.admit(protoRequest{call: protoLock, key: name}, p, authed); len(f.code) != 0 {
+		return nil, grpcFailure(f)
+	}
+	if !roomFor(name) {
+		return nil, grpcFailure(errBadRequest)
+	}
+	session := etcdSession(lease)
+	if !sessionExists(session) {
+		return nil, etcdLeaseNotFound
+	}
+	opts := lockOptions{principal: p.name, session: session, addr: c.host}
+	start := time.Now()
+	for {
+		if closedForLocks() {
+			return nil, grpcFailure(closedFailure())
+		}
+		lockID, fence := store.waitLock(r.Context(), name, false, opts, etcdLockWait)
+		switch {
+		case lockID == deadlock:
+			metrics.contended(false, name)
+			return nil, grpcFailure(errDeadlock)
+		case len(lockID) != 0:
+			metrics.acquired(false, name, time.Since(start))
+			out := protoString(nil, 1, etcdHeader(fence))
+			return protoString(out, 2, name+"/"+lockID), grpcStatus{}
+		case r.Context().Err() == context.DeadlineExceeded:
+			return nil, grpcStatus{grpcDeadlineExceeded, "context deadline exceeded"}
+		case r.Context().Err() != nil:
+			return nil, grpcStatus{grpcCanceled, "context canceled"}
+		case !sessionExists(session):
+			return nil, etcdLeaseNotFound
+		case nsFull(""):
+			return nil, grpcFailure(errQuota)
+		case clientFull(opts.quotaClient()):
+			return nil, grpcFailure(errClientQuota)
+		}
+	}
+}
+
+// etcdUnlock answers Unlock by releasing the lock whose key Lock answered,
+// a key no longer held is released already
+func etcdUnlock(r *http.Request, msg []byte) ([]byte, grpcStatus) {
+	p, authed, st := grpcCaller(r)
+	if st.code != grpcOK {
+		return nil, st
+	}
+	fields, ok := protoDecode(msg)
+	var key string
+	for _, f := range fields {
+		if f.num == 1 {
+			key = string(f.b)
+		}
+	}
+	i := strings.LastIndexByte(key, '/')
+	if !ok || i < 0 {
+		return nil, grpcStatus{grpcInvalidArgument, "malformed request message"}
+	}
+	req := protoRequest{call: protoUnlock, key: key[:i], lockID: key[i+1:]}
+	c := &protoConn{ctx: r.Context(), host: remoteHost(r)}
+	if f, _ := c.admit(req, p, authed); len(f.code) != 0 {
+		return nil, grpcFailure(f)
+	}
+	if !store.unlock(req.key, req.lockID) {
+		metrics.unlockFailed(false)
+	}
+	return protoString(nil, 1, etcdHeader(0)), grpcStatus{}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEtcdLockLease(t *testing.T) {
+	srv, client := grpcTestServer(t)
+	t.Cleanup(func() { forceUnlock("etcd/x", "test") })
+
+	got, status := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseGrant", protoVarint(nil, 1, 30))
+	if status != "0" || got[2].v == 0 || got[3].v != 30 {
+		t.Fatalf("lease grant: status %s fields %v", status, got)
+	}
+	lease := got[2].v
+	if _, status := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseGrant", protoVarint(protoVarint(nil, 1, 30), 2, lease)); status != "9" {
+		t.Errorf("granting lease %d again: status %s, want 9", lease, status)
+	}
+
+	lock := protoVarint(protoString(nil, 1, "etcd/x"), 2, lease)
+	got, status = grpcCall(t, srv, client, "/v3lockpb.Lock/Lock", lock)
+	key := string(got[2].b)
+	if status != "0" || !strings.HasPrefix(key, "etcd/x/") {
+		t.Fatalf("lock: status %s fields %v", status, got)
+	}
+	if header, _ := protoDecode(got[1].b); len(header) == 0 {
+		t.Error("lock answered without a header")
+	}
+	got, _ = grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseGrant", protoVarint(nil, 1, 30))
+	other := got[2].v
+	t.Cleanup(func() { destroySession(etcdSession(int64(other))) })
+	if _, status := grpcCallTimeout(t, srv, client, "/v3lockpb.Lock/Lock", protoVarint(protoString(nil, 1, "etcd/x"), 2, other), "50m"); status != "4" {
+		t.Errorf("lock on a held name: status %s, want 4 after the deadline", status)
+	}
+	if _, status := grpcCall(t, srv, client, "/v3lockpb.Lock/Lock", protoVarint(protoString(nil, 1, "etcd/y"), 2, 12345)); status != "5" {
+		t.Errorf("lock with an unknown lease: status %s, want 5", status)
+	}
+
+	if _, status := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseRevoke", protoVarint(nil, 1, lease)); status != "0" {
+		t.Fatalf("lease revoke: status %s", status)
+	}
+	if l, _, _ := lockStatus("etcd/x"); l.state != 0 {
+		t.Error("etcd/x still locked after its lease was revoked")
+	}
+	if _, status := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseRevoke", protoVarint(nil, 1, lease)); status != "5" {
+		t.Errorf("revoking lease %d again: status %s, want 5", lease, status)
+	}
+}
+
+func TestEtcdUnlock(t *testing.T) {
+	srv, client := grpcTestServer(t)
+	t.Cleanup(func() { forceUnlock("etcd/u", "test") })
+
+	got, _ := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseGrant", protoVarint(nil, 1, 30))
+	lease := got[2].v
+	got, _ = grpcCall(t, srv, client, "/v3lockpb.Lock/Lock", protoVarint(protoString(nil, 1, "etcd/u"), 2, lease))
+	if _, status := grpcCall(t, srv, client, "/v3lockpb.Lock/Unlock", protoString(nil, 1, string(got[2].b))); status != "0" {
+		t.Fatalf("unlock: status %s", status)
+	}
+	if l, _, _ := lockStatus("etcd/u"); l.state != 0 {
+		t.Error("etcd/u still locked after Unlock")
+	}
+}
+
+func TestEtcdKeepAlive(t *testing.T) {
+	srv, client := grpcTestServer(t)
+	got, _ := grpcCall(t, srv, client, "/etcdserverpb.Lease/LeaseGrant", protoVarint(nil, 1, 10))
+	lease := got[2].v
+	t.Cleanup(func() { destroySession(etcdSession(int64(lease))) })
+
+	body, requests := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/etcdserverpb.Lease/LeaseKeepAlive", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	in := bufio.NewReader(resp.Body)
+	for _, id := range []uint64{lease, 999} {
+		go requests.Write(grpcFrame(protoVarint(nil, 1, id)))
+		msg, err := readGRPCMessage(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields, _ := protoDecode(msg)
+		var ttl uint64
+		for _, f := range fields {
+			if f.num == 3 {
+				ttl = f.v
+			}
+		}
+		if want := map[uint64]uint64{lease: 10}[id]; ttl != want {
+			t.Errorf("keepalive of lease %d: ttl %d, want %d", id, ttl, want)
+		}
+	}
+	requests.Close()
+	io.Copy(io.Discard, in)
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Errorf("keepalive stream ended with status %s", status)
+	}
+}
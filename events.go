@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of lock event
+const (
+	eventGranted     = "granted"
+	eventReleased    = "released"
+	eventExpired     = "expired"
+	eventUpgraded    = "upgraded"
+	eventDowngraded  = "downgraded"
+	eventForced      = "force-released"
+	eventStolen      = "stolen"
+	eventTransferred = "transferred"
+	eventHoldLimited = "hold-limited"
+	eventOverheld    = "overheld"
+)
+
+// lockEvent is published whenever a lock is granted or released
+type lockEvent struct {
+	Type   string    `json:"type"`
+	Key    string    `json:"key"`
+	Mode   string    `json:"mode"`
+	LockID string    `json:"lockId"`
+	Time   time.Time `json:"time"`
+}
+
+// how many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 256
+
+// subscriber receives the events for keys matching its filter on ch. ch
+// is closed when the subscriber is dropped for falling behind
+type subscriber struct {
+	// only events of keys in this namespace are delivered
+	namespace string
+	keys      map[string]bool
+	prefixes  []string
+	ch        chan lockEvent
+}
+
+// matches reports whether the subscriber wants events for key, a
+// subscriber without keys or prefixes gets everything
+func (sub *subscriber) matches(key string) bool {
+	if ns, _ := splitKey(key); ns != sub.namespace {
+		return false
+	}
+	if len(sub.keys) == 0 && len(sub.prefixes) == 0 {
+		return true
+	}
+	if sub.keys[key] {
+		return true
+	}
+	for _, prefix := range sub.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribers to lock events. lock order is shard mutex before broker
+var broker = struct {
+	sync.Mutex
+	subs map[*subscriber]bool
+}{subs: map[*subscriber]bool{}}
+
+// subscribe registers for the events of the given keys and key prefixes of
+// namespace ns
+func subscribe(ns string, keys, prefixes []string) *subscriber {
+	sub := &subscriber{namespace: ns, keys: map[string]bool{}, prefixes: prefixes, ch: make(chan lockEvent, subscriberBuffer)}
+	for _, key := range keys {
+		sub.keys[key] = true
+	}
+	broker.Lock()
+	defer broker.Unlock()
+	broker.subs[sub] = true
+	return sub
+}
+
+func unsubscribe(sub *subscriber) {
+	broker.Lock()
+	defer broker.Unlock()
+	if broker.subs[sub] {
+		delete(broker.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publish hands ev to every interested subscriber and webhook without
+// blocking, a subscriber whose buffer is full is dropped so it can tell it
+// missed events
+func publish(ev lockEvent) {
+	broker.Lock()
+	defer broker.Unlock()
+	notifyWebhooks(ev)
+	for sub := range broker.subs {
+		if !sub.matches(ev.Key) {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(broker.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
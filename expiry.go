@@ -0,0 +1,122 @@
+package main
+
+import (
+	"container/heap"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// deadline is when the lease of lock id on key, or the write intent id on
+// key, runs out. renewing a lease pushes a new deadline, the old one is
+// dropped when it comes up and the lease turns out to last longer
+type deadline struct {
+	at     time.Time
+	key    string
+	id     string
+	intent bool
+}
+
+// deadlineHeap orders deadlines earliest first
+type deadlineHeap []deadline
+
+func (h deadlineHeap) Len() int           { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h deadlineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x any)        { *h = append(*h, x.(deadline)) }
+
+func (h *deadlineHeap) Pop() any {
+	old := *h
+	d := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return d
+}
+
+// deadlines are the pending lease and intent deadlines. lock order is shard
+// mutex before deadlines
+var deadlines = struct {
+	sync.Mutex
+	h deadlineHeap
+	// signalled when a deadline earlier than every other is pushed
+	wake chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// scheduleExpiry has expiryLoop look at lock or intent id on key at at
+func scheduleExpiry(key, id string, at time.Time, intent bool) {
+	if following() {
+		// the leader expires the leases, a follower hears of it
+		return
+	}
+	deadlines.Lock()
+	defer deadlines.Unlock()
+
+	heap.Push(&deadlines.h, deadline{at: at, key: key, id: id, intent: intent})
+	if deadlines.h[0].at.Equal(at) {
+		select {
+		case deadlines.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// dueDeadlines pops the deadlines passed by now and returns when the next
+// one is, zero if there is none
+func dueDeadlines(now time.Time) (due []deadline, next time.Time) {
+	deadlines.Lock()
+	defer deadlines.Unlock()
+
+	for len(deadlines.h) != 0 && !now.Before(deadlines.h[0].at) {
+		due = append(due, heap.Pop(&deadlines.h).(deadline))
+	}
+	if len(deadlines.h) != 0 {
+		next = deadlines.h[0].at
+	}
+	return due, next
+}
+
+// expireDeadline releases the lease or drops the intent d is for, unless
+// it was released, withdrawn or renewed meanwhile
+func expireDeadline(d deadline, now time.Time) {
+	s := shardFor(d.key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[d.key]
+	if counter == nil {
+		return
+	}
+	if d.intent {
+		counter.expireIntents(now)
+		return
+	}
+	h := counter.lockID[d.id]
+	if h == nil || h.expiry.IsZero() || now.Before(h.expiry) {
+		return
+	}
+	ns, key := splitKey(d.key)
+	slog.Info("lock expired", "namespace", ns, "key", key, "lock_id", d.id)
+	counter.release(d.id, eventExpired)
+}
+
+// expiryLoop releases leases and drops write intents as soon as their
+// deadlines pass, sleeping until the earliest one in between
+func expiryLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		now := time.Now()
+		due, next := dueDeadlines(now)
+		for _, d := range due {
+			expireDeadline(d, now)
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-deadlines.wake:
+		}
+	}
+}
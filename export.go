@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// exportVersion is the version of the /admin/export document, bumped on
+// changes older servers could not read
+const exportVersion = 1
+
+// exportDoc is the whole lock table as /admin/export writes it and -import
+// reads it back
+type exportDoc struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	// the fencing token the next write lock gets
+	NextFence int64 `json:"nextFence"`
+	// the highest key version, every key is at least at it once imported
+	VersionFloor int64           `json:"versionFloor,omitempty"`
+	Sessions     []exportSession `json:"sessions"`
+	Locks        []exportLock    `json:"locks"`
+	Values       []exportValue   `json:"values,omitempty"`
+	Counters     []exportCounter `json:"counters,omitempty"`
+}
+
+// exportValue is the value a key carries, see kv.go
+type exportValue struct {
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+}
+
+// exportCounter is the counter of a key, see counters.go
+type exportCounter struct {
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+	Count     int64  `json:"count"`
+}
+
+type exportSession struct {
+	ID      string    `json:"id"`
+	TTL     string    `json:"ttl"`
+	Expires time.Time `json:"expires"`
+}
+
+// exportLock is a held key, a write lock has one holder
+type exportLock struct {
+	Namespace    string         `json:"namespace,omitempty"`
+	Key          string         `json:"key"`
+	Mode         string         `json:"mode"`
+	FencingToken int64          `json:"fencingToken,omitempty"`
+	Holders      []exportHolder `json:"holders"`
+}
+
+type exportHolder struct {
+	LockID string `json:"lockId"`
+	// the holder's mode where it is not the lock's, as for an
+	// intent-shared holder of a read locked key
+	Mode      string            `json:"mode,omitempty"`
+	Acquired  time.Time         `json:"acquired"`
+	Expires   time.Time         `json:"expires,omitzero"`
+	Owner     string            `json:"owner,omitempty"`
+	Holds     int               `json:"holds,omitempty"`
+	Session   string            `json:"session,omitempty"`
+	Txn       string            `json:"txn,omitempty"`
+	Principal string            `json:"principal,omitempty"`
+	Addr      string            `json:"addr,omitempty"`
+	Purpose   string            `json:"purpose,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// exportState copies the lock table and the sessions into a document.
+// every shard is locked, in index order, while it is copied so the export
+// is one consistent state
+func exportState() exportDoc {
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	sessions.Lock()
+	doc := exportDoc{Version: exportVersion, Exported: time.Now().UTC(), NextFence: nextFence.Load(),
+		Sessions: []exportSession{}, Locks: []exportLock{}}
+	for id, sess := range sessions.m {
+		doc.Sessions = append(doc.Sessions, exportSession{ID: id, TTL: sess.ttl.String(), Expires: sess.expiry.UTC()})
+	}
+	doc.VersionFloor = versionFloor.Load()
+	for _, s := range shards {
+		for key, count := range s.counts {
+			ns, clientKey := splitKey(key)
+			doc.Counters = append(doc.Counters, exportCounter{Namespace: ns, Key: clientKey, Count: count})
+		}
+		for key, counter := range s.locks {
+			doc.VersionFloor = max(doc.VersionFloor, counter.version)
+			ns, clientKey := splitKey(key)
+			if counter.value != nil {
+				doc.Values = append(doc.Values, exportValue{Namespace: ns, Key: clientKey, Value: counter.value})
+			}
+			if counter.state == 0 {
+				continue
+			}
+			l := exportLock{Namespace: ns, Key: clientKey, Mode: stateName(counter.state)}
+			if counter.state == 1 {
+				l.FencingToken = counter.fence
+			}
+			for id, h := range counter.lockID {
+				e := exportHolder{LockID: id, Acquired: h.acquired.UTC(), Owner: h.owner, Session: h.session,
+					Txn: h.txn, Principal: h.principal, Addr: h.addr, Purpose: h.purpose, Labels: h.labels}
+				if h.mode != counter.state {
+					e.Mode = stateName(h.mode)
+				}
+				if h.holds > 1 {
+					e.Holds = h.holds
+				}
+				if !h.expiry.IsZero() {
+					e.Expires = h.expiry.UTC()
+				}
+				l.Holders = append(l.Holders, e)
+			}
+			sort.Slice(l.Holders, func(i, j int) bool { return l.Holders[i].Acquired.Before(l.Holders[j].Acquired) })
+			doc.Locks = append(doc.Locks, l)
+		}
+	}
+	sessions.Unlock()
+	for _, s := range shards {
+		s.mu.Unlock()
+	}
+	sort.Slice(doc.Sessions, func(i, j int) bool { return doc.Sessions[i].ID < doc.Sessions[j].ID })
+	sort.Slice(doc.Locks, func(i, j int) bool {
+		if doc.Locks[i].Namespace != doc.Locks[j].Namespace {
+			return doc.Locks[i].Namespace < doc.Locks[j].Namespace
+		}
+		return doc.Locks[i].Key < doc.Locks[j].Key
+	})
+	sort.Slice(doc.Values, func(i, j int) bool {
+		if doc.Values[i].Namespace != doc.Values[j].Namespace {
+			return doc.Values[i].Namespace < doc.Values[j].Namespace
+		}
+		return doc.Values[i].Key < doc.Values[j].Key
+	})
+	sort.Slice(doc.Counters, func(i, j int) bool {
+		if doc.Counters[i].Namespace != doc.Counters[j].Namespace {
+			return doc.Counters[i].Namespace < doc.Counters[j].Namespace
+		}
+		return doc.Counters[i].Key < doc.Counters[j].Key
+	})
+	return doc
+}
+
+// exportHandler answers GET /admin/export with the lock table as a JSON
+// document, a server started with -import FILE picks it up again
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="lockserver-export.json"`)
+	writeJSON(w, 0, exportState())
+}
+
+// records turns an export document into the log records that recreate its
+// state, checking it on the way
+func (doc exportDoc) records() ([]walRecord, error) {
+	if doc.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, want %d", doc.Version, exportVersion)
+	}
+	recs := []walRecord{{Op: "next", Fence: doc.NextFence, Version: doc.VersionFloor}}
+	for _, sess := range doc.Sessions {
+		ttl, err := time.ParseDuration(sess.TTL)
+		if len(sess.ID) == 0 || err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("session %q: bad id or ttl", sess.ID)
+		}
+		recs = append(recs, walRecord{Op: "session", Session: sess.ID, TTL: int64(ttl)})
+	}
+	seen := map[string]bool{}
+	for _, l := range doc.Locks {
+		key := scopeKey(l.Namespace, l.Key)
+		if len(l.Key) == 0 || seen[key] {
+			return nil, fmt.Errorf("lock %q: missing or duplicate key", l.Key)
+		}
+		seen[key] = true
+		state, ok := stateOf(l.Mode)
+		if !ok {
+			return nil, fmt.Errorf("lock %q: bad mode %q", l.Key, l.Mode)
+		}
+		if len(l.Holders) == 0 || (state == 1 && len(l.Holders) != 1) {
+			return nil, fmt.Errorf("lock %q: a write lock has one holder, a read lock at least one", l.Key)
+		}
+		modes := make([]int, len(l.Holders))
+		var held int
+		for i, e := range l.Holders {
+			if modes[i], ok = stateOf(e.Mode); len(e.Mode) == 0 {
+				modes[i], ok = state, true
+			}
+			for _, other := range modes[:i] {
+				ok = ok && compatible[modes[i]][other]
+			}
+			if !ok {
+				return nil, fmt.Errorf("lock %q: bad or conflicting holder mode %q", l.Key, e.Mode)
+			}
+			held = strongest(held, modes[i])
+		}
+		if held != state {
+			return nil, fmt.Errorf("lock %q: holders make it %s, not %s", l.Key, stateName(held), l.Mode)
+		}
+		for i, e := range l.Holders {
+			if len(e.LockID) == 0 {
+				return nil, fmt.Errorf("lock %q: holder without a lock id", l.Key)
+			}
+			h := &holder{acquired: e.Acquired, expiry: e.Expires, principal: e.Principal, session: e.Session,
+				owner: e.Owner, holds: max(e.Holds, 1), txn: e.Txn, addr: e.Addr, purpose: e.Purpose, labels: e.Labels}
+			var fence int64
+			if state == 1 {
+				fence = l.FencingToken
+			}
+			recs = append(recs, grantRecord(key, e.LockID, modes[i], h, fence))
+		}
+	}
+	seen = map[string]bool{}
+	for _, v := range doc.Values {
+		key := scopeKey(v.Namespace, v.Key)
+		if len(v.Key) == 0 || seen[key] || len(v.Value) > maxValueSize {
+			return nil, fmt.Errorf("value of %q: missing or duplicate key or too large", v.Key)
+		}
+		seen[key] = true
+		recs = append(recs, valueRecord(key, append([]byte{}, v.Value...)))
+	}
+	seen = map[string]bool{}
+	for _, c := range doc.Counters {
+		key := scopeKey(c.Namespace, c.Key)
+		if len(c.Key) == 0 || seen[key] {
+			return nil, fmt.Errorf("counter %q: missing or duplicate key", c.Key)
+		}
+		seen[key] = true
+		recs = append(recs, walRecord{Op: "count", Key: key, Count: c.Count})
+	}
+	return recs, nil
+}
+
+// importState loads the export document at path into the empty lock table.
+// like -restore it refuses to run over a wal that already holds state
+func importState(path, walPath string) error {
+	if len(walPath) != 0 {
+		if info, err := os.Stat(walPath); err == nil && info.Size() != 0 {
+			return fmt.Errorf("-import: wal %s is not empty", walPath)
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("-import: %w", err)
+	}
+	var doc exportDoc
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return fmt.Errorf("-import: %s: %w", path, err)
+	}
+	recs, err := doc.records()
+	if err != nil {
+		return fmt.Errorf("-import: %s: %w", path, err)
+	}
+	for _, rec := range recs {
+		applyRecord(rec)
+	}
+	slog.Info("state imported", "file", path, "locks", heldCount())
+	return nil
+}
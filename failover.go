@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a follower started with -standby as well takes over once its leader has
+// been silent for -failover-after: it leads from the replica it holds,
+// runs -promote-command to move the address the clients use or tell the
+// load balancer, and deposes the old leader should it come back. every
+// takeover starts a new fencing epoch whose tokens are above any the old
+// leader can still hand out, so a resource checking tokens turns away a
+// stale leader's writers even while it can't be reached to be deposed
+
+// epochShift places the epoch above the counting bits of a fencing token,
+// the tokens of epoch E start at E<<epochShift
+const epochShift = 40
+
+var errStaleEpoch = failure{code: "stale_epoch", text: "this node is at the same or a later epoch", status: http.StatusConflict}
+
+// standby promotes this node once the leader of link has not been heard
+// from for after, it runs until then or until link stops leading it. self
+// and selfAdmin are the urls of this node's api and admin api, command is
+// run on promotion
+func standby(link *leaderLink, after time.Duration, command, self, selfAdmin string) {
+	ticker := time.NewTicker(replicaHeartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		if upstream.Load() != link {
+			return
+		}
+		// a standby that never synced has nothing to lead with
+		last := heard.Load()
+		if last == 0 || time.Since(time.Unix(0, last)) < after {
+			continue
+		}
+		promote(link, command, self, selfAdmin)
+		return
+	}
+}
+
+// promote makes this node the leader in place of the leader of link under
+// a new epoch
+func promote(link *leaderLink, command, self, selfAdmin string) {
+	link.mu.Lock()
+	link.cancel()
+	e := epoch.Add(1)
+	raise(&nextFence, e<<epochShift)
+	upstream.Store(nil)
+	link.mu.Unlock()
+
+	// the leases and sessions run on from here, sessions get a full ttl
+	// to find the new leader
+	now := time.Now()
+	for _, s := range shards {
+		s.mu.Lock()
+		for key, counter := range s.locks {
+			for id, h := range counter.lockID {
+				if !h.expiry.IsZero() {
+					scheduleExpiry(key, id, h.expiry, false)
+				}
+			}
+		}
+		s.mu.Unlock()
+	}
+	sessions.Lock()
+	for _, sess := range sessions.m {
+		sess.expiry = now.Add(sess.ttl)
+	}
+	sessions.Unlock()
+	if err := wal.append(epochRecord()); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+	slog.Warn("leader silent, took over", "leader", link.url, "epoch", e, "locks", heldCount())
+
+	if len(command) != 0 {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "LOCKSERVER_EPOCH="+strconv.FormatInt(e, 10), "LOCKSERVER_LEADER="+self,
+			"LOCKSERVER_OLD_LEADER="+link.url)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Error("promote command failed", "err", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+	go depose(link.admin, e, self, selfAdmin)
+}
+
+// epochRecord records the epoch along with the next fencing token
+func epochRecord() walRecord {
+	return walRecord{Op: "next", Fence: nextFence.Load(), Version: versionFloor.Load(), Epoch: epoch.Load()}
+}
+
+// depose tells the old leader at admin that this node leads under epoch e,
+// until it hears or a later epoch supersedes e
+func depose(admin string, e int64, self, selfAdmin string) {
+	form := url.Values{"epoch": {strconv.FormatInt(e, 10)}, "leader": {self}, "admin": {selfAdmin}}
+	for epoch.Load() == e && !following() {
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(admin, "/")+"/v1/admin/depose?"+form.Encode(), nil)
+		if err != nil {
+			return
+		}
+		if len(replicaToken) != 0 {
+			req.Header.Set("Authorization", "Bearer "+replicaToken)
+		}
+		resp, err := replicaClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			switch {
+			case resp.StatusCode == http.StatusOK:
+				slog.Info("old leader deposed", "leader", admin, "epoch", e)
+				return
+			case resp.StatusCode == http.StatusConflict:
+				slog.Warn("old leader is at a later epoch", "leader", admin, "epoch", e)
+				return
+			}
+			err = fmt.Errorf("answered %s", resp.Status)
+		}
+		slog.Debug("deposing the old leader failed, retrying", "leader", admin, "err", err)
+		time.Sleep(replicaTimeout)
+	}
+}
+
+// deposeHandler answers POST /admin/depose?epoch=N&leader=URL&admin=URL,
+// sent by the standby that took over under epoch N. from then on this node
+// grants nothing and forwards the lock api to the new leader at URL, its
+// admin calls to admin= if given. restarting it with -follow -standby
+// makes it the new standby
+func deposeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	n, err := strconv.ParseInt(query.Get("epoch"), 10, 64)
+	leader, admin := query.Get("leader"), query.Get("admin")
+	if len(admin) == 0 {
+		admin = leader
+	}
+	link := newLeaderLink(leader, admin, true)
+	if err != nil || n <= 0 || link == nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	for {
+		current := epoch.Load()
+		if n <= current {
+			replyFailure(w, r, errStaleEpoch)
+			return
+		}
+		if epoch.CompareAndSwap(current, n) {
+			break
+		}
+	}
+	if old := upstream.Swap(link); old != nil {
+		old.cancel()
+	}
+	if err := wal.append(epochRecord()); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+	slog.Warn("deposed, forwarding to the new leader", "leader", leader, "epoch", n)
+	replySuccess(w, r)
+}
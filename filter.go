@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// keyFilter selects the keys of namespace ns a listing covers: the stored
+// keys starting with prefix that, if glob is set, match it as path.Match
+// does, so * and ? stop at a /
+type keyFilter struct {
+	ns     string
+	prefix string
+	glob   string
+}
+
+func (f keyFilter) matches(stored string) bool {
+	if !strings.HasPrefix(stored, f.prefix) {
+		return false
+	}
+	ns, key := splitKey(stored)
+	if ns != f.ns {
+		return false
+	}
+	if len(f.glob) == 0 {
+		return true
+	}
+	ok, _ := path.Match(f.glob, key)
+	return ok
+}
+
+// globPrefix returns the part of glob before its first wildcard, every key
+// glob matches starts with it
+func globPrefix(glob string) string {
+	if i := strings.IndexAny(glob, `*?[\`); i >= 0 {
+		return glob[:i]
+	}
+	return glob
+}
+
+// filterParams reads the prefix= and match=GLOB parameters of a listing
+// request, false if either is not valid
+func filterParams(r *http.Request, query url.Values) (keyFilter, bool) {
+	glob := query.Get("match")
+	if _, err := path.Match(glob, ""); err != nil {
+		return keyFilter{}, false
+	}
+	prefix := query.Get("prefix")
+	// a longer prefix skips more keys before the glob is tried
+	if literal := globPrefix(glob); strings.HasPrefix(literal, prefix) {
+		prefix = literal
+	}
+	stored, ok := scopedParam(r, prefix)
+	if !ok {
+		return keyFilter{}, false
+	}
+	return keyFilter{ns: requestNamespace(r), prefix: stored, glob: glob}, true
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cluster membership by gossip, over udp. every interval a node bumps its
+// own heartbeat and sends the member list it knows to a few random peers,
+// who keep for each member the highest heartbeat heard. only a member
+// advances its own heartbeat, so one nobody hears a newer heartbeat from
+// has stopped: it is suspect after gossipSuspect intervals and dead after
+// gossipDead. a node joins by gossiping to the -gossip-join seeds until it
+// hears from someone, and on shutdown tells its peers it left. the
+// subsystems that place keys on nodes register with onMembership
+
+// how many peers a node gossips to each interval
+const gossipFanout = 3
+
+// after how many intervals without a newer heartbeat a member is suspect,
+// dead, and forgotten
+const (
+	gossipSuspect = 5
+	gossipDead    = 15
+	gossipForget  = 60
+)
+
+// largest gossip datagram read
+const gossipMaxPacket = 64 << 10
+
+// member states as /cluster/members reports them
+const (
+	memberAlive   = "alive"
+	memberSuspect = "suspect"
+	memberDead    = "dead"
+	memberLeft    = "left"
+)
+
+// member is a node of the cluster as the gossip carries it
+type member struct {
+	Name string `json:"name"`
+	// the udp address it gossips on
+	Addr string `json:"addr"`
+	// the base url its api is served at, for the nodes sending it requests
+	API       string `json:"api"`
+	Heartbeat uint64 `json:"heartbeat"`
+	Left      bool   `json:"left,omitempty"`
+	// when the heartbeat last advanced and what that makes the member,
+	// local to each node
+	seen  time.Time
+	state string
+}
+
+type gossipMessage struct {
+	From    string   `json:"from"`
+	Members []member `json:"members"`
+}
+
+type gossip struct {
+	mu       sync.Mutex
+	self     *member
+	members  map[string]*member
+	seeds    []string
+	conn     *net.UDPConn
+	interval time.Duration
+	// signs and checks every datagram, empty sends them unsigned
+	key []byte
+	// held while the watchers are told, so they hear of the changes one at
+	// a time and in order. lock order is notifyMu before mu
+	notifyMu sync.Mutex
+	watchers []func([]member)
+}
+
+// cluster is the gossip of this node, nil without -gossip-listen
+var cluster *gossip
+
+var errNoCluster = failure{code: "no_cluster", text: "not part of a cluster, see -gossip-listen", status: http.StatusNotFound}
+
+// startGossip listens on addr and gossips as name, reachable at api, every
+// interval. seeds are the gossip addresses of nodes to join through
+func startGossip(name, addr, api string, seeds []string, key []byte, interval time.Duration) (*gossip, error) {
+	if len(name) == 0 {
+		return nil, errors.New("empty node name")
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	self := &member{Name: name, Addr: conn.LocalAddr().String(), API: api, Heartbeat: 1, seen: time.Now(), state: memberAlive}
+	if host, _, _ := net.SplitHostPort(addr); len(host) == 0 || net.ParseIP(host).IsUnspecified() {
+		// peers need an address they can reach, not the wildcard
+		_, port, _ := net.SplitHostPort(self.Addr)
+		self.Addr = net.JoinHostPort(hostName(), port)
+	}
+	g := &gossip{self: self, members: map[string]*member{name: self}, seeds: seeds, conn: conn,
+		interval: interval, key: key}
+	go g.receive()
+	go g.run()
+	slog.Info("gossip started", "node", name, "addr", self.Addr, "seeds", strings.Join(seeds, ","))
+	return g, nil
+}
+
+// hostName is the name other nodes are told to reach this one at when it
+// listens on every interface
+func hostName() string {
+	name, err := os.Hostname()
+	if err != nil || len(name) == 0 {
+		return "localhost"
+	}
+	return name
+}
+
+// onMembership calls fn with the live members, this node among them, now
+// and whenever a member joins, leaves or is found dead. fn must not block
+func (g *gossip) onMembership(fn func([]member)) {
+	g.notifyMu.Lock()
+	defer g.notifyMu.Unlock()
+	g.mu.Lock()
+	g.watchers = append(g.watchers, fn)
+	live := g.liveLocked()
+	g.mu.Unlock()
+	fn(live)
+}
+
+// list returns every member known, sorted by name
+func (g *gossip) list() []member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	list := make([]member, 0, len(g.members))
+	for _, m := range g.members {
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// liveLocked returns the alive and suspect members sorted by name, a
+// suspect one may only be slow. caller must hold g.mu
+func (g *gossip) liveLocked() []member {
+	var live []member
+	for _, m := range g.members {
+		if m.state == memberAlive || m.state == memberSuspect {
+			live = append(live, *m)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].Name < live[j].Name })
+	return live
+}
+
+// run gossips every interval until the node leaves
+func (g *gossip) run() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for round := 0; ; round++ {
+		<-ticker.C
+		g.mu.Lock()
+		if g.self.Left {
+			g.mu.Unlock()
+			return
+		}
+		g.self.Heartbeat++
+		g.self.seen = time.Now()
+		changed := g.ageLocked(time.Now())
+		targets := g.targetsLocked(round)
+		b := g.encodeLocked()
+		g.mu.Unlock()
+		if changed {
+			g.notify()
+		}
+		for _, addr := range targets {
+			g.send(addr, b)
+		}
+	}
+}
+
+// ageLocked moves the members not heard from on to suspect and dead and
+// forgets the long gone, it reports whether the live members changed.
+// caller must hold g.mu
+func (g *gossip) ageLocked(now time.Time) bool {
+	changed := false
+	for name, m := range g.members {
+		if m == g.self {
+			continue
+		}
+		silent := now.Sub(m.seen)
+		state := m.state
+		switch {
+		case silent > gossipForget*g.interval:
+			delete(g.members, name)
+			continue
+		case m.Left:
+			state = memberLeft
+		case silent > gossipDead*g.interval:
+			state = memberDead
+		case silent > gossipSuspect*g.interval:
+			state = memberSuspect
+		}
+		if state != m.state {
+			slog.Info("cluster member "+state, "node", name, "addr", m.Addr)
+			// suspect members still count as live
+			changed = changed || state == memberDead || state == memberLeft
+			m.state = state
+		}
+	}
+	return changed
+}
+
+// targetsLocked picks the gossip addresses to send to this round: a few
+// live peers, the seeds while there are none, and now and then a dead one
+// in case it is back. caller must hold g.mu
+func (g *gossip) targetsLocked(round int) []string {
+	var live, dead []string
+	for _, m := range g.members {
+		switch {
+		case m == g.self:
+		case m.state == memberAlive || m.state == memberSuspect:
+			live = append(live, m.Addr)
+		case m.state == memberDead:
+			dead = append(dead, m.Addr)
+		}
+	}
+	rand.Shuffle(len(live), func(i, j int) { live[i], live[j] = live[j], live[i] })
+	targets := live[:min(len(live), gossipFanout)]
+	if len(live) == 0 {
+		targets = append(targets, g.seeds...)
+	}
+	if len(dead) != 0 && round%gossipSuspect == 0 {
+		targets = append(targets, dead[rand.N(len(dead))])
+	}
+	return targets
+}
+
+// encodeLocked returns the datagram of this node's member list, signed if
+// there is a key. the dead are left out, and those that left once the
+// news had time to spread, so nodes forgetting them at different times
+// don't teach each other about them again. caller must hold g.mu
+func (g *gossip) encodeLocked() []byte {
+	msg := gossipMessage{From: g.self.Name}
+	for _, m := range g.members {
+		if m.state == memberDead || (m.state == memberLeft && time.Since(m.seen) > gossipSuspect*g.interval) {
+			continue
+		}
+		msg.Members = append(msg.Members, *m)
+	}
+	b, _ := json.Marshal(msg)
+	if len(g.key) == 0 {
+		return b
+	}
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(b)
+	return append(mac.Sum(nil), b...)
+}
+
+func (g *gossip) send(addr string, b []byte) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		slog.Debug("gossip peer unresolved", "addr", addr, "err", err)
+		return
+	}
+	if _, err := g.conn.WriteToUDP(b, udpAddr); err != nil {
+		slog.Debug("gossip send failed", "addr", addr, "err", err)
+	}
+}
+
+// receive merges the member lists peers send until the socket is closed
+func (g *gossip) receive() {
+	buf := make([]byte, gossipMaxPacket)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		b := buf[:n]
+		if len(g.key) != 0 {
+			mac := hmac.New(sha256.New, g.key)
+			if len(b) < mac.Size() {
+				continue
+			}
+			mac.Write(b[mac.Size():])
+			if !hmac.Equal(mac.Sum(nil), b[:mac.Size()]) {
+				slog.Debug("gossip with a bad signature dropped", "from", from)
+				continue
+			}
+			b = b[mac.Size():]
+		}
+		var msg gossipMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			slog.Debug("malformed gossip dropped", "from", from, "err", err)
+			continue
+		}
+		if g.merge(msg.Members) {
+			g.notify()
+		}
+	}
+}
+
+// merge takes in the members whose heartbeat advanced, it reports whether
+// the live members changed
+func (g *gossip) merge(members []member) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	changed := false
+	now := time.Now()
+	for _, in := range members {
+		if in.Name == g.self.Name || len(in.Name) == 0 {
+			continue
+		}
+		m := g.members[in.Name]
+		if m != nil && in.Heartbeat <= m.Heartbeat {
+			continue
+		}
+		state := memberAlive
+		if in.Left {
+			state = memberLeft
+		}
+		if m == nil || m.state != state {
+			slog.Info("cluster member "+state, "node", in.Name, "addr", in.Addr)
+			changed = true
+		}
+		in.seen, in.state = now, state
+		g.members[in.Name] = &in
+	}
+	return changed
+}
+
+// notify tells the watchers the live members
+func (g *gossip) notify() {
+	g.notifyMu.Lock()
+	defer g.notifyMu.Unlock()
+	g.mu.Lock()
+	live := g.liveLocked()
+	watchers := append([]func([]member){}, g.watchers...)
+	g.mu.Unlock()
+	for _, fn := range watchers {
+		fn(live)
+	}
+}
+
+// leave tells the live peers this node is going away, so they stop
+// counting on it at once instead of waiting for it to turn dead
+func (g *gossip) leave() {
+	g.mu.Lock()
+	g.self.Left = true
+	g.self.Heartbeat++
+	b := g.encodeLocked()
+	var peers []string
+	for _, m := range g.members {
+		if m != g.self && (m.state == memberAlive || m.state == memberSuspect) {
+			peers = append(peers, m.Addr)
+		}
+	}
+	g.mu.Unlock()
+	for _, addr := range peers {
+		g.send(addr, b)
+	}
+	g.conn.Close()
+}
+
+// clusterMembersHandler answers GET /cluster/members with a line per node
+// of the cluster, "NAME API STATE", this one marked with a last "self",
+// JSON clients get {"self": NAME, "members": [...]}
+func clusterMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if cluster == nil {
+		replyFailure(w, r, errNoCluster)
+		return
+	}
+	type jsonMember struct {
+		Name      string    `json:"name"`
+		Addr      string    `json:"addr"`
+		API       string    `json:"api"`
+		State     string    `json:"state"`
+		Heartbeat uint64    `json:"heartbeat"`
+		LastSeen  time.Time `json:"lastSeen"`
+	}
+	list := cluster.list()
+	if wantsJSON(r) {
+		out := struct {
+			Self    string       `json:"self"`
+			Members []jsonMember `json:"members"`
+		}{Self: cluster.self.Name, Members: []jsonMember{}}
+		for _, m := range list {
+			out.Members = append(out.Members, jsonMember{m.Name, m.Addr, m.API, m.state, m.Heartbeat, m.seen.UTC()})
+		}
+		writeJSON(w, 0, out)
+		return
+	}
+	for _, m := range list {
+		line := fmt.Sprintf("%s %s %s", m.Name, m.API, m.state)
+		if m.Name == cluster.self.Name {
+			line += " self"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the listener of -grpc-listen serves the LockServer service of
+// proto/lockserver.proto to generated grpc clients. grpc is protobuf
+// messages over http/2: a call is a POST to /lockserver.LockServer/Lock
+// whose body holds the request message behind a five byte prefix, the
+// reply carries the response message the same way and the call's status
+// in the grpc-status and grpc-message trailers. the standard library
+// serves http/2 with tls or, as grpc clients dial an insecure address,
+// without (h2c), and the messages are encoded by hand like the frames of
+// -proto-listen, whose code answers the calls: api keys sent as x-api-key
+// or authorization metadata, acl rules and the rate limiter apply the same
+
+// grpc status codes
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcStatus is the status a call ends with
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+// grpcFailure is the status of a call refused with f
+func grpcFailure(f failure) grpcStatus {
+	st := grpcStatus{code: grpcUnknown, message: f.code}
+	if len(f.text) != 0 {
+		st.message += ": " + f.text
+	}
+	switch f.status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		st.code = grpcInvalidArgument
+	case http.StatusUnauthorized:
+		st.code = grpcUnauthenticated
+	case http.StatusForbidden:
+		st.code = grpcPermissionDenied
+	case http.StatusNotFound:
+		st.code = grpcNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		st.code = grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		st.code = grpcResourceExhausted
+	case http.StatusServiceUnavailable:
+		st.code = grpcUnavailable
+	case http.StatusInternalServerError:
+		st.code = grpcInternal
+	}
+	return st
+}
+
+// grpcUnary answers the request message of a unary call with the response
+// message, which is only sent if the status is OK
+type grpcUnary func(r *http.Request, msg []byte) ([]byte, grpcStatus)
+
+// grpcMethods are the calls served by path
+var grpcMethods = map[string]http.HandlerFunc{
+	"/lockserver.LockServer/Lock":    serveUnary(grpcLockCall(protoLock)),
+	"/lockserver.LockServer/RLock":   serveUnary(grpcLockCall(protoRLock)),
+	"/lockserver.LockServer/Unlock":  serveUnary(grpcLockCall(protoUnlock)),
+	"/lockserver.LockServer/RUnlock": serveUnary(grpcLockCall(protoRUnlock)),
+	"/lockserver.LockServer/Renew":   serveUnary(grpcLockCall(protoRenew)),
+
+	// the etcd facade of etcd.go
+	"/etcdserverpb.Lease/LeaseGrant":     serveUnary(etcdLeaseGrant),
+	"/etcdserverpb.Lease/LeaseRevoke":    serveUnary(etcdLeaseRevoke),
+	"/etcdserverpb.Lease/LeaseKeepAlive": etcdKeepAlive,
+	"/v3lockpb.Lock/Lock":                serveUnary(etcdLock),
+	"/v3lockpb.Lock/Unlock":              serveUnary(etcdUnlock),
+}
+
+// newGRPCServer returns the server of -grpc-listen, serving tls with
+// the certificate of base if it has one. there are no read or write
+// timeouts, a lock may wait and a keepalive stream lasts as long as its
+// lease
+func newGRPCServer(base *http.Server) *http.Server {
+	p := new(http.Protocols)
+	if base.TLSConfig != nil {
+		p.SetHTTP2(true)
+	} else {
+		p.SetUnencryptedHTTP2(true)
+	}
+	return &http.Server{Handler: http.HandlerFunc(grpcHandler), BaseContext: base.BaseContext,
+		IdleTimeout: base.IdleTimeout, Protocols: p, HTTP2: base.HTTP2, TLSConfig: base.TLSConfig}
+}
+
+// listenGRPC serves the grpc service on addr with the server newGRPCServer
+// returns for base
+func listenGRPC(addr string, base *http.Server) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := newGRPCServer(base)
+	serveInBackground(s, l)
+	return s, nil
+}
+
+// grpcHandler answers the grpc calls of grpcMethods
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && !strings.HasPrefix(ct, "application/grpc+proto") {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	method := grpcMethods[r.URL.Path]
+	if method == nil {
+		endGRPC(w, grpcStatus{grpcUnimplemented, "unknown method " + r.URL.Path})
+		return
+	}
+	if timeout, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	method(w, r)
+}
+
+// grpcTimeout parses the grpc-timeout header, an amount followed by its
+// unit, false if there is none
+func grpcTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	unit := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond,
+		'u': time.Microsecond, 'n': time.Nanosecond}[s[len(s)-1]]
+	if unit == 0 {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// readGRPCMessage reads the next length prefixed message of a call, io.EOF
+// once the client sent the last one
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("message prefix cut short")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxProtoFrame {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d", size, maxProtoFrame)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, fmt.Errorf("message cut short")
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage sends msg with its prefix and flushes it to the client
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(append(prefix[:], msg...)); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// endGRPC ends the call with st in its trailers
+func endGRPC(w http.ResponseWriter, st grpcStatus) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(st.code))
+	if len(st.message) != 0 {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(st.message))
+	}
+}
+
+// grpcEscape percent-encodes what grpc-message may not carry as is
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// serveUnary answers a call taking and returning one message with call
+func serveUnary(call grpcUnary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		msg, err := readGRPCMessage(r.Body)
+		if err == io.EOF {
+			err = fmt.Errorf("no request message")
+		}
+		if err != nil {
+			endGRPC(w, grpcStatus{grpcInvalidArgument, err.Error()})
+			return
+		}
+		out, st := call(r, msg)
+		if st.code == grpcOK {
+			if err := writeGRPCMessage(w, out); err != nil {
+				return
+			}
+		}
+		endGRPC(w, st)
+	}
+}
+
+// grpcCaller authenticates the caller of r from its metadata, authed
+// false without -api-keys
+func grpcCaller(r *http.Request) (p principal, authed bool, st grpcStatus) {
+	a := currentAuth()
+	if a == nil {
+		return principal{}, false, grpcStatus{}
+	}
+	if p, authed = a.authenticate(r); !authed {
+		return p, false, grpcFailure(errUnauthorized)
+	}
+	return p, true, grpcStatus{}
+}
+
+// grpcLockCall answers the LockServer method of call, the message of its
+// -proto-listen Request of the same call
+func grpcLockCall(call int) grpcUnary {
+	return func(r *http.Request, msg []byte) ([]byte, grpcStatus) {
+		p, authed, st := grpcCaller(r)
+		if st.code != grpcOK {
+			return nil, st
+		}
+		req := protoRequest{call: call}
+		if !decodeProtoCall(&req, msg) {
+			return nil, grpcStatus{grpcInvalidArgument, "malformed request message"}
+		}
+		c := &protoConn{ctx: r.Context(), host: remoteHost(r)}
+		resp := c.call(req, p, authed)
+		switch {
+		case (call == protoUnlock || call == protoRUnlock || call == protoRenew) && resp.f == errNotHeld:
+			// success false, as for a lock not granted
+		case len(resp.f.code) != 0:
+			return nil, grpcFailure(resp.f)
+		}
+		var out []byte
+		if resp.ok {
+			out = protoVarint(out, 1, 1)
+		}
+		if call == protoLock || call == protoRLock {
+			out = protoString(out, 2, resp.lockID)
+			out = protoVarint(out, 3, uint64(resp.fence))
+			out = protoVarint(out, 4, uint64(resp.retryAfter.Milliseconds()))
+		}
+		return out, grpcStatus{}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// grpcTestServer serves the grpc listener over h2c and returns a client
+// for it
+func grpcTestServer(t *testing.T) (*httptest.Server, *http.Client) {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(grpcHandler))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+	p := new(http.Protocols)
+	p.SetUnencryptedHTTP2(true)
+	return srv, &http.Client{Transport: &http.Transport{Protocols: p}}
+}
+
+// grpcFrame is msg with its length prefix
+func grpcFrame(msg []byte) []byte {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	return append(prefix[:], msg...)
+}
+
+// grpcCall makes a unary call and returns the fields of its response
+// message and its grpc-status
+func grpcCall(t *testing.T, srv *httptest.Server, client *http.Client, method string, msg []byte) (map[int]protoField, string) {
+	t.Helper()
+	return grpcCallTimeout(t, srv, client, method, msg, "")
+}
+
+// grpcCallTimeout is grpcCall with a grpc-timeout, none if it is empty
+func grpcCallTimeout(t *testing.T, srv *httptest.Server, client *http.Client, method string, msg []byte, timeout string) (map[int]protoField, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+method, bytes.NewReader(grpcFrame(msg)))
+	req.Header.Set("Content-Type", "application/grpc")
+	if len(timeout) != 0 {
+		req.Header.Set("Grpc-Timeout", timeout)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("%s answered over HTTP/%d", method, resp.ProtoMajor)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := map[int]protoField{}
+	if len(body) != 0 {
+		out, err := readGRPCMessage(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, ok := protoDecode(out)
+		if !ok {
+			t.Fatalf("%s: malformed response", method)
+		}
+		for _, f := range decoded {
+			fields[f.num] = f
+		}
+	}
+	return fields, resp.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPCLockUnlock(t *testing.T) {
+	srv, client := grpcTestServer(t)
+	t.Cleanup(func() { forceUnlock("grpc/x", "test") })
+
+	lock := protoString(nil, 1, "grpc/x")
+	got, status := grpcCall(t, srv, client, "/lockserver.LockServer/Lock", lock)
+	if status != "0" || got[1].v != 1 || len(got[2].b) == 0 || got[3].v == 0 {
+		t.Fatalf("lock: status %s fields %v", status, got)
+	}
+	id := string(got[2].b)
+
+	got, status = grpcCall(t, srv, client, "/lockserver.LockServer/Lock", lock)
+	if status != "0" || got[1].v != 0 {
+		t.Errorf("second lock: status %s fields %v, want not granted", status, got)
+	}
+	got, status = grpcCall(t, srv, client, "/lockserver.LockServer/Unlock", protoString(lock, 2, "nobody"))
+	if status != "0" || got[1].v != 0 {
+		t.Errorf("unlock with another id: status %s fields %v", status, got)
+	}
+	got, status = grpcCall(t, srv, client, "/lockserver.LockServer/Unlock", protoString(lock, 2, id))
+	if status != "0" || got[1].v != 1 {
+		t.Errorf("unlock: status %s fields %v", status, got)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	srv, client := grpcTestServer(t)
+	if _, status := grpcCall(t, srv, client, "/lockserver.LockServer/Lock", []byte{0xff}); status != "3" {
+		t.Errorf("malformed lock: status %s, want 3", status)
+	}
+	if _, status := grpcCall(t, srv, client, "/lockserver.LockServer/Nope", nil); status != "12" {
+		t.Errorf("unknown method: status %s, want 12", status)
+	}
+	confineKey(t)
+	if _, status := grpcCall(t, srv, client, "/lockserver.LockServer/Lock", protoString(nil, 1, "a/x")); status != "16" {
+		t.Errorf("lock without an api key: status %s, want 16", status)
+	}
+}
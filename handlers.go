@@ -0,0 +1,987 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// durationParam parses the optional duration query parameter name, it
+// returns 0 if the parameter is absent and false if it is not a positive duration
+func durationParam(query url.Values, name string) (time.Duration, bool) {
+	value := query.Get(name)
+	if len(value) == 0 {
+		return 0, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// limitParam parses the optional page size limit, it returns
+// defaultListLimit if the parameter is absent, caps it at maxListLimit
+// and returns false if it is not a positive number
+func limitParam(query url.Values) (int, bool) {
+	stringLimit := query.Get("limit")
+	if len(stringLimit) == 0 {
+		return defaultListLimit, true
+	}
+	limit, err := strconv.Atoi(stringLimit)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	return min(limit, maxListLimit), true
+}
+
+// limits on the metadata a lock request may attach
+const (
+	maxLabels      = 16
+	maxLabelLength = 256
+)
+
+// metadataParams parses purpose= and the repeated label=NAME=VALUE
+// parameters of a lock request into opts, false if they are malformed or
+// too long
+func metadataParams(query url.Values, opts *lockOptions) bool {
+	opts.purpose = query.Get("purpose")
+	if len(opts.purpose) > maxLabelLength || len(query["label"]) > maxLabels {
+		return false
+	}
+	for _, label := range query["label"] {
+		name, value, ok := strings.Cut(label, "=")
+		if !ok || len(name) == 0 || len(label) > maxLabelLength {
+			return false
+		}
+		if opts.labels == nil {
+			opts.labels = map[string]string{}
+		}
+		opts.labels[name] = value
+	}
+	return true
+}
+
+func lHandler(w http.ResponseWriter, r *http.Request, readLock bool) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	opts := lockOptions{ttl: ttl, principal: callerName(r), session: query.Get("session"), owner: query.Get("owner"),
+		addr: remoteHost(r), trace: requestSpan(r.Context())}
+	if p := query.Get("priority"); len(p) != 0 {
+		var err error
+		if opts.priority, err = strconv.Atoi(p); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	opts.intent = query.Get("intent")
+	if (readLock && len(opts.intent) != 0) || !metadataParams(query, &opts) || !versionParam(query, &opts) ||
+		(readLock && opts.checkVersion) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if sharedStore() && (len(opts.session) != 0 || len(opts.owner) != 0 || opts.priority != 0 || len(opts.intent) != 0 ||
+		len(opts.purpose) != 0 || len(opts.labels) != 0 || opts.checkVersion) {
+		replyFailure(w, r, errUnsupported)
+		return
+	}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	if len(opts.intent) != 0 && !intentExists(path, opts.intent) {
+		replyFailure(w, r, errNoIntent)
+		return
+	}
+	ticket := query.Get("ticket")
+	if len(ticket) > maxTicket {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	holdOpen(w, wait)
+	var idem *idempotent
+	if key := r.Header.Get("Idempotency-Key"); len(key) != 0 {
+		if len(key) > maxIdempotencyKey {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		if sharedStore() {
+			replyFailure(w, r, errUnsupported)
+			return
+		}
+		e, replay, f, ok := claimIdempotent(r, key, path, readLock)
+		if !ok {
+			replyFailure(w, r, f)
+			return
+		}
+		if replay {
+			w.Header().Set("Idempotent-Replayed", "true")
+			replyGranted(w, r, e.lockID, e.fence)
+			return
+		}
+		idem = e
+	}
+	ctx := r.Context()
+	var doneWaiting func() bool
+	if len(ticket) != 0 && wait > 0 {
+		if ctx, doneWaiting, ok = waitWithTicket(ctx, path, ticket, callerName(r)); !ok {
+			if idem != nil {
+				idem.finish("", 0)
+			}
+			replyFailure(w, r, errTicketInUse)
+			return
+		}
+	}
+	var lockID string
+	var fence int64
+	start := time.Now()
+	if wait > 0 {
+		lockID, fence = store.waitLock(ctx, path, readLock, opts, wait)
+	} else if readLock {
+		lockID = store.rlock(path, opts)
+	} else {
+		lockID, fence = store.lock(path, opts)
+	}
+	if doneWaiting != nil && doneWaiting() {
+		// granted just as it was cancelled, nobody would release it
+		if len(lockID) != 0 && lockID != deadlock {
+			if readLock {
+				store.runlock(path, lockID)
+			} else {
+				store.unlock(path, lockID)
+			}
+		}
+		lockID, fence = "", 0
+		if idem != nil {
+			idem.finish(lockID, fence)
+		}
+		replyFailure(w, r, errCancelled)
+		return
+	}
+	if idem != nil {
+		idem.finish(lockID, fence)
+	}
+
+	if lockID == deadlock {
+		metrics.contended(readLock, path)
+		replyFailure(w, r, errDeadlock)
+	} else if len(lockID) == 0 && opts.checkVersion && keyVersion(path) != opts.ifVersion {
+		replyFailure(w, r, errStaleVersion)
+	} else if len(lockID) == 0 && nsFull(requestNamespace(r)) {
+		replyFull(w, r, errQuota)
+	} else if len(lockID) == 0 && clientFull(opts.quotaClient()) {
+		replyFull(w, r, errClientQuota)
+	} else if len(lockID) == 0 {
+		metrics.contended(readLock, path)
+		replyRetry(w, r, path)
+	} else {
+		metrics.acquired(readLock, path, time.Since(start))
+		if sharedStore() {
+			replyGranted(w, r, lockID, fence)
+			return
+		}
+		// the version can't change while the lock is held
+		version := keyVersion(path)
+		replyGrantedAt(w, r, lockID, fence, &version)
+	}
+}
+
+func ulHandler(w http.ResponseWriter, r *http.Request, readUnLock bool) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if _, ok := query["lock-id"]; !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+
+	lockID := query.Get("lock-id")
+	if len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	releasing := startChild(requestSpan(r.Context()), "lock.release")
+	res := false
+	if readUnLock {
+		res = store.runlock(path, lockID)
+	} else {
+		res = store.unlock(path, lockID)
+	}
+	releasing.end("key", path, "lock_id", lockID, "released", strconv.FormatBool(res))
+
+	if res {
+		replySuccess(w, r)
+	} else {
+		metrics.unlockFailed(readUnLock)
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+// lockMultiHandler write locks every key= of the request or none of them
+func lockMultiHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	var keys []string
+	for _, key := range query["key"] {
+		key, ok := scopedParam(r, key)
+		if !ok || !roomFor(key) {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		keys = append(keys, key)
+	}
+	keys = slices.Compact(slices.Sorted(slices.Values(keys)))
+	if len(keys) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if hierarchical {
+		// a key inside another of the same transaction could never be granted
+		for _, key := range keys {
+			for _, parent := range ancestors(key) {
+				if _, found := slices.BinarySearch(keys, parent); found {
+					replyFailure(w, r, errBadRequest)
+					return
+				}
+			}
+		}
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, keys...); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	opts := lockOptions{ttl: ttl, principal: callerName(r), session: query.Get("session"), addr: remoteHost(r)}
+	if !metadataParams(query, &opts) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+
+	holdOpen(w, wait)
+	start := time.Now()
+	txn, held := lockMulti(r.Context(), keys, opts, wait)
+	if txn == deadlock {
+		replyFailure(w, r, errDeadlock)
+		return
+	}
+	if len(txn) == 0 && nsFull(requestNamespace(r)) {
+		replyFull(w, r, errQuota)
+		return
+	}
+	if len(txn) == 0 && clientFull(opts.quotaClient()) {
+		replyFull(w, r, errClientQuota)
+		return
+	}
+	if len(txn) == 0 {
+		replyRetry(w, r, keys...)
+		return
+	}
+	waited := time.Since(start)
+	for i := range held {
+		metrics.acquired(false, held[i].Key, waited)
+		held[i].Key = clientKey(held[i].Key)
+	}
+	replyTxn(w, r, txn, held)
+}
+
+// unlockMultiHandler releases every lock of a multi-key transaction
+func unlockMultiHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	txn := r.URL.Query().Get("txn")
+	if len(txn) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if unlockMulti(requestNamespace(r), txn) {
+		replySuccess(w, r)
+	} else {
+		metrics.unlockFailed(false)
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+func upgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	lockID := query.Get("lock-id")
+	if len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	holdOpen(w, wait)
+	fence, held := upgrade(r.Context(), path, lockID, wait)
+	switch {
+	case !held:
+		replyFailure(w, r, errNotHeld)
+	case fence == 0:
+		replyRetry(w, r, path)
+	default:
+		replyGranted(w, r, lockID, fence)
+	}
+}
+
+func downgradeHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	lockID := query.Get("lock-id")
+	if len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	downgraded, held := downgrade(path, lockID)
+	switch {
+	case !held:
+		replyFailure(w, r, errNotHeld)
+	case !downgraded:
+		replyFailure(w, r, errReentrant)
+	default:
+		replySuccess(w, r)
+	}
+}
+
+func renewHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	lockID := query.Get("lock-id")
+	if len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok || ttl == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	if store.renew(path, lockID, ttl) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+// forceUnlockHandler releases the key from under its holders, for clearing a
+// lock left behind by a holder that is gone for good
+func forceUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if forceUnlock(path, callerName(r)) != 0 {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNotHeld)
+	}
+}
+
+// unlockAllHandler answers POST /unlock-all?owner=ID or
+// /unlock-all?session=ID, releasing every lock of the owner or session in
+// one call for an instance that has to let go of everything. callers
+// without admin rights only release the locks they took themselves. the
+// reply counts the released locks
+func unlockAllHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	owner, session := query.Get("owner"), query.Get("session")
+	if len(owner) == 0 == (len(session) == 0) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	released := unlockAll(requestNamespace(r), func(h *holder) bool {
+		if p.perms&permAdmin == 0 && h.principal != p.name {
+			return false
+		}
+		if len(owner) != 0 {
+			return h.owner == owner
+		}
+		return h.session == session
+	})
+	slog.Info("released all locks", "owner", owner, "session", session, "locks", released, "by", p.name)
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Status   string `json:"status"`
+			Released int    `json:"released"`
+		}{"success", released})
+		return
+	}
+	fmt.Fprintf(w, "success %d\n", released)
+}
+
+func createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	ttl, ok := durationParam(r.URL.Query(), "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl == 0 {
+		ttl = time.Duration(sessionTTL.Load())
+	}
+	id, ok := createSession(ttl)
+	if !ok {
+		replyFailure(w, r, errInternal)
+		return
+	}
+	replySession(w, r, id)
+}
+
+func renewSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if renewSession(r.URL.Query().Get("session")) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNoSession)
+	}
+}
+
+func destroySessionHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if destroySession(r.URL.Query().Get("session")) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNoSession)
+	}
+}
+
+// how long /watch blocks if no wait is given
+const defaultWatchWait = 30 * time.Second
+
+// watchHandler answers success once the key is unlocked, or retry if it is
+// still locked when wait runs out
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if wait == 0 {
+		wait = defaultWatchWait
+	}
+	holdOpen(w, wait)
+	if watch(r.Context(), path, wait) {
+		replySuccess(w, r)
+	} else {
+		replyRetry(w, r, path)
+	}
+}
+
+// subscriptionParams reads the repeated key= and prefix= parameters of an
+// event stream, false if one is not valid
+func subscriptionParams(r *http.Request, query url.Values) ([]string, []string, bool) {
+	var keys, prefixes []string
+	for _, key := range query["key"] {
+		key, ok := scopedParam(r, key)
+		if !ok {
+			return nil, nil, false
+		}
+		keys = append(keys, key)
+	}
+	for _, prefix := range query["prefix"] {
+		prefix, ok := scopedParam(r, prefix)
+		if !ok {
+			return nil, nil, false
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return keys, prefixes, true
+}
+
+// wsHandler pushes lock events as JSON text messages over a websocket.
+// repeated key= and prefix= parameters choose the keys, none means all
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	keys, prefixes, ok := subscriptionParams(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	conn, rw, err := wsUpgrade(w, r)
+	if err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	sub := subscribe(requestNamespace(r), keys, prefixes)
+	defer unsubscribe(sub)
+
+	// the reader answers pings and notices the client going away, all
+	// writes happen on this goroutine
+	control := make(chan wsFrame)
+	done := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(done)
+		for {
+			opcode, payload, err := wsReadFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			var reply wsFrame
+			switch opcode {
+			case wsPing:
+				reply = wsFrame{wsPong, payload}
+			case wsClose:
+				reply = wsFrame{wsClose, payload}
+			default:
+				continue
+			}
+			select {
+			case control <- reply:
+			case <-quit:
+				return
+			}
+			if opcode == wsClose {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// dropped for falling behind
+				wsWriteFrame(rw.Writer, wsClose, nil)
+				return
+			}
+			ev.Key = clientKey(ev.Key)
+			b, _ := json.Marshal(ev)
+			if err := wsWriteFrame(rw.Writer, wsText, b); err != nil {
+				return
+			}
+		case f := <-control:
+			if err := wsWriteFrame(rw.Writer, f.opcode, f.payload); err != nil || f.opcode == wsClose {
+				return
+			}
+		case <-done:
+			return
+		case <-r.Context().Done():
+			// shutting down
+			wsWriteFrame(rw.Writer, wsClose, nil)
+			return
+		}
+	}
+}
+
+func fenceHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	token, err := strconv.ParseInt(query.Get("token"), 10, 64)
+	if err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if store.validateFence(path, token) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errStaleToken)
+	}
+}
+
+// page size limits of /locks and /stats
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// lockEntry is one held lock id in the JSON body of /locks
+type lockEntry struct {
+	Key       string            `json:"key"`
+	Mode      string            `json:"mode"`
+	LockID    string            `json:"lockId"`
+	Acquired  time.Time         `json:"acquired"`
+	Expires   time.Time         `json:"expires,omitzero"`
+	Principal string            `json:"principal,omitempty"`
+	Session   string            `json:"session,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	Holds     int               `json:"holds,omitempty"`
+	Purpose   string            `json:"purpose,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Addr      string            `json:"addr,omitempty"`
+	// lease left in milliseconds, absent for a lock without ttl
+	RemainingMs int64 `json:"remainingMs,omitempty"`
+}
+
+// lockEntries lists the holders of locks as of now
+func lockEntries(locks []heldLock, now time.Time) []lockEntry {
+	entries := []lockEntry{}
+	for _, l := range locks {
+		for i, id := range l.ids {
+			h := l.holders[i]
+			e := lockEntry{Key: clientKey(l.key), Mode: stateName(h.mode), LockID: id,
+				Acquired: h.acquired.UTC(), Expires: h.expiry.UTC(), Principal: h.principal, Session: h.session,
+				Owner: h.owner, Holds: h.holds, Purpose: h.purpose, Labels: h.labels, Addr: h.addr}
+			if !h.expiry.IsZero() {
+				e.RemainingMs = max(h.expiry.Sub(now).Milliseconds(), 1)
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// writeLockLine writes the text line of a held lock:
+// KEY MODE LOCKID acquired=TIME [expires=TIME remaining=DURATION]
+// [principal=NAME] [session=ID] [owner=OWNER holds=N] [purpose=PURPOSE]
+// [label:NAME=VALUE...] [addr=ADDR]
+// KEY is quoted
+func writeLockLine(w io.Writer, e lockEntry) {
+	fmt.Fprintf(w, "%s %s %s acquired=%s", strconv.Quote(e.Key), e.Mode, e.LockID, e.Acquired.Format(time.RFC3339Nano))
+	if !e.Expires.IsZero() {
+		fmt.Fprintf(w, " expires=%s remaining=%s", e.Expires.Format(time.RFC3339Nano),
+			time.Duration(e.RemainingMs)*time.Millisecond)
+	}
+	if len(e.Principal) != 0 {
+		fmt.Fprintf(w, " principal=%s", e.Principal)
+	}
+	if len(e.Session) != 0 {
+		fmt.Fprintf(w, " session=%s", e.Session)
+	}
+	if len(e.Owner) != 0 {
+		fmt.Fprintf(w, " owner=%s holds=%d", strconv.Quote(e.Owner), e.Holds)
+	}
+	if len(e.Purpose) != 0 {
+		fmt.Fprintf(w, " purpose=%s", strconv.Quote(e.Purpose))
+	}
+	for _, name := range sortedKeys(e.Labels) {
+		fmt.Fprintf(w, " label:%s=%s", name, strconv.Quote(e.Labels[name]))
+	}
+	if len(e.Addr) != 0 {
+		fmt.Fprintf(w, " addr=%s", e.Addr)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// locksHandler lists held locks, optionally only the keys starting with
+// prefix= or matching match=GLOB, one line per lock id as written by
+// writeLockLine. when more locks remain the Next-After header holds the
+// value to pass as after= to fetch the next page. JSON clients get
+// {"locks": [...], "nextAfter": KEY}
+func locksHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := limitParam(query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	filter, ok := filterParams(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	var after string
+	if a := query.Get("after"); len(a) != 0 {
+		if after, ok = scopedParam(r, a); !ok {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	locks, more := listLocks(filter, after, limit)
+	var nextAfter string
+	if more {
+		nextAfter = clientKey(locks[len(locks)-1].key)
+		w.Header().Set("Next-After", nextAfter)
+	}
+	entries := lockEntries(locks, time.Now())
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Locks     []lockEntry `json:"locks"`
+			NextAfter string      `json:"nextAfter,omitempty"`
+		}{entries, nextAfter})
+		return
+	}
+	for _, e := range entries {
+		writeLockLine(w, e)
+	}
+}
+
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	lHandler(w, r, false)
+}
+
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	ulHandler(w, r, false)
+}
+
+func rlockHandler(w http.ResponseWriter, r *http.Request) {
+	lHandler(w, r, true)
+}
+
+func runlockHandler(w http.ResponseWriter, r *http.Request) {
+	ulHandler(w, r, true)
+}
+
+// keyStatus is how a key is locked and by whom, as /status answers it
+type keyStatus struct {
+	Key          string      `json:"key"`
+	State        string      `json:"state"`
+	Readers      int         `json:"readers,omitempty"`
+	Queued       int         `json:"queued,omitempty"`
+	FencingToken int64       `json:"fencingToken,omitempty"`
+	Locks        []lockEntry `json:"locks"`
+}
+
+func statusOf(path string, now time.Time) keyStatus {
+	l, queued, fence := lockStatus(path)
+	st := keyStatus{Key: clientKey(path), State: stateName(l.state), Queued: queued, FencingToken: fence,
+		Locks: lockEntries([]heldLock{l}, now)}
+	switch l.state {
+	case 0:
+		st.State = "unlocked"
+	case 2:
+		for _, h := range l.holders {
+			if h.mode == 2 {
+				st.Readers++
+			}
+		}
+	}
+	return st
+}
+
+// writeStateLine writes "unlocked", "write" or "read N" with the number
+// of readers
+func writeStateLine(w io.Writer, st keyStatus) {
+	if st.Readers != 0 {
+		fmt.Fprintf(w, "%s %d\n", st.State, st.Readers)
+	} else {
+		fmt.Fprintf(w, "%s\n", st.State)
+	}
+}
+
+// statusHandler answers GET /status?key=PATH without taking a lock: a first
+// line "unlocked", "read N" with the number of readers or "write", then
+// the line of every holder as in /locks. JSON clients get {"key", "state",
+// "readers", "queued", "fencingToken", "locks"}, queued counting blocking
+// requests and write intents
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	st := statusOf(path, time.Now())
+	if wantsJSON(r) {
+		writeJSON(w, 0, st)
+		return
+	}
+	writeStateLine(w, st)
+	for _, e := range st.Locks {
+		writeLockLine(w, e)
+	}
+}
+
+// keyQueue is the queue of a key as /queue answers it
+type keyQueue struct {
+	Key   string          `json:"key"`
+	Queue []queuedRequest `json:"queue"`
+}
+
+// queueHandler answers GET /queue?key=PATH with the requests waiting for
+// PATH in the order they are to be served, a line "POSITION MODE
+// queued=TIME waited=D estimated=D" each followed by the priority,
+// principal, owner and address when known. estimated is how long until it
+// is likely served, judging by the holder's lease and the typical hold of
+// the key. JSON clients get {"key", "queue": [...]}
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	q := keyQueue{Key: clientKey(path), Queue: queueOf(path, time.Now())}
+	if wantsJSON(r) {
+		writeJSON(w, 0, q)
+		return
+	}
+	for _, e := range q.Queue {
+		fmt.Fprintf(w, "%d %s queued=%s waited=%s estimated=%s", e.Position, e.Mode, e.Queued.Format(time.RFC3339Nano),
+			time.Duration(e.WaitedMs)*time.Millisecond, time.Duration(e.EstimatedWaitMs)*time.Millisecond)
+		if e.Priority != 0 {
+			fmt.Fprintf(w, " priority=%d", e.Priority)
+		}
+		if len(e.Principal) != 0 {
+			fmt.Fprintf(w, " principal=%s", e.Principal)
+		}
+		if len(e.Owner) != 0 {
+			fmt.Fprintf(w, " owner=%s", strconv.Quote(e.Owner))
+		}
+		if len(e.Addr) != 0 {
+			fmt.Fprintf(w, " addr=%s", e.Addr)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// largest /status/bulk request body
+const maxBulkBody = 1 << 20
+
+// bulkStatusHandler answers POST /status/bulk, whose body is a JSON array
+// of up to maxListLimit keys, with the status of each in one round trip:
+// a line "KEY STATE" per key, STATE as on the first line of /status.
+// JSON clients get {"keys": [...]} with the /status object of each key
+func bulkStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var keys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBody)).Decode(&keys); err != nil || len(keys) > maxListLimit {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	paths := make([]string, len(keys))
+	for i, key := range keys {
+		path, ok := scopedParam(r, key)
+		if !ok {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		if !aclPermits(r, aclList, key) {
+			replyFailure(w, r, errForbidden)
+			return
+		}
+		paths[i] = path
+	}
+	now := time.Now()
+	statuses := make([]keyStatus, len(paths))
+	for i, path := range paths {
+		statuses[i] = statusOf(path, now)
+	}
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Keys []keyStatus `json:"keys"`
+		}{statuses})
+		return
+	}
+	for _, st := range statuses {
+		fmt.Fprintf(w, "%q ", st.Key)
+		writeStateLine(w, st)
+	}
+}
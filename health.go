@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// healthzHandler answers ok for as long as the process serves http, it is
+// the liveness probe
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// notReady returns why the server should not be sent lock requests, empty
+// if it should
+func notReady() []string {
+	var reasons []string
+	if draining.Load() {
+		reasons = append(reasons, "shutting down")
+	} else if maintenance.Load() {
+		reasons = append(reasons, "in maintenance")
+	}
+	if link := upstream.Load(); link != nil && link.deposed {
+		reasons = append(reasons, "deposed by "+link.url)
+	} else if link != nil && !synced.Load() {
+		reasons = append(reasons, "replica not synced with the leader")
+	}
+	if err := wal.failing(); err != nil {
+		reasons = append(reasons, "wal: "+err.Error())
+	}
+	if b, ok := store.(*redisBackend); ok {
+		if err := b.failing(); err != nil {
+			reasons = append(reasons, "redis: "+strings.TrimPrefix(err.Error(), "redis: "))
+		}
+	}
+	if b, ok := store.(*leaseBackend); ok {
+		if err := b.failing(); err != nil {
+			reasons = append(reasons, "kubernetes: "+err.Error())
+		}
+	}
+	return reasons
+}
+
+// readyzHandler is the readiness probe, 200 while the server takes locks
+// and 503 with the reasons while it is draining, in maintenance or can't
+// write its wal
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	reasons := notReady()
+	if wantsJSON(r) {
+		if len(reasons) != 0 {
+			writeJSON(w, http.StatusServiceUnavailable, struct {
+				Status  string   `json:"status"`
+				Reasons []string `json:"reasons"`
+			}{"not_ready", reasons})
+			return
+		}
+		writeJSON(w, 0, struct {
+			Status string `json:"status"`
+		}{"ready"})
+		return
+	}
+	if len(reasons) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, reason := range reasons {
+			w.Write([]byte("not ready: " + reason + "\n"))
+		}
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
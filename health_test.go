@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzMaintenance(t *testing.T) {
+	readyz := func() (int, string) {
+		w := httptest.NewRecorder()
+		readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code, w.Body.String()
+	}
+	if code, body := readyz(); code != http.StatusOK {
+		t.Fatalf("readyz: %d %s", code, body)
+	}
+	maintenance.Store(true)
+	t.Cleanup(func() { maintenance.Store(false) })
+	if code, body := readyz(); code != http.StatusServiceUnavailable || !strings.Contains(body, "not ready: in maintenance") {
+		t.Errorf("readyz in maintenance: %d %s", code, body)
+	}
+}
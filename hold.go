@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// how often a held stream says it still holds the lock if the request sets
+// no keepalive
+const defaultKeepalive = 10 * time.Second
+
+// holdHandler answers POST /hold?key=PATH with a lock that lasts as long as
+// the response stream: the first line is the grant as /lock answers it,
+// then "held" every keepalive=DURATION. the lock is released as soon as
+// the client closes the stream or stops reading, and a last "released"
+// line ends the stream if the lock is lost first, e.g. to a force-unlock.
+// mode=read takes a read lock, wait=DURATION queues for the lock. the lock
+// has no lease, the connection is its lease
+func holdHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	readLock := query.Get("mode") == "read"
+	if mode := query.Get("mode"); len(mode) != 0 && mode != "read" && mode != "write" {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	keepalive, ok := durationParam(query, "keepalive")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if keepalive == 0 {
+		keepalive = defaultKeepalive
+	}
+	opts := lockOptions{principal: callerName(r), addr: remoteHost(r)}
+	if !metadataParams(query, &opts) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	holdOpen(w, wait)
+	var lockID string
+	var fence int64
+	start := time.Now()
+	if wait > 0 {
+		lockID, fence = store.waitLock(r.Context(), path, readLock, opts, wait)
+	} else if readLock {
+		lockID = store.rlock(path, opts)
+	} else {
+		lockID, fence = store.lock(path, opts)
+	}
+	switch {
+	case lockID == deadlock:
+		replyFailure(w, r, errDeadlock)
+		return
+	case len(lockID) == 0 && nsFull(requestNamespace(r)):
+		replyFull(w, r, errQuota)
+		return
+	case len(lockID) == 0 && clientFull(opts.quotaClient()):
+		replyFull(w, r, errClientQuota)
+		return
+	case len(lockID) == 0:
+		metrics.contended(readLock, path)
+		replyRetry(w, r, path)
+		return
+	}
+	metrics.acquired(readLock, path, time.Since(start))
+	defer func() {
+		if readLock {
+			store.runlock(path, lockID)
+		} else {
+			store.unlock(path, lockID)
+		}
+	}()
+
+	rc := http.NewResponseController(w)
+	// each write must reach the client within the write timeout, the
+	// stream as a whole has no deadline
+	send := func(write func()) bool {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		} else {
+			rc.SetWriteDeadline(time.Time{})
+		}
+		write()
+		return rc.Flush() == nil
+	}
+	if !send(func() { replyGranted(w, r, lockID, fence) }) {
+		return
+	}
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+		if !lockHeld(path, lockID) {
+			send(func() { holdLine(w, r, "released") })
+			return
+		}
+		if !send(func() { holdLine(w, r, "held") }) {
+			return
+		}
+	}
+}
+
+func holdLine(w http.ResponseWriter, r *http.Request, status string) {
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: status})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", status)
+}
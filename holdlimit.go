@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// -hold-limits caps how long the keys it selects may be held whatever
+// lease they were taken with, so a runaway job renewing forever or a lock
+// taken without a ttl can't keep a shared key. a lock held past the
+// ceiling of its key is released as hold-limited, or with
+// -hold-limit-action flag reported once as overheld and left alone. both
+// are audited, published as lock events and logged
+
+var (
+	// the longest the keys they select may be held
+	holdLimits atomic.Pointer[[]ttlRule]
+	// report the locks over their ceiling instead of releasing them
+	holdLimitFlag atomic.Bool
+)
+
+// how often the sweeper compares the locks held with -hold-limits
+const holdLimitInterval = time.Second
+
+// parseHoldLimitAction parses the value of -hold-limit-action, telling
+// whether locks over their ceiling are only flagged
+func parseHoldLimitAction(name string) (bool, error) {
+	switch name {
+	case "release":
+		return false, nil
+	case "flag":
+		return true, nil
+	}
+	return false, fmt.Errorf("-hold-limit-action must be release or flag, not %q", name)
+}
+
+// enforceHoldLimits releases, or flags, the locks held longer than the
+// -hold-limits ceiling of their key
+func enforceHoldLimits(now time.Time) {
+	rules := holdLimits.Load()
+	if rules == nil || len(*rules) == 0 {
+		return
+	}
+	flagOnly := holdLimitFlag.Load()
+	for _, s := range shards {
+		s.mu.Lock()
+		for path, counter := range s.locks {
+			if counter.state == 0 {
+				continue
+			}
+			limit := ttlFor(rules, path)
+			if limit == 0 {
+				continue
+			}
+			for id, h := range counter.lockID {
+				held := now.Sub(h.acquired)
+				if held <= limit || (flagOnly && h.overheld) {
+					continue
+				}
+				ns, key := splitKey(path)
+				if flagOnly {
+					h.overheld = true
+					slog.Warn("lock held past its hold limit", "namespace", ns, "key", key, "lock_id", id,
+						"held", held, "limit", limit, "principal", h.principal, "owner", h.owner)
+					audit.record(eventOverheld, path, h.mode, id, h, "")
+					publish(lockEvent{Type: eventOverheld, Key: path, Mode: stateName(h.mode), LockID: id, Time: now})
+					continue
+				}
+				slog.Warn("lock released at its hold limit", "namespace", ns, "key", key, "lock_id", id,
+					"held", held, "limit", limit, "principal", h.principal, "owner", h.owner)
+				counter.release(id, eventHoldLimited)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long the grant of a lock request carrying an Idempotency-Key is
+// replayed to retries with the same key
+const idempotencyTTL = 10 * time.Minute
+
+// longest Idempotency-Key accepted
+const maxIdempotencyKey = 256
+
+var errIdempotencyKey = failure{code: "idempotency_key", text: "idempotency key was used for another request",
+	status: http.StatusUnprocessableEntity}
+
+// idempotent is the outcome of the first lock request sent with an
+// Idempotency-Key
+type idempotent struct {
+	path     string
+	readLock bool
+	lockID   string
+	fence    int64
+	expires  time.Time
+	// closed once the first request has its lock
+	done chan struct{}
+}
+
+// idempotency holds granted and in flight lock requests by caller scoped
+// Idempotency-Key. they are not in the wal, a restart forgets them. lock
+// order is idempotency before shard mutex
+var idempotency = struct {
+	sync.Mutex
+	m map[string]*idempotent
+}{m: map[string]*idempotent{}}
+
+// claimIdempotent looks up the lock request key of the caller of r. replay
+// is set if the lock it was granted is still held and should be answered
+// again, otherwise the request goes ahead and must report its outcome with
+// finish. a request still in flight with key is waited for. it fails if key
+// was used to lock another path or mode
+func claimIdempotent(r *http.Request, key, path string, readLock bool) (e *idempotent, replay bool, f failure, ok bool) {
+	key = requestNamespace(r) + "\x00" + callerName(r) + "\x00" + key
+	for {
+		idempotency.Lock()
+		e = idempotency.m[key]
+		if e != nil && (e.path != path || e.readLock != readLock) {
+			idempotency.Unlock()
+			return nil, false, errIdempotencyKey, false
+		}
+		if e == nil || (e.isDone() && !lockHeld(path, e.lockID)) {
+			e = &idempotent{path: path, readLock: readLock, done: make(chan struct{})}
+			idempotency.m[key] = e
+			idempotency.Unlock()
+			return e, false, failure{}, true
+		}
+		idempotency.Unlock()
+		if e.isDone() {
+			return e, true, failure{}, true
+		}
+		<-e.done
+	}
+}
+
+func (e *idempotent) isDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish records the lock the request was granted, an empty lockID leaves
+// nothing to replay and a retry tries to lock again
+func (e *idempotent) finish(lockID string, fence int64) {
+	idempotency.Lock()
+	defer idempotency.Unlock()
+
+	if len(lockID) != 0 && lockID != deadlock {
+		e.lockID, e.fence = lockID, fence
+	}
+	e.expires = time.Now().Add(idempotencyTTL)
+	close(e.done)
+}
+
+// expireIdempotency forgets the grants whose replay window passed by now
+func expireIdempotency(now time.Time) {
+	idempotency.Lock()
+	defer idempotency.Unlock()
+
+	for key, e := range idempotency.m {
+		if e.isDone() && !now.Before(e.expires) {
+			delete(idempotency.m, key)
+		}
+	}
+}
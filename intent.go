@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// how long a write intent lasts if the request sets no ttl
+const defaultIntentTTL = 30 * time.Second
+
+var errNoIntent = failure{code: "no_intent", text: "no such write intent", status: http.StatusNotFound}
+
+// registerIntent queues a write intent on path that lasts ttl. from then
+// on new locks are refused except those queued ahead of it, the readers
+// holding path drain and /lock with the intent is granted once they have
+func registerIntent(path string, ttl time.Duration, priority int) string {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.getCounter(path)
+	t := counter.enqueue(1, priority)
+	t.intent, t.expires = newID(), t.arrived.Add(ttl)
+	scheduleExpiry(path, t.intent, t.expires, true)
+	return t.intent
+}
+
+// intentExists reports whether the write intent id is live on path
+func intentExists(path, id string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	return counter != nil && counter.intentTicket(id) != nil
+}
+
+// cancelIntent withdraws the write intent id on path
+func cancelIntent(path, id string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	return counter != nil && counter.dropIntent(id)
+}
+
+// intentHandler answers POST /intent?key=PATH&ttl=DURATION&priority=N with
+// the id of a new write intent on PATH
+func intentHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl == 0 {
+		ttl = defaultIntentTTL
+	}
+	var priority int
+	if p := query.Get("priority"); len(p) != 0 {
+		var err error
+		if priority, err = strconv.Atoi(p); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	id := registerIntent(path, ttl, priority)
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success", Intent: id})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", id)
+}
+
+// cancelIntentHandler answers POST /intent/cancel?key=PATH&intent=ID
+func cancelIntentHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	id := query.Get("intent")
+	if !ok || len(id) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if cancelIntent(path, id) {
+		replySuccess(w, r)
+	} else {
+		replyFailure(w, r, errNoIntent)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the JWKS document is fetched again
+	jwksRefresh = 10 * time.Minute
+	// least time between two fetches for a token signed by an unknown key
+	jwksMinRefresh = 30 * time.Second
+	// clock skew tolerated on exp and nbf
+	jwtLeeway = time.Minute
+)
+
+// jwtScopes are the token scopes that grant a permission, ns:NAME scopes
+// confine the caller to namespace NAME
+var jwtScopes = map[string]permission{
+	"lock:read":          permRead,
+	"lock:write":         permWrite,
+	"admin:force-unlock": permAdmin,
+}
+
+// jwtVerifier authenticates requests by a JWT sent as "Authorization:
+// Bearer TOKEN", signed by a static key or by one of the keys of a JWKS
+// document. the sub claim names the caller and its scopes are its
+// permissions
+type jwtVerifier struct {
+	issuer   string
+	audience string
+	// the -jwt-key, nil with a JWKS url
+	static  crypto.PublicKey
+	jwksURL string
+	client  *http.Client
+
+	mu sync.Mutex
+	// JWKS keys by kid
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// hmacKey is a shared secret for the HS algorithms
+type hmacKey []byte
+
+func newJWTVerifier(keyPath, jwksURL, issuer, audience string) (*jwtVerifier, error) {
+	v := &jwtVerifier{issuer: issuer, audience: audience, jwksURL: jwksURL,
+		client: &http.Client{Timeout: 10 * time.Second}, keys: map[string]crypto.PublicKey{}}
+	if len(keyPath) != 0 {
+		b, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		if v.static, err = parseJWTKey(b); err != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+		return v, nil
+	}
+	if err := v.fetch(); err != nil {
+		// the identity provider may come up later, the keys are
+		// fetched again for the tokens that come in
+		slog.Error("jwks fetch failed", "url", jwksURL, "err", err)
+	}
+	go func() {
+		for range time.Tick(jwksRefresh) {
+			if err := v.fetch(); err != nil {
+				slog.Error("jwks fetch failed", "url", jwksURL, "err", err)
+			}
+		}
+	}()
+	return v, nil
+}
+
+// parseJWTKey reads a PEM public key, or takes anything else as an HMAC
+// secret
+func parseJWTKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		secret := bytes.TrimSpace(b)
+		if len(secret) < 32 {
+			return nil, errors.New("hmac secret shorter than 32 bytes")
+		}
+		return hmacKey(secret), nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// jwk is one key of a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, errors.New("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("bad ec point")
+		}
+		return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// fetch replaces the JWKS keys with those the url serves now
+func (v *jwtVerifier) fetch() error {
+	v.mu.Lock()
+	v.fetched = time.Now()
+	v.mu.Unlock()
+
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks: %s", resp.Status)
+	}
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range doc.Keys {
+		if len(k.Use) != 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn("jwks key skipped", "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+// key returns the key a token with kid is signed with, fetching the JWKS
+// again for a kid it does not know yet
+func (v *jwtVerifier) key(kid string) crypto.PublicKey {
+	if v.static != nil {
+		return v.static
+	}
+	v.mu.Lock()
+	key, stale := v.keys[kid], time.Since(v.fetched) >= jwksMinRefresh
+	v.mu.Unlock()
+	if key != nil || !stale {
+		return key
+	}
+	if err := v.fetch(); err != nil {
+		slog.Error("jwks fetch failed", "url", v.jwksURL, "err", err)
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.keys[kid]
+}
+
+// jwtClaims are the claims the server looks at
+type jwtClaims struct {
+	Subject     string          `json:"sub"`
+	Issuer      string          `json:"iss"`
+	Audience    json.RawMessage `json:"aud"`
+	Expires     *float64        `json:"exp"`
+	NotBefore   *float64        `json:"nbf"`
+	Scope       string          `json:"scope"`
+	Scp         json.RawMessage `json:"scp"`
+	Permissions []string        `json:"permissions"`
+}
+
+// stringList reads a claim that is either a string or a list of strings
+func stringList(raw json.RawMessage) []string {
+	var one string
+	if json.Unmarshal(raw, &one) == nil {
+		return strings.Fields(one)
+	}
+	var list []string
+	json.Unmarshal(raw, &list)
+	return list
+}
+
+// verify checks the signature and the time, issuer and audience claims of
+// token
+func (v *jwtVerifier) verify(token string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("not a jwt")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	key := v.key(header.Kid)
+	if key == nil {
+		return claims, fmt.Errorf("unknown key %q", header.Kid)
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return claims, err
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return claims, err
+	}
+	now := time.Now()
+	if claims.Expires == nil || now.After(time.Unix(int64(*claims.Expires), 0).Add(jwtLeeway)) {
+		return claims, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return claims, errors.New("token not valid yet")
+	}
+	if len(v.issuer) != 0 && claims.Issuer != v.issuer {
+		return claims, errors.New("wrong issuer")
+	}
+	if len(v.audience) != 0 && !slices.Contains(stringList(claims.Audience), v.audience) {
+		return claims, errors.New("wrong audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifyJWTSignature checks sig over signed for alg, which must suit the
+// type of key so a public key can't be passed off as an HMAC secret
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h func() hash.Hash
+	var ch crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		h, ch = sha256.New, crypto.SHA256
+	case "384":
+		h, ch = sha512.New384, crypto.SHA384
+	case "512":
+		h, ch = sha512.New, crypto.SHA512
+	}
+	digest := func() []byte {
+		d := h()
+		d.Write(signed)
+		return d.Sum(nil)
+	}
+	bad := errors.New("bad signature")
+	switch k := key.(type) {
+	case hmacKey:
+		if !strings.HasPrefix(alg, "HS") || h == nil {
+			break
+		}
+		mac := hmac.New(h, k)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return bad
+		}
+		return nil
+	case *rsa.PublicKey:
+		if h == nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(alg, "RS"):
+			if rsa.VerifyPKCS1v15(k, ch, digest(), sig) != nil {
+				return bad
+			}
+			return nil
+		case strings.HasPrefix(alg, "PS"):
+			if rsa.VerifyPSS(k, ch, digest(), sig, nil) != nil {
+				return bad
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || h == nil || len(sig) != 2*size {
+			break
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest(), r, s) {
+			return bad
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, signed, sig) {
+			return bad
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %q does not suit the key", alg)
+}
+
+func (v *jwtVerifier) authenticate(r *http.Request) (principal, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || strings.Count(token, ".") != 2 {
+		return principal{}, false
+	}
+	claims, err := v.verify(token)
+	if err != nil {
+		slog.Debug("jwt refused", "err", err)
+		return principal{}, false
+	}
+	p := principal{name: claims.Subject}
+	scopes := append(append(strings.Fields(claims.Scope), stringList(claims.Scp)...), claims.Permissions...)
+	for _, scope := range scopes {
+		if ns, ok := strings.CutPrefix(scope, "ns:"); ok && nsPattern.MatchString(ns) {
+			p.namespaces = append(p.namespaces, ns)
+		}
+		p.perms |= jwtScopes[scope]
+	}
+	return p, true
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where a pod finds its service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sClient reads and writes coordination.k8s.io/v1 Lease objects of one
+// kubernetes namespace through the api server's REST api
+type k8sClient struct {
+	// api server url, e.g. https://10.96.0.1:443 or a kubectl proxy
+	base      string
+	namespace string
+	// service account token file, read for every request since bound
+	// tokens are rotated. empty sends no token
+	tokenPath string
+	http      *http.Client
+}
+
+// newK8sClient talks to api if set, otherwise to the api server of the
+// cluster the server runs in with the pod's service account. namespace
+// defaults to the pod's
+func newK8sClient(api, namespace string) (*k8sClient, error) {
+	c := &k8sClient{base: strings.TrimSuffix(api, "/"), namespace: namespace, http: &http.Client{Timeout: 5 * time.Second}}
+	if len(c.base) == 0 {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if len(host) == 0 || len(port) == 0 {
+			return nil, errors.New("not running in a kubernetes cluster, set -k8s-api")
+		}
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates in " + serviceAccountDir + "/ca.crt")
+		}
+		c.http.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		c.base = "https://" + net.JoinHostPort(host, port)
+		c.tokenPath = serviceAccountDir + "/token"
+	}
+	if len(c.namespace) == 0 {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, errors.New("no -k8s-namespace and no service account namespace")
+		}
+		c.namespace = strings.TrimSpace(string(ns))
+	}
+	return c, nil
+}
+
+// k8sTime is a metav1.MicroTime
+type k8sTime struct{ time.Time }
+
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (t k8sTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(microTime))
+}
+
+func (t *k8sTime) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	var err error
+	t.Time, err = time.Parse(microTime, s)
+	return err
+}
+
+// k8sLease is the part of a Lease object the lock server reads and writes,
+// they are the fields client-go's leader election uses
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace,omitempty"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       *string  `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds *int32   `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *k8sTime `json:"acquireTime,omitempty"`
+		RenewTime            *k8sTime `json:"renewTime,omitempty"`
+		LeaseTransitions     *int32   `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// holder returns who holds the lease, empty if nobody does or the holder
+// let it run out
+func (l *k8sLease) holder(now time.Time) string {
+	if l.Spec.HolderIdentity == nil || len(*l.Spec.HolderIdentity) == 0 {
+		return ""
+	}
+	if l.Spec.RenewTime != nil && l.Spec.LeaseDurationSeconds != nil &&
+		now.After(l.Spec.RenewTime.Add(time.Duration(*l.Spec.LeaseDurationSeconds)*time.Second)) {
+		return ""
+	}
+	return *l.Spec.HolderIdentity
+}
+
+// errLeaseConflict is a write that lost against another one, the lease
+// changed since it was read
+var errLeaseConflict = errors.New("lease was changed concurrently")
+
+// do sends a request for the lease name, or the lease collection if name
+// is empty, and decodes the lease it answers into out. it returns false
+// without error for 404
+func (c *k8sClient) do(method, name string, in *k8sLease, out *k8sLease) (bool, error) {
+	url := c.base + "/apis/coordination.k8s.io/v1/namespaces/" + c.namespace + "/leases"
+	if len(name) != 0 {
+		url += "/" + name
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return false, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.tokenPath) != 0 {
+		token, err := os.ReadFile(c.tokenPath)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode == http.StatusConflict:
+		return false, errLeaseConflict
+	case resp.StatusCode >= 300:
+		return false, fmt.Errorf("kubernetes api %s %s: %s: %s", method, url, resp.Status, bytes.TrimSpace(b))
+	}
+	if out != nil {
+		return true, json.Unmarshal(b, out)
+	}
+	return true, nil
+}
+
+// how long a lease held by the lock server lasts without being renewed
+const k8sLeaseDuration = 15 * time.Second
+
+// acquire makes identity the holder of lease name if nobody holds it. it
+// returns false if somebody else does or another writer won the race
+func (c *k8sClient) acquire(name, identity string) (bool, error) {
+	var lease k8sLease
+	found, err := c.do(http.MethodGet, name, nil, &lease)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if found {
+		if holder := lease.holder(now); len(holder) != 0 && holder != identity {
+			return false, nil
+		}
+	} else {
+		lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+		lease.Metadata.Name = name
+	}
+	transitions := int32(0)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions
+	}
+	if found && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != identity {
+		transitions++
+	}
+	seconds := int32(k8sLeaseDuration / time.Second)
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &k8sTime{now}
+	lease.Spec.RenewTime = &k8sTime{now}
+	lease.Spec.LeaseTransitions = &transitions
+	if found {
+		_, err = c.do(http.MethodPut, name, &lease, nil)
+	} else {
+		_, err = c.do(http.MethodPost, "", &lease, nil)
+	}
+	if errors.Is(err, errLeaseConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// renew moves the renew time of lease name to now, false if identity no
+// longer holds it
+func (c *k8sClient) renew(name, identity string) (bool, error) {
+	var lease k8sLease
+	found, err := c.do(http.MethodGet, name, nil, &lease)
+	if err != nil || !found || lease.holder(time.Now()) != identity {
+		return false, err
+	}
+	lease.Spec.RenewTime = &k8sTime{time.Now()}
+	_, err = c.do(http.MethodPut, name, &lease, nil)
+	if errors.Is(err, errLeaseConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release gives up lease name if identity still holds it, the way client-go
+// does: clearing the holder and shortening the lease to a second
+func (c *k8sClient) release(name, identity string) error {
+	var lease k8sLease
+	found, err := c.do(http.MethodGet, name, nil, &lease)
+	if err != nil || !found || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != identity {
+		return err
+	}
+	empty, second := "", int32(1)
+	lease.Spec.HolderIdentity = &empty
+	lease.Spec.LeaseDurationSeconds = &second
+	lease.Spec.RenewTime = &k8sTime{time.Now()}
+	_, err = c.do(http.MethodPut, name, &lease, nil)
+	return err
+}
+
+// a Lease name must be a dns subdomain
+var leaseNameRE = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// leaseBackend is the in-process lock table with the write locks of keys
+// under prefix backed by Lease objects: such a lock is granted only once
+// the lock server also holds the Lease named by the rest of the key, with
+// the lock id as holder identity, so client-go leader election and http
+// clients exclude each other. a keeper renews the Lease while the lock is
+// held and releases it once the lock is gone, however it went. read locks
+// of those keys are never granted, a Lease has a single holder
+type leaseBackend struct {
+	memoryBackend
+	client *k8sClient
+	prefix string
+
+	mu sync.Mutex
+	// the error of the latest api call, nil once one succeeds again
+	err error
+}
+
+// leaseName returns the Lease backing path, false if path is not mirrored
+func (b *leaseBackend) leaseName(path string) (string, bool) {
+	if ns, _ := splitKey(path); len(ns) != 0 || !strings.HasPrefix(path, b.prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, b.prefix), true
+}
+
+// note records the outcome of an api call
+func (b *leaseBackend) note(err error) {
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+	if err != nil {
+		slog.Error("kubernetes api call failed", "err", err)
+	}
+}
+
+// failing returns the error of the latest api call, nil if it succeeded
+func (b *leaseBackend) failing() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// mirror takes the Lease of a write lock granted on path, undoing the grant
+// if somebody else holds it
+func (b *leaseBackend) mirror(path, name, lockID string) bool {
+	ok, err := b.client.acquire(name, lockID)
+	b.note(err)
+	if !ok {
+		unlock(path, lockID)
+		return false
+	}
+	go b.keep(path, name, lockID)
+	return true
+}
+
+// keep renews the Lease of lockID until the lock is released, then
+// releases the Lease. a lost Lease releases the lock
+func (b *leaseBackend) keep(path, name, lockID string) {
+	for {
+		time.Sleep(k8sLeaseDuration / 3)
+		if !lockHeld(path, lockID) {
+			b.note(b.client.release(name, lockID))
+			return
+		}
+		ok, err := b.client.renew(name, lockID)
+		b.note(err)
+		if !ok && err == nil {
+			slog.Warn("kubernetes lease lost, releasing its lock", "key", path, "lease", name, "lock_id", lockID)
+			unlock(path, lockID)
+			return
+		}
+	}
+}
+
+func (b *leaseBackend) lock(path string, opts lockOptions) (string, int64) {
+	name, mirrored := b.leaseName(path)
+	if mirrored && !leaseNameRE.MatchString(name) {
+		slog.Warn("key is not a valid lease name", "key", path)
+		return "", 0
+	}
+	id, fence := lock(path, opts)
+	if len(id) == 0 || id == deadlock || !mirrored || b.mirror(path, name, id) {
+		return id, fence
+	}
+	return "", 0
+}
+
+func (b *leaseBackend) rlock(path string, opts lockOptions) string {
+	if _, mirrored := b.leaseName(path); mirrored {
+		return ""
+	}
+	return rlock(path, opts)
+}
+
+// waitLock queues on the lock table and then polls the Lease with backoff,
+// kubernetes has no queue to park on
+func (b *leaseBackend) waitLock(ctx context.Context, path string, readLock bool, opts lockOptions, wait time.Duration) (string, int64) {
+	name, mirrored := b.leaseName(path)
+	if !mirrored {
+		return waitLock(ctx, path, readLock, opts, wait)
+	}
+	if readLock || !leaseNameRE.MatchString(name) {
+		return "", 0
+	}
+	deadline := time.Now().Add(wait)
+	backoff := 100 * time.Millisecond
+	for {
+		id, fence := waitLock(ctx, path, false, opts, time.Until(deadline))
+		if len(id) == 0 || id == deadlock || b.mirror(path, name, id) {
+			return id, fence
+		}
+		left := time.Until(deadline)
+		if left <= 0 || closedForLocks() || !sleepCtx(ctx, min(backoff, left)) {
+			return "", 0
+		}
+		backoff = min(2*backoff, time.Second)
+	}
+}
+
+// unlock hands the Lease back right away rather than at the keeper's next
+// look
+func (b *leaseBackend) unlock(path string, lockID string) bool {
+	if !unlock(path, lockID) {
+		return false
+	}
+	if name, mirrored := b.leaseName(path); mirrored {
+		b.note(b.client.release(name, lockID))
+	}
+	return true
+}
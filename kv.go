@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// a key can carry a small value, e.g. who leads or the metadata of the job
+// holding it. only the holder of the key's write lock may set or delete
+// it, anybody may read it, under a read lock for a value nobody is
+// changing meanwhile. values outlive the locks guarding them and are kept
+// in the wal
+
+// maxValueSize bounds the value a key can carry
+const maxValueSize = 64 << 10
+
+var errValueSize = failure{code: "value_size", text: "value is larger than 64KiB", status: http.StatusRequestEntityTooLarge}
+
+var errNoValue = failure{code: "no_value", text: "key has no value", status: http.StatusNotFound}
+
+// putValue sets the value of path to value, or deletes it if value is nil,
+// if lockID holds the write lock on path
+func putValue(path, lockID string, value []byte) (failure, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.state != 1 || counter.lockID[lockID] == nil {
+		f := errNotHeld
+		f.text = "lock id holds no write lock on key"
+		return f, false
+	}
+	if err := wal.putValue(path, value); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return errInternal, false
+	}
+	counter.value = value
+	return failure{}, true
+}
+
+// getValue returns the value of path and the version of path as of it. a
+// non-empty lockID must hold a lock on path
+func getValue(path, lockID string) ([]byte, int64, failure, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	switch {
+	case len(lockID) != 0 && (counter == nil || counter.lockID[lockID] == nil):
+		return nil, 0, errNotHeld, false
+	case counter == nil || counter.value == nil:
+		return nil, 0, errNoValue, false
+	}
+	return counter.value, counter.version, failure{}, true
+}
+
+// kvPutHandler answers POST /kv/put?key=PATH&lock-id=LOCKID, setting the
+// value of PATH to the request body while LOCKID holds its write lock
+func kvPutHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok || len(query.Get("lock-id")) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	value, err := io.ReadAll(io.LimitReader(r.Body, maxValueSize+1))
+	if err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if len(value) > maxValueSize {
+		replyFailure(w, r, errValueSize)
+		return
+	}
+	if f, ok := putValue(path, query.Get("lock-id"), value); !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	replySuccess(w, r)
+}
+
+// kvDeleteHandler answers POST /kv/delete?key=PATH&lock-id=LOCKID, dropping
+// the value of PATH while LOCKID holds its write lock
+func kvDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok || len(query.Get("lock-id")) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if f, ok := putValue(path, query.Get("lock-id"), nil); !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	replySuccess(w, r)
+}
+
+// kvGetHandler answers GET /kv/get?key=PATH with the value of PATH as the
+// body and the version of PATH in Key-Version, JSON clients get {"status",
+// "value", "version"} with the value in base64. with lock-id=LOCKID the
+// value is only read while LOCKID holds a lock on PATH
+func kvGetHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	value, version, f, ok := getValue(path, query.Get("lock-id"))
+	if !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	w.Header().Set(keyVersionHeader, strconv.FormatInt(version, 10))
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success", Value: value, Version: &version})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(value)
+}
+
+// ownKV reports whether r, sent to /v1/kv/put, /v1/kv/get or /v1/kv/delete,
+// is for the kv api above rather than consul's, which names the key in the
+// path instead of key=
+func ownKV(r *http.Request) bool {
+	return r.URL.Query().Has("key")
+}
+
+// kvOr serves the requests ownKV claims with own and the others, consul's,
+// with other
+func kvOr(own, other http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ownKV(r) {
+			own(w, r)
+			return
+		}
+		other(w, r)
+	}
+}
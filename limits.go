@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// limits on the keys clients may use, they may change on a config reload
+var (
+	// longest key in bytes, 0 for no limit
+	maxKeyLength atomic.Int64
+	// matches the keys made of allowed characters only, nil allows any
+	keyChars atomic.Pointer[regexp.Regexp]
+	// most distinct keys the lock table may hold, 0 for no limit
+	maxKeys atomic.Int64
+	// most read locks a key may have at once, 0 for no limit
+	maxReaders atomic.Int64
+	// caps overriding maxReaders on the keys they select
+	readerLimits atomic.Pointer[[]readerLimit]
+	// leases of the keys they select, the default overriding -default-ttl
+	// and the longest allowed
+	ttlDefaults, ttlLimits atomic.Pointer[[]ttlRule]
+	// refuse a ttl over the limit instead of shortening it
+	ttlReject atomic.Bool
+)
+
+var errTTLTooLong = failure{code: "ttl_too_long", text: "ttl is longer than the key allows", status: http.StatusBadRequest}
+
+// readerLimit caps the read locks held at once on key, or with prefix set
+// on every key starting with key
+type readerLimit struct {
+	key    string
+	prefix bool
+	max    int
+}
+
+// ttlRule is the lease of the keys a -ttl-defaults, -ttl-limits or
+// -hold-limits pattern selects, key itself or with prefix set every key
+// starting with key
+type ttlRule struct {
+	key    string
+	prefix bool
+	ttl    time.Duration
+}
+
+// tableKeys counts the keys in the lock table
+var tableKeys atomic.Int64
+
+// how often the sweeper drops idle keys from the lock table
+const pruneInterval = 10 * time.Second
+
+// parseKeyChars compiles the -key-chars character class, e.g. a-z0-9/_-,
+// nil for an empty one
+func parseKeyChars(class string) (*regexp.Regexp, error) {
+	if len(class) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile("^[" + class + "]*$")
+}
+
+// validKey reports whether key, or a prefix of keys, is short enough and
+// made of allowed characters
+func validKey(key string) bool {
+	if limit := maxKeyLength.Load(); limit > 0 && int64(len(key)) > limit {
+		return false
+	}
+	if chars := keyChars.Load(); chars != nil && !chars.MatchString(key) {
+		return false
+	}
+	return true
+}
+
+// parseReaderLimits reads the -reader-limits list of PATTERN=N caps, a
+// PATTERN is a key or a prefix ending in *
+func parseReaderLimits(spec string) ([]readerLimit, error) {
+	var limits []readerLimit
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		pattern, n, ok := strings.Cut(item, "=")
+		limit := readerLimit{key: pattern}
+		var err error
+		if limit.max, err = strconv.Atoi(n); !ok || err != nil || limit.max < 0 {
+			return nil, fmt.Errorf("%q: want PATTERN=N", item)
+		}
+		limit.key, limit.prefix = strings.CutSuffix(pattern, "*")
+		limits = append(limits, limit)
+	}
+	return limits, nil
+}
+
+// readerCap is how many read locks path may have at once, 0 for no limit:
+// the cap of the pattern matching its key exactly, else of the longest
+// prefix matching it, else -max-readers. patterns apply in every namespace
+func readerCap(path string) int {
+	key := clientKey(path)
+	match := -1
+	var limit int
+	if limits := readerLimits.Load(); limits != nil {
+		for _, l := range *limits {
+			switch {
+			case !l.prefix && l.key == key:
+				return l.max
+			case l.prefix && strings.HasPrefix(key, l.key) && len(l.key) > match:
+				match, limit = len(l.key), l.max
+			}
+		}
+	}
+	if match >= 0 {
+		return limit
+	}
+	return int(maxReaders.Load())
+}
+
+// parseTTLRules reads a -ttl-defaults, -ttl-limits or -hold-limits list of
+// PATTERN=DURATION, a PATTERN is a key or a prefix ending in *
+func parseTTLRules(spec string) ([]ttlRule, error) {
+	var rules []ttlRule
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		pattern, d, ok := strings.Cut(item, "=")
+		rule := ttlRule{}
+		var err error
+		if rule.ttl, err = time.ParseDuration(d); !ok || err != nil || rule.ttl <= 0 {
+			return nil, fmt.Errorf("%q: want PATTERN=DURATION", item)
+		}
+		rule.key, rule.prefix = strings.CutSuffix(pattern, "*")
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// ttlFor returns the lease the rules give path, 0 if none selects it: the
+// rule for its key exactly, else the longest prefix matching it. rules
+// apply in every namespace
+func ttlFor(rules *[]ttlRule, path string) time.Duration {
+	if rules == nil {
+		return 0
+	}
+	key := clientKey(path)
+	match := -1
+	var ttl time.Duration
+	for _, rule := range *rules {
+		switch {
+		case !rule.prefix && rule.key == key:
+			return rule.ttl
+		case rule.prefix && strings.HasPrefix(key, rule.key) && len(rule.key) > match:
+			match, ttl = len(rule.key), rule.ttl
+		}
+	}
+	return ttl
+}
+
+// leaseFor returns the lease of a lock on paths requested with ttl, 0
+// meaning none was asked for: ttl, else the shortest -ttl-defaults of the
+// paths, else -default-ttl. it is held to the shortest -ttl-limits of the
+// paths, a default silently, a ttl asked for is refused with -ttl-reject
+// and false. no lease at all is over any limit
+func leaseFor(ttl time.Duration, paths ...string) (time.Duration, bool) {
+	var def, limit time.Duration
+	for _, path := range paths {
+		if d := ttlFor(ttlDefaults.Load(), path); d != 0 && (def == 0 || d < def) {
+			def = d
+		}
+		if l := ttlFor(ttlLimits.Load(), path); l != 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	asked := ttl != 0
+	if !asked {
+		ttl = def
+	}
+	if ttl == 0 {
+		ttl = time.Duration(defaultTTL.Load())
+	}
+	if limit == 0 || (ttl != 0 && ttl <= limit) {
+		return ttl, true
+	}
+	if asked && ttlReject.Load() {
+		return 0, false
+	}
+	return limit, true
+}
+
+// readersFull reports whether counter has as many read locks as its key
+// may. caller must hold the shard mutex
+func (counter *lockCounter) readersFull() bool {
+	limit := readerCap(counter.key)
+	return limit > 0 && counter.state == 2 && len(counter.lockID) >= limit
+}
+
+// roomFor reports whether path is in the lock table already or the table
+// has room for it. the check is not atomic with adding the key, so
+// concurrent requests may overshoot the limit by a few keys
+func roomFor(path string) bool {
+	limit := maxKeys.Load()
+	if limit <= 0 || tableKeys.Load() < limit {
+		return true
+	}
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locks[path] != nil
+}
+
+// pruneCounters drops the keys nobody holds, queues for or waits on and
+// without a value from the lock table, so it only keeps the keys in use.
+// their versions live on in versionFloor, their per key metrics go with
+// them
+func pruneCounters() {
+	var pruned []string
+	for _, s := range shards {
+		s.mu.Lock()
+		for key, counter := range s.locks {
+			if counter.state == 0 && len(counter.lockID) == 0 && len(counter.queue) == 0 && len(counter.waiters) == 0 &&
+				counter.value == nil {
+				raise(&versionFloor, counter.version)
+				delete(s.locks, key)
+				tableKeys.Add(-1)
+				pruned = append(pruned, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	metrics.forget(pruned)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// -listeners serves the api on more addresses than -listen, each through
+// its own chain of middleware: "127.0.0.1:8090,:8443+tls+read-only,
+// :8091+admin+local" adds a plain listener on localhost, a tls one on
+// every interface that only answers reads and an admin port only local
+// callers may use. the options of a listener are
+//
+//	tls        serve https with the -tls-cert certificate and client ca
+//	admin      serve the admin endpoints, moving them off the client port
+//	           like -admin-listen does
+//	local      refuse callers not on a loopback address
+//	read-only  refuse everything but GET and HEAD
+
+var errReadOnly = failure{code: "read_only", text: "this listener only serves reads", status: http.StatusMethodNotAllowed}
+
+// listenerSpec is one listener of -listeners
+type listenerSpec struct {
+	addr                        string
+	tls, admin, local, readOnly bool
+}
+
+// parseListeners parses the comma separated ADDR[+OPTION...] of -listeners
+func parseListeners(s string) ([]listenerSpec, error) {
+	var specs []listenerSpec
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.Split(item, "+")
+		spec := listenerSpec{addr: parts[0]}
+		if _, _, err := net.SplitHostPort(spec.addr); err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		for _, option := range parts[1:] {
+			switch option {
+			case "tls":
+				spec.tls = true
+			case "admin":
+				spec.admin = true
+			case "local":
+				spec.local = true
+			case "read-only":
+				spec.readOnly = true
+			default:
+				return nil, fmt.Errorf("%q: unknown option %q", item, option)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// adminListener returns the first listener serving the admin endpoints
+func adminListener(specs []listenerSpec) (listenerSpec, bool) {
+	for _, spec := range specs {
+		if spec.admin {
+			return spec, true
+		}
+	}
+	return listenerSpec{}, false
+}
+
+// chain wraps handler in the middleware the options of spec ask for
+func (spec listenerSpec) chain(handler http.Handler) http.Handler {
+	if spec.readOnly {
+		handler = readOnly(handler)
+	}
+	if spec.local {
+		handler = loopbackOnly(handler)
+	}
+	return handler
+}
+
+// readOnly refuses every request but GET and HEAD
+func readOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			replyFailure(w, r, errReadOnly)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// loopbackOnly refuses callers not on a loopback address
+func loopbackOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := net.ParseIP(remoteHost(r)); ip == nil || !ip.IsLoopback() {
+			replyFailure(w, r, errForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// listenSpec starts serving handler through the chain of spec with the
+// timeouts and protocols of base, its tls config for a tls listener. it
+// returns the server to shut down with base
+func listenSpec(spec listenerSpec, base *http.Server, handler http.Handler, maxConns int) (*http.Server, error) {
+	s := &http.Server{Handler: spec.chain(handler), BaseContext: base.BaseContext,
+		ReadTimeout: base.ReadTimeout, WriteTimeout: base.WriteTimeout, IdleTimeout: base.IdleTimeout,
+		Protocols: base.Protocols, HTTP2: base.HTTP2}
+	if spec.admin {
+		// like -admin-listen, profiles and traces take as long as asked
+		s.WriteTimeout = 0
+	}
+	if spec.tls {
+		if base.TLSConfig == nil {
+			return nil, fmt.Errorf("%s: tls needs -tls-cert", spec.addr)
+		}
+		s.TLSConfig = base.TLSConfig
+	}
+	l, err := net.Listen("tcp", spec.addr)
+	if err != nil {
+		return nil, err
+	}
+	serveInBackground(s, newLimitListener(l, maxConns))
+	return s, nil
+}
+
+// listenExtra starts a server for each of specs, serving handler, the
+// admin ones adminHandler. it returns the servers to shut down with base
+func listenExtra(specs []listenerSpec, base *http.Server, adminHandler http.Handler, maxConns int) ([]*http.Server, error) {
+	var servers []*http.Server
+	for _, spec := range specs {
+		handler := base.Handler
+		if spec.admin {
+			handler = adminHandler
+		}
+		s, err := listenSpec(spec, base, handler, maxConns)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// listenClient listens on addr, the -listen address, unless activated,
+// the socket systemd passed for it, stands in
+func listenClient(addr string, activated net.Listener, maxConns int) (net.Listener, error) {
+	if activated == nil {
+		var err error
+		if activated, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	return newLimitListener(activated, maxConns), nil
+}
+
+// listenAdmin serves handler on addr, the -admin-listen address, or on
+// activated, the admin socket systemd passed, with the timeouts,
+// protocols and tls config of base. there is no write timeout, profiles
+// and traces take as long as asked
+func listenAdmin(addr string, activated net.Listener, base *http.Server, handler http.Handler) (*http.Server, error) {
+	s := &http.Server{Handler: handler, BaseContext: base.BaseContext,
+		ReadTimeout: base.ReadTimeout, IdleTimeout: base.IdleTimeout,
+		Protocols: base.Protocols, TLSConfig: base.TLSConfig}
+	if activated == nil {
+		var err error
+		if activated, err = net.Listen("tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	serveInBackground(s, activated)
+	return s, nil
+}
+
+// serveOn serves s on l, over tls if s has a tls config, until s is shut
+// down
+func serveOn(s *http.Server, l net.Listener) error {
+	if s.TLSConfig != nil {
+		return s.ServeTLS(l, "", "")
+	}
+	return s.Serve(l)
+}
+
+// serveInBackground serves s on l in a goroutine of its own, a listener
+// failing before s is shut down ends the process
+func serveInBackground(s *http.Server, l net.Listener) {
+	go func() {
+		if err := serveOn(s, l); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
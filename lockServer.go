@@ -1,196 +1,907 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// holder is one granted lockID
+type holder struct {
+	// the state the lock was taken in, the key's state is the strongest
+	// of its holders' modes
+	mode     int
+	acquired time.Time
+	// lease deadline, zero if the lock was taken without a ttl
+	expiry time.Time
+	// authenticated caller that took the lock, empty if auth is disabled
+	principal string
+	// session the lock is bound to, empty if none
+	session string
+	// identity the lock was taken for, empty if none. an owner may take a
+	// write lock it already holds under the same principal again, holds
+	// counts how many times
+	owner string
+	holds int
+	// multi-key transaction the lock belongs to, empty if none
+	txn string
+	// address of the client that took the lock
+	addr string
+	// what the lock was taken for and free form labels, shown to whoever
+	// lists it
+	purpose string
+	labels  map[string]string
+	// reported for being held past the -hold-limits ceiling of its key
+	overheld bool
+	// when the holder was last heard of renewing or taking the lock
+	// again, zero if it wasn't since acquired
+	seen time.Time
+}
+
+// lastSeen is when the holder of h was last heard of through the lock
+func (h *holder) lastSeen() time.Time {
+	if h.seen.IsZero() {
+		return h.acquired
+	}
+	return h.seen
+}
+
+// lockOptions are the optional parts of a lock request
+type lockOptions struct {
+	// lease length, 0 holds the lock until it is unlocked
+	ttl       time.Duration
+	principal string
+	// release the lock when this session ends, empty for none
+	session string
+	// reentrant owner identity, empty for none
+	owner string
+	// queue priority of a blocking request, higher is served first
+	priority int
+	// multi-key transaction the grant belongs to, empty if none
+	txn string
+	// address the request came from
+	addr string
+	// write intent the request takes the lock for, empty if none
+	intent string
+	// stored with the lock, see holder
+	purpose string
+	labels  map[string]string
+	// with checkVersion a write lock is only granted if the key is still
+	// at version ifVersion
+	checkVersion bool
+	ifVersion    int64
+	// the span the grant is traced under, the zero span for none
+	trace span
+}
+
 type lockCounter struct {
-	// 0 -> unlock, 1 -> write lock, 2 -> read lock
+	key string
+	// 0 -> unlock, 1 -> write lock, 2 -> read lock, 3 to 5 the intention
+	// modes of modes.go
 	state  int
-	lockID map[int]bool
+	lockID map[string]*holder
+	// requests parked until the path is unlocked, closed on wakeup
+	waiters []chan struct{}
+	// blocking requests waiting for the path
+	queue []*ticket
+	// fencing token of the latest write lock granted on this path
+	fence int64
+	// fencing token of the latest write lock on this path to end, see
+	// versions.go
+	version int64
+	// the value the path carries, nil for none, see kv.go
+	value []byte
 }
 
-var lockMap = map[string]*lockCounter{}
-var uid int // uid its incrementing counter
-var mu sync.Mutex
+// shard is one slice of the lock table. paths are spread over the shards by
+// hash so requests for unrelated keys don't serialize on a single mutex
+type shard struct {
+	mu    sync.Mutex
+	locks map[string]*lockCounter
+	// the counters of the keys on the shard, see counters.go
+	counts map[string]int64
+}
 
-// write lock for a particular path it locks if the path is not already locked
-// using read lock or write lock, it returns lockID if successful otherwise -1
-func lock(path string) int {
-	// log.Println("lock path=", path)
-	mu.Lock()
-	defer mu.Unlock()
+const defaultShardCount = 64
+
+var shards = newShards(defaultShardCount)
+
+// nextFence is the fencing token handed to the next write lock, it only
+// ever increases so a newer writer always carries a bigger token
+var nextFence atomic.Int64
+
+// epoch counts the standbys that took over, see failover.go
+var epoch atomic.Int64
+
+// defaultTTL is the lease in nanoseconds of locks requested without ttl=, 0
+// holds them until unlocked. it may change on a config reload
+var defaultTTL atomic.Int64
+
+// how often the sweeper looks for expired leases
+const sweepInterval = 100 * time.Millisecond
 
-	counter := lockMap[path]
+func stateName(state int) string {
+	switch state {
+	case 1:
+		return "write"
+	case 2:
+		return "read"
+	case modeIS:
+		return "intent-shared"
+	case modeIX:
+		return "intent-exclusive"
+	case modeSIX:
+		return "shared-intent-exclusive"
+	}
+	return "unlocked"
+}
+
+func newShards(n int) []*shard {
+	s := make([]*shard, n)
+	for i := range s {
+		s[i] = &shard{locks: map[string]*lockCounter{}, counts: map[string]int64{}}
+	}
+	return s
+}
+
+// shardIndex returns the index in shards of the shard holding path
+func shardIndex(path string) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(len(shards)))
+}
+
+// shardFor returns the shard holding path
+func shardFor(path string) *shard {
+	return shards[shardIndex(path)]
+}
+
+// newID returns a random 128-bit hex id, lock ids, transaction ids and
+// session ids can't be guessed from the ones a client has seen
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// raise moves v up to at least n
+func raise(v *atomic.Int64, n int64) {
+	for {
+		old := v.Load()
+		if old >= n || v.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+func newLockCounter(key string) *lockCounter {
+	return &lockCounter{key: key, lockID: make(map[string]*holder), version: versionFloor.Load()}
+}
+
+// getCounter returns the counter for path, creating it if needed.
+// caller must hold s.mu
+func (s *shard) getCounter(path string) *lockCounter {
+	counter := s.locks[path]
 	if counter == nil {
-		counter = &lockCounter{lockID: make(map[int]bool)}
-		lockMap[path] = counter
-	}
-	if counter.state == 0 {
-		counter.state = 1
-		id := uid
-		uid++
-		counter.lockID[id] = true
-		return id
-	} else {
-		return -1
+		counter = newLockCounter(path)
+		s.locks[path] = counter
+		tableKeys.Add(1)
+	}
+	return counter
+}
+
+// grant hands out a new lockID on counter and moves it to state, with a
+// lease of opts.ttl if it is set. it returns "" if the grant could not be
+// logged, its session has ended, its namespace or client is at its quota
+// or this node follows a leader. caller must hold the shard mutex
+func (counter *lockCounter) grant(state int, opts lockOptions) (id string) {
+	granting := startChild(opts.trace, "lock.grant")
+	defer func() { granting.end("key", counter.key, "mode", stateName(state), "lock_id", id) }()
+	if following() {
+		// a request that waited across a deposition
+		return ""
+	}
+	client := opts.quotaClient()
+	if !reserve(counter.key, client) {
+		return ""
+	}
+	if hierarchical && !treeReserve(counter.key, state) {
+		unreserve(counter.key, client)
+		return ""
+	}
+	id = newID()
+	h := &holder{mode: state, acquired: time.Now(), principal: opts.principal, session: opts.session, owner: opts.owner, holds: 1,
+		txn: opts.txn, addr: opts.addr, purpose: opts.purpose, labels: opts.labels}
+	if opts.ttl > 0 {
+		h.expiry = h.acquired.Add(opts.ttl)
+		scheduleExpiry(counter.key, id, h.expiry, false)
+	}
+	ref := lockRef{counter.key, id}
+	if len(h.session) != 0 && !attachLock(h.session, ref) {
+		if hierarchical {
+			treeRelease(counter.key, state)
+		}
+		unreserve(counter.key, client)
+		return ""
+	}
+	var fence int64
+	if state == 1 {
+		fence = nextFence.Add(1) - 1
 	}
+	if err := wal.grant(counter.key, id, state, h, fence); err != nil {
+		slog.Error("wal write failed", "err", err)
+		if len(h.session) != 0 {
+			detachLock(h.session, ref)
+		}
+		if hierarchical {
+			treeRelease(counter.key, state)
+		}
+		unreserve(counter.key, client)
+		return ""
+	}
+	if state == 1 {
+		counter.fence = fence
+	}
+	if len(h.txn) != 0 {
+		attachTxn(h.txn, ref)
+	}
+	counter.state = strongest(counter.state, state)
+	counter.lockID[id] = h
+	if len(opts.intent) != 0 {
+		counter.dropIntent(opts.intent)
+	}
+	publish(lockEvent{Type: eventGranted, Key: counter.key, Mode: stateName(state), LockID: id, Time: h.acquired})
+	audit.record(eventGranted, counter.key, state, id, h, "")
+	return id
+}
+
+// release drops lockID from counter and marks the path unlocked once the
+// last holder is gone, reason is the event published for it. a forced or
+// stolen release has been audited by its caller already. caller must hold
+// the shard mutex
+func (counter *lockCounter) release(lockID string, reason string) {
+	if err := wal.release(counter.key, lockID); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+	if h := counter.lockID[lockID]; h != nil && len(h.session) != 0 {
+		detachLock(h.session, lockRef{counter.key, lockID})
+	}
+	if h := counter.lockID[lockID]; h != nil && len(h.txn) != 0 {
+		detachTxn(h.txn, lockRef{counter.key, lockID})
+	}
+	mode := counter.state
+	if h := counter.lockID[lockID]; h != nil {
+		mode = h.mode
+		if reason != eventForced && reason != eventStolen {
+			audit.record(reason, counter.key, mode, lockID, h, "")
+		}
+		if hierarchical {
+			treeRelease(counter.key, mode)
+		}
+		unreserve(counter.key, h.quotaClient())
+		metrics.released(stateName(mode), counter.key, time.Since(h.acquired))
+	}
+	delete(counter.lockID, lockID)
+	publish(lockEvent{Type: reason, Key: counter.key, Mode: stateName(mode), LockID: lockID, Time: time.Now()})
+	if len(counter.lockID) == 0 && counter.state == 1 {
+		counter.version = counter.fence
+		counter.phase()
+	}
+	counter.state = 0
+	for _, h := range counter.lockID {
+		counter.state = strongest(counter.state, h.mode)
+	}
+	// an upgrade waits for the last other reader, so every release wakes
+	counter.wakeup()
+}
+
+// promote turns the read lock lockID, the only holder of counter, into the
+// write lock. it returns the new fencing token, 0 if the upgrade conflicts
+// in the tree or cannot be logged. caller must hold the shard mutex
+func (counter *lockCounter) promote(lockID string) int64 {
+	if hierarchical && !treeUpgrade(counter.key) {
+		return 0
+	}
+	fence := nextFence.Add(1) - 1
+	if err := wal.upgrade(counter.key, lockID, fence); err != nil {
+		slog.Error("wal write failed", "err", err)
+		if hierarchical {
+			treeRelease(counter.key, 1)
+			treeRestore(counter.key, 2)
+		}
+		return 0
+	}
+	counter.state = 1
+	counter.lockID[lockID].mode = 1
+	counter.fence = fence
+	publish(lockEvent{Type: eventUpgraded, Key: counter.key, Mode: stateName(1), LockID: lockID, Time: time.Now()})
+	audit.record(eventUpgraded, counter.key, 1, lockID, counter.lockID[lockID], "")
+	return fence
+}
+
+// wakeup releases every parked waiter so they can retry. caller must hold
+// the shard mutex
+func (counter *lockCounter) wakeup() {
+	for _, ch := range counter.waiters {
+		close(ch)
+	}
+	counter.waiters = nil
+}
+
+// dropWaiter removes a waiter that gave up. caller must hold the shard mutex
+func (counter *lockCounter) dropWaiter(ch chan struct{}) {
+	for i, waiter := range counter.waiters {
+		if waiter == ch {
+			counter.waiters = append(counter.waiters[:i], counter.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// wlock takes the write lock on counter, returns "" if it is held or
+// others are queued ahead of t. an owner already holding the
+// write lock under the same api key gets its lockID back with one more hold,
+// the same owner name sent with another key contends like anyone else. the
+// key carries its namespace, so a hold is never reentered across namespaces.
+// caller must hold the shard mutex
+func (counter *lockCounter) wlock(opts lockOptions, t *ticket) string {
+	if counter.state == 1 && len(opts.owner) != 0 {
+		for id, h := range counter.lockID {
+			if h.owner != opts.owner || h.principal != opts.principal {
+				break
+			}
+			if err := wal.hold(counter.key, id, h.holds+1); err != nil {
+				slog.Error("wal write failed", "err", err)
+				return ""
+			}
+			h.holds++
+			h.seen = time.Now()
+			return id
+		}
+	}
+	if counter.state != 0 || (opts.checkVersion && counter.version != opts.ifVersion) || !counter.admit(t, 1) {
+		return ""
+	}
+	return counter.grant(1, opts)
+}
+
+// rlock takes a read lock on counter, returns "" if it is write locked, has
+// as many readers as its key may or a writer is queued ahead of t. caller
+// must hold the shard mutex
+func (counter *lockCounter) rlock(opts lockOptions, t *ticket) string {
+	if !compatible[2][counter.state] || counter.readersFull() || !counter.admit(t, 2) {
+		return ""
+	}
+	return counter.grant(2, opts)
+}
+
+// write lock for a particular path it locks if the path is not already locked
+// using read lock or write lock, it returns lockID and its fencing token if
+// successful otherwise "". if opts.ttl > 0 the lock is released automatically
+// once ttl has elapsed
+func lock(path string, opts lockOptions) (string, int64) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.getCounter(path)
+	id := counter.wlock(opts, counter.intentTicket(opts.intent))
+	if len(id) == 0 {
+		return "", 0
+	}
+	return id, counter.fence
 }
 
 // write unlock for a particular path and lockID it unlocks if the path and lockID is valid
-// that is if it was locked before using write lock. It returns true if successful otherwise false
-func unlock(path string, lockID int) bool {
-	// log.Println("unlock path=", path, ", id=", lockID)
-	mu.Lock()
-	defer mu.Unlock()
+// that is if it was locked before using write lock. It returns true if successful otherwise false.
+// a reentrant lock taken several times by its owner stays locked until every hold is unlocked
+func unlock(path string, lockID string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	counter := lockMap[path]
+	counter := s.locks[path]
 	if counter == nil || counter.state != 1 {
 		return false
 	}
+	return counter.unhold(lockID)
+}
 
-	if _, ok := counter.lockID[lockID]; !ok {
+// unhold gives back one hold of lockID on counter, releasing it with the
+// last. it returns false if lockID holds no lock on counter. caller must
+// hold the shard mutex
+func (counter *lockCounter) unhold(lockID string) bool {
+	h, ok := counter.lockID[lockID]
+	if !ok {
 		return false
 	}
+	if h.holds > 1 {
+		if err := wal.hold(counter.key, lockID, h.holds-1); err != nil {
+			slog.Error("wal write failed", "err", err)
+			return false
+		}
+		h.holds--
+		return true
+	}
 
-	delete(counter.lockID, lockID)
-	counter.state = 0
+	counter.release(lockID, eventReleased)
 	return true
 }
 
 // read lock for a particular path it locks if the path is not already locked
-// using write lock, it returns lockID if successful otherwise -1. multiple
-// readers allowed to have the read lock
-func rlock(path string) int {
-	// log.Println("rlock path=", path)
-	mu.Lock()
-	defer mu.Unlock()
-
-	counter := lockMap[path]
-	if counter == nil {
-		counter = &lockCounter{lockID: make(map[int]bool)}
-		lockMap[path] = counter
+// using write lock, it returns lockID if successful otherwise "". multiple
+// readers allowed to have the read lock. if opts.ttl > 0 this reader's lock
+// is released automatically once ttl has elapsed
+func rlock(path string, opts lockOptions) string {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.getCounter(path).rlock(opts, nil)
+}
+
+// waitLock is lock (or rlock if readLock) that parks the caller until the
+// path can be locked instead of failing straight away. waiting callers are
+// queued and served by priority, then arrival order. it returns "" if the lock
+// could not be taken within wait or before ctx is done, the caller having
+// gone, and deadlock if waiting would never end. the fencing token is 0 for
+// reads
+func waitLock(ctx context.Context, path string, readLock bool, opts lockOptions, wait time.Duration) (string, int64) {
+	if readLock {
+		return waitMode(ctx, path, 2, opts, wait)
 	}
-	if counter.state == 0 || counter.state == 2 {
-		counter.state = 2
+	return waitMode(ctx, path, 1, opts, wait)
+}
 
-		id := uid
-		uid++
-		counter.lockID[id] = true
-		// log.Println("rlock path=", path, counter)
-		return id
-	} else {
-		return -1
+// waitMode is waitLock for a lock in any of the modes of modes.go, the
+// fencing token is 0 unless mode is 1
+func waitMode(ctx context.Context, path string, mode int, opts lockOptions, wait time.Duration) (lockID string, _ int64) {
+	waiting := startChild(opts.trace, "lock.wait")
+	if waiting != nil {
+		opts.trace = *waiting
+	}
+	defer func() { waiting.end("key", path, "mode", stateName(mode), "lock_id", lockID) }()
+	s := shardFor(path)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var t *ticket
+	who := opts.identity()
+	var unwait func()
+	for {
+		// in hierarchical mode the path may also be blocked by a lock
+		// elsewhere in the tree, which does not wake the path's waiters
+		var treeCh <-chan struct{}
+		if hierarchical {
+			treeCh = treeChanged()
+		}
+		s.mu.Lock()
+		counter := s.getCounter(path)
+		if closedForLocks() {
+			counter.dequeue(t)
+			s.mu.Unlock()
+			return "", 0
+		}
+		var id string
+		if mode != 1 {
+			id = counter.mlock(mode, opts, t)
+		} else if t == nil {
+			id = counter.wlock(opts, counter.intentTicket(opts.intent))
+		} else {
+			id = counter.wlock(opts, t)
+		}
+		if len(id) == 0 && opts.checkVersion && counter.version != opts.ifVersion {
+			// a version only grows, waiting can't help
+			counter.dequeue(t)
+			s.mu.Unlock()
+			return "", 0
+		}
+		if len(id) != 0 {
+			if t != nil {
+				counter.dequeue(t)
+			}
+			var fence int64
+			if mode == 1 {
+				fence = counter.fence
+			}
+			s.mu.Unlock()
+			return id, fence
+		}
+		if t == nil {
+			t = counter.enqueue(mode, opts.priority)
+			t.principal, t.owner, t.addr = opts.principal, opts.owner, opts.addr
+			// a request for an intent waits in the intent's place
+			if it := counter.intentTicket(opts.intent); it != nil && mode == 1 {
+				t.priority, t.arrived, t.intent = it.priority, it.arrived, it.intent
+			}
+		}
+		ch := make(chan struct{})
+		counter.waiters = append(counter.waiters, ch)
+		s.mu.Unlock()
+
+		if len(who) != 0 {
+			if unwait == nil {
+				unwait = waitFor(who, path)
+				defer unwait()
+			}
+			if deadlocked(who, path) {
+				s.mu.Lock()
+				counter.dropWaiter(ch)
+				counter.dequeue(t)
+				s.mu.Unlock()
+				return deadlock, 0
+			}
+		}
+
+		select {
+		case <-ch:
+		case <-treeCh:
+			s.mu.Lock()
+			counter.dropWaiter(ch)
+			s.mu.Unlock()
+		case <-timer.C:
+			s.mu.Lock()
+			counter.dropWaiter(ch)
+			counter.dequeue(t)
+			s.mu.Unlock()
+			return "", 0
+		case <-ctx.Done():
+			s.mu.Lock()
+			counter.dropWaiter(ch)
+			counter.dequeue(t)
+			s.mu.Unlock()
+			return "", 0
+		}
+	}
+}
+
+// watch blocks until path is unlocked, wait elapses or ctx is done. it
+// returns true if the path is unlocked
+func watch(ctx context.Context, path string, wait time.Duration) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	counter := s.locks[path]
+	if counter == nil || counter.state == 0 {
+		s.mu.Unlock()
+		return true
+	}
+	ch := make(chan struct{})
+	counter.waiters = append(counter.waiters, ch)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	counter.dropWaiter(ch)
+	s.mu.Unlock()
+	return false
+}
+
+// upgrade atomically converts the read lock lockID on path into the write
+// lock, keeping its lockID, once it is the only reader. if wait > 0 it
+// blocks up to wait for the other readers to go, otherwise it gives up
+// straight away or when ctx is done. it returns the fencing token of the
+// write lock or 0 if it was not upgraded, and held false if lockID is no
+// read lock on path
+func upgrade(ctx context.Context, path string, lockID string, wait time.Duration) (fence int64, held bool) {
+	s := shardFor(path)
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		var treeCh <-chan struct{}
+		if hierarchical {
+			treeCh = treeChanged()
+		}
+		s.mu.Lock()
+		counter := s.locks[path]
+		if counter == nil || counter.state != 2 || counter.lockID[lockID] == nil || counter.lockID[lockID].mode != 2 {
+			s.mu.Unlock()
+			return 0, false
+		}
+		if len(counter.lockID) == 1 {
+			if fence := counter.promote(lockID); fence != 0 {
+				s.mu.Unlock()
+				return fence, true
+			}
+		}
+		if timeout == nil || closedForLocks() {
+			s.mu.Unlock()
+			return 0, true
+		}
+		ch := make(chan struct{})
+		counter.waiters = append(counter.waiters, ch)
+		s.mu.Unlock()
+
+		select {
+		case <-ch:
+			continue
+		case <-treeCh:
+		case <-timeout:
+			s.mu.Lock()
+			counter.dropWaiter(ch)
+			s.mu.Unlock()
+			return 0, true
+		case <-ctx.Done():
+			s.mu.Lock()
+			counter.dropWaiter(ch)
+			s.mu.Unlock()
+			return 0, true
+		}
+		s.mu.Lock()
+		counter.dropWaiter(ch)
+		s.mu.Unlock()
+	}
+}
+
+// downgrade atomically converts the write lock lockID on path into a read
+// lock with the same lockID, letting other readers in without the key ever
+// being unlocked. a reentrant lock must first be unlocked down to a single
+// hold. held is false if lockID is not the write lock on path
+func downgrade(path string, lockID string) (downgraded, held bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.state != 1 {
+		return false, false
 	}
+	h := counter.lockID[lockID]
+	if h == nil {
+		return false, false
+	}
+	if h.holds > 1 {
+		return false, true
+	}
+	if err := wal.downgrade(path, lockID); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return false, true
+	}
+	if hierarchical {
+		treeDowngrade(path)
+	}
+	counter.state = 2
+	counter.version = counter.fence
+	h.mode = 2
+	publish(lockEvent{Type: eventDowngraded, Key: path, Mode: stateName(2), LockID: lockID, Time: time.Now()})
+	audit.record(eventDowngraded, path, 2, lockID, h, "")
+	counter.wakeup()
+	return true, true
 }
 
 // read unlock for a particular path and lockID it unlocks if the path and lockID is valid
 // that is if it was locked before using read lock. It returns true if successful otherwise false
 // read lock for the path released only if all the read lock holders releases the lock
-func runlock(path string, lockID int) bool {
-	// log.Println("runlock path=", path, ", id=", lockID, lockMap[path])
-	mu.Lock()
-	defer mu.Unlock()
+func runlock(path string, lockID string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	counter := lockMap[path]
+	counter := s.locks[path]
 	if counter == nil || counter.state != 2 {
 		return false
 	}
 
-	if _, ok := counter.lockID[lockID]; !ok {
+	if h, ok := counter.lockID[lockID]; !ok || h.mode != 2 {
 		return false
 	}
-	delete(counter.lockID, lockID)
-
-	if len(counter.lockID) == 0 {
-		counter.state = 0
-	}
+	counter.release(lockID, eventReleased)
 	return true
 }
 
-func lHandler(w http.ResponseWriter, r *http.Request, readLock bool) {
-	if r.Method != "POST" {
-		fmt.Fprintf(w, "failure only post method is supported\n")
-		return
+// forceUnlock releases every lock held on path whoever holds it, reentrant
+// holds included, and returns how many lockIDs were released. by is the
+// admin asking, for the audit log
+func forceUnlock(path, by string) int {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil {
+		return 0
 	}
-	query := r.URL.Query()
-	if _, ok := query["key"]; !ok {
-		fmt.Fprintf(w, "failure\n")
-		return
-	}
-	path := r.URL.Query().Get("key")
-	lockID := -1
-	if readLock {
-		lockID = rlock(path)
-	} else {
-		lockID = lock(path)
+	released := len(counter.lockID)
+	for id, h := range counter.lockID {
+		audit.record(eventForced, path, counter.state, id, h, by)
+		counter.release(id, eventForced)
 	}
+	return released
+}
 
-	if lockID == -1 {
-		fmt.Fprintf(w, "retry\n")
-	} else {
-		fmt.Fprintf(w, strconv.Itoa(lockID)+"\n")
+// unlockAll releases every lock in namespace ns whose holder matches
+// match and returns how many lockIDs were released, reentrant holds
+// included
+func unlockAll(ns string, match func(*holder) bool) int {
+	var released int
+	for _, s := range shards {
+		s.mu.Lock()
+		for _, counter := range s.locks {
+			if keyNS, _ := splitKey(counter.key); keyNS != ns {
+				continue
+			}
+			for id, h := range counter.lockID {
+				if match(h) {
+					counter.release(id, eventReleased)
+					released++
+				}
+			}
+		}
+		s.mu.Unlock()
 	}
+	return released
 }
 
-func ulHandler(w http.ResponseWriter, r *http.Request, readUnLock bool) {
-	if r.Method != "POST" {
-		fmt.Fprintf(w, "failure only post method is supported\n")
-		return
-	}
-	query := r.URL.Query()
-	if _, ok := query["key"]; !ok {
-		fmt.Fprintf(w, "failure\n")
-		return
+// renew extends the lease of lockID on path to ttl from now, whether it is
+// a read or a write lock. it returns true if successful otherwise false
+func renew(path string, lockID string, ttl time.Duration) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.lockID[lockID] == nil {
+		return false
 	}
-	if _, ok := query["lock-id"]; !ok {
-		fmt.Fprintf(w, "failure\n")
-		return
+	deadline := time.Now().Add(ttl)
+	if err := wal.renew(path, lockID, deadline); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return false
 	}
+	counter.lockID[lockID].expiry = deadline
+	counter.lockID[lockID].seen = time.Now()
+	scheduleExpiry(path, lockID, deadline, false)
+	return true
+}
 
-	path := r.URL.Query().Get("key")
-	stringID := r.URL.Query().Get("lock-id")
-	if len(stringID) == 0 {
-		fmt.Fprintf(w, "failure\n")
-		return
-	}
+// lockPrincipal returns the caller that took lockID on path, false if it
+// does not hold path
+func lockPrincipal(path, lockID string) (string, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	lockID, err := strconv.Atoi(stringID)
-	if err != nil {
-		fmt.Println(err)
-		return
-	}
-	res := false
-	if readUnLock {
-		res = runlock(path, lockID)
-	} else {
-		res = unlock(path, lockID)
+	counter := s.locks[path]
+	if counter == nil || counter.lockID[lockID] == nil {
+		return "", false
 	}
+	return counter.lockID[lockID].principal, true
+}
 
-	if res {
-		fmt.Fprintf(w, "success\n")
-	} else {
-		fmt.Fprintf(w, "failure\n")
-	}
+// lockHeld reports whether lockID still holds path
+func lockHeld(path, lockID string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	return counter != nil && counter.lockID[lockID] != nil
 }
 
-func lockHandler(w http.ResponseWriter, r *http.Request) {
-	lHandler(w, r, false)
+// validateFence reports whether token is the fencing token of the write
+// lock currently held on path, a resource guarded by the lock should refuse
+// writes carrying any other token
+func validateFence(path string, token int64) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	return counter != nil && counter.state == 1 && counter.fence == token
 }
 
-func unlockHandler(w http.ResponseWriter, r *http.Request) {
-	ulHandler(w, r, false)
+// heldLock is a snapshot of the holders of one locked path
+type heldLock struct {
+	key     string
+	state   int
+	ids     []string // in acquisition order
+	holders []holder
 }
 
-func rlockHandler(w http.ResponseWriter, r *http.Request) {
-	lHandler(w, r, true)
+// held copies the holders of counter in acquisition order. caller must
+// hold the shard mutex
+func (counter *lockCounter) held() heldLock {
+	l := heldLock{key: counter.key, state: counter.state}
+	for id := range counter.lockID {
+		l.ids = append(l.ids, id)
+	}
+	sort.Slice(l.ids, func(i, j int) bool {
+		return counter.lockID[l.ids[i]].acquired.Before(counter.lockID[l.ids[j]].acquired)
+	})
+	for _, id := range l.ids {
+		l.holders = append(l.holders, *counter.lockID[id])
+	}
+	return l
+}
+
+// lockStatus returns the holders of path, how many blocking requests and
+// write intents are queued on it and the fencing token of its latest write
+// lock
+func lockStatus(path string) (l heldLock, queued int, fence int64) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil {
+		return heldLock{key: path}, 0, 0
+	}
+	return counter.held(), len(counter.queue), counter.fence
+}
+
+// listLocks returns the locked paths filter selects that sort after after,
+// ordered by path, at most limit of them. more reports whether
+// further paths remain past the last one returned
+// the shards are visited one at a time, so the result is not a single
+// point in time snapshot across shards
+func listLocks(filter keyFilter, after string, limit int) (locks []heldLock, more bool) {
+	for _, s := range shards {
+		s.mu.Lock()
+		for key, counter := range s.locks {
+			if counter.state == 0 || key <= after || !filter.matches(key) {
+				continue
+			}
+			locks = append(locks, counter.held())
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].key < locks[j].key })
+	if len(locks) > limit {
+		locks, more = locks[:limit], true
+	}
+	return locks, more
 }
 
-func runlockHandler(w http.ResponseWriter, r *http.Request) {
-	ulHandler(w, r, true)
+// sweeper periodically ends the sessions that stopped sending heartbeats,
+// enforces -hold-limits and forgets stale idempotency keys, rate limit
+// buckets and idle keys.
+// leases and intents are left to expiryLoop
+func sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var pruned, limited time.Time
+	for now := range ticker.C {
+		if !following() {
+			expireSessions(now)
+			if now.Sub(limited) >= holdLimitInterval {
+				enforceHoldLimits(now)
+				limited = now
+			}
+		}
+		expireIdempotency(now)
+		pruneBuckets(now)
+		if now.Sub(pruned) >= pruneInterval {
+			pruneCounters()
+			pruned = now
+		}
+	}
 }
 
 // The four REST APIs will look like this:
@@ -198,12 +909,711 @@ func runlockHandler(w http.ResponseWriter, r *http.Request) {
 // POST http://localhost:8090/unlock?key=PATH&lock-id=lockID
 // POST http://localhost:8090/rlock?key=PATH
 // POST http://localhost:8090/runlock?key=PATH&lock-id=lockID
+// lock and rlock take an optional ttl=DURATION (e.g. ttl=30s) after which
+// the lock is released automatically, and an optional wait=DURATION to block
+// until the lock is available instead of returning retry straight away.
+// POST http://localhost:8090/intent?key=PATH&ttl=DURATION reserves the next
+// write lock on PATH, new locks are refused until lock?intent=ID takes it.
+// POST http://localhost:8090/lock-multi?key=PATH&key=PATH2 write locks every key
+// or none, POST http://localhost:8090/unlock-multi?txn=TXN releases them.
+// POST http://localhost:8090/upgrade?key=PATH&lock-id=lockID&wait=DURATION
+// turns a read lock into the write lock once it is the only reader.
+// POST http://localhost:8090/downgrade?key=PATH&lock-id=lockID turns the write
+// lock into a read lock.
+// POST http://localhost:8090/mlock?key=PATH&mode=MODE locks PATH in the
+// multi-granularity mode IS, IX, S, SIX or X, POST /munlock?key=PATH&lock-id=lockID
+// releases it.
+// POST http://localhost:8090/renew?key=PATH&lock-id=lockID&ttl=DURATION
+// extends a lease to ttl from now.
+// a write lock grant also carries a Fencing-Token header which can be checked
+// with GET http://localhost:8090/fence?key=PATH&token=TOKEN.
+// POST http://localhost:8090/kv/put?key=PATH&lock-id=lockID sets the value of
+// PATH to the body while lockID holds its write lock, /kv/delete drops it
+// and GET /kv/get?key=PATH reads it.
+// POST http://localhost:8090/counter/incr?key=PATH&by=N adds N to the counter
+// of PATH and returns it, GET /counter/get?key=PATH reads it.
+// GET http://localhost:8090/version?key=PATH tells the version of PATH, which
+// grants carry in Key-Version, lock?if-version=N only locks PATH still at N.
+// POST http://localhost:8090/session/create?ttl=DURATION returns a session id,
+// locks taken with session=ID are released once the session misses its
+// heartbeats (POST /session/renew?session=ID) or is destroyed
+// (POST /session/destroy?session=ID).
+// GET http://localhost:8090/watch?key=PATH&wait=DURATION blocks until PATH is
+// unlocked.
+// GET ws://localhost:8090/ws?key=PATH&prefix=PREFIX streams lock events.
+// GET http://localhost:8090/events?prefix=PREFIX&type=TYPE streams them as server-sent events.
+// GET http://localhost:8090/locks?prefix=PREFIX&match=GLOB&limit=N&after=KEY lists held locks.
+// GET http://localhost:8090/status?key=PATH tells how PATH is locked and by whom.
+// POST http://localhost:8090/status/bulk with a JSON array of keys tells it for each.
+// GET http://localhost:8090/queue?key=PATH lists the requests waiting for PATH.
+// POST http://localhost:8090/cancel?key=PATH&ticket=ID withdraws the request waiting with ticket=ID.
+// GET http://localhost:8090/stats/holdtimes?prefix=PREFIX tells how long locks were held.
+// GET http://localhost:8090/stats/keys?prefix=PREFIX counts grants, refusals and waiters per key.
+// GET http://localhost:8090/ui is a dashboard of locks, queues and sessions fed by /admin/state.
+// POST http://localhost:8090/force-unlock?key=PATH releases every lock on PATH.
+// POST http://localhost:8090/unlock-all?owner=ID releases every lock of an owner or session=ID.
+// POST http://localhost:8090/hold?key=PATH holds PATH for as long as the response stream stays open.
+// POST http://localhost:8090/transfer?key=PATH&lock-id=lockID&to-owner=X hands
+// the lock to owner X under a new lock id.
+// POST http://localhost:8090/steal?key=PATH&force-token=TOKEN takes over
+// the write lock with fencing token TOKEN.
+// GET http://localhost:8090/audit?key=PATH&since=TIME&limit=N reads the audit log.
+// POST http://localhost:8090/elect?group=G&candidate=ID&ttl=DURATION campaigns
+// for leadership of G, the leader renews with /elect/renew and steps down
+// with /elect/resign, GET /elect/leader?group=G&term=N&wait=DURATION tells
+// and watches who leads.
+// POST http://localhost:8090/barrier/enter?name=B&parties=N&wait=DURATION
+// blocks until N callers have entered B, GET /barrier/wait?name=B&generation=G
+// waits for a round entered without wait=.
+// POST http://localhost:8090/cond/wait?key=PATH&lock-id=lockID&wait=DURATION
+// releases the write lock until /cond/signal?key=PATH or /cond/broadcast
+// wakes the waiter, which then takes it again.
+// GET and POST http://localhost:8090/log-level?level=LEVEL read and change
+// the log level.
+// GET http://localhost:8090/admin/snapshot dumps the lock table for -restore.
+// GET http://localhost:8090/admin/export dumps locks and sessions as a JSON document for -import.
+// POST http://localhost:8090/admin/reload reloads the config like SIGHUP.
+// GET http://localhost:8090/admin/replicate streams the lock table to followers started with -follow.
+// POST http://localhost:8090/admin/depose?epoch=N&leader=URL hands leadership to a standby that took over.
+// GET http://localhost:8090/admin/orphans lists the locks that look orphaned, POST with lock-id=ID or all=true releases them.
+// GET and POST http://localhost:8090/admin/maintenance?enabled=BOOL read and switch maintenance, which refuses
+// new locks while unlocks and renewals go on.
+// GET http://localhost:8090/debug/pprof/ and /debug/vars serve profiles and expvar to admins.
+// with -admin-listen the admin endpoints (force-unlock, admin/state, audit,
+// log-level, admin/snapshot, admin/export, admin/replicate, admin/depose,
+// admin/orphans, admin/maintenance, admin/reload, ui and debug) are only
+// served there.
+// /v1/session/ and /v1/kv/ answer consul's session and kv lock api.
+// GET http://localhost:8090/healthz and /readyz are the liveness and
+// readiness probes.
+// every endpoint but /metrics, /log-level, the probes and consul's is also
+// served under http://localhost:8090/v1/ns/NAMESPACE/ with keys of their own
+// per namespace.
+// every endpoint but /metrics, the probes, ui and debug is served under
+// http://localhost:8090/v1/ as well, the unversioned paths answer as v1 or
+// the version a Lockserver-Api-Version request header asks for.
+// GET http://localhost:8090/versions lists the api versions.
+// GET http://localhost:8090/cluster/members lists the nodes gossip found with -gossip-listen.
+// GET http://localhost:8090/v1/openapi.json describes the routes as OpenAPI 3.
+// GET http://localhost:8090/metrics serves prometheus metrics
+//
+// "lockServer bench [flags]" drives a running server with lock and unlock
+// requests and reports throughput and latency percentiles instead.
 func main() {
-	uid = 1
-	http.HandleFunc("/lock", lockHandler)
-	http.HandleFunc("/unlock", unlockHandler)
-	http.HandleFunc("/rlock", rlockHandler)
-	http.HandleFunc("/runlock", runlockHandler)
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(benchMain(os.Args[2:]))
+	}
+	walPath := flag.String("wal", "", "append lock mutations to this file and replay it on startup, empty disables persistence")
+	walCompact := flag.Int64("wal-compact-size", 64<<20, "compact the -wal file down to the held locks once it grows past this many bytes and twice its size after the last compaction, 0 only compacts on startup")
+	importPath := flag.String("import", "", "load the lock table from this /admin/export file on startup")
+	restorePath := flag.String("restore", "", "load the lock table from this /admin/snapshot file on startup")
+	respAddr := flag.String("resp-listen", "", "also answer redis lock clients (SET NX PX, GET, DEL and the unlock scripts) on this address, empty disables it")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "send the spans of sampled traces to this OpenTelemetry collector as OTLP/HTTP JSON, e.g. http://localhost:4318, empty disables it")
+	grpcAddr := flag.String("grpc-listen", "", "also serve the grpc LockServer service of proto/lockserver.proto on this address, empty disables it")
+	protoAddr := flag.String("proto-listen", "", "also take and release locks over length prefixed protobuf frames on this tcp address, see proto/lockserver.proto, empty disables it")
+	redisAddr := flag.String("redis", "", "keep lock state in the redis server at host:port or redis://[:PASSWORD@]HOST:PORT[/DB], shared by every lock server using it")
+	redisPrefix := flag.String("redis-prefix", "lockserver:", "prepended to the redis keys of -redis")
+	leasePrefix := flag.String("k8s-leases", "", "back write locks of keys under this prefix with kubernetes Lease objects named by the rest of the key, empty disables it")
+	k8sAPI := flag.String("k8s-api", "", "kubernetes api server url for -k8s-leases, e.g. a kubectl proxy, empty uses the in-cluster service account")
+	k8sNamespace := flag.String("k8s-namespace", "", "kubernetes namespace of the -k8s-leases Leases, empty uses the pod's")
+	auditPath := flag.String("audit-log", "", "append who acquired and released which lock to this file, empty disables auditing")
+	certPath := flag.String("tls-cert", "", "serve https using this certificate file, requires -tls-key")
+	keyPath := flag.String("tls-key", "", "private key file for -tls-cert")
+	reloadCert := flag.Bool("tls-reload", false, "pick up rotated -tls-cert and -tls-key files without a restart")
+	clientCA := flag.String("tls-client-ca", "", "require client certificates signed by an authority in this PEM file")
+	clientOptional := flag.Bool("tls-client-optional", false, "with -tls-client-ca, verify client certificates but let clients without one connect")
+	certsPath := flag.String("client-certs", "", "authenticate requests by client certificate identities listed in this file")
+	aclPath := flag.String("acl", "", "restrict the keys each caller may use to the rules in this file")
+	hooksPath := flag.String("webhooks", "", "post the lock events of the keys in this file's rules to their urls, empty disables webhooks")
+	hooksSecret := flag.String("webhook-secret", "", "sign webhook deliveries with the HMAC secret in this file")
+	jwtKey := flag.String("jwt-key", "", "accept JWT bearer tokens signed with this PEM public key or HMAC secret file")
+	jwksURL := flag.String("jwt-jwks", "", "accept JWT bearer tokens signed with a key served by this JWKS url")
+	jwtIssuer := flag.String("jwt-issuer", "", "required iss claim of JWT bearer tokens")
+	jwtAudience := flag.String("jwt-audience", "", "required aud claim of JWT bearer tokens")
+	adminListen := flag.String("admin-listen", "", "serve force-unlock, the dashboard and the other admin endpoints on this address only instead of the client port")
+	adminKeysPath := flag.String("admin-api-keys", "", "with -admin-listen, require an admin key from this file there instead of the client port's credentials")
+	keyLength := flag.Int("max-key-length", 1024, "refuse keys longer than this many bytes, 0 for no limit")
+	keyCharClass := flag.String("key-chars", "", "refuse keys with characters outside this regexp character class, e.g. a-zA-Z0-9/_.-, empty allows any")
+	keyLimit := flag.Int("max-keys", 0, "refuse new keys while the lock table holds this many, 0 for no limit")
+	readerMax := flag.Int("max-readers", 0, "most read locks a key may have at once, 0 for no limit")
+	ttlDefaultSpec := flag.String("ttl-defaults", "", "comma separated PATTERN=DURATION leases overriding -default-ttl for the locks requested without ttl=, a PATTERN is a key or a prefix ending in *")
+	ttlLimitSpec := flag.String("ttl-limits", "", "comma separated PATTERN=DURATION longest leases the keys PATTERN selects may be locked or renewed with, longer ones are shortened to it")
+	rejectTTL := flag.Bool("ttl-reject", false, "refuse a ttl= over the -ttl-limits of its key instead of shortening it")
+	holdLimitSpec := flag.String("hold-limits", "", "comma separated PATTERN=DURATION longest the keys PATTERN selects may be held whatever their lease, a PATTERN is a key or a prefix ending in *")
+	orphanFactor := flag.Float64("orphan-factor", 10, "report a lock held this many times longer than the 99th percentile hold of its key as orphaned, 0 disables it")
+	orphanSilence := flag.Duration("orphan-silence", 30*time.Minute, "report a lock whose holder neither renewed it, took it again nor sent a session heartbeat for this long as orphaned, 0 disables it")
+	holdAction := flag.String("hold-limit-action", "release", "what happens to a lock held past its -hold-limits: release it, or flag it in the audit log and lock events")
+	readerSpec := flag.String("reader-limits", "", "comma separated PATTERN=N read lock caps overriding -max-readers, a PATTERN is a key or a prefix ending in *")
+	keysPath := flag.String("api-keys", "", "require an api key from this file on every lock request, empty disables authentication")
+	shardCount := flag.Int("shards", defaultShardCount, "number of independently locked slices of the lock table")
+	quota := flag.Int("namespace-quota", 0, "most lock ids one /v1/ns/ namespace may hold at once, 0 for no limit")
+	perClient := flag.Int("client-quota", 0, "most lock ids one api key or client address may hold at once, 0 for no limit")
+	drainTimeout := flag.Duration("drain-timeout", 0, "on shutdown wait this long for held locks to be released")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "on shutdown wait this long for in-flight requests to finish")
+	readTimeout := flag.Duration("read-timeout", 10*time.Second, "time a client has to send a request, 0 for none")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "time a reply has to be written after any wait the request asked for, 0 for none")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "close keep-alive connections idle this long")
+	fairQueue := flag.Bool("fair", false, "refuse requests without wait= while blocking requests are queued on the key")
+	policyName := flag.String("rw-policy", "read", "reader/writer policy: read lets readers join while writers are queued, write makes them wait for queued writers, phase-fair alternates the readers and writers that queued")
+	aging := flag.Duration("priority-aging", time.Second, "queued requests gain one priority level per this much waiting, 0 disables aging")
+	flag.BoolVar(&hierarchical, "hierarchical", false, "treat keys as slash separated paths, a lock also conflicts with locks on ancestors and descendants")
+	listen := flag.String("listen", ":8090", "address to serve on, host:port")
+	listeners := flag.String("listeners", "", "more addresses to serve on, comma separated ADDR[+tls][+admin][+local][+read-only], see the README")
+	unixSocket := flag.String("unix-socket", "", "also serve the api in plain http on a unix domain socket at this path, empty disables it")
+	unixMode := flag.String("unix-socket-mode", "0660", "octal permissions of the -unix-socket file, who may write it may connect")
+	unixGroup := flag.String("unix-socket-group", "", "group owning the -unix-socket file, empty keeps the server's")
+	gossipAddr := flag.String("gossip-listen", "", "gossip cluster membership with the other lock servers over udp on this address, empty runs alone")
+	gossipJoin := flag.String("gossip-join", "", "comma separated gossip addresses of cluster members to join through")
+	nodeName := flag.String("node-name", "", "name of this node in the cluster, empty uses the host name and -listen port")
+	advertise := flag.String("advertise", "", "base url the other cluster members, or the leader this -standby deposes, reach this node's api at, empty derives it from the host name and -listen")
+	gossipInterval := flag.Duration("gossip-interval", time.Second, "how often a node gossips, members silent for 15 of them are dead")
+	partition := flag.Bool("partition", false, "with -gossip-listen spread the keys over the cluster members by consistent hashing, forwarding requests to the owner of their key")
+	followURL := flag.String("follow", "", "replicate the lock table of the leader at this base url, answering status and listings locally and forwarding everything else to it")
+	followAdmin := flag.String("follow-admin", "", "base url of the leader's admin api the -follow stream and admin calls go to, empty uses -follow")
+	followToken := flag.String("follow-token", "", "read the leader's admin api key for the -follow stream from this file")
+	standbyMode := flag.Bool("standby", false, "with -follow take over as leader once the leader has been silent for -failover-after")
+	failoverAfter := flag.Duration("failover-after", 5*time.Second, "how long a -standby waits for a silent leader before taking over")
+	promoteCommand := flag.String("promote-command", "", "shell command a -standby runs on taking over, e.g. to move a floating address or tell the load balancer")
+	gossipKey := flag.String("gossip-key", "", "sign and check gossip with the shared HMAC secret in this file")
+	useHTTP2 := flag.Bool("http2", true, "serve HTTP/2 to TLS clients that negotiate it")
+	h2c := flag.Bool("h2c", false, "also serve HTTP/2 over plain connections (prior knowledge h2c)")
+	maxStreams := flag.Int("h2-max-streams", 250, "requests one HTTP/2 connection may have in flight at once")
+	maxConns := flag.Int("max-conns", 0, "most client connections open at once, further ones wait to be accepted, 0 for no limit")
+	lockTTL := flag.Duration("default-ttl", 0, "lease of locks requested without ttl=, 0 holds them until unlocked")
+	sessTTL := flag.Duration("session-ttl", defaultSessionTTL, "heartbeat ttl of sessions created without ttl=")
+	rate := flag.Float64("rate-limit", 0, "lock attempts a second each client may make, 0 for no limit")
+	burst := flag.Int("rate-burst", 10, "lock attempts a client may make at once before -rate-limit applies")
+	mutexProfile := flag.Int("mutex-profile", 0, "sample 1 in this many mutex contention events for /debug/pprof/mutex, 0 disables it")
+	blockProfile := flag.Duration("block-profile", 0, "sample about one blocking event per this much time goroutines spend blocked, for /debug/pprof/block, 0 disables it")
+	statsdAddr := flag.String("statsd", "", "also push metrics to the statsd server at host:port, empty disables it")
+	statsdPrefix := flag.String("statsd-prefix", "lockserver.", "prepended to the statsd metric names")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "how often metrics are pushed to -statsd")
+	dogstatsd := flag.Bool("dogstatsd", false, "send -statsd metrics with dogstatsd tags instead of folding them into the names")
+	statsdTags := flag.String("statsd-tags", "", "comma separated name:value dogstatsd tags added to every metric, e.g. env:prod")
+	levelName := flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+	flag.String("config", "", "read settings from this json file, SIGHUP reloads it")
+	flag.Parse()
+	setupLogging()
 
-	http.ListenAndServe(":8090", nil)
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	var jwtAuth *jwtVerifier
+	if len(*jwtKey) != 0 && len(*jwksURL) != 0 {
+		log.Fatal("-jwt-key and -jwt-jwks are exclusive")
+	}
+	if len(*jwtKey) != 0 || len(*jwksURL) != 0 {
+		if jwtAuth, err = newJWTVerifier(*jwtKey, *jwksURL, *jwtIssuer, *jwtAudience); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// like the audit log, webhooks only hear of what happens once the wal
+	// is replayed
+	var hooks *webhookSet
+	hooksLive := false
+	// apply hands the settings that may change at runtime to the server
+	apply := func() error {
+		if *sessTTL <= 0 {
+			return errors.New("-session-ttl must be positive")
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(*levelName)); err != nil {
+			return fmt.Errorf("-log-level: %w", err)
+		}
+		policy, err := parseRWPolicy(*policyName)
+		if err != nil {
+			return err
+		}
+		chars, err := parseKeyChars(*keyCharClass)
+		if err != nil {
+			return fmt.Errorf("-key-chars: %w", err)
+		}
+		readerCaps, err := parseReaderLimits(*readerSpec)
+		if err != nil {
+			return fmt.Errorf("-reader-limits: %w", err)
+		}
+		leaseDefaults, err := parseTTLRules(*ttlDefaultSpec)
+		if err != nil {
+			return fmt.Errorf("-ttl-defaults: %w", err)
+		}
+		leaseLimits, err := parseTTLRules(*ttlLimitSpec)
+		if err != nil {
+			return fmt.Errorf("-ttl-limits: %w", err)
+		}
+		holdCeilings, err := parseTTLRules(*holdLimitSpec)
+		if err != nil {
+			return fmt.Errorf("-hold-limits: %w", err)
+		}
+		flagOverheld, err := parseHoldLimitAction(*holdAction)
+		if err != nil {
+			return err
+		}
+		var creds authenticators
+		if len(*certsPath) != 0 {
+			c, err := loadClientCerts(*certsPath)
+			if err != nil {
+				return err
+			}
+			creds = append(creds, c)
+		}
+		if len(*keysPath) != 0 {
+			a, err := loadAPIKeys(*keysPath)
+			if err != nil {
+				return err
+			}
+			creds = append(creds, a)
+		}
+		if jwtAuth != nil {
+			creds = append(creds, jwtAuth)
+		}
+		var rules *aclPolicy
+		if len(*aclPath) != 0 {
+			if len(creds) == 0 {
+				return errors.New("-acl needs -api-keys, -client-certs or -jwt-key/-jwt-jwks to tell callers apart")
+			}
+			if rules, err = loadACL(*aclPath); err != nil {
+				return err
+			}
+		}
+		var adminKeys *apiKeys
+		if len(*adminKeysPath) != 0 {
+			if adminKeys, err = loadAPIKeys(*adminKeysPath); err != nil {
+				return err
+			}
+		}
+		var loaded *webhookSet
+		if len(*hooksPath) != 0 {
+			if loaded, err = loadWebhooks(*hooksPath); err != nil {
+				return err
+			}
+		}
+		var secret []byte
+		if len(*hooksSecret) != 0 {
+			if secret, err = loadSecret(*hooksSecret); err != nil {
+				return err
+			}
+		}
+		acl.Store(rules)
+		webhookSecret.Store(&secret)
+		if hooks = loaded; hooksLive {
+			setWebhooks(hooks)
+		}
+		var current authenticator
+		switch {
+		case len(creds) == 1:
+			current = creds[0]
+		case len(creds) > 1:
+			current = creds
+		}
+		setAuth(current)
+		if adminKeys != nil {
+			current = adminKeys
+		}
+		adminAuth.set(current)
+		maxKeyLength.Store(int64(*keyLength))
+		keyChars.Store(chars)
+		maxKeys.Store(int64(*keyLimit))
+		maxReaders.Store(int64(*readerMax))
+		readerLimits.Store(&readerCaps)
+		ttlDefaults.Store(&leaseDefaults)
+		ttlLimits.Store(&leaseLimits)
+		ttlReject.Store(*rejectTTL)
+		holdLimits.Store(&holdCeilings)
+		holdLimitFlag.Store(flagOverheld)
+		fair.Store(*fairQueue)
+		rwPolicy.Store(policy)
+		priorityAging.Store(int64(*aging))
+		namespaceQuota.Store(int64(*quota))
+		clientQuota.Store(int64(*perClient))
+		defaultTTL.Store(int64(max(*lockTTL, 0)))
+		sessionTTL.Store(int64(*sessTTL))
+		logLevel.Set(level)
+		setRateLimit(*rate, *burst)
+		return nil
+	}
+	if err := apply(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *shardCount <= 0 {
+		log.Fatal("-shards must be positive")
+	}
+	shards = newShards(*shardCount)
+	nextFence.Store(1)
+	if len(*followURL) != 0 {
+		if len(*walPath) != 0 || len(*auditPath) != 0 || len(*restorePath) != 0 || len(*importPath) != 0 ||
+			len(*redisAddr) != 0 || len(*leasePrefix) != 0 || len(*respAddr) != 0 || len(*protoAddr) != 0 ||
+			len(*grpcAddr) != 0 || len(*hooksPath) != 0 || *partition {
+			log.Fatal("-follow can't be combined with -wal, -audit-log, -restore, -import, -redis, -k8s-leases, -resp-listen, -proto-listen, -grpc-listen, -webhooks or -partition, the leader keeps the lock table")
+		}
+		if len(*followAdmin) == 0 {
+			*followAdmin = *followURL
+		}
+		link := newLeaderLink(*followURL, *followAdmin, false)
+		if link == nil {
+			log.Fatal("-follow and -follow-admin must be urls")
+		}
+		upstream.Store(link)
+	} else if *standbyMode {
+		log.Fatal("-standby needs -follow")
+	}
+	if *standbyMode && *failoverAfter <= 0 {
+		log.Fatal("-failover-after must be positive")
+	}
+	if len(*restorePath) != 0 {
+		if err := restoreSnapshot(*restorePath, *walPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*importPath) != 0 {
+		if len(*restorePath) != 0 {
+			log.Fatal("-import and -restore are exclusive")
+		}
+		if err := importState(*importPath, *walPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*walPath) != 0 {
+		if wal, err = openWAL(*walPath, *walCompact); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(*redisAddr) != 0 {
+		if len(*walPath) != 0 || len(*auditPath) != 0 || len(*restorePath) != 0 || len(*importPath) != 0 || len(*respAddr) != 0 || hierarchical {
+			log.Fatal("-redis can't be combined with -wal, -audit-log, -restore, -import, -resp-listen or -hierarchical")
+		}
+		client, err := newRedisClient(*redisAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b := &redisBackend{client: client, prefix: *redisPrefix}
+		if _, ok := b.do("PING"); !ok {
+			slog.Warn("redis not reachable yet, /readyz reports it", "addr", *redisAddr)
+		}
+		store = b
+	}
+	if len(*leasePrefix) != 0 {
+		if len(*redisAddr) != 0 {
+			log.Fatal("-k8s-leases can't be combined with -redis")
+		}
+		client, err := newK8sClient(*k8sAPI, *k8sNamespace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = &leaseBackend{client: client, prefix: *leasePrefix}
+	}
+	if len(*auditPath) != 0 {
+		if audit, err = openAudit(*auditPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !following() {
+		// the leader posts the events a follower replays
+		hooksLive = true
+		setWebhooks(hooks)
+	}
+	runtime.SetMutexProfileFraction(*mutexProfile)
+	if *blockProfile > 0 {
+		runtime.SetBlockProfileRate(int(*blockProfile))
+	}
+	go expiryLoop()
+	go sweeper(sweepInterval)
+	go orphanLoop(*orphanFactor, *orphanSilence)
+	if len(*followToken) != 0 {
+		token, err := loadSecret(*followToken)
+		if err != nil {
+			log.Fatal("-follow-token: ", err)
+		}
+		replicaToken = string(token)
+	}
+	if link := upstream.Load(); link != nil {
+		go follow(link)
+	}
+	if len(*statsdAddr) != 0 {
+		if *statsdInterval <= 0 {
+			log.Fatal("-statsd-interval must be positive")
+		}
+		var tags []string
+		if len(*statsdTags) != 0 {
+			if !*dogstatsd {
+				log.Fatal("-statsd-tags needs -dogstatsd")
+			}
+			tags = strings.Split(*statsdTags, ",")
+		}
+		exporter, err := newStatsdExporter(*statsdAddr, *statsdPrefix, *dogstatsd, tags)
+		if err != nil {
+			log.Fatal("-statsd: ", err)
+		}
+		go exporter.run(*statsdInterval)
+	}
+	// not http.DefaultServeMux, which net/http/pprof and expvar register on
+	mux := http.NewServeMux()
+	extraListeners, err := parseListeners(*listeners)
+	if err != nil {
+		log.Fatal("-listeners: ", err)
+	}
+	adminExtra, hasAdminExtra := adminListener(extraListeners)
+	activatedLn, activatedAdminLn, err := activatedListeners()
+	if err != nil {
+		log.Fatal("socket activation: ", err)
+	}
+	// the privileged endpoints move to their own mux and credentials with
+	// -admin-listen, so the client port can be exposed more widely
+	adminMux, adminPerm := mux, requirePerm
+	if len(*adminListen) != 0 || hasAdminExtra || activatedAdminLn != nil {
+		adminMux, adminPerm = http.NewServeMux(), adminAuth.require
+	} else if len(*adminKeysPath) != 0 {
+		log.Fatal("-admin-api-keys needs -admin-listen or an admin listener")
+	}
+	clientRoutes, privileged := routes(), adminRoutes(adminPerm)
+	// the endpoints a -redis backend serves, the others need the lock table
+	// of this process
+	backendRoutes := map[string]bool{"/lock": true, "/unlock": true, "/rlock": true, "/runlock": true, "/renew": true, "/fence": true,
+		"/cancel": true}
+	// each route is served as /v1/ROUTE and, for the clients written before
+	// the api was versioned, as ROUTE. apiRoutes collects what each mux
+	// serves for its /v1/openapi.json
+	apiRoutes := map[*http.ServeMux][]route{}
+	serveVersioned := func(mux *http.ServeMux, rt route) {
+		mux.HandleFunc(rt.path, legacy(rt.path, rt.handler))
+		mux.HandleFunc("/v1"+rt.path, versioned(1, rt.handler))
+		rt.doc.flat = true
+		apiRoutes[mux] = append(apiRoutes[mux], rt)
+	}
+	serveRoutes := func(mux *http.ServeMux, routes []route) map[string]http.HandlerFunc {
+		namespaced := map[string]http.HandlerFunc{}
+		for _, route := range routes {
+			if !backendRoutes[route.path] {
+				route.handler = localOnly(route.handler)
+			}
+			namespaced[route.path] = route.handler
+			apiRoutes[mux] = append(apiRoutes[mux], route)
+			mux.HandleFunc(route.path, legacy(route.path, route.handler))
+			if !strings.HasPrefix(route.path, "/session/") && !strings.HasPrefix(route.path, "/kv/") {
+				// /v1/session/ and /v1/kv/ are consul's, served below
+				mux.HandleFunc("/v1"+route.path, versioned(1, route.handler))
+			}
+		}
+		mux.HandleFunc("/v1/ns/", versioned(1, namespaceRouter(namespaced)))
+		return namespaced
+	}
+	if adminMux == mux {
+		clientRoutes = append(clientRoutes, privileged...)
+	} else {
+		// the dashboard extends leases through the admin port as well
+		privileged = append(privileged, route{"/renew", instrument("renew", adminPerm(permRead, renewHandler)), renewDoc})
+		serveRoutes(adminMux, privileged)
+	}
+	served := serveRoutes(mux, clientRoutes)
+	for _, rt := range flatAdminRoutes(adminPerm, func() error { return config.reload(apply) }) {
+		serveVersioned(adminMux, rt)
+	}
+	serveVersioned(mux, route{"/cluster/members", instrument("cluster/members", requirePerm(permRead, clusterMembersHandler)),
+		getDoc("the nodes of the cluster as the gossip knows them")})
+	for mux, routes := range apiRoutes {
+		mux.HandleFunc("/v1/openapi.json", openAPIHandler(routes))
+	}
+	adminMux.HandleFunc("/ui", uiHandler)
+	serveDiagnostics(adminMux, adminPerm)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/versions", versionsHandler)
+	// consul clients PUT /v1/session/create, renew and destroy, ours POST
+	consulSession := instrument("consul/session", requirePerm(permRead, localOnly(consulSessionHandler)))
+	mux.HandleFunc("/v1/session/create", postOr(versioned(1, served["/session/create"]),
+		instrument("consul/session", requirePerm(permRead, localOnly(consulSessionCreateHandler)))))
+	mux.HandleFunc("/v1/session/renew", postOr(versioned(1, served["/session/renew"]), consulSession))
+	mux.HandleFunc("/v1/session/destroy", postOr(versioned(1, served["/session/destroy"]), consulSession))
+	mux.HandleFunc("/v1/session/", consulSession)
+	consulKV := instrument("consul/kv", requirePerm(permWrite, localOnly(consulKVHandler)))
+	for _, path := range []string{"/kv/put", "/kv/get", "/kv/delete"} {
+		mux.HandleFunc("/v1"+path, kvOr(versioned(1, served[path]), consulKV))
+	}
+	mux.HandleFunc("/v1/kv/", consulKV)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	server := &http.Server{Addr: *listen, Handler: mux, BaseContext: func(net.Listener) context.Context { return drainCtx },
+		ReadTimeout: *readTimeout, WriteTimeout: writeTimeout, IdleTimeout: *idleTimeout,
+		Protocols: serverProtocols(*useHTTP2, *h2c), HTTP2: &http.HTTP2Config{MaxConcurrentStreams: *maxStreams}}
+	// systemd's socket stands in for -listen
+	ln, err := listenClient(*listen, activatedLn, *maxConns)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if (len(*clientCA) != 0 || len(*certsPath) != 0) && len(*certPath) == 0 {
+		log.Fatal("-tls-client-ca and -client-certs need -tls-cert")
+	}
+	if len(*certsPath) != 0 && len(*clientCA) == 0 {
+		log.Fatal("-client-certs needs -tls-client-ca to verify the certificates")
+	}
+	if server.TLSConfig, err = serverTLS(*certPath, *keyPath, *clientCA, *reloadCert, *clientOptional); err != nil {
+		log.Fatal(err)
+	}
+
+	// the urls other nodes reach this one at
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	scheme := "http"
+	if server.TLSConfig != nil {
+		scheme = "https"
+	}
+	api := *advertise
+	if len(api) == 0 {
+		api = scheme + "://" + net.JoinHostPort(hostName(), port)
+	}
+	adminAPI := api
+	if adminMux != mux {
+		adminAddr := *adminListen
+		if activatedAdminLn != nil {
+			adminAddr = activatedAdminLn.Addr().String()
+		} else if len(adminAddr) == 0 {
+			adminAddr = adminExtra.addr
+		}
+		_, adminPort, _ := net.SplitHostPort(adminAddr)
+		adminAPI = scheme + "://" + net.JoinHostPort(hostName(), adminPort)
+	}
+	if link := upstream.Load(); link != nil && *standbyMode {
+		go standby(link, *failoverAfter, *promoteCommand, api, adminAPI)
+	}
+	if len(*gossipAddr) != 0 {
+		name := *nodeName
+		if len(name) == 0 {
+			name = hostName() + ":" + port
+		}
+		var key []byte
+		if len(*gossipKey) != 0 {
+			if key, err = loadSecret(*gossipKey); err != nil {
+				log.Fatal("-gossip-key: ", err)
+			}
+		}
+		var seeds []string
+		if len(*gossipJoin) != 0 {
+			seeds = strings.Split(*gossipJoin, ",")
+		}
+		if *gossipInterval <= 0 {
+			log.Fatal("-gossip-interval must be positive")
+		}
+		if cluster, err = startGossip(name, *gossipAddr, api, seeds, key, *gossipInterval); err != nil {
+			log.Fatal("-gossip-listen: ", err)
+		}
+	}
+	if *partition {
+		if cluster == nil {
+			log.Fatal("-partition needs -gossip-listen")
+		}
+		if len(*redisAddr) != 0 || len(*leasePrefix) != 0 || hierarchical {
+			log.Fatal("-partition can't be combined with -redis or -k8s-leases, which share one lock table already, or -hierarchical")
+		}
+		startPartitioning()
+		server.Handler = partitioned(mux)
+	}
+	// a follower sends the leader whatever it does not answer from its
+	// replica, admin calls included
+	leaderRoutes := map[string]bool{}
+	for _, rt := range slices.Concat(clientRoutes, privileged) {
+		if !replicaRoutes[rt.path] {
+			leaderRoutes[rt.path] = true
+		}
+	}
+	server.Handler = followerOf(server.Handler, leaderRoutes, false)
+
+	adminHandler := followerOf(adminMux, leaderRoutes, true)
+	var adminServer *http.Server
+	if len(*adminListen) != 0 || activatedAdminLn != nil {
+		if adminServer, err = listenAdmin(*adminListen, activatedAdminLn, server, adminHandler); err != nil {
+			log.Fatal(err)
+		}
+	}
+	extraServers, err := listenExtra(extraListeners, server, adminHandler, *maxConns)
+	if err != nil {
+		log.Fatal("-listeners: ", err)
+	}
+	if len(*unixSocket) != 0 {
+		if err := serveUnix(server, *unixSocket, *unixMode, *unixGroup, *maxConns); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if len(*otlpEndpoint) != 0 {
+		startSpanExport(*otlpEndpoint, "lockserver")
+	}
+
+	var respListener net.Listener
+	if len(*respAddr) != 0 {
+		if respListener, err = listenRESP(*respAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var protoListener net.Listener
+	if len(*protoAddr) != 0 {
+		if protoListener, err = listenProto(*protoAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var grpcServer *http.Server
+	if len(*grpcAddr) != 0 {
+		if grpcServer, err = listenGRPC(*grpcAddr, server); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			config.reload(apply)
+		}
+	}()
+
+	// on SIGTERM or ^C stop taking locks, let in-flight requests finish and
+	// close the listener
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		slog.Info("draining")
+		if cluster != nil {
+			cluster.leave()
+		}
+		drain(*drainTimeout)
+		if respListener != nil {
+			respListener.Close()
+		}
+		if protoListener != nil {
+			protoListener.Close()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if adminServer != nil {
+			if err := adminServer.Shutdown(ctx); err != nil {
+				slog.Error("admin shutdown", "err", err)
+			}
+		}
+		for _, s := range extraServers {
+			if err := s.Shutdown(ctx); err != nil {
+				slog.Error("listener shutdown", "err", err)
+			}
+		}
+		if grpcServer != nil {
+			if err := grpcServer.Shutdown(ctx); err != nil {
+				slog.Error("grpc shutdown", "err", err)
+			}
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+		close(stopped)
+	}()
+	if err := serveOn(server, ln); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	if err := wal.close(); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+	if err := audit.close(); err != nil {
+		slog.Error("audit write failed", "err", err)
+	}
+	stopSpanExport()
 }
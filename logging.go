@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel is the least severe level written to the log, -log-level sets
+// it and POST /log-level changes it at runtime
+var logLevel = new(slog.LevelVar)
+
+// setupLogging writes the server log, including the log package's output,
+// as one json object per line to stderr
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel})))
+}
+
+// requestLog collects what a request did for its log line, the reply
+// helpers fill it in
+type requestLog struct {
+	result string
+	code   string
+	lockID string
+	txn    string
+	caller string
+	span   span
+}
+
+type requestLogKey struct{}
+
+// noteReply records the outcome of r for its log line, r may come from an
+// endpoint that is not logged
+func noteReply(r *http.Request, result, code string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.result, entry.code = result, code
+	}
+}
+
+// noteLockID records the lock or transaction id r was granted
+func noteLockID(r *http.Request, lockID, txn string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.lockID, entry.txn = lockID, txn
+	}
+}
+
+// noteCaller records the authenticated caller of r
+func noteCaller(r *http.Request, name string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.caller = name
+	}
+}
+
+// statusWriter remembers the status code written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// logRequest writes the log line of one request: failures the server is
+// to blame for are errors, other failures warnings, the rest info
+func logRequest(endpoint string, r *http.Request, entry *requestLog, status int, elapsed time.Duration) {
+	level := slog.LevelInfo
+	switch {
+	case entry.result == "failure" && status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case entry.result == "failure":
+		level = slog.LevelWarn
+	}
+	ctx := context.Background()
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	query := r.URL.Query()
+	attrs := []slog.Attr{slog.String("endpoint", endpoint)}
+	if ns := requestNamespace(r); len(ns) != 0 {
+		attrs = append(attrs, slog.String("namespace", ns))
+	}
+	switch keys := query["key"]; len(keys) {
+	case 0:
+	case 1:
+		attrs = append(attrs, slog.String("key", keys[0]))
+	default:
+		attrs = append(attrs, slog.Any("keys", keys))
+	}
+	attrs = append(attrs, slog.String("result", entry.result))
+	if len(entry.code) != 0 {
+		attrs = append(attrs, slog.String("code", entry.code))
+	}
+	lockID := entry.lockID
+	if len(lockID) == 0 {
+		lockID = query.Get("lock-id")
+	}
+	if len(lockID) != 0 {
+		attrs = append(attrs, slog.String("lock_id", lockID))
+	}
+	txn := entry.txn
+	if len(txn) == 0 {
+		txn = query.Get("txn")
+	}
+	if len(txn) != 0 {
+		attrs = append(attrs, slog.String("txn", txn))
+	}
+	for _, name := range []string{"owner", "session"} {
+		if v := query.Get(name); len(v) != 0 {
+			attrs = append(attrs, slog.String(name, v))
+		}
+	}
+	if len(entry.caller) != 0 {
+		attrs = append(attrs, slog.String("caller", entry.caller))
+	}
+	attrs = append(attrs, slog.String("trace_id", entry.span.traceID), slog.String("span_id", entry.span.spanID))
+	if len(entry.span.parentID) != 0 {
+		attrs = append(attrs, slog.String("parent_span_id", entry.span.parentID))
+	}
+	attrs = append(attrs,
+		slog.Int("status", status),
+		slog.String("client", r.RemoteAddr),
+		slog.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+	)
+	slog.LogAttrs(ctx, level, "request", attrs...)
+}
+
+// logLevelHandler answers the current log level, a POST with level=debug,
+// info, warn or error changes it until the next restart or reload
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Write([]byte(strings.ToLower(logLevel.Level().String()) + "\n"))
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(r.URL.Query().Get("level"))); err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	// logged as a warning so it shows whichever way the level moved
+	slog.Warn("log level changed", "level", level.String(), "caller", callerName(r))
+	logLevel.Set(level)
+	replySuccess(w, r)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// maintenance is switched on by an admin to let the locks held run out
+// before an upgrade: like draining new acquisitions are refused and
+// blocked ones give up, but unlocks, renewals and reads go on and the
+// server keeps running
+var maintenance atomic.Bool
+
+var errMaintenance = failure{code: "maintenance", text: "server is in maintenance, no new locks are granted", status: http.StatusServiceUnavailable}
+
+// closedForLocks tells whether new acquisitions are refused, while the
+// server drains or is in maintenance
+func closedForLocks() bool {
+	return draining.Load() || maintenance.Load()
+}
+
+// closedFailure is the answer to an acquisition while closedForLocks
+func closedFailure() failure {
+	if draining.Load() {
+		return errDraining
+	}
+	return errMaintenance
+}
+
+// maintenanceHandler answers GET /admin/maintenance with on or off and
+// POST /admin/maintenance?enabled=BOOL switching it. switching it on wakes
+// every parked waiter so it gives up
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		if maintenance.Load() {
+			w.Write([]byte("on\n"))
+		} else {
+			w.Write([]byte("off\n"))
+		}
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if maintenance.Swap(enabled) != enabled {
+		slog.Warn("maintenance switched", "enabled", enabled, "caller", callerName(r), "held", heldCount())
+	}
+	if enabled {
+		for _, s := range shards {
+			s.mu.Lock()
+			for _, counter := range s.locks {
+				counter.wakeup()
+			}
+			s.mu.Unlock()
+		}
+	}
+	replySuccess(w, r)
+}
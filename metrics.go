@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds in seconds of the request latency histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// upper bounds in seconds of the lock hold time histogram buckets
+var holdBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 1800, 3600, 21600}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+	max    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) add(seconds float64) {
+	for i, bound := range h.bounds {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+	h.max = max(h.max, seconds)
+}
+
+// merge adds the observations of other, which has the same buckets, to h
+func (h *histogram) merge(other *histogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.sum += other.sum
+	h.count += other.count
+	h.max = max(h.max, other.max)
+}
+
+// quantile estimates the q quantile as the upper bound of the bucket it
+// falls in, capped by the largest observation
+func (h *histogram) quantile(q float64) float64 {
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		if float64(cumulative) >= rank {
+			return min(bound, h.max)
+		}
+	}
+	return h.max
+}
+
+// write prints h as prometheus histogram name with labels, a comma
+// separated list of label="value" pairs
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// serverMetrics holds the counters exported on /metrics, mode labels are
+// "write" or "read"
+type serverMetrics struct {
+	mu             sync.Mutex
+	acquisitions   map[string]uint64
+	failures       map[string]uint64
+	unlockFailures map[string]uint64
+	contention     map[string]uint64        // key -> contended acquisitions
+	grants         map[string]uint64        // key -> granted acquisitions
+	waited         map[string]time.Duration // key -> time granted requests queued
+	latency        map[string]*histogram
+	holdTimes      map[string]*histogram // mode -> time from grant to release
+	keyHoldTimes   map[string]*histogram // key -> time from grant to release
+}
+
+var metrics = &serverMetrics{
+	acquisitions:   map[string]uint64{},
+	failures:       map[string]uint64{},
+	unlockFailures: map[string]uint64{},
+	contention:     map[string]uint64{},
+	grants:         map[string]uint64{},
+	waited:         map[string]time.Duration{},
+	latency:        map[string]*histogram{},
+	holdTimes:      map[string]*histogram{},
+	keyHoldTimes:   map[string]*histogram{},
+}
+
+func modeLabel(readLock bool) string {
+	if readLock {
+		return "read"
+	}
+	return "write"
+}
+
+// keySeries is how many keys /metrics exports a per key series for, the
+// ones with the most requests
+const keySeries = 200
+
+// acquired records a lock on path granted after queueing for waited
+func (m *serverMetrics) acquired(readLock bool, path string, waited time.Duration) {
+	m.acquiredAs(modeLabel(readLock), path, waited)
+}
+
+// acquiredAs is acquired for a lock in the mode named mode
+func (m *serverMetrics) acquiredAs(mode string, path string, waited time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acquisitions[mode]++
+	m.grants[path]++
+	m.waited[path] += waited
+}
+
+func (m *serverMetrics) contended(readLock bool, path string) {
+	m.contendedAs(modeLabel(readLock), path)
+}
+
+func (m *serverMetrics) contendedAs(mode string, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[mode]++
+	m.contention[path]++
+}
+
+func (m *serverMetrics) unlockFailed(readLock bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unlockFailures[modeLabel(readLock)]++
+}
+
+func (m *serverMetrics) observe(endpoint string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.latency[endpoint]
+	if h == nil {
+		h = newHistogram(latencyBuckets)
+		m.latency[endpoint] = h
+	}
+	h.add(d.Seconds())
+}
+
+// released records that a lock on path in the mode named mode was held
+// for d
+func (m *serverMetrics) released(mode string, path string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.holdTimes[mode] == nil {
+		m.holdTimes[mode] = newHistogram(holdBuckets)
+	}
+	if m.keyHoldTimes[path] == nil {
+		m.keyHoldTimes[path] = newHistogram(holdBuckets)
+	}
+	m.holdTimes[mode].add(d.Seconds())
+	m.keyHoldTimes[path].add(d.Seconds())
+}
+
+// forget drops the per key counters and hold times of keys, pruned from
+// the lock table
+func (m *serverMetrics) forget(keys []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.contention, key)
+		delete(m.grants, key)
+		delete(m.waited, key)
+		delete(m.keyHoldTimes, key)
+	}
+}
+
+// instrument records the latency of every request served by handler
+func instrument(endpoint string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &requestLog{span: startSpan(w, r, endpoint)}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, entry)))
+		elapsed := time.Since(start)
+		entry.span.export(start.Add(elapsed), sw.status >= http.StatusInternalServerError,
+			"http.request.method", r.Method, "http.route", r.URL.Path, "http.response.status_code", strconv.Itoa(sw.status))
+		metrics.observe(endpoint, elapsed)
+		logRequest(endpoint, r, entry, sw.status, elapsed)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeCounters(w http.ResponseWriter, name, help, label string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(k), values[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// topKeys returns the n keys of m with the largest weight, sorted
+func topKeys[V any](m map[string]V, n int, weight func(V) uint64) []string {
+	keys := sortedKeys(m)
+	if len(keys) <= n {
+		return keys
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return weight(m[keys[i]]) > weight(m[keys[j]]) })
+	keys = keys[:n]
+	sort.Strings(keys)
+	return keys
+}
+
+// heldByMode counts the lock ids held in each mode, write and read always
+// among them
+func heldByMode() map[string]uint64 {
+	held := map[string]uint64{"write": 0, "read": 0}
+	for _, s := range shards {
+		s.mu.Lock()
+		for _, counter := range s.locks {
+			for _, h := range counter.lockID {
+				held[stateName(h.mode)]++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return held
+}
+
+// metricsHandler serves the counters in the prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	held := heldByMode()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	writeCounters(w, "lockserver_acquisitions_total", "Locks granted.", "mode", metrics.acquisitions)
+	writeCounters(w, "lockserver_acquisition_failures_total", "Lock requests refused because the key was held.", "mode", metrics.failures)
+	writeCounters(w, "lockserver_unlock_failures_total", "Unlock requests for a key and lock id that were not held.", "mode", metrics.unlockFailures)
+	fmt.Fprintf(w, "# HELP lockserver_key_contention_total Lock requests refused because the key was held, per key.\n# TYPE lockserver_key_contention_total counter\n")
+	for _, stored := range topKeys(metrics.contention, keySeries, func(n uint64) uint64 { return n }) {
+		ns, key := splitKey(stored)
+		fmt.Fprintf(w, "lockserver_key_contention_total{namespace=\"%s\",key=\"%s\"} %d\n", ns, labelEscaper.Replace(key), metrics.contention[stored])
+	}
+
+	if cluster != nil {
+		members := map[string]uint64{memberAlive: 0, memberSuspect: 0, memberDead: 0, memberLeft: 0}
+		for _, m := range cluster.list() {
+			members[m.state]++
+		}
+		fmt.Fprintf(w, "# HELP lockserver_cluster_members Cluster members known by gossip, per state.\n# TYPE lockserver_cluster_members gauge\n")
+		for _, state := range sortedKeys(members) {
+			fmt.Fprintf(w, "lockserver_cluster_members{state=\"%s\"} %d\n", state, members[state])
+		}
+	}
+	fmt.Fprintf(w, "# HELP lockserver_keys Keys in the lock table, held or recently used.\n# TYPE lockserver_keys gauge\nlockserver_keys %d\n", tableKeys.Load())
+	inMaintenance := 0
+	if maintenance.Load() {
+		inMaintenance = 1
+	}
+	fmt.Fprintf(w, "# HELP lockserver_maintenance 1 while maintenance refuses new locks.\n# TYPE lockserver_maintenance gauge\nlockserver_maintenance %d\n", inMaintenance)
+	orphaned := 0
+	if report := orphans.Load(); report != nil {
+		orphaned = len(report.Orphans)
+	}
+	fmt.Fprintf(w, "# HELP lockserver_orphans Locks the last orphan analysis flagged.\n# TYPE lockserver_orphans gauge\nlockserver_orphans %d\n", orphaned)
+	fmt.Fprintf(w, "# HELP lockserver_fencing_epoch Standby takeovers the fencing tokens count.\n# TYPE lockserver_fencing_epoch gauge\nlockserver_fencing_epoch %d\n", epoch.Load())
+	fmt.Fprintf(w, "# HELP lockserver_locks_held Lock ids currently held.\n# TYPE lockserver_locks_held gauge\n")
+	for _, mode := range sortedKeys(held) {
+		fmt.Fprintf(w, "lockserver_locks_held{mode=\"%s\"} %d\n", mode, held[mode])
+	}
+
+	namespaces.Lock()
+	writeCounters(w, "lockserver_namespace_acquisitions_total", "Lock ids granted, per /v1/ns/ namespace.", "namespace", namespaces.granted)
+	fmt.Fprintf(w, "# HELP lockserver_namespace_locks_held Lock ids currently held, per /v1/ns/ namespace.\n# TYPE lockserver_namespace_locks_held gauge\n")
+	for _, ns := range sortedKeys(namespaces.granted) {
+		fmt.Fprintf(w, "lockserver_namespace_locks_held{namespace=\"%s\"} %d\n", ns, namespaces.held[ns])
+	}
+	namespaces.Unlock()
+
+	fmt.Fprintf(w, "# HELP lockserver_request_duration_seconds Request latency.\n# TYPE lockserver_request_duration_seconds histogram\n")
+	for _, endpoint := range sortedKeys(metrics.latency) {
+		metrics.latency[endpoint].write(w, "lockserver_request_duration_seconds", fmt.Sprintf("endpoint=\"%s\"", endpoint))
+	}
+
+	fmt.Fprintf(w, "# HELP lockserver_hold_duration_seconds Time locks were held from grant to release.\n# TYPE lockserver_hold_duration_seconds histogram\n")
+	for _, mode := range sortedKeys(metrics.holdTimes) {
+		metrics.holdTimes[mode].write(w, "lockserver_hold_duration_seconds", fmt.Sprintf("mode=\"%s\"", mode))
+	}
+	fmt.Fprintf(w, "# HELP lockserver_key_hold_duration_seconds Time locks were held from grant to release, per key.\n# TYPE lockserver_key_hold_duration_seconds histogram\n")
+	for _, stored := range topKeys(metrics.keyHoldTimes, keySeries, func(h *histogram) uint64 { return h.count }) {
+		ns, key := splitKey(stored)
+		labels := fmt.Sprintf("namespace=\"%s\",key=\"%s\"", ns, labelEscaper.Replace(key))
+		metrics.keyHoldTimes[stored].write(w, "lockserver_key_hold_duration_seconds", labels)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneForgetsKeyMetrics(t *testing.T) {
+	id, _ := store.lock("metrics/a", lockOptions{})
+	metrics.acquired(false, "metrics/a", 0)
+	metrics.contended(false, "metrics/a")
+	metrics.released("write", "metrics/a", time.Second)
+	pruneCounters()
+	metrics.mu.Lock()
+	_, kept := metrics.grants["metrics/a"]
+	metrics.mu.Unlock()
+	if !kept {
+		t.Fatal("the counters of a held key were dropped")
+	}
+
+	store.unlock("metrics/a", id)
+	pruneCounters()
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if _, ok := metrics.grants["metrics/a"]; ok {
+		t.Error("grants of a pruned key kept")
+	}
+	if _, ok := metrics.contention["metrics/a"]; ok {
+		t.Error("contention of a pruned key kept")
+	}
+	if _, ok := metrics.keyHoldTimes["metrics/a"]; ok {
+		t.Error("hold times of a pruned key kept")
+	}
+}
+
+func TestKeySeriesCapped(t *testing.T) {
+	t.Cleanup(func() {
+		var keys []string
+		for i := range keySeries + 10 {
+			keys = append(keys, fmt.Sprintf("metrics/%d", i))
+		}
+		metrics.forget(keys)
+	})
+	for i := range keySeries + 10 {
+		for range i + 1 {
+			metrics.contended(false, fmt.Sprintf("metrics/%d", i))
+			metrics.released("write", fmt.Sprintf("metrics/%d", i), time.Millisecond)
+		}
+	}
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	if n := strings.Count(body, "lockserver_key_contention_total{"); n > keySeries {
+		t.Errorf("%d per key contention series, want at most %d", n, keySeries)
+	}
+	if n := strings.Count(body, "lockserver_key_hold_duration_seconds_count{"); n > keySeries {
+		t.Errorf("%d per key hold time histograms, want at most %d", n, keySeries)
+	}
+	if strings.Contains(body, `key="metrics/0"}`) {
+		t.Error("the least contended key was exported")
+	}
+	if !strings.Contains(body, fmt.Sprintf(`key="metrics/%d"}`, keySeries+9)) {
+		t.Error("the most contended key was not exported")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// intention modes for locking hierarchical keys at coarse and fine grain
+// at once, lock states next to 1 (write, X) and 2 (read, S). a client
+// about to lock /db/table1 first takes the matching intention on /db, IS
+// before S and IX before X, so a lock on the whole of /db sees the work
+// going on below it. SIX reads the whole of /db at once while writing
+// parts of it. unlike -hierarchical the server does not take intentions
+// on its own, the client walks the path
+const (
+	modeIS  = 3
+	modeIX  = 4
+	modeSIX = 5
+)
+
+// compatible[a][b] reports whether locks in states a and b may be held on
+// one key together, the unlocked state 0 goes with every mode
+var compatible = [6][6]bool{
+	0:       {true, true, true, true, true, true},
+	1:       {0: true},
+	2:       {0: true, 2: true, modeIS: true},
+	modeIS:  {0: true, 2: true, modeIS: true, modeIX: true, modeSIX: true},
+	modeIX:  {0: true, modeIS: true, modeIX: true},
+	modeSIX: {0: true, modeIS: true},
+}
+
+// strongest is the state of a key held in states a and b: a request is
+// compatible with it when it is compatible with every holder
+func strongest(a, b int) int {
+	switch {
+	case a == b || b == 0:
+		return a
+	case a == 0:
+		return b
+	case a == 1 || b == 1:
+		return 1
+	case a == modeIS:
+		return b
+	case b == modeIS:
+		return a
+	}
+	// two of S, IX and SIX
+	return modeSIX
+}
+
+// parseMode reads the mode= of /mlock, IS, IX, S, SIX or X in any case
+func parseMode(name string) (int, bool) {
+	switch strings.ToUpper(name) {
+	case "X":
+		return 1, true
+	case "S":
+		return 2, true
+	case "IS":
+		return modeIS, true
+	case "IX":
+		return modeIX, true
+	case "SIX":
+		return modeSIX, true
+	}
+	return 0, false
+}
+
+// stateOf is the state stateName calls name
+func stateOf(name string) (int, bool) {
+	for state := 1; state <= modeSIX; state++ {
+		if stateName(state) == name {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// mlock takes a lock in mode on counter, returns "" if it is held in a
+// mode that does not go with it or a conflicting request is queued ahead
+// of t. caller must hold the shard mutex
+func (counter *lockCounter) mlock(mode int, opts lockOptions, t *ticket) string {
+	switch mode {
+	case 1:
+		return counter.wlock(opts, t)
+	case 2:
+		return counter.rlock(opts, t)
+	}
+	if !compatible[mode][counter.state] || !counter.admit(t, mode) {
+		return ""
+	}
+	return counter.grant(mode, opts)
+}
+
+// lockMode locks path in mode if that goes with how it is held, it returns
+// the lockID and for X its fencing token if successful otherwise ""
+func lockMode(path string, mode int, opts lockOptions) (string, int64) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.getCounter(path)
+	id := counter.mlock(mode, opts, nil)
+	if len(id) == 0 || mode != 1 {
+		return id, 0
+	}
+	return id, counter.fence
+}
+
+// unlockMode releases the lock lockID holds on path in whichever mode, one
+// hold at a time for a reentrant X. it returns false if lockID holds no
+// lock on path
+func unlockMode(path, lockID string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	return counter != nil && counter.unhold(lockID)
+}
+
+// mlockHandler answers POST /mlock?key=PATH&mode=MODE with a lock id for
+// PATH in MODE, one of IS, IX, S, SIX or X, and the fencing token for X.
+// ttl=, wait=, owner=, session=, priority=, purpose= and label= are those
+// of /lock. S and X are the read and write locks of /rlock and /lock
+func mlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	mode, ok := parseMode(query.Get("mode"))
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if hierarchical && mode != 1 && mode != 2 {
+		f := errUnsupported
+		f.text = "-hierarchical takes intentions itself"
+		replyFailure(w, r, f)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	wait, ok := durationParam(query, "wait")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	opts := lockOptions{ttl: ttl, principal: callerName(r), session: query.Get("session"), owner: query.Get("owner"),
+		addr: remoteHost(r), trace: requestSpan(r.Context())}
+	if p := query.Get("priority"); len(p) != 0 {
+		var err error
+		if opts.priority, err = strconv.Atoi(p); err != nil {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+	}
+	if !metadataParams(query, &opts) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	holdOpen(w, wait)
+	var lockID string
+	var fence int64
+	start := time.Now()
+	if wait > 0 {
+		lockID, fence = waitMode(r.Context(), path, mode, opts, wait)
+	} else {
+		lockID, fence = lockMode(path, mode, opts)
+	}
+
+	switch {
+	case lockID == deadlock:
+		metrics.contendedAs(stateName(mode), path)
+		replyFailure(w, r, errDeadlock)
+	case len(lockID) == 0 && nsFull(requestNamespace(r)):
+		replyFull(w, r, errQuota)
+	case len(lockID) == 0 && clientFull(opts.quotaClient()):
+		replyFull(w, r, errClientQuota)
+	case len(lockID) == 0:
+		metrics.contendedAs(stateName(mode), path)
+		replyRetry(w, r, path)
+	default:
+		metrics.acquiredAs(stateName(mode), path, time.Since(start))
+		replyGranted(w, r, lockID, fence)
+	}
+}
+
+// munlockHandler answers POST /munlock?key=PATH&lock-id=LOCKID, releasing
+// the lock LOCKID holds on PATH whatever its mode
+func munlockHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	lockID := query.Get("lock-id")
+	if !ok || len(lockID) == 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if !unlockMode(path, lockID) {
+		replyFailure(w, r, errNotHeld)
+		return
+	}
+	replySuccess(w, r)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// nsSep brackets the tenant in the keys of a namespace: key k of namespace t
+// is stored as "\x00t\x00k", so no two namespaces share a key. keys sent to
+// the flat routes, the default namespace "", may not contain it
+const nsSep = "\x00"
+
+// nsPattern is what a namespace name may look like
+var nsPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// namespaceQuota is how many lockIDs one namespace may hold at once, 0 for
+// no limit. the default namespace is never limited. it may change on a
+// config reload
+var namespaceQuota atomic.Int64
+
+// namespaces tracks what each named namespace holds and has been granted.
+// lock order is shard mutex before namespaces
+var namespaces = struct {
+	sync.Mutex
+	held    map[string]int
+	granted map[string]uint64
+}{held: map[string]int{}, granted: map[string]uint64{}}
+
+func scopeKey(ns, key string) string {
+	if len(ns) == 0 {
+		return key
+	}
+	return nsSep + ns + nsSep + key
+}
+
+// splitKey returns the namespace of a stored key and the key as its clients
+// know it
+func splitKey(stored string) (ns, key string) {
+	if !strings.HasPrefix(stored, nsSep) {
+		return "", stored
+	}
+	ns, key, _ = strings.Cut(stored[len(nsSep):], nsSep)
+	return ns, key
+}
+
+// clientKey is the key as the clients of its namespace know it
+func clientKey(stored string) string {
+	_, key := splitKey(stored)
+	return key
+}
+
+type namespaceKey struct{}
+
+// requestNamespace returns the namespace r was sent to, empty for the flat
+// routes
+func requestNamespace(r *http.Request) string {
+	ns, _ := r.Context().Value(namespaceKey{}).(string)
+	return ns
+}
+
+// namespaceRouter serves /v1/ns/NS/ROUTE with the handler of ROUTE and
+// namespace NS in the request context
+func namespaceRouter(routes map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns, route, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/ns/"), "/")
+		handler := routes["/"+route]
+		if !ok || handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !nsPattern.MatchString(ns) {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns)))
+	}
+}
+
+// keyParam returns the key= parameter of r stored under the request's
+// namespace, false if it is missing, not a valid key or new while the lock
+// table is full
+func keyParam(r *http.Request, query url.Values) (string, bool) {
+	if _, ok := query["key"]; !ok {
+		return "", false
+	}
+	path, ok := scopedParam(r, query.Get("key"))
+	return path, ok && roomFor(path)
+}
+
+// scopedParam stores a key or key prefix sent with r under the request's
+// namespace, false if it is not valid
+func scopedParam(r *http.Request, key string) (string, bool) {
+	if strings.Contains(key, nsSep) || !validKey(key) {
+		return "", false
+	}
+	return scopeKey(requestNamespace(r), key), true
+}
+
+// nsReserve counts one more lockID held under the namespace of key, it
+// returns false if the namespace is at its quota
+func nsReserve(key string) bool {
+	ns, _ := splitKey(key)
+	if len(ns) == 0 {
+		return true
+	}
+	namespaces.Lock()
+	defer namespaces.Unlock()
+
+	if quota := int(namespaceQuota.Load()); quota > 0 && namespaces.held[ns] >= quota {
+		return false
+	}
+	namespaces.held[ns]++
+	namespaces.granted[ns]++
+	return true
+}
+
+// nsRelease forgets a lockID held under the namespace of key
+func nsRelease(key string) {
+	ns, _ := splitKey(key)
+	if len(ns) == 0 {
+		return
+	}
+	namespaces.Lock()
+	defer namespaces.Unlock()
+
+	if namespaces.held[ns]--; namespaces.held[ns] <= 0 {
+		delete(namespaces.held, ns)
+	}
+}
+
+// nsRestore counts a replayed lockID, quotas do not apply to locks already
+// granted
+func nsRestore(key string) {
+	ns, _ := splitKey(key)
+	if len(ns) == 0 {
+		return
+	}
+	namespaces.Lock()
+	defer namespaces.Unlock()
+
+	namespaces.held[ns]++
+	// a replay grants nothing new, but /metrics lists the held locks of
+	// the namespaces in granted
+	if _, ok := namespaces.granted[ns]; !ok {
+		namespaces.granted[ns] = 0
+	}
+}
+
+// nsFull reports whether namespace ns holds as many locks as it may
+func nsFull(ns string) bool {
+	quota := int(namespaceQuota.Load())
+	if len(ns) == 0 || quota <= 0 {
+		return false
+	}
+	namespaces.Lock()
+	defer namespaces.Unlock()
+
+	return namespaces.held[ns] >= quota
+}
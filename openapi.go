@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// route is an endpoint: its path, the handler serving it and the
+// description /v1/openapi.json is generated from
+type route struct {
+	path    string
+	handler http.HandlerFunc
+	doc     routeDoc
+}
+
+// routeDoc describes an endpoint for the OpenAPI document
+type routeDoc struct {
+	methods []string
+	summary string
+	params  []apiParam
+	// zero values of the types of the JSON request and reply bodies, reply
+	// nil for a reply not described further
+	body, reply any
+	// served for the default namespace only, not under /v1/ns/NAMESPACE/
+	flat bool
+}
+
+// postDoc describes a POST endpoint answering with the usual reply body
+func postDoc(summary string, params ...apiParam) routeDoc {
+	return routeDoc{methods: []string{http.MethodPost}, summary: summary, params: params, reply: reply{}}
+}
+
+func getDoc(summary string, params ...apiParam) routeDoc {
+	return routeDoc{methods: []string{http.MethodGet}, summary: summary, params: params}
+}
+
+// replies sets the type of the JSON reply body
+func (doc routeDoc) replies(v any) routeDoc {
+	doc.reply = v
+	return doc
+}
+
+// apiParam is a query parameter, or with header set a request header
+type apiParam struct {
+	name, about string
+	// JSON schema type, "duration" for a Go duration such as 30s
+	kind     string
+	required bool
+	// may be given more than once
+	repeated bool
+	header   bool
+}
+
+func (p apiParam) need() apiParam {
+	p.required = true
+	return p
+}
+
+func (p apiParam) many() apiParam {
+	p.repeated = true
+	return p
+}
+
+var (
+	pKey         = apiParam{name: "key", about: "the lock key", kind: "string", required: true}
+	pLockID      = apiParam{name: "lock-id", about: "the lock id the key was granted with", kind: "string", required: true}
+	pTTL         = apiParam{name: "ttl", about: "lease after which the lock is released", kind: "duration"}
+	pWait        = apiParam{name: "wait", about: "block up to this long instead of answering retry", kind: "duration"}
+	pOwner       = apiParam{name: "owner", about: "name of the holder, for /unlock-all and listings", kind: "string"}
+	pSession     = apiParam{name: "session", about: "tie the lock to this session", kind: "string"}
+	pPriority    = apiParam{name: "priority", about: "queue ahead of waiters with a lower priority", kind: "integer"}
+	pIntent      = apiParam{name: "intent", about: "the intent id registered with /intent", kind: "string"}
+	pPurpose     = apiParam{name: "purpose", about: "why the lock is taken, shown in listings", kind: "string"}
+	pLabel       = apiParam{name: "label", about: "NAME=VALUE label shown in listings", kind: "string", repeated: true}
+	pTicket      = apiParam{name: "ticket", about: "an id /cancel can withdraw the blocked request by", kind: "string"}
+	pIdempotency = apiParam{name: "Idempotency-Key", about: "repeat the first reply to retries sending the same key", kind: "string", header: true}
+	pPrefix      = apiParam{name: "prefix", about: "only keys starting with this", kind: "string", repeated: true}
+	pMatch       = apiParam{name: "match", about: "only keys matching this glob", kind: "string", repeated: true}
+	pLimit       = apiParam{name: "limit", about: "at most this many entries", kind: "integer"}
+	pGroup       = apiParam{name: "group", about: "the election group", kind: "string", required: true}
+	pBarrier     = apiParam{name: "name", about: "the barrier", kind: "string", required: true}
+)
+
+var lockParams = []apiParam{pKey, pTTL, pWait, pOwner, pSession, pPriority, pIntent, pPurpose, pLabel, pTicket, pIdempotency}
+
+// schemaOf returns the JSON schema of the values of type t as
+// encoding/json writes them
+func schemaOf(t reflect.Type) map[string]any {
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		var required []string
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if len(name) == 0 {
+				name = field.Name
+			}
+			properties[name] = schemaOf(field.Type)
+			if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]any{"type": "object", "properties": properties}
+		if len(required) != 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]any{}
+}
+
+// operationID turns a route such as /session/create into sessionCreate,
+// prefixed with the method as in getLogLevel for routes taking several
+func (doc routeDoc) operationID(method, path string) string {
+	words := strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '-' })
+	if len(doc.methods) > 1 {
+		words = append([]string{strings.ToLower(method)}, words...)
+	}
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+func (doc routeDoc) operation(method, path string) map[string]any {
+	params := []any{}
+	for _, p := range doc.params {
+		schema := map[string]any{"type": p.kind}
+		if p.kind == "duration" {
+			schema = map[string]any{"type": "string", "example": "30s"}
+		}
+		if p.repeated {
+			schema = map[string]any{"type": "array", "items": schema}
+		}
+		in := "query"
+		if p.header {
+			in = "header"
+		}
+		params = append(params, map[string]any{"name": p.name, "in": in, "description": p.about, "required": p.required, "schema": schema})
+	}
+	replySchema := map[string]any{"type": "object"}
+	if doc.reply != nil {
+		replySchema = schemaOf(reflect.TypeOf(doc.reply))
+	}
+	op := map[string]any{
+		"operationId": doc.operationID(method, path),
+		"summary":     doc.summary,
+		"parameters":  params,
+		"responses": map[string]any{
+			"200": map[string]any{"description": "success", "content": map[string]any{
+				"text/plain":       map[string]any{"schema": map[string]any{"type": "string"}},
+				"application/json": map[string]any{"schema": replySchema},
+			}},
+			"default": map[string]any{"description": "retry or failure", "content": map[string]any{
+				"text/plain":       map[string]any{"schema": map[string]any{"type": "string"}},
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/reply"}},
+			}},
+		},
+	}
+	if doc.body != nil {
+		op["requestBody"] = map[string]any{"required": true, "content": map[string]any{
+			"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(doc.body))},
+		}}
+	}
+	return op
+}
+
+// openAPI builds the OpenAPI 3 document of routes. paths are relative to
+// the /v1 and /v1/ns/{namespace} servers, flat routes only have the first
+func openAPI(routes []route) map[string]any {
+	paths := map[string]any{}
+	for _, rt := range routes {
+		item := map[string]any{}
+		for _, method := range rt.doc.methods {
+			item[strings.ToLower(method)] = rt.doc.operation(method, rt.path)
+		}
+		if rt.doc.flat {
+			item["servers"] = []any{map[string]any{"url": "/v1"}}
+		}
+		paths[rt.path] = item
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "lockServer",
+			"version":     "1",
+			"description": "read write locks and the primitives built on them. every reply is plain text unless the request accepts application/json",
+		},
+		"servers": []any{
+			map[string]any{"url": "/v1", "description": "the default namespace"},
+			map[string]any{"url": "/v1/ns/{namespace}", "description": "a namespace with keys of its own",
+				"variables": map[string]any{"namespace": map[string]any{"default": "default"}}},
+		},
+		"security": []any{map[string]any{"bearer": []any{}}, map[string]any{}},
+		"components": map[string]any{
+			"securitySchemes": map[string]any{"bearer": map[string]any{"type": "http", "scheme": "bearer",
+				"description": "an api key or JWT, when the server requires one"}},
+			"schemas": map[string]any{"reply": schemaOf(reflect.TypeFor[reply]())},
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIHandler answers GET /v1/openapi.json with the OpenAPI document of
+// routes, for generating clients in other languages
+func openAPIHandler(routes []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, 0, openAPI(routes))
+	}
+}
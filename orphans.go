@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the orphan analyzer looks for locks a holder probably forgot before
+// something blocks on them: locks held far longer than the locks of their
+// key usually are, and locks whose holder has not been heard of for long,
+// neither renewing its lease, sending the heartbeats of its session nor
+// taking the lock again. /admin/orphans lists what it found and releases
+// the orphans an admin picks
+
+// how often the orphan analyzer looks at the locks held
+const orphanInterval = 30 * time.Second
+
+// a lock held for less is never long held, however short the others are
+const minOrphanHold = time.Minute
+
+// hold times a key needs before its own are the norm, fewer and the hold
+// times of every key are
+const minOrphanSamples = 20
+
+// reasons a lock is an orphan
+const (
+	orphanLongHeld = "long-held"
+	orphanSilent   = "silent"
+)
+
+// orphan is a lock the analyzer flagged
+type orphan struct {
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key"`
+	LockID    string    `json:"lockId"`
+	Mode      string    `json:"mode"`
+	Acquired  time.Time `json:"acquired"`
+	HeldMs    int64     `json:"heldMs"`
+	// the 99th percentile hold of the key, or of every key while it has
+	// few of its own
+	NormMs int64 `json:"normMs"`
+	// when the holder was last heard of, as the silence is measured
+	LastSeen  time.Time `json:"lastSeen"`
+	Reasons   []string  `json:"reasons"`
+	Principal string    `json:"principal,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Session   string    `json:"session,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+
+	path string
+}
+
+// orphanReport is the outcome of the last run of the analyzer
+type orphanReport struct {
+	Checked time.Time `json:"checked"`
+	Orphans []orphan  `json:"orphans"`
+}
+
+// orphans is the latest report, nil before the first run
+var orphans atomic.Pointer[orphanReport]
+
+// holdNorm is the 99th percentile hold of the locks on path, of every key
+// while path has fewer than minOrphanSamples, 0 while none was released
+func holdNorm(path string) time.Duration {
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+
+	h := metrics.keyHoldTimes[path]
+	if h == nil || h.count < minOrphanSamples {
+		h = newHistogram(holdBuckets)
+		for _, mode := range metrics.holdTimes {
+			h.merge(mode)
+		}
+	}
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.quantile(0.99) * float64(time.Second))
+}
+
+// findOrphans flags the locks held longer than factor times their norm,
+// factor 0 disabling it, and those whose holder was silent for silence, 0
+// disabling it
+func findOrphans(now time.Time, factor float64, silence time.Duration) []orphan {
+	var found []orphan
+	for _, s := range shards {
+		s.mu.Lock()
+		for path, counter := range s.locks {
+			for id, h := range counter.lockID {
+				ns, key := splitKey(path)
+				found = append(found, orphan{Namespace: ns, Key: key, LockID: id, Mode: stateName(h.mode),
+					Acquired: h.acquired.UTC(), HeldMs: now.Sub(h.acquired).Milliseconds(), LastSeen: h.lastSeen().UTC(),
+					Principal: h.principal, Owner: h.owner, Session: h.session, Addr: h.addr, path: path})
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	// the norms and heartbeats are looked up without the shard mutexes
+	flagged := []orphan{}
+	for _, o := range found {
+		held := time.Duration(o.HeldMs) * time.Millisecond
+		if factor > 0 && held >= minOrphanHold {
+			if norm := holdNorm(o.path); norm > 0 {
+				o.NormMs = norm.Milliseconds()
+				if held > time.Duration(factor*float64(norm)) {
+					o.Reasons = append(o.Reasons, orphanLongHeld)
+				}
+			}
+		}
+		if len(o.Session) != 0 {
+			if heard, ok := sessionHeard(o.Session); ok && heard.After(o.LastSeen) {
+				o.LastSeen = heard
+			}
+		}
+		if silence > 0 && now.Sub(o.LastSeen) > silence {
+			o.Reasons = append(o.Reasons, orphanSilent)
+		}
+		if len(o.Reasons) != 0 {
+			flagged = append(flagged, o)
+		}
+	}
+	sort.Slice(flagged, func(i, j int) bool { return flagged[i].HeldMs > flagged[j].HeldMs })
+	return flagged
+}
+
+// orphanLoop runs the analyzer every orphanInterval and logs each orphan
+// once when it is first flagged
+func orphanLoop(factor float64, silence time.Duration) {
+	ticker := time.NewTicker(orphanInterval)
+	defer ticker.Stop()
+	reported := map[string]bool{}
+	for now := range ticker.C {
+		if following() {
+			continue
+		}
+		found := findOrphans(now, factor, silence)
+		flagged := map[string]bool{}
+		for _, o := range found {
+			flagged[o.LockID] = true
+			if !reported[o.LockID] {
+				slog.Warn("lock looks orphaned", "namespace", o.Namespace, "key", o.Key, "lock_id", o.LockID,
+					"reasons", strings.Join(o.Reasons, ","), "held", time.Duration(o.HeldMs)*time.Millisecond,
+					"principal", o.Principal, "owner", o.Owner)
+			}
+		}
+		reported = flagged
+		orphans.Store(&orphanReport{Checked: now, Orphans: found})
+	}
+}
+
+// releaseLock releases lockID on path from under its holder as if
+// force-unlocked by by, it returns false if lockID does not hold path
+func releaseLock(path, lockID, by string) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.lockID[lockID] == nil {
+		return false
+	}
+	audit.record(eventForced, path, counter.lockID[lockID].mode, lockID, counter.lockID[lockID], by)
+	counter.release(lockID, eventForced)
+	return true
+}
+
+// orphansHandler answers GET /admin/orphans with the latest report of the
+// analyzer, a line per orphan, longest held first: "KEY LOCKID MODE
+// held=D reasons=REASON,..." followed by the namespace, the norm, the last
+// sign of its holder and who holds it. JSON clients get {"checked", "orphans": [...]}.
+// POST /admin/orphans?lock-id=ID force-releases the reported orphans named
+// by lock-id=, or all=true every one of them, answering "success N" with
+// the number released
+func orphansHandler(w http.ResponseWriter, r *http.Request) {
+	report := orphans.Load()
+	if report == nil {
+		report = &orphanReport{Orphans: []orphan{}}
+	}
+	if r.Method != http.MethodPost {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		if wantsJSON(r) {
+			writeJSON(w, 0, report)
+			return
+		}
+		for _, o := range report.Orphans {
+			fmt.Fprintf(w, "%s %s %s held=%s reasons=%s", strconv.Quote(o.Key), o.LockID, o.Mode,
+				time.Duration(o.HeldMs)*time.Millisecond, strings.Join(o.Reasons, ","))
+			if len(o.Namespace) != 0 {
+				fmt.Fprintf(w, " namespace=%s", o.Namespace)
+			}
+			if o.NormMs != 0 {
+				fmt.Fprintf(w, " norm=%s", time.Duration(o.NormMs)*time.Millisecond)
+			}
+			fmt.Fprintf(w, " last-seen=%s", o.LastSeen.Format(time.RFC3339Nano))
+			if len(o.Principal) != 0 {
+				fmt.Fprintf(w, " principal=%s", o.Principal)
+			}
+			if len(o.Session) != 0 {
+				fmt.Fprintf(w, " session=%s", o.Session)
+			}
+			if len(o.Owner) != 0 {
+				fmt.Fprintf(w, " owner=%s", strconv.Quote(o.Owner))
+			}
+			if len(o.Addr) != 0 {
+				fmt.Fprintf(w, " addr=%s", o.Addr)
+			}
+			fmt.Fprintf(w, "\n")
+		}
+		return
+	}
+	query := r.URL.Query()
+	ids := map[string]bool{}
+	for _, id := range query["lock-id"] {
+		ids[id] = true
+	}
+	all := query.Get("all") == "true"
+	if len(ids) == 0 == !all {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	released := 0
+	for _, o := range report.Orphans {
+		if (all || ids[o.LockID]) && releaseLock(o.path, o.LockID, callerName(r)) {
+			slog.Warn("orphan released", "namespace", o.Namespace, "key", o.Key, "lock_id", o.LockID, "caller", callerName(r))
+			released++
+		}
+	}
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Status   string `json:"status"`
+			Released int    `json:"released"`
+		}{"success", released})
+		return
+	}
+	fmt.Fprintf(w, "success %d\n", released)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// with -partition the keys are spread over the live cluster members by
+// consistent hashing: each member owns the stretches of a hash ring ending
+// at its points, a key belongs to the first point past its hash. a node
+// serves the requests for its own keys and forwards the others to their
+// owner, so a member joining or leaving only moves the keys next to its
+// points. a forwarded request is never forwarded again: a node that does
+// not own its key, because its ring has not caught up with the owner's,
+// refuses it with 421 and the client tries again
+
+// ringPoints is how many points each member has on the ring, more spread
+// the keys more evenly
+const ringPoints = 128
+
+// forwardedHeader names the node that forwarded a request to its owner
+const forwardedHeader = "Lockserver-Forwarded-By"
+
+var errNotOwner = failure{code: "not_owner", text: "key belongs to another node", status: http.StatusMisdirectedRequest}
+
+var errCrossPartition = failure{code: "cross_partition", text: "keys belong to different nodes", status: http.StatusBadRequest}
+
+var errUnavailable = failure{code: "unavailable", status: http.StatusServiceUnavailable}
+
+type ringPoint struct {
+	hash  uint64
+	owner *ringMember
+}
+
+// ringMember is a member owning points, proxy forwards to its api and is
+// nil for this node
+type ringMember struct {
+	name  string
+	api   string
+	proxy *httputil.ReverseProxy
+}
+
+// hashRing is the consistent hash ring of the live members, rebuilt
+// whenever they change
+type hashRing struct {
+	points []ringPoint
+}
+
+// ring is the current ring, nil or empty until membership is known
+var ring atomic.Pointer[hashRing]
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv mixes the last bytes poorly, keys and points differing there
+	// would crowd one stretch of the ring
+	sum := h.Sum64()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], sum)
+	h.Reset()
+	h.Write(b[:])
+	return h.Sum64() ^ sum
+}
+
+// newHashRing places ringPoints points for each member, keeping the
+// forwarding proxies of the members already on the old ring
+func newHashRing(members []member, old *hashRing) *hashRing {
+	known := map[ringMember]*ringMember{}
+	if old != nil {
+		for _, p := range old.points {
+			known[ringMember{name: p.owner.name, api: p.owner.api}] = p.owner
+		}
+	}
+	r := &hashRing{}
+	for _, m := range members {
+		owner := known[ringMember{name: m.Name, api: m.API}]
+		if owner == nil {
+			owner = &ringMember{name: m.Name, api: m.API}
+			if m.Name != cluster.self.Name {
+				if owner.proxy = newForwarder(m.API, "owner"); owner.proxy == nil {
+					// an api url that doesn't parse, its keys can't be reached
+					continue
+				}
+			}
+		}
+		for i := 0; i < ringPoints; i++ {
+			r.points = append(r.points, ringPoint{hash: ringHash(m.Name + "#" + strconv.Itoa(i)), owner: owner})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// newForwarder returns a proxy to the api at base, nil if it is not a url.
+// who names the node in the reply when it can't be reached
+func newForwarder(base, who string) *httputil.ReverseProxy {
+	target, err := url.Parse(base)
+	if err != nil || len(target.Host) == 0 {
+		return nil
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	// held streams and long polls reach the client as they are written
+	proxy.FlushInterval = -1
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		f := errUnavailable
+		f.text = who + " unreachable: " + err.Error()
+		replyFailure(w, r, f)
+	}
+	return proxy
+}
+
+// owner returns the member owning the stored key
+func (r *hashRing) owner(key string) *ringMember {
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].owner
+}
+
+// startPartitioning keeps the ring in step with the cluster membership
+func startPartitioning() {
+	cluster.onMembership(func(live []member) {
+		ring.Store(newHashRing(live, ring.Load()))
+	})
+}
+
+// requestKeys returns the keys r names as they are stored, as the acl
+// reads them: key= values, the election group or barrier name, and the
+// path of consul's kv api. ok is false for a route naming no key
+func requestKeys(r *http.Request) (keys []string, ok bool) {
+	route := aclRoute(r)
+	ns, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/ns/"), "/")
+	if !strings.HasPrefix(r.URL.Path, "/v1/ns/") {
+		ns = ""
+	}
+	query := r.URL.Query()
+	if key, isKV := strings.CutPrefix(route, "/v1/kv/"); isKV {
+		return []string{scopeKey(ns, key)}, true
+	}
+	if aclRoutes[route] == 0 {
+		return nil, false
+	}
+	for _, key := range query["key"] {
+		keys = append(keys, scopeKey(ns, key))
+	}
+	if group := query.Get("group"); len(group) != 0 {
+		keys = append(keys, scopeKey(ns, electPrefix+group))
+	}
+	if name := query.Get("name"); len(name) != 0 {
+		keys = append(keys, scopeKey(ns, name))
+	}
+	return keys, len(keys) != 0
+}
+
+// partitioned serves the requests for keys this node owns with handler and
+// forwards the others to their owner. requests naming no key, such as
+// listings, are served from this node's own keys
+func partitioned(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := ring.Load()
+		keys, ok := requestKeys(r)
+		if !ok || current == nil || len(current.points) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		owner := current.owner(keys[0])
+		for _, key := range keys[1:] {
+			if current.owner(key) != owner {
+				replyFailure(w, r, errCrossPartition)
+				return
+			}
+		}
+		switch {
+		case owner.proxy == nil:
+			handler.ServeHTTP(w, r)
+		case len(r.Header.Get(forwardedHeader)) != 0:
+			replyFailure(w, r, errNotOwner)
+		default:
+			r.Header.Set(forwardedHeader, cluster.self.Name)
+			owner.proxy.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the binary listener of -proto-listen takes and releases locks over
+// plain tcp for callers to whom an http request is too slow: each frame is
+// a protobuf message prefixed with its length as a varint, the delimited
+// form every protobuf library reads and writes. a client sends Request
+// messages and gets a Response with the same id for each, see
+// proto/lockserver.proto. requests are answered in order except for locks
+// that wait, which are answered once they are decided so the connection
+// can go on meanwhile. keys are those of the default namespace, so http
+// clients see the same locks. the tree has no protobuf library, the few
+// messages are encoded by hand
+
+// maxProtoFrame is the longest frame read, a longer one closes the
+// connection
+const maxProtoFrame = 64 << 10
+
+// the calls of a Request by field number
+const (
+	protoAuth    = 2
+	protoLock    = 3
+	protoRLock   = 4
+	protoUnlock  = 5
+	protoRUnlock = 6
+	protoRenew   = 7
+)
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoField is a field of a decoded message, v holds a varint and b the
+// bytes of a length delimited field
+type protoField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// protoDecode splits a message into its fields, false if it is malformed
+func protoDecode(b []byte) ([]protoField, bool) {
+	var fields []protoField
+	for len(b) != 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, false
+		}
+		b = b[n:]
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			if f.v, n = binary.Uvarint(b); n <= 0 {
+				return nil, false
+			}
+			b = b[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, false
+			}
+			f.b, b = b[n:n+int(size)], b[n+int(size):]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, false
+			}
+			b = b[8:]
+			continue
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, false
+			}
+			b = b[4:]
+			continue
+		default:
+			return nil, false
+		}
+		fields = append(fields, f)
+	}
+	return fields, true
+}
+
+// protoVarint appends field num with the varint v, nothing for 0 as proto3
+// leaves defaults out
+func protoVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoString appends field num with the string s, nothing if it is empty
+func protoString(b []byte, num int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// protoRequest is a decoded Request, the fields of its call flattened
+type protoRequest struct {
+	id   uint64
+	call int
+	// the key, or the api key of an AuthRequest
+	key       string
+	lockID    string
+	ttl, wait time.Duration
+}
+
+// decodeProtoRequest decodes a Request, false if it is malformed or makes
+// no call. the id is set whenever it could be read
+func decodeProtoRequest(frame []byte) (protoRequest, bool) {
+	var req protoRequest
+	fields, ok := protoDecode(frame)
+	if !ok {
+		return req, false
+	}
+	var call []byte
+	for _, f := range fields {
+		switch {
+		case f.num == 1:
+			req.id = f.v
+		case f.num >= protoAuth && f.num <= protoRenew:
+			// the last of a oneof wins
+			req.call, call = f.num, f.b
+		}
+	}
+	if req.call == 0 {
+		return req, false
+	}
+	return req, decodeProtoCall(&req, call)
+}
+
+// decodeProtoCall decodes the message of req.call into req, false if it is
+// malformed
+func decodeProtoCall(req *protoRequest, call []byte) bool {
+	fields, ok := protoDecode(call)
+	if !ok {
+		return false
+	}
+	for _, f := range fields {
+		switch {
+		case f.num == 1:
+			req.key = string(f.b)
+		case f.num == 2 && (req.call == protoLock || req.call == protoRLock):
+			req.ttl = time.Duration(int64(f.v)) * time.Millisecond
+		case f.num == 3 && (req.call == protoLock || req.call == protoRLock):
+			req.wait = time.Duration(int64(f.v)) * time.Millisecond
+		case f.num == 2:
+			req.lockID = string(f.b)
+		case f.num == 3 && req.call == protoRenew:
+			req.ttl = time.Duration(int64(f.v)) * time.Millisecond
+		}
+	}
+	return true
+}
+
+// protoResponse is a Response to encode
+type protoResponse struct {
+	id         uint64
+	ok         bool
+	lockID     string
+	fence      int64
+	retryAfter time.Duration
+	// the failure, its code empty on success and for a lock to retry
+	f failure
+}
+
+// frame encodes r with its length prefix
+func (r protoResponse) frame() []byte {
+	var b []byte
+	b = protoVarint(b, 1, r.id)
+	if r.ok {
+		b = protoVarint(b, 2, 1)
+	}
+	b = protoString(b, 3, r.lockID)
+	b = protoVarint(b, 4, uint64(r.fence))
+	b = protoVarint(b, 5, uint64(r.retryAfter.Milliseconds()))
+	b = protoString(b, 6, r.f.code)
+	b = protoString(b, 7, r.f.text)
+	return append(binary.AppendUvarint(nil, uint64(len(b))), b...)
+}
+
+// protoConn is one client connection
+type protoConn struct {
+	conn net.Conn
+	in   *bufio.Reader
+	// the address the client connects from, rate limited with its name
+	host string
+	// done once the connection is closed, ending the locks still waiting
+	ctx context.Context
+
+	mu  sync.Mutex
+	out *bufio.Writer
+
+	// the caller once it authenticated, callers are anonymous without
+	// -api-keys
+	principal principal
+	authed    bool
+}
+
+// listenProto listens on addr and answers binary protocol clients there
+func listenProto(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go serveProto(l)
+	return l, nil
+}
+
+// serveProto answers binary protocol clients on l until it is closed
+func serveProto(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("proto accept failed", "err", err)
+			}
+			return
+		}
+		go serveProtoConn(conn)
+	}
+}
+
+func serveProtoConn(conn net.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	var waiting sync.WaitGroup
+	defer waiting.Wait()
+	defer cancel()
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	c := &protoConn{conn: conn, in: bufio.NewReader(conn), out: bufio.NewWriter(conn), host: host, ctx: ctx}
+	for {
+		size, err := binary.ReadUvarint(c.in)
+		if err != nil || size > maxProtoFrame {
+			return
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.in, frame); err != nil {
+			return
+		}
+		req, ok := decodeProtoRequest(frame)
+		// pipelined requests are answered together
+		flush := c.in.Buffered() == 0
+		switch {
+		case !ok:
+			if !c.send(protoResponse{id: req.id, f: errBadRequest}, flush) {
+				return
+			}
+			continue
+		case req.call == protoAuth:
+			if !c.send(c.auth(req), flush) {
+				return
+			}
+			continue
+		case req.wait > 0:
+			waiting.Add(1)
+			go func(p principal, authed bool) {
+				defer waiting.Done()
+				c.send(c.call(req, p, authed), true)
+			}(c.principal, c.authed)
+			continue
+		}
+		if !c.send(c.call(req, c.principal, c.authed), flush) {
+			return
+		}
+	}
+}
+
+// send writes r and flushes if flush is set, false if the connection
+// failed
+func (c *protoConn) send(r protoResponse, flush bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.out.Write(r.frame())
+	if !flush {
+		return true
+	}
+	if writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	return c.out.Flush() == nil
+}
+
+// auth takes the api key of an AuthRequest for the connection
+func (c *protoConn) auth(req protoRequest) protoResponse {
+	a := currentAuth()
+	if a == nil {
+		return protoResponse{id: req.id, ok: true}
+	}
+	r := &http.Request{Header: http.Header{"X-Api-Key": {req.key}}, URL: &url.URL{}}
+	p, ok := a.authenticate(r)
+	if !ok {
+		return protoResponse{id: req.id, f: errUnauthorized}
+	}
+	c.principal, c.authed = p, true
+	return protoResponse{id: req.id, ok: true}
+}
+
+// call answers a request other than an AuthRequest on behalf of p, authed
+// if the connection authenticated as p. the waiting locks are answered
+// aside from the connection's loop, which may authenticate meanwhile
+func (c *protoConn) call(req protoRequest, p principal, authed bool) protoResponse {
+	resp := protoResponse{id: req.id}
+	if resp.f, resp.retryAfter = c.admit(req, p, authed); len(resp.f.code) != 0 {
+		return resp
+	}
+	switch req.call {
+	case protoLock, protoRLock:
+		c.lock(req, p, &resp)
+	case protoUnlock, protoRUnlock:
+		if len(req.lockID) == 0 {
+			resp.f = errBadRequest
+			break
+		}
+		readUnlock := req.call == protoRUnlock
+		if readUnlock {
+			resp.ok = store.runlock(req.key, req.lockID)
+		} else {
+			resp.ok = store.unlock(req.key, req.lockID)
+		}
+		if !resp.ok {
+			metrics.unlockFailed(readUnlock)
+			resp.f = errNotHeld
+		}
+	case protoRenew:
+		if len(req.lockID) == 0 || req.ttl <= 0 {
+			resp.f = errBadRequest
+			break
+		}
+		ttl, ok := leaseFor(req.ttl, req.key)
+		if !ok {
+			resp.f = errTTLTooLong
+			break
+		}
+		if resp.ok = store.renew(req.key, req.lockID, ttl); !resp.ok {
+			resp.f = errNotHeld
+		}
+	}
+	return resp
+}
+
+// admit checks p may make the call of req on its key, authed if the
+// connection authenticated as p, and counts a lock against the rate
+// limiter. it returns why the call is refused, and when to retry one
+// refused for its rate
+func (c *protoConn) admit(req protoRequest, p principal, authed bool) (failure, time.Duration) {
+	need := permRead
+	if req.call == protoLock || req.call == protoUnlock {
+		need = permWrite
+	}
+	if currentAuth() != nil && !authed {
+		return errUnauthorized, 0
+	}
+	if currentAuth() != nil && (p.perms&need == 0 || !p.mayUse("")) {
+		return errForbidden, 0
+	}
+	if strings.Contains(req.key, nsSep) || !validKey(req.key) {
+		return errBadRequest, 0
+	}
+	if currentAuth() != nil && (!keyAllowed(p, protoRights(req.call), req.key) ||
+		((req.call == protoUnlock || req.call == protoRUnlock) && !releaseAllowed(p, req.key, req.lockID))) {
+		return errForbidden, 0
+	}
+	if req.call == protoLock || req.call == protoRLock {
+		if wait, ok := allow(rateKey(p.name, c.host), time.Now()); !ok {
+			return errRateLimited, wait
+		}
+	}
+	return failure{}, 0
+}
+
+// protoRights are the rights the http route of a call takes on its key
+func protoRights(call int) aclRight {
+	switch call {
+	case protoLock, protoUnlock:
+		return aclWrite
+	case protoRLock, protoRUnlock:
+		return aclRead
+	}
+	return aclRead | aclWrite
+}
+
+// lock answers a LockRequest the way /lock and /rlock do
+func (c *protoConn) lock(req protoRequest, p principal, resp *protoResponse) {
+	readLock := req.call == protoRLock
+	if !roomFor(req.key) || req.ttl < 0 || req.wait < 0 {
+		resp.f = errBadRequest
+		return
+	}
+	if closedForLocks() {
+		resp.f = closedFailure()
+		return
+	}
+	ttl, ok := leaseFor(req.ttl, req.key)
+	if !ok {
+		resp.f = errTTLTooLong
+		return
+	}
+	opts := lockOptions{ttl: ttl, principal: p.name, addr: c.host}
+	var lockID string
+	var fence int64
+	start := time.Now()
+	if req.wait > 0 {
+		lockID, fence = store.waitLock(c.ctx, req.key, readLock, opts, req.wait)
+	} else if readLock {
+		lockID = store.rlock(req.key, opts)
+	} else {
+		lockID, fence = store.lock(req.key, opts)
+	}
+	switch {
+	case lockID == deadlock:
+		metrics.contended(readLock, req.key)
+		resp.f = errDeadlock
+	case len(lockID) == 0 && nsFull(""):
+		resp.f = errQuota
+	case len(lockID) == 0 && clientFull(opts.quotaClient()):
+		resp.f = errClientQuota
+	case len(lockID) == 0:
+		metrics.contended(readLock, req.key)
+		resp.retryAfter = retryHint(req.key)
+	default:
+		metrics.acquired(readLock, req.key, time.Since(start))
+		resp.ok, resp.lockID, resp.fence = true, lockID, fence
+	}
+}
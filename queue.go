@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// fair stops requests that don't wait from taking a lock while blocking
+// requests are queued on the key, so the queue decides who gets it next.
+// it may change on a config reload
+var fair atomic.Bool
+
+// priorityAging is how long, in nanoseconds, a queued request waits to gain
+// one priority level so low priority requests are not starved forever. 0
+// disables aging, it may change on a config reload
+var priorityAging atomic.Int64
+
+// reader/writer policies, they decide whether readers may join a read lock
+// while writers are queued on the key
+const (
+	// readers join while any reader holds the key, queued writers wait for
+	// a moment without readers
+	policyRead int32 = iota
+	// no reader is admitted while a writer is queued
+	policyWrite
+	// phase-fair: no reader is admitted while a writer is queued, except
+	// that the readers queued when a write lock is released all go before
+	// the next writer, so reads and writes take turns
+	policyPhase
+)
+
+// rwPolicy is the reader/writer policy of every key, it may change on a
+// config reload
+var rwPolicy atomic.Int32
+
+// parseRWPolicy parses the value of -rw-policy
+func parseRWPolicy(name string) (int32, error) {
+	switch name {
+	case "read":
+		return policyRead, nil
+	case "write":
+		return policyWrite, nil
+	case "phase-fair":
+		return policyPhase, nil
+	}
+	return 0, fmt.Errorf("-rw-policy must be read, write or phase-fair, not %q", name)
+}
+
+// ticket is a blocking lock request queued on a key
+type ticket struct {
+	// the state asked for, 1 for a write lock and 2 for a read lock
+	mode     int
+	priority int
+	arrived  time.Time
+	// a reader queued when the write lock was released under the
+	// phase-fair policy, it goes before the queued writers
+	phased bool
+	// the write intent the ticket is or acts for, empty if none
+	intent string
+	// when the intent runs out, set on the ticket registering it only
+	expires time.Time
+	// who is waiting, as /queue lists them
+	principal, owner, addr string
+}
+
+// effective is t's priority raised by how long it has been queued
+func (t *ticket) effective(now time.Time) int {
+	aging := time.Duration(priorityAging.Load())
+	if aging <= 0 {
+		return t.priority
+	}
+	return t.priority + int(now.Sub(t.arrived)/aging)
+}
+
+// ahead reports whether q is served before t, higher effective priority
+// first and then arrival order
+func (q *ticket) ahead(t *ticket, now time.Time) bool {
+	qp, tp := q.effective(now), t.effective(now)
+	if qp != tp {
+		return qp > tp
+	}
+	return q.arrived.Before(t.arrived)
+}
+
+// admit reports whether a request holding t for a lock in mode may try to
+// take it, t is nil for a request that is not queued which only has to
+// defer to the queue in fair mode. readers that are only queued behind
+// other readers may go together, as may requests in any compatible
+// modes. unless the policy is policyRead readers, and requests in every
+// mode but write, also give way to every queued writer, and writers only
+// to the writers ahead of them and to phased readers. a live write intent
+// holds off every request but those queued ahead of it and its own.
+// caller must hold the shard mutex
+func (counter *lockCounter) admit(t *ticket, mode int) bool {
+	policy := rwPolicy.Load()
+	readLock := mode != 1
+	now := time.Now()
+	for _, queued := range counter.queue {
+		if queued == t {
+			continue
+		}
+		if !queued.expires.IsZero() {
+			own := t != nil && queued.intent == t.intent
+			if now.Before(queued.expires) && !own && (t == nil || queued.ahead(t, now)) {
+				return false
+			}
+			continue
+		}
+		if policy != policyRead && readLock != (queued.mode != 1) {
+			// a reader and a writer, the writer goes first unless the
+			// reader is phased
+			if readLock && (t == nil || !t.phased) {
+				return false
+			}
+			if !readLock && queued.phased {
+				return false
+			}
+			continue
+		}
+		if (t == nil && !fair.Load()) || (t != nil && !queued.ahead(t, now)) {
+			continue
+		}
+		if !compatible[mode][queued.mode] {
+			return false
+		}
+	}
+	return true
+}
+
+// phase hands the turn to the readers queued when the write lock on counter
+// is released under the phase-fair policy. caller must hold the shard mutex
+func (counter *lockCounter) phase() {
+	if rwPolicy.Load() != policyPhase {
+		return
+	}
+	for _, queued := range counter.queue {
+		if queued.mode != 1 {
+			queued.phased = true
+		}
+	}
+}
+
+// enqueue queues a ticket for a blocking request. caller must hold the
+// shard mutex
+func (counter *lockCounter) enqueue(mode int, priority int) *ticket {
+	t := &ticket{mode: mode, priority: priority, arrived: time.Now()}
+	counter.queue = append(counter.queue, t)
+	return t
+}
+
+// dequeue removes t, served or given up, and wakes the waiters so whoever is
+// now first can try. a nil t is not queued. caller must hold the shard mutex
+func (counter *lockCounter) dequeue(t *ticket) {
+	for i, queued := range counter.queue {
+		if queued == t {
+			counter.queue = append(counter.queue[:i], counter.queue[i+1:]...)
+			counter.wakeup()
+			return
+		}
+	}
+}
+
+// intentTicket returns a ticket acting for the live write intent id on
+// counter, queued where the intent is, nil if there is no such intent.
+// caller must hold the shard mutex
+func (counter *lockCounter) intentTicket(id string) *ticket {
+	if len(id) == 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, queued := range counter.queue {
+		if queued.intent == id && !queued.expires.IsZero() && now.Before(queued.expires) {
+			return &ticket{mode: 1, priority: queued.priority, arrived: queued.arrived, intent: id}
+		}
+	}
+	return nil
+}
+
+// dropIntent removes the write intent id, used or cancelled, and returns
+// whether it was queued. caller must hold the shard mutex
+func (counter *lockCounter) dropIntent(id string) bool {
+	for _, queued := range counter.queue {
+		if queued.intent == id && !queued.expires.IsZero() {
+			counter.dequeue(queued)
+			return true
+		}
+	}
+	return false
+}
+
+// expireIntents drops the write intents of counter that ran out. caller
+// must hold the shard mutex
+func (counter *lockCounter) expireIntents(now time.Time) {
+	for i := 0; i < len(counter.queue); i++ {
+		if queued := counter.queue[i]; !queued.expires.IsZero() && !now.Before(queued.expires) {
+			counter.dequeue(queued)
+			i--
+		}
+	}
+}
+
+// queuedRequest is a request queued on a key as /queue lists it
+type queuedRequest struct {
+	// 1 for the request served next
+	Position int `json:"position"`
+	// the mode asked for, or intent for a write intent
+	Mode      string    `json:"mode"`
+	Priority  int       `json:"priority,omitempty"`
+	Queued    time.Time `json:"queued"`
+	WaitedMs  int64     `json:"waitedMs"`
+	Principal string    `json:"principal,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	// how long until the request is likely served, as a Retry-After hint
+	// would tell it before any jitter
+	EstimatedWaitMs int64 `json:"estimatedWaitMs"`
+}
+
+// queueOf lists the requests queued on path in the order they are to be
+// served, by effective priority and then arrival
+func queueOf(path string, now time.Time) []queuedRequest {
+	s := shardFor(path)
+	s.mu.Lock()
+	var queue []*ticket
+	if counter := s.locks[path]; counter != nil {
+		queue = append(queue, counter.queue...)
+	}
+	sort.SliceStable(queue, func(i, j int) bool { return queue[i].ahead(queue[j], now) })
+	queued := make([]queuedRequest, len(queue))
+	for i, t := range queue {
+		queued[i] = queuedRequest{Position: i + 1, Mode: stateName(t.mode), Priority: t.effective(now),
+			Queued: t.arrived, WaitedMs: now.Sub(t.arrived).Milliseconds(),
+			Principal: t.principal, Owner: t.owner, Addr: t.addr}
+		if !t.expires.IsZero() {
+			queued[i].Mode = "intent"
+		}
+	}
+	s.mu.Unlock()
+
+	// the holder's lease and the typical hold are looked up without the
+	// shard mutex
+	remaining, typical, _ := holdLeft(path, now)
+	for i := range queued {
+		queued[i].EstimatedWaitMs = (remaining + time.Duration(i)*typical).Milliseconds()
+	}
+	return queued
+}
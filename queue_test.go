@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests are queued on key
+func waitQueued(t *testing.T, key string, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); len(queueOf(key, time.Now())) != n; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued on %s, want %d", len(queueOf(key, time.Now())), key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// grant is the outcome of a blocking request made in the background
+type grant struct {
+	owner, id string
+}
+
+// waitInBackground makes a blocking write lock request on key with opts,
+// waiting up to five seconds, and sends its outcome to granted
+func waitInBackground(key string, opts lockOptions, granted chan<- grant) {
+	go func() {
+		id, _ := store.waitLock(context.Background(), key, false, opts, 5*time.Second)
+		granted <- grant{opts.owner, id}
+	}()
+}
+
+func TestQueueOrder(t *testing.T) {
+	const key = "queue/x"
+	t.Cleanup(func() { forceUnlock(key, "test") })
+	held, _ := store.lock(key, lockOptions{})
+	granted := make(chan grant, 2)
+	for i, owner := range []string{"first", "second"} {
+		waitInBackground(key, lockOptions{owner: owner}, granted)
+		waitQueued(t, key, i+1)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/queue?key="+key, nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	queueHandler(w, r)
+	var q keyQueue
+	if err := json.NewDecoder(w.Body).Decode(&q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Queue) != 2 || q.Queue[0].Owner != "first" || q.Queue[0].Position != 1 ||
+		q.Queue[1].Owner != "second" || q.Queue[1].Position != 2 || q.Queue[0].Mode != "write" {
+		t.Fatalf("/queue answered %+v", q.Queue)
+	}
+
+	store.unlock(key, held)
+	for _, want := range []string{"first", "second"} {
+		got := <-granted
+		if got.owner != want || len(got.id) == 0 {
+			t.Fatalf("granted %+v, want %s", got, want)
+		}
+		if want == "first" {
+			waitQueued(t, key, 1)
+		}
+		store.unlock(key, got.id)
+	}
+	if queue := queueOf(key, time.Now()); len(queue) != 0 {
+		t.Errorf("queue left behind: %+v", queue)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	const key = "queue/p"
+	t.Cleanup(func() { forceUnlock(key, "test") })
+	held, _ := store.lock(key, lockOptions{})
+	granted := make(chan grant, 2)
+	waitInBackground(key, lockOptions{owner: "low"}, granted)
+	waitQueued(t, key, 1)
+	waitInBackground(key, lockOptions{owner: "high", priority: 5}, granted)
+	waitQueued(t, key, 2)
+	if queue := queueOf(key, time.Now()); queue[0].Owner != "high" {
+		t.Errorf("position 1 is %s, want the higher priority request", queue[0].Owner)
+	}
+	store.unlock(key, held)
+	if got := <-granted; got.owner != "high" {
+		t.Errorf("%s was served first, want high", got.owner)
+	} else {
+		store.unlock(key, got.id)
+	}
+	if got := <-granted; len(got.id) != 0 {
+		store.unlock(key, got.id)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// clientQuota is how many lockIDs one client may hold at once, 0 for no
+// limit. it may change on a config reload
+var clientQuota atomic.Int64
+
+// clients counts the lockIDs each client holds. lock order is shard mutex
+// before clients
+var clients = struct {
+	sync.Mutex
+	held map[string]int
+}{held: map[string]int{}}
+
+// quotaClient is who a lock counts against: the api key name, else the
+// address it was requested from. the owner is picked by the caller and
+// isn't looked at, so naming new owners never buys more locks. empty
+// escapes the quota
+func quotaClient(principal, addr string) string {
+	switch {
+	case len(principal) != 0:
+		return "key:" + principal
+	case len(addr) != 0:
+		return "ip:" + addr
+	}
+	return ""
+}
+
+func (opts lockOptions) quotaClient() string {
+	return quotaClient(opts.principal, opts.addr)
+}
+
+func (h *holder) quotaClient() string {
+	return quotaClient(h.principal, h.addr)
+}
+
+// clientReserve counts one more lockID held by client, it returns false if
+// the client is at its quota
+func clientReserve(client string) bool {
+	if len(client) == 0 {
+		return true
+	}
+	clients.Lock()
+	defer clients.Unlock()
+
+	if quota := int(clientQuota.Load()); quota > 0 && clients.held[client] >= quota {
+		return false
+	}
+	clients.held[client]++
+	return true
+}
+
+// clientRelease forgets a lockID held by client
+func clientRelease(client string) {
+	if len(client) == 0 {
+		return
+	}
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.held[client]--; clients.held[client] <= 0 {
+		delete(clients.held, client)
+	}
+}
+
+// clientRestore counts a replayed lockID, quotas do not apply to locks
+// already granted
+func clientRestore(client string) {
+	if len(client) == 0 {
+		return
+	}
+	clients.Lock()
+	defer clients.Unlock()
+
+	clients.held[client]++
+}
+
+// clientFull reports whether client holds as many locks as it may
+func clientFull(client string) bool {
+	quota := int(clientQuota.Load())
+	if len(client) == 0 || quota <= 0 {
+		return false
+	}
+	clients.Lock()
+	defer clients.Unlock()
+
+	return clients.held[client] >= quota
+}
+
+// reserve counts a new lockID on key against the quotas of its namespace
+// and of client, it returns false if either is full
+func reserve(key, client string) bool {
+	if !nsReserve(key) {
+		return false
+	}
+	if !clientReserve(client) {
+		nsRelease(key)
+		return false
+	}
+	return true
+}
+
+// unreserve gives back what reserve took
+func unreserve(key, client string) {
+	nsRelease(key)
+	clientRelease(client)
+}
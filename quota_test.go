@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestClientQuotaIgnoresOwner(t *testing.T) {
+	clientQuota.Store(1)
+	t.Cleanup(func() {
+		clientQuota.Store(0)
+		forceUnlock("quota/a", "test")
+		forceUnlock("quota/b", "test")
+		forceUnlock("quota/c", "test")
+	})
+	if id, _ := store.lock("quota/a", lockOptions{principal: "tokA", owner: "one", addr: "10.0.0.1"}); len(id) == 0 {
+		t.Fatal("first lock of tokA refused")
+	}
+	if id, _ := store.lock("quota/b", lockOptions{principal: "tokA", owner: "two", addr: "10.0.0.1"}); len(id) != 0 {
+		t.Error("tokA got past its quota by naming another owner")
+	}
+	if id, _ := store.lock("quota/c", lockOptions{principal: "tokB", owner: "one", addr: "10.0.0.1"}); len(id) == 0 {
+		t.Error("tokB was refused for the locks of tokA at the same address")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bucket is the token bucket of one client
+type bucket struct {
+	tokens float64
+	// when tokens was last topped up
+	updated time.Time
+}
+
+// limiter hands out lock attempts per client at rate a second with bursts
+// of up to burst, a rate of 0 lets everything through. a config reload may
+// change both
+var limiter = struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}{buckets: map[string]*bucket{}}
+
+func setRateLimit(rate float64, burst int) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.rate = rate
+	limiter.burst = float64(max(burst, 1))
+}
+
+// refill tops b up to now. caller must hold the limiter mutex
+func (b *bucket) refill(now time.Time) {
+	b.tokens = min(limiter.burst, b.tokens+now.Sub(b.updated).Seconds()*limiter.rate)
+	b.updated = now
+}
+
+// allow takes a token from client's bucket, if it is empty it returns how
+// long until the next one
+func allow(client string, now time.Time) (time.Duration, bool) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	if limiter.rate <= 0 {
+		return 0, true
+	}
+	b := limiter.buckets[client]
+	if b == nil {
+		b = &bucket{tokens: limiter.burst, updated: now}
+		limiter.buckets[client] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / limiter.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// pruneBuckets forgets the clients whose bucket has filled up again, they
+// start over with a full one anyway
+func pruneBuckets(now time.Time) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	for client, b := range limiter.buckets {
+		if b.refill(now); b.tokens >= limiter.burst {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+// rateClient is who r counts against: the api key's name, or the client
+// address if auth is disabled or the key has no name
+func rateClient(r *http.Request) string {
+	return rateKey(callerName(r), remoteHost(r))
+}
+
+// rateKey is who a caller named name, empty without auth, at host counts
+// against, whatever listener it came in on
+func rateKey(name, host string) string {
+	if len(name) != 0 {
+		return "key:" + name
+	}
+	return "ip:" + host
+}
+
+// remoteHost is the address r came from without its port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit refuses lock attempts past the client's rate with 429 and a
+// Retry-After of the whole seconds until it may try again
+func rateLimit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := allow(rateClient(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			replyFailure(w, r, errRateLimited)
+			return
+		}
+		handler(w, r)
+	}
+}
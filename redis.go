@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient speaks just enough RESP to run commands and scripts on one
+// redis server, keeping a few idle connections around
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply, the connection it came from is still good
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisClient parses a host:port or redis://[:PASSWORD@]HOST:PORT[/DB]
+// address
+func newRedisClient(addr string) (*redisClient, error) {
+	c := &redisClient{addr: addr, timeout: 5 * time.Second, idle: make(chan *redisConn, 16)}
+	if !strings.Contains(addr, "://") {
+		return c, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Scheme != "redis" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("bad redis address %q", addr)
+	}
+	c.addr = u.Host
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+		if len(c.password) == 0 {
+			c.password = u.User.Username()
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) != 0 {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("bad redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if len(c.password) != 0 {
+		if _, err := rc.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do runs one command and returns its reply: a string, an int64, nil, a
+// []any or a redisError as the error
+func (c *redisClient) do(args ...string) (any, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.idle:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := rc.do(c.timeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+func (rc *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	rc.conn.SetDeadline(time.Now().Add(timeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = replyErr
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", line)
+}
+
+// the scripts see the time of the redis server, so frontends with skewed
+// clocks agree on when a lease runs out
+const redisNow = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// redisKeepReaders makes the reader set expire with its longest lease
+const redisKeepReaders = `
+local last = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')[2]
+if last == 'inf' then
+	redis.call('PERSIST', KEYS[2])
+elseif last then
+	redis.call('PEXPIREAT', KEYS[2], last)
+end
+`
+
+// KEYS: write lock, readers, fence counter. ARGV: lock id, ttl in ms
+const redisLockScript = redisNow + `
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('ZCARD', KEYS[2]) > 0 then
+	return false
+end
+local fence = redis.call('INCR', KEYS[3])
+if tonumber(ARGV[2]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1] .. ' ' .. fence, 'NX', 'PX', ARGV[2])
+else
+	redis.call('SET', KEYS[1], ARGV[1] .. ' ' .. fence, 'NX')
+end
+return fence
+`
+
+// KEYS: write lock, readers. ARGV: lock id, ttl in ms
+const redisRLockScript = redisNow + `
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return false
+end
+local expiry = '+inf'
+if tonumber(ARGV[2]) > 0 then
+	expiry = now + tonumber(ARGV[2])
+end
+redis.call('ZADD', KEYS[2], expiry, ARGV[1])
+` + redisKeepReaders + `
+return 1
+`
+
+// KEYS: write lock. ARGV: lock id
+const redisUnlockScript = `
+local v = redis.call('GET', KEYS[1])
+if v and string.match(v, '^%S+') == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// KEYS: write lock, readers. ARGV: lock id
+const redisRUnlockScript = redisNow + `
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+return redis.call('ZREM', KEYS[2], ARGV[1])
+`
+
+// KEYS: write lock, readers. ARGV: lock id, ttl in ms
+const redisRenewScript = redisNow + `
+local v = redis.call('GET', KEYS[1])
+if v and string.match(v, '^%S+') == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if not redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[2], 'XX', now + tonumber(ARGV[2]), ARGV[1])
+` + redisKeepReaders + `
+return 1
+`
+
+// redisBackend keeps lock state in redis so several lock servers can
+// share it. a write lock is a key set with NX and a PX lease holding
+// "LOCKID FENCE", the readers of a key are a sorted set of lock ids scored
+// by lease deadline. every check and update of a key runs as one script so
+// the frontends never race. fencing tokens count up per key
+type redisBackend struct {
+	client *redisClient
+	// prepended to every redis key
+	prefix string
+
+	mu sync.Mutex
+	// the error of the latest command, nil once one succeeds again
+	err error
+}
+
+// keys returns the redis keys of path: write lock, readers and fence
+// counter. the hash tag keeps them in one slot of a redis cluster
+func (b *redisBackend) keys(path string) (string, string, string) {
+	base := b.prefix + "{" + path + "}"
+	return base + ":w", base + ":r", base + ":fence"
+}
+
+// eval runs script with keys and args
+func (b *redisBackend) eval(script string, keys []string, args ...string) (any, bool) {
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return b.do(append(cmd, args...)...)
+}
+
+// do runs a command, false if redis could not be reached or failed it
+func (b *redisBackend) do(args ...string) (any, bool) {
+	reply, err := b.client.do(args...)
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+	if err != nil {
+		slog.Error("redis command failed", "err", err)
+		return nil, false
+	}
+	return reply, true
+}
+
+// failing returns the error of the latest command, nil if it succeeded
+func (b *redisBackend) failing() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+func ttlMillis(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "0"
+	}
+	return strconv.FormatInt(max(ttl.Milliseconds(), 1), 10)
+}
+
+func (b *redisBackend) lock(path string, opts lockOptions) (string, int64) {
+	w, readers, fence := b.keys(path)
+	id := newID()
+	reply, ok := b.eval(redisLockScript, []string{w, readers, fence}, id, ttlMillis(opts.ttl))
+	if token, isInt := reply.(int64); ok && isInt {
+		return id, token
+	}
+	return "", 0
+}
+
+func (b *redisBackend) rlock(path string, opts lockOptions) string {
+	w, readers, _ := b.keys(path)
+	id := newID()
+	reply, ok := b.eval(redisRLockScript, []string{w, readers}, id, ttlMillis(opts.ttl))
+	if n, isInt := reply.(int64); ok && isInt && n == 1 {
+		return id
+	}
+	return ""
+}
+
+// waitLock polls redis with backoff, there is no queue to park on
+func (b *redisBackend) waitLock(ctx context.Context, path string, readLock bool, opts lockOptions, wait time.Duration) (string, int64) {
+	deadline := time.Now().Add(wait)
+	backoff := 10 * time.Millisecond
+	for {
+		var id string
+		var fence int64
+		if readLock {
+			id = b.rlock(path, opts)
+		} else {
+			id, fence = b.lock(path, opts)
+		}
+		if len(id) != 0 {
+			return id, fence
+		}
+		left := time.Until(deadline)
+		if left <= 0 || closedForLocks() || !sleepCtx(ctx, min(backoff, left)) {
+			return "", 0
+		}
+		backoff = min(2*backoff, 250*time.Millisecond)
+	}
+}
+
+func (b *redisBackend) unlock(path string, lockID string) bool {
+	w, _, _ := b.keys(path)
+	reply, ok := b.eval(redisUnlockScript, []string{w}, lockID)
+	n, _ := reply.(int64)
+	return ok && n == 1
+}
+
+func (b *redisBackend) runlock(path string, lockID string) bool {
+	w, readers, _ := b.keys(path)
+	reply, ok := b.eval(redisRUnlockScript, []string{w, readers}, lockID)
+	n, _ := reply.(int64)
+	return ok && n == 1
+}
+
+func (b *redisBackend) renew(path string, lockID string, ttl time.Duration) bool {
+	w, readers, _ := b.keys(path)
+	reply, ok := b.eval(redisRenewScript, []string{w, readers}, lockID, ttlMillis(ttl))
+	n, _ := reply.(int64)
+	return ok && n == 1
+}
+
+func (b *redisBackend) validateFence(path string, token int64) bool {
+	w, _, _ := b.keys(path)
+	reply, _ := b.do("GET", w)
+	v, _ := reply.(string)
+	_, fence, ok := strings.Cut(v, " ")
+	return ok && fence == strconv.FormatInt(token, 10)
+}
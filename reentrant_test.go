@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReentrantPerKey(t *testing.T) {
+	const key = "reent/x"
+	setAuth(&apiKeys{keys: map[[sha256.Size]byte]principal{
+		sha256.Sum256([]byte("tokenA")): {name: "tokA", perms: permFull},
+		sha256.Sum256([]byte("tokenB")): {name: "tokB", perms: permFull},
+	}})
+	t.Cleanup(func() {
+		setAuth(nil)
+		forceUnlock(key, "test")
+	})
+	lockAs := func(token string) (int, string) {
+		r := httptest.NewRequest(http.MethodPost, "/lock?key="+key+"&owner=worker", nil)
+		r.Header.Set("X-Api-Key", token)
+		w := httptest.NewRecorder()
+		requirePerm(permWrite, lockHandler)(w, r)
+		return w.Code, w.Body.String()
+	}
+	code, first := lockAs("tokenA")
+	if code != http.StatusOK {
+		t.Fatalf("lock with tokenA: %d %s", code, first)
+	}
+	if code, again := lockAs("tokenA"); code != http.StatusOK || again != first {
+		t.Errorf("owner worker relocking with tokenA: %d %q, want %q back", code, again, first)
+	}
+	if code, body := lockAs("tokenB"); code != http.StatusConflict {
+		t.Errorf("owner worker locking with tokenB: %d %s, want %d", code, body, http.StatusConflict)
+	}
+	if l, _, _ := lockStatus(key); len(l.ids) != 1 {
+		t.Errorf("%s held by %v, want one lock id", key, l.ids)
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a node started with -follow is a read-only replica of the leader at its
+// url: it streams the leader's lock table from /admin/replicate, a
+// snapshot followed by every record the leader logs, and answers /status,
+// /locks and /stats/holdtimes from its copy so dashboards and pollers stay
+// off the leader. every other lock api request is forwarded to the leader,
+// which stays the only node granting, releasing and expiring locks. a
+// replica that loses the stream or falls behind starts over from a fresh
+// snapshot
+
+// the stream is the wal format with two records of its own: "synced" ends
+// the snapshot and "ping" keeps an idle stream from looking dead
+const (
+	replicaSynced = "synced"
+	replicaPing   = "ping"
+)
+
+// how many records a replica may have waiting before it is dropped and
+// has to resync
+const replicaBuffer = 4096
+
+// how often the leader pings an idle stream, a replica hearing nothing
+// for replicaTimeout reconnects
+const (
+	replicaHeartbeat = time.Second
+	replicaTimeout   = 5 * replicaHeartbeat
+)
+
+// how long a replica waits before reconnecting to the leader
+const replicaRetry = time.Second
+
+// replicaRoutes are the lock api routes a replica answers itself
+var replicaRoutes = map[string]bool{
+	"/status": true, "/status/bulk": true, "/locks": true, "/stats/holdtimes": true, "/admin/state": true,
+}
+
+// leaderHeader names the leader's base url in every answer of a follower
+// or a deposed leader, clients send their requests there directly
+const leaderHeader = "Lockserver-Leader"
+
+var errFollower = failure{code: "follower", text: "this node replicates another, stream from the leader", status: http.StatusConflict}
+
+// replicas are the streams of the followers of this node. lock order is
+// shard mutex and sessions before replicas
+var replicas = struct {
+	sync.Mutex
+	m map[chan walRecord]bool
+}{m: map[chan walRecord]bool{}}
+
+// leaderLink is the leader a follower replicates and forwards to
+type leaderLink struct {
+	url, admin string
+	// forward to the leader's api and its admin api
+	api, adminAPI *httputil.ReverseProxy
+	// a deposed leader keeps no replica and forwards its reads as well,
+	// see failover.go
+	deposed bool
+	// held while a record of the stream is applied, so a standby taking
+	// over stops the stream between two records
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// newLeaderLink returns the link to the leader at url with its admin api
+// at admin, nil if either is not a url
+func newLeaderLink(url, admin string, deposed bool) *leaderLink {
+	link := &leaderLink{url: url, admin: admin, api: newForwarder(url, "leader"), adminAPI: newForwarder(admin, "leader"),
+		deposed: deposed}
+	if link.api == nil || link.adminAPI == nil {
+		return nil
+	}
+	link.ctx, link.cancel = context.WithCancel(context.Background())
+	return link
+}
+
+// upstream is the leader of this node, nil while it leads. it is set with
+// -follow before any request is served
+var upstream atomic.Pointer[leaderLink]
+
+// following tells whether this node defers to a leader, it grants and
+// expires no locks of its own meanwhile
+func following() bool {
+	return upstream.Load() != nil
+}
+
+// replicaToken is the leader's admin api key a follower streams with,
+// empty for none
+var replicaToken string
+
+// synced is whether a follower holds the leader's table, false while it
+// connects and reads the snapshot
+var synced atomic.Bool
+
+// heard is when a synced follower last heard from its leader in unix
+// nanoseconds, 0 if it never synced
+var heard atomic.Int64
+
+// replicate queues rec for every follower, dropping those that fell
+// behind. it is called for each record logged, under the lock that orders
+// it
+func replicate(rec walRecord) {
+	replicas.Lock()
+	defer replicas.Unlock()
+
+	for ch := range replicas.m {
+		select {
+		case ch <- rec:
+		default:
+			slog.Warn("replica fell behind, dropped")
+			delete(replicas.m, ch)
+			close(ch)
+		}
+	}
+}
+
+// addReplica registers a follower and returns its stream with the snapshot
+// it starts from. every shard and the sessions are locked meanwhile so no
+// record is missed or sent twice
+func addReplica() (chan walRecord, []byte, error) {
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	sessions.Lock()
+	var b bytes.Buffer
+	err := writeSnapshot(&b)
+	ch := make(chan walRecord, replicaBuffer)
+	if err == nil {
+		json.NewEncoder(&b).Encode(walRecord{Op: replicaSynced})
+		replicas.Lock()
+		replicas.m[ch] = true
+		replicas.Unlock()
+	}
+	sessions.Unlock()
+	for _, s := range shards {
+		s.mu.Unlock()
+	}
+	return ch, b.Bytes(), err
+}
+
+// dropReplica unregisters a follower that went away
+func dropReplica(ch chan walRecord) {
+	replicas.Lock()
+	defer replicas.Unlock()
+
+	if replicas.m[ch] {
+		delete(replicas.m, ch)
+		close(ch)
+	}
+}
+
+// replicateHandler answers GET /admin/replicate with the stream a
+// follower keeps its table with, newline delimited JSON records
+func replicateHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if following() {
+		replyFailure(w, r, errFollower)
+		return
+	}
+	ch, snap, err := addReplica()
+	if err != nil {
+		slog.Error("snapshot failed", "err", err)
+		replyFailure(w, r, errInternal)
+		return
+	}
+	defer dropReplica(ch)
+	slog.Info("replica connected", "addr", r.RemoteAddr)
+
+	rc := http.NewResponseController(w)
+	// like /hold each write must reach the follower within the write
+	// timeout, the stream as a whole has no deadline
+	send := func(b []byte) bool {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		} else {
+			rc.SetWriteDeadline(time.Time{})
+		}
+		w.Write(b)
+		return rc.Flush() == nil
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if !send(snap) {
+		return
+	}
+	ping, _ := json.Marshal(walRecord{Op: replicaPing})
+	ping = append(ping, '\n')
+	ticker := time.NewTicker(replicaHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case rec, ok := <-ch:
+			if !ok {
+				return
+			}
+			b, _ := json.Marshal(rec)
+			if !send(append(b, '\n')) {
+				return
+			}
+		case <-ticker.C:
+			if !send(ping) {
+				return
+			}
+		case <-r.Context().Done():
+			slog.Info("replica disconnected", "addr", r.RemoteAddr)
+			return
+		}
+	}
+}
+
+var replicaClient = &http.Client{}
+
+// follow keeps the lock table a replica of the leader of link for as long
+// as it leads this node
+func follow(link *leaderLink) {
+	for upstream.Load() == link {
+		err := followStream(link)
+		synced.Store(false)
+		if link.ctx.Err() != nil {
+			return
+		}
+		slog.Warn("replication stream lost, reconnecting", "leader", link.admin, "err", err)
+		time.Sleep(replicaRetry)
+	}
+}
+
+// followStream replaces the lock table with the snapshot the leader sends
+// and applies its records until the stream ends
+func followStream(link *leaderLink) error {
+	req, err := http.NewRequestWithContext(link.ctx, http.MethodGet, strings.TrimSuffix(link.admin, "/")+"/v1/admin/replicate", nil)
+	if err != nil {
+		return err
+	}
+	if len(replicaToken) != 0 {
+		req.Header.Set("Authorization", "Bearer "+replicaToken)
+	}
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader answered %s", resp.Status)
+	}
+	// a leader that hangs without closing the connection stops pinging
+	idle := time.AfterFunc(replicaTimeout, func() { resp.Body.Close() })
+	defer idle.Stop()
+
+	link.mu.Lock()
+	if upstream.Load() != link {
+		link.mu.Unlock()
+		return nil
+	}
+	resetTable()
+	link.mu.Unlock()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var rec walRecord
+		if err := dec.Decode(&rec); err != nil {
+			return err
+		}
+		idle.Reset(replicaTimeout)
+		link.mu.Lock()
+		if upstream.Load() != link {
+			link.mu.Unlock()
+			return nil
+		}
+		switch rec.Op {
+		case replicaPing:
+		case replicaSynced:
+			synced.Store(true)
+			slog.Info("replica synced", "leader", link.admin, "locks", heldCount())
+		default:
+			applyReplicated(rec)
+		}
+		if synced.Load() {
+			heard.Store(time.Now().UnixNano())
+		}
+		link.mu.Unlock()
+	}
+}
+
+// applyReplicated applies a record of the leader under the lock it was
+// logged under there
+func applyReplicated(rec walRecord) {
+	switch rec.Op {
+	case "next":
+		applyRecord(rec)
+	case "session", "endsession":
+		sessions.Lock()
+		applyRecord(rec)
+		sessions.Unlock()
+	default:
+		s := shardFor(rec.Key)
+		s.mu.Lock()
+		applyRecord(rec)
+		s.mu.Unlock()
+	}
+}
+
+// resetTable empties the lock table, the sessions and the transactions
+// for a replica to start over from a snapshot
+func resetTable() {
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	var dropped int64
+	for _, s := range shards {
+		for key, counter := range s.locks {
+			for _, h := range counter.lockID {
+				if hierarchical {
+					treeRelease(key, h.mode)
+				}
+				unreserve(key, h.quotaClient())
+			}
+			counter.wakeup()
+		}
+		dropped += int64(len(s.locks))
+		s.locks = map[string]*lockCounter{}
+		s.counts = map[string]int64{}
+	}
+	tableKeys.Add(-dropped)
+	sessions.Lock()
+	sessions.m = map[string]*session{}
+	sessions.Unlock()
+	txns.Lock()
+	txns.m = map[string]map[lockRef]bool{}
+	txns.Unlock()
+	for _, s := range shards {
+		s.mu.Unlock()
+	}
+}
+
+// apiRoute returns the route of path without its /v1/ns/NS or /v1 prefix
+func apiRoute(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/v1/ns/"); ok {
+		_, route, _ := strings.Cut(rest, "/")
+		return "/" + route
+	}
+	return strings.TrimPrefix(path, "/v1")
+}
+
+// followerOf serves the requests for the routes in leaderRoutes, and
+// consul's api, by forwarding them to the leader while this node follows
+// one, to its admin api if admin is set. the others, such as the reads of
+// replicaRoutes, the probes and /metrics, are answered by handler from
+// the replica. a deposed leader, which has none, forwards the reads too.
+// every answer names the leader in leaderHeader
+func followerOf(handler http.Handler, leaderRoutes map[string]bool, admin bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		link := upstream.Load()
+		if link != nil {
+			w.Header().Set(leaderHeader, link.url)
+		}
+		route := apiRoute(r.URL.Path)
+		if link == nil || !(leaderRoutes[route] || (link.deposed && replicaRoutes[route]) ||
+			strings.HasPrefix(r.URL.Path, "/v1/kv/") || strings.HasPrefix(r.URL.Path, "/v1/session/")) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if admin {
+			link.adminAPI.ServeHTTP(w, r)
+			return
+		}
+		link.api.ServeHTTP(w, r)
+	})
+}
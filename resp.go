@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the redis protocol listener answers the handful of commands redis lock
+// clients (redsync, redlock) send: SET key value NX PX ms takes the write
+// lock on key with value as its owner, GET answers the owner of the write
+// lock and the compare-and-delete and compare-and-pexpire scripts they
+// EVAL release and extend it. there is no lua, the scripts are recognized
+// by what they call. keys are those of the default namespace, so http
+// clients see the same locks
+
+// respScripts maps the sha1 of every script seen to what it does, for
+// EVALSHA
+var respScripts = struct {
+	sync.Mutex
+	kinds map[string]string
+}{kinds: map[string]string{}}
+
+// scriptKind tells what a lock client's script does: "unlock" compares
+// the value and deletes, "unlock-1" also answers -1 for a missing key,
+// "extend" compares and sets a new lease and "acquire" extends the lock if
+// the value holds it and takes it otherwise
+func scriptKind(script string) string {
+	s := strings.ToLower(script)
+	switch {
+	case !strings.Contains(s, `"get"`) && !strings.Contains(s, `'get'`):
+		return ""
+	case strings.Contains(s, "del") && strings.Contains(s, "-1"):
+		// redsync answers -1 when nobody holds the key
+		return "unlock-1"
+	case strings.Contains(s, "del"):
+		return "unlock"
+	case strings.Contains(s, "nx"):
+		return "acquire"
+	case strings.Contains(s, "pexpire"):
+		return "extend"
+	}
+	return ""
+}
+
+func learnScript(script string) (sha, kind string) {
+	sum := sha1.Sum([]byte(script))
+	sha, kind = hex.EncodeToString(sum[:]), scriptKind(script)
+	if len(kind) != 0 {
+		respScripts.Lock()
+		respScripts.kinds[sha] = kind
+		respScripts.Unlock()
+	}
+	return sha, kind
+}
+
+// respWriteHolder returns the lockID of the write lock value holds on path.
+// caller must hold the shard mutex
+func respWriteHolder(counter *lockCounter, value string) string {
+	if counter == nil || counter.state != 1 {
+		return ""
+	}
+	for id, h := range counter.lockID {
+		if h.owner == value {
+			return id
+		}
+	}
+	return ""
+}
+
+// respSet write locks the unlocked path for value, SET NX. a key held in
+// any way, even by value itself, is refused like redis refuses SET NX on
+// an existing key
+func respSet(path, value string, opts lockOptions) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.getCounter(path)
+	if counter.state != 0 {
+		return false
+	}
+	opts.owner = value
+	return len(counter.wlock(opts, nil)) != 0
+}
+
+// respGet returns the owner of the write lock on path
+func respGet(path string) (string, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.state != 1 {
+		return "", false
+	}
+	for _, h := range counter.lockID {
+		return h.owner, true
+	}
+	return "", false
+}
+
+// respDeleteIf releases the write lock value holds on path. it returns 1
+// if it did, 0 if someone else holds path and -1 if nobody does
+func respDeleteIf(path, value string) int64 {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.state == 0 {
+		return -1
+	}
+	id := respWriteHolder(counter, value)
+	if len(id) == 0 {
+		return 0
+	}
+	counter.release(id, eventReleased)
+	return 1
+}
+
+// respExpireIf moves the lease of the write lock value holds on path to
+// ttl from now
+func respExpireIf(path, value string, ttl time.Duration) bool {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := respWriteHolder(s.locks[path], value)
+	if len(id) == 0 {
+		return false
+	}
+	deadline := time.Now().Add(ttl)
+	if err := wal.renew(path, id, deadline); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return false
+	}
+	s.locks[path].lockID[id].expiry = deadline
+	scheduleExpiry(path, id, deadline, false)
+	return true
+}
+
+// respConn is one client connection
+type respConn struct {
+	in  *redisConn
+	out *bufio.Writer
+	// the caller once AUTH succeeded, callers are anonymous without -api-keys
+	principal principal
+	authed    bool
+}
+
+func (c *respConn) simple(s string) { fmt.Fprintf(c.out, "+%s\r\n", s) }
+func (c *respConn) fail(s string)   { fmt.Fprintf(c.out, "-%s\r\n", s) }
+func (c *respConn) int(n int64)     { fmt.Fprintf(c.out, ":%d\r\n", n) }
+func (c *respConn) null()           { c.out.WriteString("$-1\r\n") }
+
+func (c *respConn) bulk(s string) {
+	fmt.Fprintf(c.out, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// listenRESP listens on addr and answers redis protocol clients there
+func listenRESP(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go serveRESP(l)
+	return l, nil
+}
+
+// serveRESP answers redis protocol clients on l until it is closed
+func serveRESP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("resp accept failed", "err", err)
+			}
+			return
+		}
+		go serveRESPConn(conn)
+	}
+}
+
+func serveRESPConn(conn net.Conn) {
+	defer conn.Close()
+	c := &respConn{in: &redisConn{conn: conn, r: bufio.NewReader(conn)}, out: bufio.NewWriter(conn)}
+	for {
+		cmd, err := c.in.read()
+		if err != nil {
+			return
+		}
+		items, _ := cmd.([]any)
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			c.fail("ERR expected an array of bulk strings")
+		} else if !c.command(strings.ToUpper(args[0]), args[1:]) {
+			c.out.Flush()
+			return
+		}
+		// pipelined commands are answered together
+		if c.in.r.Buffered() == 0 {
+			if err := c.out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// mayLock reports whether the connection may take and release locks
+func (c *respConn) mayLock() bool {
+	if currentAuth() == nil {
+		return true
+	}
+	if !c.authed {
+		c.fail("NOAUTH Authentication required.")
+		return false
+	}
+	if c.principal.perms&permWrite == 0 || !c.principal.mayUse("") {
+		c.fail("NOPERM this key may not lock")
+		return false
+	}
+	return true
+}
+
+// mayUse reports whether the connection may use key with one of rights,
+// checked as the http routes check the keys they name
+func (c *respConn) mayUse(rights aclRight, key string) bool {
+	if currentAuth() == nil || keyAllowed(c.principal, rights, key) {
+		return true
+	}
+	c.fail("NOPERM this key may not be used")
+	return false
+}
+
+// mayDelete reports whether the connection may DEL key, which releases
+// every holder and so takes unlock-others on the locks of other identities
+func (c *respConn) mayDelete(key string) bool {
+	if !c.mayUse(aclWrite, key) {
+		return false
+	}
+	if currentAuth() == nil {
+		return true
+	}
+	s := shardFor(key)
+	s.mu.Lock()
+	var ids []string
+	if counter := s.locks[key]; counter != nil {
+		for id := range counter.lockID {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range ids {
+		if !releaseAllowed(c.principal, key, id) {
+			c.fail("NOPERM this key may not be used")
+			return false
+		}
+	}
+	return true
+}
+
+// mayDeleteAll is mayDelete for every key of a DEL, which deletes none of
+// them if one is refused
+func (c *respConn) mayDeleteAll(keys []string) bool {
+	for _, key := range keys {
+		if !c.mayDelete(key) {
+			return false
+		}
+	}
+	return true
+}
+
+// limited reports whether the connection is past its rate of lock
+// attempts, as rateLimit tells http clients
+func (c *respConn) limited() bool {
+	if wait, ok := allow(rateKey(c.principal.name, c.remoteHost()), time.Now()); !ok {
+		c.fail(fmt.Sprintf("ERR %s, retry in %s", errRateLimited.text, wait.Round(time.Millisecond)))
+		return true
+	}
+	return false
+}
+
+// command answers one command, false closes the connection
+func (c *respConn) command(name string, args []string) bool {
+	switch name {
+	case "PING":
+		if len(args) != 0 {
+			c.bulk(args[0])
+		} else {
+			c.simple("PONG")
+		}
+	case "QUIT":
+		c.simple("OK")
+		return false
+	case "SELECT":
+		if len(args) == 1 && args[0] == "0" {
+			c.simple("OK")
+		} else {
+			c.fail("ERR only database 0 exists")
+		}
+	case "CLIENT":
+		c.simple("OK")
+	case "AUTH":
+		c.auth(args)
+	case "GET":
+		if len(args) != 1 {
+			c.fail("ERR wrong number of arguments for 'get' command")
+		} else if c.mayLock() && c.mayUse(aclList, args[0]) {
+			if value, ok := respGet(args[0]); ok {
+				c.bulk(value)
+			} else {
+				c.null()
+			}
+		}
+	case "SET":
+		if c.mayLock() {
+			c.set(args)
+		}
+	case "DEL":
+		if len(args) == 0 {
+			c.fail("ERR wrong number of arguments for 'del' command")
+		} else if c.mayLock() && c.mayDeleteAll(args) {
+			var n int64
+			for _, key := range args {
+				if !strings.Contains(key, nsSep) && forceUnlock(key, c.principal.name) != 0 {
+					n++
+				}
+			}
+			c.int(n)
+		}
+	case "SCRIPT":
+		if len(args) == 2 && strings.EqualFold(args[0], "LOAD") {
+			sha, _ := learnScript(args[1])
+			c.bulk(sha)
+		} else {
+			c.fail("ERR only SCRIPT LOAD is supported")
+		}
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			c.fail("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		} else if c.mayLock() {
+			c.eval(name == "EVALSHA", args)
+		}
+	default:
+		c.fail(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+	}
+	return true
+}
+
+// auth takes AUTH TOKEN or AUTH USER TOKEN, the token is an api key
+func (c *respConn) auth(args []string) {
+	a := currentAuth()
+	if len(args) == 0 || len(args) > 2 {
+		c.fail("ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if a == nil {
+		c.simple("OK")
+		return
+	}
+	r := &http.Request{Header: http.Header{"X-Api-Key": {args[len(args)-1]}}, URL: &url.URL{}}
+	p, ok := a.authenticate(r)
+	if !ok {
+		c.fail("WRONGPASS invalid api key")
+		return
+	}
+	c.principal, c.authed = p, true
+	c.simple("OK")
+}
+
+// leaseArg parses the lease of SET ... PX ms or EX s
+func leaseArg(unit, n string) (time.Duration, bool) {
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	if strings.EqualFold(unit, "EX") {
+		return time.Duration(v) * time.Second, true
+	}
+	return time.Duration(v) * time.Millisecond, true
+}
+
+// set answers SET key value NX [PX ms|EX s], other forms of SET would
+// overwrite a held lock and are refused
+func (c *respConn) set(args []string) {
+	if len(args) < 2 {
+		c.fail("ERR wrong number of arguments for 'set' command")
+		return
+	}
+	key, value := args[0], args[1]
+	nx, ttl := false, time.Duration(0)
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "PX", "EX":
+			if i+1 == len(args) {
+				c.fail("ERR syntax error")
+				return
+			}
+			var ok bool
+			if ttl, ok = leaseArg(args[i], args[i+1]); !ok {
+				c.fail("ERR invalid expire time in 'set' command")
+				return
+			}
+			i++
+		default:
+			c.fail("ERR only SET key value NX [PX ms|EX s] is supported")
+			return
+		}
+	}
+	if !nx {
+		c.fail("ERR only SET key value NX [PX ms|EX s] is supported")
+		return
+	}
+	if strings.Contains(key, nsSep) || !validKey(key) || !roomFor(key) {
+		c.fail("ERR invalid key")
+		return
+	}
+	if !c.mayUse(aclWrite, key) || c.limited() {
+		return
+	}
+	if closedForLocks() {
+		c.fail("ERR " + closedFailure().text)
+		return
+	}
+	ttl, ok := leaseFor(ttl, key)
+	if !ok {
+		c.fail("ERR " + errTTLTooLong.text)
+		return
+	}
+	if respSet(key, value, lockOptions{ttl: ttl, principal: c.principal.name, addr: c.remoteHost()}) {
+		metrics.acquired(false, key, 0)
+		c.simple("OK")
+	} else {
+		metrics.contended(false, key)
+		c.null()
+	}
+}
+
+func (c *respConn) remoteHost() string {
+	host, _, err := net.SplitHostPort(c.in.conn.RemoteAddr().String())
+	if err != nil {
+		return c.in.conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// eval answers EVAL script numkeys key... arg... and its EVALSHA form for
+// the scripts of the lock clients
+func (c *respConn) eval(bySHA bool, args []string) {
+	var kind string
+	if bySHA {
+		respScripts.Lock()
+		kind = respScripts.kinds[strings.ToLower(args[0])]
+		respScripts.Unlock()
+		if len(kind) == 0 {
+			c.fail("NOSCRIPT No matching script. Please use EVAL.")
+			return
+		}
+	} else if _, kind = learnScript(args[0]); len(kind) == 0 {
+		c.fail("ERR only the lock, unlock and extend scripts of redis lock clients are supported")
+		return
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys != 1 || len(args) < 4 {
+		c.fail("ERR the lock scripts take one key and a value")
+		return
+	}
+	key, argv := args[2], args[3:]
+	if !c.mayUse(aclWrite, key) {
+		return
+	}
+	switch kind {
+	case "unlock", "unlock-1":
+		n := respDeleteIf(key, argv[0])
+		if n == -1 && kind == "unlock" {
+			n = 0
+		}
+		c.int(n)
+	case "extend", "acquire":
+		if len(argv) < 2 {
+			c.fail("ERR the script takes a value and a lease")
+			return
+		}
+		ttl, ok := leaseArg("PX", argv[1])
+		if !ok {
+			c.fail("ERR invalid expire time")
+			return
+		}
+		if ttl, ok = leaseFor(ttl, key); !ok {
+			c.fail("ERR " + errTTLTooLong.text)
+			return
+		}
+		extended := respExpireIf(key, argv[0], ttl)
+		switch {
+		case kind == "extend" && extended:
+			c.int(1)
+		case kind == "extend":
+			c.int(0)
+		case extended:
+			c.simple("OK")
+		default:
+			c.set([]string{key, argv[0], "NX", "PX", argv[1]})
+		}
+	}
+}
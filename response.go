@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// failure is a reason a request failed
+type failure struct {
+	// machine readable code of the JSON body
+	code string
+	// detail appended to the text "failure" body, may be empty
+	text   string
+	status int
+}
+
+var (
+	errBadRequest   = failure{code: "bad_request", status: http.StatusBadRequest}
+	errNotHeld      = failure{code: "not_held", status: http.StatusNotFound}
+	errStaleToken   = failure{code: "stale_token", status: http.StatusConflict}
+	errReentrant    = failure{code: "reentrant", text: "lock is held more than once", status: http.StatusConflict}
+	errNoSession    = failure{code: "no_session", text: "no such session", status: http.StatusNotFound}
+	errDeadlock     = failure{code: "deadlock", text: "waiting would deadlock", status: http.StatusConflict}
+	errNoLeader     = failure{code: "no_leader", text: "no leader", status: http.StatusNotFound}
+	errQuota        = failure{code: "quota", text: "namespace lock quota reached", status: http.StatusTooManyRequests}
+	errNoAudit      = failure{code: "no_audit", text: "audit log disabled", status: http.StatusNotFound}
+	errRateLimited  = failure{code: "rate_limited", text: "too many lock attempts", status: http.StatusTooManyRequests}
+	errClientQuota  = failure{code: "client_quota", text: "client lock quota reached", status: http.StatusTooManyRequests}
+	errUnsupported  = failure{code: "unsupported", text: "not supported by the storage backend", status: http.StatusNotImplemented}
+	errDraining     = failure{code: "draining", text: "server is shutting down", status: http.StatusServiceUnavailable}
+	errInternal     = failure{code: "internal", status: http.StatusInternalServerError}
+	errUnauthorized = failure{code: "unauthorized", text: "unauthorized", status: http.StatusUnauthorized}
+	errForbidden    = failure{code: "forbidden", text: "forbidden", status: http.StatusForbidden}
+)
+
+// reply is the JSON body of the lock endpoints, status is one of granted,
+// retry, success or failure
+type reply struct {
+	Status       string    `json:"status"`
+	LockID       string    `json:"lockId,omitempty"`
+	FencingToken int64     `json:"fencingToken,omitempty"`
+	Session      string    `json:"session,omitempty"`
+	Txn          string    `json:"txn,omitempty"`
+	Intent       string    `json:"intent,omitempty"`
+	Locks        []heldKey `json:"locks,omitempty"`
+	Code         string    `json:"code,omitempty"`
+	Message      string    `json:"message,omitempty"`
+	// with status retry, milliseconds to wait before trying again
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+	// with status retry, the place the request would take in the queue of
+	// the key and how long it would likely wait there
+	QueuePosition   int   `json:"queuePosition,omitempty"`
+	EstimatedWaitMs int64 `json:"estimatedWaitMs,omitempty"`
+	// version of the key a lock was granted on, see versions.go
+	Version *int64 `json:"version,omitempty"`
+	// the value of a key, see kv.go
+	Value []byte `json:"value,omitempty"`
+	// the value of a counter, see counters.go
+	Count *int64 `json:"count,omitempty"`
+}
+
+// wantsJSON reports whether the client asked for JSON in its Accept
+// header, everyone else gets the plain text bodies
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || params["q"] == "0" {
+				continue
+			}
+			if mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowMethod reports whether r uses method, answering 405 if it doesn't.
+// GET endpoints also accept HEAD
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	replyFailure(w, r, failure{
+		code:   "method_not_allowed",
+		text:   "only " + strings.ToLower(method) + " method is supported",
+		status: http.StatusMethodNotAllowed,
+	})
+	return false
+}
+
+// writeJSON writes v with status, 0 means 200
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("write response", "err", err)
+	}
+}
+
+// writeTimeout is how long a handler has to write its reply, counted from
+// the end of the wait a blocking request asked for. 0 is no limit
+var writeTimeout time.Duration
+
+// holdOpen pushes the write deadline of a request that blocks for up to
+// wait past the wait, so the server's write timeout only limits the reply
+func holdOpen(w http.ResponseWriter, wait time.Duration) {
+	if writeTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + writeTimeout))
+	}
+}
+
+// replyGranted answers a granted lock, write locks also carry their
+// fencing token in the Fencing-Token header
+func replyGranted(w http.ResponseWriter, r *http.Request, lockID string, fence int64) {
+	replyGrantedAt(w, r, lockID, fence, nil)
+}
+
+// replyGrantedAt is replyGranted for a lock granted with its key at
+// version, which the Key-Version header also carries unless it is nil
+func replyGrantedAt(w http.ResponseWriter, r *http.Request, lockID string, fence int64, version *int64) {
+	if fence != 0 {
+		w.Header().Set("Fencing-Token", strconv.FormatInt(fence, 10))
+	}
+	if version != nil {
+		w.Header().Set(keyVersionHeader, strconv.FormatInt(*version, 10))
+	}
+	noteReply(r, "granted", "")
+	noteLockID(r, lockID, "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "granted", LockID: lockID, FencingToken: fence, Version: version})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", lockID)
+}
+
+// replyTxn answers granted multi-key locks with the transaction id, the
+// text body follows it with a "KEY" LOCKID FENCE line per key
+func replyTxn(w http.ResponseWriter, r *http.Request, txn string, held []heldKey) {
+	noteReply(r, "granted", "")
+	noteLockID(r, "", txn)
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "granted", Txn: txn, Locks: held})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", txn)
+	for _, k := range held {
+		fmt.Fprintf(w, "%s %s %d\n", strconv.Quote(k.Key), k.LockID, k.FencingToken)
+	}
+}
+
+// replySession answers a created session with its id
+func replySession(w http.ResponseWriter, r *http.Request, id string) {
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success", Session: id})
+		return
+	}
+	fmt.Fprintf(w, "%s\n", id)
+}
+
+// replyRetry answers a contended lock request with 409 and a Retry-After
+// hint of when paths could be free, along with the Queue-Position and
+// Estimated-Wait-Ms the request would have if it waited
+func replyRetry(w http.ResponseWriter, r *http.Request, paths ...string) {
+	estimate, position := waitEstimate(paths...)
+	hint := jitter(estimate)
+	setRetryAfter(w, hint)
+	w.Header().Set("Queue-Position", strconv.Itoa(position))
+	w.Header().Set("Estimated-Wait-Ms", strconv.FormatInt(estimate.Milliseconds(), 10))
+	noteReply(r, "retry", "")
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusConflict, reply{Status: "retry", RetryAfterMs: hint.Milliseconds(),
+			QueuePosition: position, EstimatedWaitMs: estimate.Milliseconds()})
+		return
+	}
+	w.WriteHeader(http.StatusConflict)
+	fmt.Fprintf(w, "retry\n")
+}
+
+func replySuccess(w http.ResponseWriter, r *http.Request) {
+	noteReply(r, "success", "")
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success"})
+		return
+	}
+	fmt.Fprintf(w, "success\n")
+}
+
+func replyFailure(w http.ResponseWriter, r *http.Request, f failure) {
+	noteReply(r, "failure", f.code)
+	if wantsJSON(r) {
+		writeJSON(w, f.status, reply{Status: "failure", Code: f.code, Message: f.text})
+		return
+	}
+	w.WriteHeader(f.status)
+	if len(f.text) != 0 {
+		fmt.Fprintf(w, "failure %s\n", f.text)
+	} else {
+		fmt.Fprintf(w, "failure\n")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import "net/http"
+
+// renewDoc describes /renew, which the admin port serves as well for the
+// dashboard
+var renewDoc = postDoc("extend the lease of a lock to ttl from now", pKey, pLockID, pTTL.need())
+
+// routes is the route table of the client port. every route but /metrics
+// is served for the default namespace and, under /v1/ns/NS/, for each
+// named one
+func routes() []route {
+	return []route{
+		{"/lock", instrument("lock", requirePerm(permWrite, rateLimit(lockHandler))),
+			postDoc("take the write lock on key", append(lockParams,
+				apiParam{name: "if-version", about: "only if the key is still at this version", kind: "integer"})...)},
+		{"/unlock", instrument("unlock", requirePerm(permWrite, unlockHandler)),
+			postDoc("release a write lock", pKey, pLockID)},
+		{"/rlock", instrument("rlock", requirePerm(permRead, rateLimit(rlockHandler))),
+			postDoc("take a read lock on key", lockParams...)},
+		{"/runlock", instrument("runlock", requirePerm(permRead, runlockHandler)),
+			postDoc("release a read lock", pKey, pLockID)},
+		{"/session/create", instrument("session/create", requirePerm(permRead, createSessionHandler)),
+			postDoc("create a session, its locks are released when it is not renewed within ttl", pTTL)},
+		{"/session/renew", instrument("session/renew", requirePerm(permRead, renewSessionHandler)),
+			postDoc("renew a session", pSession.need())},
+		{"/session/destroy", instrument("session/destroy", requirePerm(permRead, destroySessionHandler)),
+			postDoc("destroy a session and release its locks", pSession.need())},
+		{"/lock-multi", instrument("lock-multi", requirePerm(permWrite, rateLimit(lockMultiHandler))),
+			postDoc("write lock every key or none", pKey.many(), pTTL, pWait, pSession, pPurpose, pLabel)},
+		{"/unlock-multi", instrument("unlock-multi", requirePerm(permWrite, unlockMultiHandler)),
+			postDoc("release the locks of a lock-multi transaction",
+				apiParam{name: "txn", about: "the transaction id lock-multi answered", kind: "string", required: true})},
+		{"/upgrade", instrument("upgrade", requirePerm(permWrite, rateLimit(upgradeHandler))),
+			postDoc("turn a read lock into the write lock", pKey, pLockID, pWait)},
+		{"/downgrade", instrument("downgrade", requirePerm(permWrite, downgradeHandler)),
+			postDoc("turn the write lock into a read lock", pKey, pLockID)},
+		{"/mlock", instrument("mlock", requirePerm(permWrite, rateLimit(mlockHandler))),
+			postDoc("lock key in a multi-granularity mode", pKey, apiParam{name: "mode", about: "IS, IX, S, SIX or X", kind: "string", required: true},
+				pTTL, pWait, pOwner, pSession, pPriority, pPurpose, pLabel)},
+		{"/munlock", instrument("munlock", requirePerm(permWrite, munlockHandler)),
+			postDoc("release a lock in whatever mode", pKey, pLockID)},
+		{"/renew", instrument("renew", requirePerm(permRead, renewHandler)), renewDoc},
+		{"/watch", instrument("watch", requirePerm(permRead, watchHandler)),
+			getDoc("wait until key is released", pKey, pWait)},
+		{"/ws", requirePerm(permRead, wsHandler),
+			getDoc("websocket of lock events", pKey.many(), pPrefix)},
+		{"/events", requirePerm(permRead, eventsHandler),
+			getDoc("server-sent events of lock activity", pKey.many(), pPrefix,
+				apiParam{name: "type", about: "only events of this type, e.g. granted, released or expired", kind: "string", repeated: true},
+				apiParam{name: "keepalive", about: "write a comment this often", kind: "duration"})},
+		{"/kv/put", instrument("kv/put", requirePerm(permWrite, kvPutHandler)),
+			postDoc("set the value of key to the request body while holding its write lock", pKey, pLockID)},
+		{"/kv/get", instrument("kv/get", requirePerm(permRead, kvGetHandler)),
+			getDoc("the value of key", pKey, apiParam{name: "lock-id", about: "only read while this lock id holds a lock on key", kind: "string"})},
+		{"/kv/delete", instrument("kv/delete", requirePerm(permWrite, kvDeleteHandler)),
+			postDoc("drop the value of key while holding its write lock", pKey, pLockID)},
+		{"/counter/incr", instrument("counter/incr", requirePerm(permWrite, counterIncrHandler)),
+			postDoc("add to the counter of key and return its new value", pKey,
+				apiParam{name: "by", about: "what to add, 1 by default, negative to count down", kind: "integer"},
+				apiParam{name: "max", about: "refuse an increment taking the counter above this", kind: "integer"})},
+		{"/counter/get", instrument("counter/get", requirePerm(permRead, counterGetHandler)),
+			getDoc("the counter of key, 0 if never incremented", pKey)},
+		{"/version", instrument("version", requirePerm(permRead, versionHandler)),
+			getDoc("the version of key, the fencing token of its last write lock to end", pKey)},
+		{"/fence", instrument("fence", requirePerm(permRead, fenceHandler)),
+			getDoc("check a fencing token is still the current one", pKey,
+				apiParam{name: "token", about: "the fencing token", kind: "integer", required: true})},
+		{"/locks", instrument("locks", requirePerm(permRead, locksHandler)),
+			getDoc("list held locks", pPrefix, pMatch, pLimit, apiParam{name: "after", about: "continue after this key", kind: "string"})},
+		{"/status", instrument("status", requirePerm(permRead, statusHandler)),
+			getDoc("state and holders of key", pKey).replies(keyStatus{})},
+		{"/cancel", instrument("cancel", requirePerm(permWrite, cancelHandler)),
+			postDoc("withdraw the blocked lock or rlock request sent with ticket", pKey,
+				apiParam{name: "ticket", about: "the ticket= of the request", kind: "string", required: true})},
+		{"/queue", instrument("queue", requirePerm(permRead, queueHandler)),
+			getDoc("requests waiting for key in the order they are served", pKey).replies(keyQueue{})},
+		{"/status/bulk", instrument("status/bulk", requirePerm(permRead, bulkStatusHandler)),
+			routeDoc{methods: []string{http.MethodPost}, summary: "state and holders of the keys in the body", body: []string{}}},
+		{"/stats/holdtimes", instrument("stats/holdtimes", requirePerm(permRead, holdTimesHandler)),
+			getDoc("how long the locks of each key were held", pPrefix, pMatch, pLimit)},
+		{"/stats/keys", instrument("stats/keys", requirePerm(permRead, keyStatsHandler)),
+			getDoc("requests granted, refused and queued per key", pPrefix, pMatch, pLimit)},
+		{"/unlock-all", instrument("unlock-all", requirePerm(permWrite, unlockAllHandler)),
+			postDoc("release every lock of an owner or session", pOwner, pSession)},
+		{"/transfer", instrument("transfer", requirePerm(permWrite, rateLimit(transferHandler))),
+			postDoc("hand a lock to another owner under a new lock id", pKey, pLockID, pTTL, pSession, pPurpose, pLabel,
+				apiParam{name: "to-owner", about: "the owner the lock is handed to", kind: "string", required: true})},
+		{"/steal", instrument("steal", requirePerm(permAdmin, stealHandler)),
+			postDoc("take the write lock over from a dead holder whose lease has not run out", pKey, pTTL, pOwner, pSession, pPurpose, pLabel,
+				apiParam{name: "force-token", about: "fencing token of the lock taken over", kind: "integer", required: true})},
+		{"/hold", instrument("hold", requirePerm(permWrite, rateLimit(holdHandler))),
+			postDoc("hold key while the response stream stays open", pKey, pWait, pPurpose, pLabel,
+				apiParam{name: "mode", about: "read or write, write if missing", kind: "string"},
+				apiParam{name: "keepalive", about: "write a line this often", kind: "duration"})},
+		{"/elect", instrument("elect", requirePerm(permWrite, rateLimit(electHandler))),
+			postDoc("campaign for leadership of group", pGroup, pTTL, pWait, pSession,
+				apiParam{name: "candidate", about: "the candidate's name", kind: "string", required: true})},
+		{"/elect/renew", instrument("elect/renew", requirePerm(permWrite, electRenewHandler)),
+			postDoc("extend the leader's term", pGroup, pLockID, pTTL)},
+		{"/elect/resign", instrument("elect/resign", requirePerm(permWrite, electResignHandler)),
+			postDoc("step down as leader", pGroup, pLockID)},
+		{"/elect/leader", instrument("elect/leader", requirePerm(permRead, leaderHandler)),
+			getDoc("who leads group, or wait for a term after term", pGroup, pWait,
+				apiParam{name: "term", about: "wait for a newer term than this", kind: "integer"}).replies(leader{})},
+		{"/barrier/enter", instrument("barrier/enter", requirePerm(permWrite, barrierEnterHandler)),
+			postDoc("enter a barrier, blocking until parties callers have", pBarrier, pWait,
+				apiParam{name: "parties", about: "callers the barrier waits for", kind: "integer", required: true}).replies(barrierState{})},
+		{"/barrier/wait", instrument("barrier/wait", requirePerm(permRead, barrierWaitHandler)),
+			getDoc("wait for a barrier generation to complete", pBarrier, pWait,
+				apiParam{name: "generation", about: "the generation entered", kind: "integer", required: true}).replies(barrierState{})},
+		{"/intent", instrument("intent", requirePerm(permWrite, rateLimit(intentHandler))),
+			postDoc("announce a write lock so new readers queue behind it", pKey, pTTL, pPriority)},
+		{"/intent/cancel", instrument("intent/cancel", requirePerm(permWrite, cancelIntentHandler)),
+			postDoc("withdraw an intent", pKey, pIntent.need())},
+		{"/cond/wait", instrument("cond/wait", requirePerm(permWrite, rateLimit(condWaitHandler))),
+			postDoc("release the write lock until signalled, then take it again", pKey, pLockID, pTTL, pWait)},
+		{"/cond/signal", instrument("cond/signal", requirePerm(permWrite, signalHandler)),
+			postDoc("wake one /cond/wait waiter of key", pKey).replies(nil)},
+		{"/cond/broadcast", instrument("cond/broadcast", requirePerm(permWrite, broadcastHandler)),
+			postDoc("wake every /cond/wait waiter of key", pKey).replies(nil)},
+	}
+}
+
+// adminRoutes is the route table of the privileged endpoints, their
+// callers checked with perm: the client port's credentials, or the admin
+// credentials once they move to an admin port of their own
+func adminRoutes(perm func(permission, http.HandlerFunc) http.HandlerFunc) []route {
+	return []route{
+		{"/admin/state", instrument("admin/state", perm(permAdmin, adminStateHandler)),
+			getDoc("locks, queues, hot keys and sessions as the dashboard shows them")},
+		{"/force-unlock", instrument("force-unlock", perm(permAdmin, forceUnlockHandler)),
+			postDoc("release key whoever holds it", pKey)},
+		{"/audit", instrument("audit", perm(permAdmin, auditHandler)),
+			getDoc("read the audit log", apiParam{name: "key", about: "only entries of this key", kind: "string"}, pPrefix, pLimit,
+				apiParam{name: "since", about: "RFC 3339 time of the first entry", kind: "string"},
+				apiParam{name: "until", about: "RFC 3339 time past the last entry", kind: "string"})},
+	}
+}
+
+// flatAdminRoutes are the privileged endpoints served for the default
+// namespace only, reload re-reads the configuration for /admin/reload
+func flatAdminRoutes(perm func(permission, http.HandlerFunc) http.HandlerFunc, reload func() error) []route {
+	return []route{
+		{"/log-level", perm(permAdmin, logLevelHandler),
+			routeDoc{methods: []string{http.MethodGet, http.MethodPost}, summary: "read or, with level, change the log level",
+				params: []apiParam{{name: "level", about: "debug, info, warn or error", kind: "string"}}}},
+		{"/admin/snapshot", perm(permAdmin, localOnly(snapshotHandler)),
+			getDoc("the lock table as newline delimited JSON for -restore")},
+		{"/admin/export", perm(permAdmin, localOnly(exportHandler)),
+			getDoc("locks and sessions as one JSON document for -import").replies(exportDoc{})},
+		{"/admin/replicate", perm(permAdmin, localOnly(replicateHandler)),
+			getDoc("the lock table and then every change to it as newline delimited JSON, for -follow")},
+		{"/admin/depose", perm(permAdmin, localOnly(deposeHandler)),
+			postDoc("step down for the standby that took over under epoch",
+				apiParam{name: "epoch", about: "the epoch the standby took over under", kind: "integer", required: true},
+				apiParam{name: "leader", about: "base url of the new leader", kind: "string", required: true},
+				apiParam{name: "admin", about: "base url of the new leader's admin api, the leader's if absent", kind: "string"})},
+		{"/admin/maintenance", perm(permAdmin, maintenanceHandler),
+			routeDoc{methods: []string{http.MethodGet, http.MethodPost}, summary: "read or, with enabled, switch maintenance, which refuses new locks",
+				params: []apiParam{{name: "enabled", about: "true refuses new locks, false grants them again", kind: "boolean"}}}},
+		{"/admin/orphans", perm(permAdmin, orphansHandler),
+			routeDoc{methods: []string{http.MethodGet, http.MethodPost}, summary: "list the locks that look orphaned or, with POST, release them",
+				params: []apiParam{{name: "lock-id", about: "release this reported orphan", kind: "string", repeated: true},
+					{name: "all", about: "release every reported orphan", kind: "boolean"}}, reply: orphanReport{}}},
+		{"/admin/reload", perm(permAdmin, reloadHandler(reload)),
+			postDoc("re-read the config and credential files like SIGHUP")},
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session groups locks that are all released once its holder stops
+// sending heartbeats for longer than ttl
+type session struct {
+	ttl    time.Duration
+	expiry time.Time
+	locks  map[lockRef]bool
+}
+
+// lockRef names one granted lockID
+type lockRef struct {
+	key string
+	id  string
+}
+
+const defaultSessionTTL = 15 * time.Second
+
+// sessionTTL is the heartbeat ttl in nanoseconds of sessions created
+// without ttl=, it may change on a config reload
+var sessionTTL atomic.Int64
+
+// sessions by id. lock order is shard mutex before sessions
+var sessions = struct {
+	sync.Mutex
+	m map[string]*session
+}{m: map[string]*session{}}
+
+// createSession registers a session that lives until ttl passes without a
+// heartbeat, it returns the new session id or false if it could not be logged
+func createSession(ttl time.Duration) (string, bool) {
+	id := newID()
+	return id, openSession(id, ttl)
+}
+
+// openSession is createSession for a session id chosen by the caller, it
+// returns false if the id is taken or the session could not be logged
+func openSession(id string, ttl time.Duration) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if sessions.m[id] != nil {
+		return false
+	}
+	if err := wal.createSession(id, ttl); err != nil {
+		slog.Error("wal write failed", "err", err)
+		return false
+	}
+	sessions.m[id] = &session{ttl: ttl, expiry: time.Now().Add(ttl), locks: map[lockRef]bool{}}
+	return true
+}
+
+// renewSession is a heartbeat, it pushes the session deadline to ttl from now.
+// it returns false if the session does not exist
+func renewSession(id string) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sess := sessions.m[id]
+	if sess == nil {
+		return false
+	}
+	sess.expiry = time.Now().Add(sess.ttl)
+	return true
+}
+
+// sessionHeard returns when session id last sent a heartbeat, false if it
+// does not exist
+func sessionHeard(id string) (time.Time, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sess := sessions.m[id]
+	if sess == nil {
+		return time.Time{}, false
+	}
+	return sess.expiry.Add(-sess.ttl), true
+}
+
+// sessionLease returns the heartbeat ttl of session id, false if it does
+// not exist
+func sessionLease(id string) (time.Duration, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sess := sessions.m[id]
+	if sess == nil {
+		return 0, false
+	}
+	return sess.ttl, true
+}
+
+func sessionExists(id string) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	return sessions.m[id] != nil
+}
+
+// destroySession ends session id and releases every lock bound to it, it
+// returns false if the session does not exist
+func destroySession(id string) bool {
+	sessions.Lock()
+	sess := sessions.m[id]
+	delete(sessions.m, id)
+	sessions.Unlock()
+
+	if sess == nil {
+		return false
+	}
+	endSession(id, sess, eventReleased)
+	return true
+}
+
+// endSession releases the locks of a session already removed from
+// sessions. the releases are logged before the session end so a crash in
+// between cannot leave locks bound to a session that no longer exists.
+// reason is the event published for each released lock
+func endSession(id string, sess *session, reason string) {
+	for ref := range sess.locks {
+		s := shardFor(ref.key)
+		s.mu.Lock()
+		if counter := s.locks[ref.key]; counter != nil {
+			if h := counter.lockID[ref.id]; h != nil && h.session == id {
+				counter.release(ref.id, reason)
+			}
+		}
+		s.mu.Unlock()
+	}
+	if err := wal.endSession(id); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+}
+
+// expireSessions ends every session whose heartbeat deadline passed by now
+func expireSessions(now time.Time) {
+	expired := map[string]*session{}
+	sessions.Lock()
+	for id, sess := range sessions.m {
+		if !now.Before(sess.expiry) {
+			expired[id] = sess
+			delete(sessions.m, id)
+		}
+	}
+	sessions.Unlock()
+
+	for id, sess := range expired {
+		slog.Info("session expired", "session", id)
+		endSession(id, sess, eventExpired)
+	}
+}
+
+// attachLock binds a granted lock to session id, it returns false if the
+// session no longer exists. caller must hold the shard mutex of ref.key
+func attachLock(id string, ref lockRef) bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	sess := sessions.m[id]
+	if sess == nil {
+		return false
+	}
+	sess.locks[ref] = true
+	return true
+}
+
+// detachLock unbinds a released lock from session id. caller must hold the
+// shard mutex of ref.key
+func detachLock(id string, ref lockRef) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if sess := sessions.m[id]; sess != nil {
+		delete(sess.locks, ref)
+	}
+}
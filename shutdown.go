@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the server starts shutting down, from then on new
+// acquisitions are refused and blocked ones give up
+var draining atomic.Bool
+
+// drainCtx is the base context of every request, it is done once draining
+// starts so long polls and websockets return
+var drainCtx, stopRequests = context.WithCancel(context.Background())
+
+// drain stops new acquisitions, wakes every parked waiter so it gives up,
+// then waits up to wait for the locks still held to be released. held
+// leases survive the restart in the wal if one is in use
+func drain(wait time.Duration) {
+	draining.Store(true)
+	stopRequests()
+	for _, s := range shards {
+		s.mu.Lock()
+		for _, counter := range s.locks {
+			counter.wakeup()
+		}
+		s.mu.Unlock()
+	}
+
+	deadline := time.Now().Add(wait)
+	held := heldCount()
+	for held != 0 && time.Now().Before(deadline) {
+		time.Sleep(sweepInterval)
+		held = heldCount()
+	}
+	if held != 0 && wal == nil {
+		slog.Warn("shutting down with locks held, they are lost without -wal", "held", held)
+	}
+}
+
+// heldCount returns how many lockIDs are held across the shards
+func heldCount() int {
+	held := 0
+	for _, s := range shards {
+		s.mu.Lock()
+		for _, counter := range s.locks {
+			held += len(counter.lockID)
+		}
+		s.mu.Unlock()
+	}
+	return held
+}
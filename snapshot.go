@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// snapshot returns the whole lock table in the wal format. every shard is
+// locked, in index order, while it is copied so the snapshot is one
+// consistent state
+func snapshot() ([]byte, error) {
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	sessions.Lock()
+	var b bytes.Buffer
+	err := writeSnapshot(&b)
+	sessions.Unlock()
+	for _, s := range shards {
+		s.mu.Unlock()
+	}
+	return b.Bytes(), err
+}
+
+// snapshotHandler answers a snapshot of the lock table, a server started
+// with -restore FILE picks it up again
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	b, err := snapshot()
+	if err != nil {
+		slog.Error("snapshot failed", "err", err)
+		replyFailure(w, r, errInternal)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="lockserver.snapshot"`)
+	w.Write(b)
+}
+
+// restoreSnapshot loads the snapshot at path into the empty lock table. it
+// refuses to run over a wal that already holds state, the two would be
+// merged lock by lock
+func restoreSnapshot(path, walPath string) error {
+	if len(walPath) != 0 {
+		if info, err := os.Stat(walPath); err == nil && info.Size() != 0 {
+			return fmt.Errorf("-restore: wal %s is not empty", walPath)
+		}
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("-restore: %w", err)
+	}
+	if err := replayWAL(path); err != nil {
+		return fmt.Errorf("-restore: %w", err)
+	}
+	slog.Info("snapshot restored", "file", path, "locks", heldCount())
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// eventTypes are the kinds of lock event a type= filter of /events may name
+var eventTypes = map[string]bool{
+	eventGranted: true, eventReleased: true, eventExpired: true, eventUpgraded: true, eventDowngraded: true,
+	eventForced: true, eventStolen: true, eventTransferred: true, eventHoldLimited: true, eventOverheld: true,
+}
+
+// eventsHandler answers GET /events with a text/event-stream of lock
+// events, each a server-sent event named after its type with the event as
+// JSON for data, the same as /ws sends. repeated key= and prefix= choose
+// the keys and type= the kinds of event, none means all. a comment line
+// every keepalive=DURATION keeps proxies from closing an idle stream. a
+// client falling too far behind gets a last "dropped" event and the stream
+// ends, it reconnects and reads /locks for what it missed
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	keys, prefixes, ok := subscriptionParams(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	types := map[string]bool{}
+	for _, t := range query["type"] {
+		if !eventTypes[t] {
+			replyFailure(w, r, errBadRequest)
+			return
+		}
+		types[t] = true
+	}
+	keepalive, ok := durationParam(query, "keepalive")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if keepalive == 0 {
+		keepalive = defaultKeepalive
+	}
+
+	sub := subscribe(requestNamespace(r), keys, prefixes)
+	defer unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	// like /hold each write must reach the client within the write
+	// timeout, the stream as a whole has no deadline
+	send := func(format string, args ...any) bool {
+		if writeTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+		} else {
+			rc.SetWriteDeadline(time.Time{})
+		}
+		fmt.Fprintf(w, format, args...)
+		return rc.Flush() == nil
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers responses unless told otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	if !send(": subscribed\n\n") {
+		return
+	}
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.ch:
+			if !ok {
+				send("event: dropped\ndata: {}\n\n")
+				return
+			}
+			if len(types) != 0 && !types[ev.Type] {
+				continue
+			}
+			ev.Key = clientKey(ev.Key)
+			b, _ := json.Marshal(ev)
+			if !send("event: %s\ndata: %s\n\n", ev.Type, b) {
+				return
+			}
+		case <-ticker.C:
+			if !send(": keepalive\n\n") {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
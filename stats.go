@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// holdTimeStats summarises how long the locks on a key were held
+type holdTimeStats struct {
+	Key    string  `json:"key,omitempty"`
+	Count  uint64  `json:"count"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+	MaxMs  float64 `json:"maxMs"`
+}
+
+func summarise(key string, h *histogram) holdTimeStats {
+	stats := holdTimeStats{Key: key, Count: h.count, P50Ms: h.quantile(0.5) * 1000, P99Ms: h.quantile(0.99) * 1000, MaxMs: h.max * 1000}
+	if h.count != 0 {
+		stats.MeanMs = h.sum / float64(h.count) * 1000
+	}
+	return stats
+}
+
+// holdTimes returns the hold times of the keys filter selects, longest held
+// first, and all of them together
+func holdTimes(filter keyFilter) (keys []holdTimeStats, all holdTimeStats) {
+	total := newHistogram(holdBuckets)
+	metrics.mu.Lock()
+	for stored, h := range metrics.keyHoldTimes {
+		if filter.matches(stored) {
+			keys = append(keys, summarise(clientKey(stored), h))
+			total.merge(h)
+		}
+	}
+	metrics.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].MaxMs != keys[j].MaxMs {
+			return keys[i].MaxMs > keys[j].MaxMs
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys, summarise("", total)
+}
+
+// millis turns a count of milliseconds into a duration for printing
+func millis(ms float64) time.Duration {
+	return time.Duration(ms * float64(time.Millisecond)).Round(time.Millisecond)
+}
+
+func writeHoldTimeLine(w io.Writer, name string, stats holdTimeStats) {
+	fmt.Fprintf(w, "%s count=%d mean=%s p50=%s p99=%s max=%s\n", name, stats.Count, millis(stats.MeanMs), millis(stats.P50Ms), millis(stats.P99Ms), millis(stats.MaxMs))
+}
+
+// holdTimesHandler answers GET /stats/holdtimes?prefix=PREFIX&match=GLOB&limit=N
+// with how long the locks released so far were held: a first "all" line
+// over every key selected, then one line per key, longest held
+// first. percentiles are estimated from the histogram buckets
+func holdTimesHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := limitParam(query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	filter, ok := filterParams(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	keys, all := holdTimes(filter)
+	keys = keys[:min(limit, len(keys))]
+	if wantsJSON(r) {
+		if keys == nil {
+			keys = []holdTimeStats{}
+		}
+		writeJSON(w, 0, struct {
+			All  holdTimeStats   `json:"all"`
+			Keys []holdTimeStats `json:"keys"`
+		}{all, keys})
+		return
+	}
+	writeHoldTimeLine(w, "all", all)
+	for _, stats := range keys {
+		writeHoldTimeLine(w, stats.Key, stats)
+	}
+}
+
+// keyStat counts what became of the lock requests on a key since the start
+type keyStat struct {
+	Key       string  `json:"key"`
+	Granted   uint64  `json:"granted"`
+	Refused   uint64  `json:"refused"`
+	AvgWaitMs float64 `json:"avgWaitMs"`
+	Waiters   int     `json:"waiters"`
+}
+
+// keyStats returns the request counts of the keys filter selects, most
+// refused first
+func keyStats(filter keyFilter) []keyStat {
+	byKey := map[string]*keyStat{}
+	stat := func(stored string) *keyStat {
+		if !filter.matches(stored) {
+			return nil
+		}
+		if byKey[stored] == nil {
+			byKey[stored] = &keyStat{Key: clientKey(stored)}
+		}
+		return byKey[stored]
+	}
+
+	metrics.mu.Lock()
+	for stored, n := range metrics.grants {
+		if st := stat(stored); st != nil {
+			st.Granted = n
+			st.AvgWaitMs = float64(metrics.waited[stored]) / float64(n) / float64(time.Millisecond)
+		}
+	}
+	for stored, n := range metrics.contention {
+		if st := stat(stored); st != nil {
+			st.Refused = n
+		}
+	}
+	metrics.mu.Unlock()
+	for _, s := range shards {
+		s.mu.Lock()
+		for stored, counter := range s.locks {
+			if len(counter.queue) == 0 {
+				continue
+			}
+			if st := stat(stored); st != nil {
+				st.Waiters = len(counter.queue)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	stats := make([]keyStat, 0, len(byKey))
+	for _, st := range byKey {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Refused != stats[j].Refused {
+			return stats[i].Refused > stats[j].Refused
+		}
+		if stats[i].Waiters != stats[j].Waiters {
+			return stats[i].Waiters > stats[j].Waiters
+		}
+		return stats[i].Key < stats[j].Key
+	})
+	return stats
+}
+
+// keyStatsHandler answers GET /stats/keys?prefix=PREFIX&match=GLOB&limit=N
+// with one line per key selected: the requests granted and refused
+// since the start, the average time granted requests queued and the
+// requests queued right now, most refused first
+func keyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	limit, ok := limitParam(query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	filter, ok := filterParams(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	stats := keyStats(filter)
+	stats = stats[:min(limit, len(stats))]
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Keys []keyStat `json:"keys"`
+		}{stats})
+		return
+	}
+	for _, st := range stats {
+		fmt.Fprintf(w, "%s granted=%d refused=%d wait=%s waiters=%d\n", st.Key, st.Granted, st.Refused, millis(st.AvgWaitMs), st.Waiters)
+	}
+}
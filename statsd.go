@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// the statsd exporter pushes the counters of /metrics to a statsd or
+// dogstatsd server over udp every interval, for where nothing scrapes
+// prometheus. counters go out as the increase since the last push,
+// gauges as they are and the latency and hold time histograms as the
+// number of observations and their mean in milliseconds over the
+// interval. the per key series stay on /metrics only
+
+// largest packet sent, what fits an ethernet frame after the ip and udp
+// headers with room to spare
+const statsdPacket = 1432
+
+// statsdTag is a dimension of a series, sent as a dogstatsd tag or folded
+// into the name for plain statsd
+type statsdTag struct {
+	name, value string
+}
+
+type statsdExporter struct {
+	conn   net.Conn
+	prefix string
+	// dogstatsd tags series, plain statsd gets them in the name
+	dogstatsd bool
+	// appended to the tags of every series with dogstatsd
+	tags []string
+	// the totals at the last push, by series
+	last map[string]float64
+	buf  bytes.Buffer
+}
+
+// newStatsdExporter sends to addr, host:port. tags are dogstatsd
+// name:value tags for every series and need dogstatsd
+func newStatsdExporter(addr, prefix string, dogstatsd bool, tags []string) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdExporter{conn: conn, prefix: prefix, dogstatsd: dogstatsd, tags: tags, last: map[string]float64{}}, nil
+}
+
+// run pushes every interval for as long as the server runs
+func (e *statsdExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.push()
+	}
+}
+
+// sanitize turns a label value into a statsd name or tag part, which may
+// not hold the separators of the wire format
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", "\n", "_", " ", "_")
+
+// line queues one series, flushing the packet first if it would not fit
+func (e *statsdExporter) line(name string, value float64, kind string, tags ...statsdTag) {
+	var b strings.Builder
+	b.WriteString(e.prefix)
+	b.WriteString(name)
+	if !e.dogstatsd {
+		for _, tag := range tags {
+			b.WriteString("." + statsdEscaper.Replace(tag.value))
+		}
+	}
+	fmt.Fprintf(&b, ":%g|%s", value, kind)
+	if e.dogstatsd && len(tags)+len(e.tags) != 0 {
+		parts := append([]string{}, e.tags...)
+		for _, tag := range tags {
+			parts = append(parts, tag.name+":"+statsdEscaper.Replace(tag.value))
+		}
+		b.WriteString("|#" + strings.Join(parts, ","))
+	}
+	if e.buf.Len() != 0 && e.buf.Len()+1+b.Len() > statsdPacket {
+		e.flush()
+	}
+	if e.buf.Len() != 0 {
+		e.buf.WriteByte('\n')
+	}
+	e.buf.WriteString(b.String())
+}
+
+// delta returns how much the total of series grew since the last push
+func (e *statsdExporter) delta(series string, total float64) float64 {
+	d := total - e.last[series]
+	e.last[series] = total
+	return d
+}
+
+// counter queues the increase of a counter since the last push
+func (e *statsdExporter) counter(name string, total uint64, tags ...statsdTag) {
+	series := name
+	for _, tag := range tags {
+		series += "," + tag.name + "=" + tag.value
+	}
+	if d := e.delta(series, float64(total)); d != 0 {
+		e.line(name, d, "c", tags...)
+	}
+}
+
+// histogram queues the observations of h since the last push and their
+// mean in milliseconds
+func (e *statsdExporter) histogram(name string, h *histogram, tags ...statsdTag) {
+	series := name
+	for _, tag := range tags {
+		series += "," + tag.name + "=" + tag.value
+	}
+	n := e.delta(series+",count", float64(h.count))
+	sum := e.delta(series+",sum", h.sum)
+	if n == 0 {
+		return
+	}
+	e.line(name+".count", n, "c", tags...)
+	e.line(name+".mean_ms", sum/n*1000, "g", tags...)
+}
+
+func (e *statsdExporter) flush() {
+	if e.buf.Len() == 0 {
+		return
+	}
+	if _, err := e.conn.Write(e.buf.Bytes()); err != nil {
+		slog.Debug("statsd push failed", "err", err)
+	}
+	e.buf.Reset()
+}
+
+// push sends the current counters
+func (e *statsdExporter) push() {
+	held := heldByMode()
+	e.line("keys", float64(tableKeys.Load()), "g")
+	for _, mode := range sortedKeys(held) {
+		e.line("locks_held", float64(held[mode]), "g", statsdTag{"mode", mode})
+	}
+
+	metrics.mu.Lock()
+	for _, mode := range sortedKeys(metrics.acquisitions) {
+		e.counter("acquisitions", metrics.acquisitions[mode], statsdTag{"mode", mode})
+	}
+	for _, mode := range sortedKeys(metrics.failures) {
+		e.counter("acquisition_failures", metrics.failures[mode], statsdTag{"mode", mode})
+	}
+	for _, mode := range sortedKeys(metrics.unlockFailures) {
+		e.counter("unlock_failures", metrics.unlockFailures[mode], statsdTag{"mode", mode})
+	}
+	for _, endpoint := range sortedKeys(metrics.latency) {
+		e.histogram("request_duration", metrics.latency[endpoint], statsdTag{"endpoint", endpoint})
+	}
+	for _, mode := range sortedKeys(metrics.holdTimes) {
+		e.histogram("hold_duration", metrics.holdTimes[mode], statsdTag{"mode", mode})
+	}
+	metrics.mu.Unlock()
+
+	namespaces.Lock()
+	for _, ns := range sortedKeys(namespaces.granted) {
+		e.counter("namespace_acquisitions", namespaces.granted[ns], statsdTag{"namespace", ns})
+		e.line("namespace_locks_held", float64(namespaces.held[ns]), "g", statsdTag{"namespace", ns})
+	}
+	namespaces.Unlock()
+	e.flush()
+}
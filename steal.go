@@ -0,0 +1,100 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"strconv"
+)
+
+// steal takes the write lock on path over from its holder, one known to be
+// dead whose lease has not run out yet. token must be the fencing token of
+// the lock taken over, so a steal meant for a dead holder never displaces
+// whoever took the key since. the old lockID is released and audited with
+// by as the one stealing, the new one gets a fresh fencing token. the old
+// lockID is only released once the new lock is known to be grantable, and
+// handed back should the grant fail anyway
+func steal(path string, token int64, opts lockOptions, by string) (string, int64, failure, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	switch {
+	case counter == nil || counter.state != 1:
+		return "", 0, errNotHeld, false
+	case counter.fence != token:
+		return "", 0, errStaleToken, false
+	case clientFull(opts.quotaClient()):
+		return "", 0, errClientQuota, false
+	}
+	if f, fails := counter.handOverFails(opts); fails {
+		return "", 0, f, false
+	}
+	stolen, fence, version := maps.Clone(counter.lockID), counter.fence, counter.version
+	for id, h := range stolen {
+		audit.record(eventStolen, path, counter.state, id, h, by)
+		counter.release(id, eventStolen)
+	}
+	// still under the shard mutex, so no waiter woken by the release can
+	// get in first
+	id := counter.grant(1, opts)
+	if len(id) == 0 {
+		for id, h := range stolen {
+			counter.reinstate(id, h, fence, version)
+		}
+		return "", 0, errInternal, false
+	}
+	return id, counter.fence, failure{}, true
+}
+
+// stealHandler answers POST /steal?key=PATH&force-token=TOKEN&ttl=DURATION
+// with a new lock id and fencing token for PATH, taken over from the write
+// lock holding it with fencing token TOKEN. owner=, session=, purpose= and
+// label= apply to the new lock as for /lock. a token that is not the
+// current one is refused with 409 stale_token
+func stealHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	token, err := strconv.ParseInt(query.Get("force-token"), 10, 64)
+	if err != nil || token <= 0 {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl, ok = leaseFor(ttl, path); !ok {
+		replyFailure(w, r, errTTLTooLong)
+		return
+	}
+	if closedForLocks() {
+		replyFailure(w, r, closedFailure())
+		return
+	}
+	opts := lockOptions{ttl: ttl, principal: callerName(r), session: query.Get("session"), owner: query.Get("owner"),
+		addr: remoteHost(r)}
+	if !metadataParams(query, &opts) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	id, fence, f, ok := steal(path, token, opts, callerName(r))
+	if !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	metrics.acquired(false, path, 0)
+	replyGranted(w, r, id, fence)
+}
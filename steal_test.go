@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestSteal(t *testing.T) {
+	t.Cleanup(func() { forceUnlock("steal/a", "test") })
+	old, fence := store.lock("steal/a", lockOptions{owner: "dead"})
+	if _, _, f, ok := steal("steal/a", fence+1, lockOptions{owner: "B"}, "test"); ok || f != errStaleToken {
+		t.Errorf("steal with a stale token: ok %v %s, want %s", ok, f.code, errStaleToken.code)
+	}
+	id, newFence, f, ok := steal("steal/a", fence, lockOptions{owner: "B"}, "test")
+	if !ok {
+		t.Fatalf("steal: %s", f.code)
+	}
+	if newFence <= fence {
+		t.Errorf("stolen lock has fencing token %d, want more than %d", newFence, fence)
+	}
+	l, _, _ := lockStatus("steal/a")
+	if len(l.ids) != 1 || l.ids[0] != id || l.holders[0].owner != "B" {
+		t.Errorf("steal/a held by %v, want %s alone", l.ids, id)
+	}
+	if store.unlock("steal/a", old) {
+		t.Error("the stolen lock id still unlocks steal/a")
+	}
+}
+
+func TestStealHandsBack(t *testing.T) {
+	t.Cleanup(func() { forceUnlock("steal/b", "test") })
+	old, fence := store.lock("steal/b", lockOptions{owner: "dead"})
+	wal = fullWAL(t)
+	t.Cleanup(func() { wal = nil })
+	if _, _, f, ok := steal("steal/b", fence, lockOptions{owner: "B"}, "test"); ok || f != errInternal {
+		t.Fatalf("steal that can't be logged: ok %v %s, want %s", ok, f.code, errInternal.code)
+	}
+	if _, _, f, ok := steal("steal/b", fence, lockOptions{owner: "B"}, "test"); ok || f != errInternal {
+		t.Errorf("steal while the wal is failing: ok %v %s, want %s", ok, f.code, errInternal.code)
+	}
+	l, _, got := lockStatus("steal/b")
+	if len(l.ids) != 1 || l.ids[0] != old || got != fence || l.holders[0].owner != "dead" {
+		t.Errorf("steal/b held by %v with fencing token %d, want %s with %d", l.ids, got, old, fence)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// backend keeps the lock state behind the lock, unlock, rlock, runlock,
+// renew and fence endpoints. like the lock table functions a method
+// returns "" or false when the lock is not granted, not held or the state
+// could not be reached
+type backend interface {
+	lock(path string, opts lockOptions) (string, int64)
+	rlock(path string, opts lockOptions) string
+	// waitLock blocks up to wait for the lock to be granted, giving up
+	// once ctx is done
+	waitLock(ctx context.Context, path string, readLock bool, opts lockOptions, wait time.Duration) (string, int64)
+	unlock(path string, lockID string) bool
+	runlock(path string, lockID string) bool
+	renew(path string, lockID string, ttl time.Duration) bool
+	validateFence(path string, token int64) bool
+}
+
+// store is the backend in use. it is set once at startup before any
+// request is served
+var store backend = memoryBackend{}
+
+// memoryBackend is the in-process lock table, every endpoint works with it
+// and with leaseBackend which builds on it
+type memoryBackend struct{}
+
+func (memoryBackend) lock(path string, opts lockOptions) (string, int64) { return lock(path, opts) }
+func (memoryBackend) rlock(path string, opts lockOptions) string         { return rlock(path, opts) }
+func (memoryBackend) unlock(path string, lockID string) bool             { return unlock(path, lockID) }
+func (memoryBackend) runlock(path string, lockID string) bool            { return runlock(path, lockID) }
+func (memoryBackend) validateFence(path string, token int64) bool        { return validateFence(path, token) }
+
+func (memoryBackend) waitLock(ctx context.Context, path string, readLock bool, opts lockOptions, wait time.Duration) (string, int64) {
+	return waitLock(ctx, path, readLock, opts, wait)
+}
+
+func (memoryBackend) renew(path string, lockID string, ttl time.Duration) bool {
+	return renew(path, lockID, ttl)
+}
+
+// sharedStore reports whether lock state lives outside the process, in
+// which case only the backend's endpoints work
+func sharedStore() bool {
+	_, shared := store.(*redisBackend)
+	return shared
+}
+
+// localOnly answers 501 for an endpoint that needs the in-process lock
+// table while another backend is in use
+func localOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if sharedStore() {
+			replyFailure(w, r, errUnsupported)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// sleepCtx pauses a polling backend for d, false if ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// under systemd socket activation systemd binds the ports of the socket
+// units and hands them to the server as file descriptors from 3 on,
+// LISTEN_FDS saying how many and LISTEN_FDNAMES what FileDescriptorName=
+// named them. the server serves on those instead of binding -listen and
+// -admin-listen itself, and since systemd keeps the sockets open
+// connections arriving during a restart wait in their backlog instead of
+// being refused
+
+// the first file descriptor systemd passes
+const listenFdsStart = 3
+
+// activatedListeners returns the sockets systemd passed this process: the
+// one named "admin" serves the admin endpoints, the other the api. both
+// are nil without socket activation. the variables are cleared so the
+// processes the server starts don't take the sockets for theirs
+func activatedListeners() (api, admin net.Listener, err error) {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		return nil, nil, nil
+	}
+	fdNames := strings.Split(names, ":")
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("socket %d (%s): %w", i, name, err)
+		}
+		switch {
+		case name == "admin" && admin == nil:
+			admin = l
+		case name != "admin" && api == nil:
+			api = l
+		default:
+			l.Close()
+			return nil, nil, fmt.Errorf("socket %d (%s): only one api and one admin socket can be passed", i, name)
+		}
+	}
+	return api, admin, nil
+}
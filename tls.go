@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often a reloading certReloader looks at the certificate files
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in certPath/keyPath and, if reload is
+// set, picks up rotated files without a restart
+type certReloader struct {
+	certPath string
+	keyPath  string
+	reload   bool
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certPath, keyPath string, reload bool) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath, reload: reload}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads the key pair from disk. caller must hold mu or own c exclusively
+func (c *certReloader) load() error {
+	info, err := os.Stat(c.certPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = info.ModTime()
+	c.checked = time.Now()
+	return nil
+}
+
+// getCertificate is the tls.Config hook, a failed reload keeps serving the
+// previous certificate
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reload && time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if info, err := os.Stat(c.certPath); err == nil && !info.ModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				slog.Error("tls certificate reload failed", "err", err)
+			} else {
+				slog.Info("tls certificate reloaded", "cert", c.certPath)
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// tlsConfig serves the certificate of c. with clientCAs set clients must
+// present a certificate signed by one of them, or may if optional is set
+func (c *certReloader) tlsConfig(clientCAs *x509.CertPool, optional bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if optional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return config
+}
+
+// serverTLS returns the tls config of the -tls-cert and -tls-key
+// certificate, verifying client certificates against the ca file clientCA
+// if it is set, or nil when there is no certificate
+func serverTLS(certPath, keyPath, clientCA string, reload, clientOptional bool) (*tls.Config, error) {
+	if len(certPath) == 0 && len(keyPath) == 0 {
+		return nil, nil
+	}
+	if len(certPath) == 0 || len(keyPath) == 0 {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	certs, err := newCertReloader(certPath, keyPath, reload)
+	if err != nil {
+		return nil, err
+	}
+	var clientCAs *x509.CertPool
+	if len(clientCA) != 0 {
+		if clientCAs, err = loadClientCAs(clientCA); err != nil {
+			return nil, err
+		}
+	}
+	return certs.tlsConfig(clientCAs, clientOptional), nil
+}
+
+// loadClientCAs reads the PEM bundle of the authorities client
+// certificates must be signed by
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// clientCerts authenticates requests by the verified client certificate
+// of their connection
+type clientCerts struct {
+	// certificate identity -> principal named after it
+	ids map[string]principal
+}
+
+// loadClientCerts reads a file with one "IDENTITY read|full|admin
+// [NAMESPACE...]" entry per line. IDENTITY is matched against the URI,
+// DNS and email SANs of the certificate and then its subject common name,
+// e.g. spiffe://prod/billing or billing.svc. blank lines and lines
+// starting with # are ignored
+func loadClientCerts(path string) (*clientCerts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &clientCerts{ids: map[string]principal{}}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: want IDENTITY PERMISSION [NAMESPACE...]", path, line)
+		}
+		perms, ok := parsePermission(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unknown permission %q", path, line, fields[1])
+		}
+		scope, err := parseNamespaces(fields[2:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		c.ids[fields[0]] = principal{name: fields[0], perms: perms, namespaces: scope}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// certIdentities lists the names cert may be known by, most specific first
+func certIdentities(cert *x509.Certificate) []string {
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	if len(cert.Subject.CommonName) != 0 {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return ids
+}
+
+func (c *clientCerts) authenticate(r *http.Request) (principal, bool) {
+	// VerifiedChains is only set once the chain checked out against -tls-client-ca
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return principal{}, false
+	}
+	for _, id := range certIdentities(r.TLS.VerifiedChains[0][0]) {
+		if p, ok := c.ids[id]; ok {
+			return p, true
+		}
+	}
+	return principal{}, false
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// spans follow the w3c trace context: a request carrying a traceparent
+// header joins the caller's trace as a child span, any other request starts
+// a trace of its own. the span of a request is answered in the
+// traceresponse header and written to its log line, and the lock core
+// opens child spans for the wait of a blocking lock and for the grant and
+// release a lock request makes. with -otlp-endpoint the spans of sampled traces are sent to an
+// OpenTelemetry collector as OTLP/HTTP JSON, the child spans are also
+// logged at debug level. this is trace context and span export only, not
+// the OpenTelemetry sdk, whose go.opentelemetry.io modules the tree does
+// not depend on: no baggage, no sampler but the caller's sampled flag and
+// no metrics or logs over OTLP
+
+// kinds of span in OTLP
+const (
+	spanInternal = 1
+	spanServer   = 2
+)
+
+// span is one traced operation, a request or a step of the lock core
+type span struct {
+	traceID string
+	spanID  string
+	// the caller's span, empty if the request started the trace
+	parentID string
+	// trace flags, 01 when the caller sampled the trace
+	flags string
+
+	name  string
+	kind  int
+	start time.Time
+}
+
+// parseTraceparent reads a version 00 traceparent header, ok is false if
+// it is missing or malformed
+func parseTraceparent(h string) (traceID, parentID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", "", false
+	}
+	traceID, parentID, flags = parts[1], parts[2], parts[3]
+	if !isTraceHex(traceID, 32) || !isTraceHex(parentID, 16) || !isTraceHex(flags, 2) {
+		return "", "", "", false
+	}
+	// all zero ids are invalid
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", "", false
+	}
+	return traceID, parentID, flags, true
+}
+
+// isTraceHex reports whether s is n lower case hex digits
+func isTraceHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newSpanID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sampled reports whether the trace of s is exported
+func (s span) sampled() bool {
+	flags, err := strconv.ParseUint(s.flags, 16, 8)
+	return err == nil && flags&1 != 0
+}
+
+// startSpan opens the span of r, a request to endpoint, and answers it in
+// the traceresponse header, tracestate is passed back unchanged. a trace
+// the request starts is sampled while spans are exported
+func startSpan(w http.ResponseWriter, r *http.Request, endpoint string) span {
+	s := span{spanID: newSpanID(), flags: "00", name: endpoint, kind: spanServer, start: time.Now()}
+	if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID, s.flags = traceID, parentID, flags
+		if state := r.Header.Get("tracestate"); len(state) != 0 {
+			w.Header().Set("tracestate", state)
+		}
+	} else {
+		s.traceID = newID()
+		if spanExporter.Load() != nil {
+			s.flags = "01"
+		}
+	}
+	w.Header().Set("traceresponse", "00-"+s.traceID+"-"+s.spanID+"-"+s.flags)
+	return s
+}
+
+// requestSpan is the span of the request ctx is from, the zero span
+// outside of one
+func requestSpan(ctx context.Context) span {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return entry.span
+	}
+	return span{}
+}
+
+// startChild opens a span named name under parent, nil if parent is the
+// zero span
+func startChild(parent span, name string) *span {
+	if len(parent.traceID) == 0 {
+		return nil
+	}
+	return &span{traceID: parent.traceID, spanID: newSpanID(), parentID: parent.spanID, flags: parent.flags,
+		name: name, kind: spanInternal, start: time.Now()}
+}
+
+// end finishes the child span s with the attributes attrs, name and value
+// in turn, logging it and exporting it if its trace is sampled. a nil s
+// is ignored
+func (s *span) end(attrs ...string) {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		args := []any{"name", s.name, "trace_id", s.traceID, "span_id", s.spanID, "parent_span_id", s.parentID,
+			"duration_ms", float64(end.Sub(s.start).Microseconds()) / 1000}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			args = append(args, attrs[i], attrs[i+1])
+		}
+		slog.Debug("span", args...)
+	}
+	s.export(end, false, attrs...)
+}
+
+// export queues s, ended at end and failed if set, for the collector of
+// -otlp-endpoint if its trace is sampled
+func (s *span) export(end time.Time, failed bool, attrs ...string) {
+	e := spanExporter.Load()
+	if e == nil || !s.sampled() {
+		return
+	}
+	o := otlpSpan{TraceID: s.traceID, SpanID: s.spanID, ParentSpanID: s.parentID, Name: s.name, Kind: s.kind,
+		Start: strconv.FormatInt(s.start.UnixNano(), 10), End: strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: []otlpAttribute{}}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		o.Attributes = append(o.Attributes, otlpAttribute{Key: attrs[i], Value: otlpValue{String: attrs[i+1]}})
+	}
+	if failed {
+		// STATUS_CODE_ERROR
+		o.Status.Code = 2
+	}
+	select {
+	case e.queue <- o:
+	default:
+		// the collector can't keep up, the span is dropped
+	}
+}
+
+// the OTLP/HTTP JSON encoding of a span
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	String string `json:"stringValue"`
+}
+
+// how many spans wait for the collector before new ones are dropped, and
+// how many go in one export
+const (
+	spanQueue = 4096
+	spanBatch = 512
+)
+
+// how often the queued spans are sent
+const spanFlushInterval = 5 * time.Second
+
+// otlpExporter sends the spans queued to an OpenTelemetry collector
+type otlpExporter struct {
+	url     string
+	service string
+	queue   chan otlpSpan
+	client  *http.Client
+	// closed to send what is queued and stop
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// spanExporter is the exporter of -otlp-endpoint, nil if spans are not
+// exported
+var spanExporter atomic.Pointer[otlpExporter]
+
+// startSpanExport sends the spans of sampled traces to the collector at
+// endpoint, OTLP/HTTP's /v1/traces is appended unless endpoint has a path
+func startSpanExport(endpoint, service string) {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.Contains(strings.TrimPrefix(strings.TrimPrefix(url, "http://"), "https://"), "/") {
+		url += "/v1/traces"
+	}
+	e := &otlpExporter{url: url, service: service, queue: make(chan otlpSpan, spanQueue),
+		client: &http.Client{Timeout: 10 * time.Second}, stop: make(chan struct{})}
+	e.done.Add(1)
+	go e.run()
+	spanExporter.Store(e)
+}
+
+// stopSpanExport sends the spans still queued and stops exporting
+func stopSpanExport() {
+	e := spanExporter.Swap(nil)
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	e.done.Wait()
+}
+
+func (e *otlpExporter) run() {
+	defer e.done.Done()
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-e.queue:
+			if batch = append(batch, s); len(batch) < spanBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for len(e.queue) != 0 && len(batch) < spanQueue {
+				batch = append(batch, <-e.queue)
+			}
+			e.send(batch)
+			return
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+// send posts spans to the collector, they are lost if it fails
+func (e *otlpExporter) send(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	rs := resourceSpans{ScopeSpans: []scopeSpans{{Spans: spans}}}
+	rs.Resource.Attributes = []otlpAttribute{{Key: "service.name", Value: otlpValue{String: e.service}}}
+	rs.ScopeSpans[0].Scope.Name = "lockserver"
+	body, _ := json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{rs}})
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("span export failed", "err", err, "spans", len(spans))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("span export failed", "status", resp.StatusCode, "spans", len(spans))
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// handOverFails returns why a new lock for opts could not be granted on
+// counter right now, checked before a transfer or steal releases the lock
+// it replaces so a grant that fails does not leave the key to a waiter.
+// caller must hold the shard mutex
+func (counter *lockCounter) handOverFails(opts lockOptions) (failure, bool) {
+	switch {
+	case following():
+		return errFollower, true
+	case wal.failing() != nil:
+		return errInternal, true
+	case len(opts.session) != 0 && !sessionExists(opts.session):
+		return errNoSession, true
+	}
+	return failure{}, false
+}
+
+// reinstate gives counter back the holder h of lockID, released by a
+// transfer or steal whose new grant failed all the same, with the fence
+// and version it had. the quotas and the tree let it back in as they do a
+// replayed lock. caller must hold the shard mutex
+func (counter *lockCounter) reinstate(lockID string, h *holder, fence, version int64) {
+	ref := lockRef{counter.key, lockID}
+	if len(h.session) != 0 && !attachLock(h.session, ref) {
+		// the session ended meanwhile, taking its locks along
+		return
+	}
+	if err := wal.grant(counter.key, lockID, h.mode, h, fence); err != nil {
+		slog.Error("wal write failed", "err", err)
+	}
+	nsRestore(counter.key)
+	clientRestore(h.quotaClient())
+	if hierarchical {
+		treeRestore(counter.key, h.mode)
+	}
+	if len(h.txn) != 0 {
+		attachTxn(h.txn, ref)
+	}
+	if !h.expiry.IsZero() {
+		scheduleExpiry(counter.key, lockID, h.expiry, false)
+	}
+	if h.mode == 1 {
+		counter.fence = fence
+	}
+	counter.version = version
+	counter.state = strongest(counter.state, h.mode)
+	counter.lockID[lockID] = h
+	slog.Warn("lock handed back to its holder", "key", counter.key, "lock_id", lockID)
+	publish(lockEvent{Type: eventGranted, Key: counter.key, Mode: stateName(h.mode), LockID: lockID, Time: time.Now()})
+}
+
+// transfer hands the lock lockID holds on path to owner in one step: the
+// lockID is released and a new one of the same mode granted to owner
+// before any waiter can get in, a write lock with a new fencing token.
+// the new lock keeps the old lease, purpose and labels unless opts sets
+// others. lockID is only released once the new lock is known to be
+// grantable, and handed back should the grant fail anyway
+func transfer(path, lockID string, opts lockOptions) (string, int64, failure, bool) {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil || counter.lockID[lockID] == nil {
+		return "", 0, errNotHeld, false
+	}
+	h := counter.lockID[lockID]
+	if h.holds > 1 {
+		return "", 0, errReentrant, false
+	}
+	if client := opts.quotaClient(); client != h.quotaClient() && clientFull(client) {
+		return "", 0, errClientQuota, false
+	}
+	if len(opts.purpose) == 0 && opts.labels == nil {
+		opts.purpose, opts.labels = h.purpose, h.labels
+	}
+	if opts.ttl == 0 && !h.expiry.IsZero() {
+		opts.ttl = max(time.Until(h.expiry), time.Millisecond)
+	}
+	if f, fails := counter.handOverFails(opts); fails {
+		return "", 0, f, false
+	}
+	state, fence, version := h.mode, counter.fence, counter.version
+	counter.release(lockID, eventTransferred)
+	// still under the shard mutex, so no waiter woken by the release can
+	// get in first
+	id := counter.grant(state, opts)
+	if len(id) == 0 {
+		counter.reinstate(lockID, h, fence, version)
+		return "", 0, errInternal, false
+	}
+	if state != 1 {
+		return id, 0, failure{}, true
+	}
+	return id, counter.fence, failure{}, true
+}
+
+// transferHandler answers POST /transfer?key=PATH&lock-id=LOCKID&to-owner=X
+// with the lock id for X of the lock LOCKID held on PATH, and its new
+// fencing token for a write lock. ttl= gives the new lock a lease of its
+// own and session= binds it to the recipient's session, purpose= and
+// label= replace the ones the lock was taken with
+func transferHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	path, ok := keyParam(r, query)
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	ttl, ok := durationParam(query, "ttl")
+	opts := lockOptions{ttl: ttl, principal: callerName(r), session: query.Get("session"), owner: query.Get("to-owner"),
+		addr: remoteHost(r)}
+	if !ok || len(opts.owner) == 0 || !metadataParams(query, &opts) {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	if ttl != 0 {
+		if opts.ttl, ok = leaseFor(ttl, path); !ok {
+			replyFailure(w, r, errTTLTooLong)
+			return
+		}
+	}
+	if len(opts.session) != 0 && !sessionExists(opts.session) {
+		replyFailure(w, r, errNoSession)
+		return
+	}
+	id, fence, f, ok := transfer(path, query.Get("lock-id"), opts)
+	if !ok {
+		replyFailure(w, r, f)
+		return
+	}
+	replyGranted(w, r, id, fence)
+}
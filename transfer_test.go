@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	t.Cleanup(func() { forceUnlock("xfer/a", "test") })
+	old, fence := store.lock("xfer/a", lockOptions{owner: "A", purpose: "deploy"})
+	if _, _, f, ok := transfer("xfer/a", "nobody", lockOptions{owner: "B"}); ok || f != errNotHeld {
+		t.Errorf("transfer of a lock id not held: ok %v %s", ok, f.code)
+	}
+	id, newFence, f, ok := transfer("xfer/a", old, lockOptions{owner: "B"})
+	if !ok {
+		t.Fatalf("transfer: %s", f.code)
+	}
+	if newFence <= fence {
+		t.Errorf("transferred lock has fencing token %d, want more than %d", newFence, fence)
+	}
+	l, _, _ := lockStatus("xfer/a")
+	if len(l.ids) != 1 || l.ids[0] != id || l.holders[0].owner != "B" || l.holders[0].purpose != "deploy" {
+		t.Errorf("xfer/a held by %v %+v, want %s for B with the old purpose", l.ids, l.holders, id)
+	}
+}
+
+func TestTransferHandsBack(t *testing.T) {
+	t.Cleanup(func() { forceUnlock("xfer/b", "test") })
+	old, fence := store.lock("xfer/b", lockOptions{owner: "A"})
+	if _, _, f, ok := transfer("xfer/b", old, lockOptions{owner: "B", session: "no-such-session"}); ok || f != errNoSession {
+		t.Errorf("transfer to a session that does not exist: ok %v %s", ok, f.code)
+	}
+	wal = fullWAL(t)
+	t.Cleanup(func() { wal = nil })
+	if _, _, f, ok := transfer("xfer/b", old, lockOptions{owner: "B"}); ok || f != errInternal {
+		t.Fatalf("transfer that can't be logged: ok %v %s, want %s", ok, f.code, errInternal.code)
+	}
+	l, _, got := lockStatus("xfer/b")
+	if len(l.ids) != 1 || l.ids[0] != old || got != fence || l.holders[0].owner != "A" {
+		t.Errorf("xfer/b held by %v with fencing token %d, want %s with %d", l.ids, got, old, fence)
+	}
+}
+
+func TestTransferNeedsWrite(t *testing.T) {
+	setAuth(&apiKeys{keys: map[[sha256.Size]byte]principal{
+		sha256.Sum256([]byte("reader")): {name: "reader", perms: permRead},
+	}})
+	t.Cleanup(func() { setAuth(nil) })
+	r := httptest.NewRequest(http.MethodPost, "/transfer?key=xfer/c&lock-id=x&to-owner=B", nil)
+	r.Header.Set("X-Api-Key", "reader")
+	w := httptest.NewRecorder()
+	requirePerm(permWrite, transferHandler)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("transfer with a read only key: %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
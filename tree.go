@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// hierarchical treats keys as slash separated paths: a lock on a path also
+// conflicts with locks on its ancestors and descendants, a write lock on
+// /a/b keeps out readers and writers of /a and /a/b/c while read locks on
+// /a and /a/b may be held together. set once at startup
+var hierarchical bool
+
+// treeNode counts the holders at and below one path
+type treeNode struct {
+	readers, writers       int // holders of exactly this path
+	subReaders, subWriters int // holders strictly below this path
+}
+
+// tree indexes held locks by path so conflicts across shards are checked
+// atomically. lock order is shard mutex before tree
+var tree = struct {
+	sync.Mutex
+	nodes map[string]*treeNode
+	// closed and replaced whenever a lock is released
+	changed chan struct{}
+}{nodes: map[string]*treeNode{}, changed: make(chan struct{})}
+
+// ancestors returns the proper ancestors of key, nearest first: /a/b/c has
+// ancestors /a/b and /a
+func ancestors(key string) []string {
+	var parents []string
+	key = strings.TrimRight(key, "/")
+	for i := strings.LastIndex(key, "/"); i > 0; i = strings.LastIndex(key, "/") {
+		key = key[:i]
+		parents = append(parents, key)
+	}
+	return parents
+}
+
+func treeGet(key string) *treeNode {
+	node := tree.nodes[key]
+	if node == nil {
+		node = &treeNode{}
+		tree.nodes[key] = node
+	}
+	return node
+}
+
+// treeReserve records a lock of state (1 write, 2 read) on key if it does not
+// conflict with a lock on an ancestor or descendant, conflicts on key
+// itself are left to its lockCounter. it returns false on conflict
+func treeReserve(key string, state int) bool {
+	tree.Lock()
+	defer tree.Unlock()
+
+	parents := ancestors(key)
+	if treeConflict(key, parents, state) {
+		return false
+	}
+	treeAdd(key, parents, state, 1)
+	return true
+}
+
+// treeFits reports whether a lock of state on key would be let in by the
+// rest of the tree right now
+func treeFits(key string, state int) bool {
+	tree.Lock()
+	defer tree.Unlock()
+
+	return !treeConflict(key, ancestors(key), state)
+}
+
+// treeConflict reports whether a lock of state on key conflicts with a lock
+// on one of its parents or descendants. caller must hold tree
+func treeConflict(key string, parents []string, state int) bool {
+	if node := tree.nodes[key]; node != nil {
+		if node.subWriters != 0 || (state == 1 && node.subReaders != 0) {
+			return true
+		}
+	}
+	for _, parent := range parents {
+		if node := tree.nodes[parent]; node != nil {
+			if node.writers != 0 || (state == 1 && node.readers != 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// treeUpgrade turns a read lock on key into a write lock if that does not
+// conflict with the rest of the tree, it returns false on conflict
+func treeUpgrade(key string) bool {
+	tree.Lock()
+	defer tree.Unlock()
+
+	parents := ancestors(key)
+	treeAdd(key, parents, 2, -1)
+	if treeConflict(key, parents, 1) {
+		treeAdd(key, parents, 2, 1)
+		return false
+	}
+	treeAdd(key, parents, 1, 1)
+	return true
+}
+
+// treeAdd moves the holder counts of key and its parents by delta. caller
+// must hold tree
+func treeAdd(key string, parents []string, state, delta int) {
+	node := treeGet(key)
+	if state == 1 {
+		node.writers += delta
+	} else {
+		node.readers += delta
+	}
+	treeDropEmpty(key, node)
+	for _, parent := range parents {
+		node := treeGet(parent)
+		if state == 1 {
+			node.subWriters += delta
+		} else {
+			node.subReaders += delta
+		}
+		treeDropEmpty(parent, node)
+	}
+}
+
+func treeDropEmpty(key string, node *treeNode) {
+	if *node == (treeNode{}) {
+		delete(tree.nodes, key)
+	}
+}
+
+// treeDowngrade turns a write lock on key into a read lock, which never
+// conflicts where the write lock did not, and wakes the tree waiters
+func treeDowngrade(key string) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	parents := ancestors(key)
+	treeAdd(key, parents, 1, -1)
+	treeAdd(key, parents, 2, 1)
+	close(tree.changed)
+	tree.changed = make(chan struct{})
+}
+
+// treeRelease forgets a lock of state on key and wakes everyone waiting
+// on a tree conflict
+func treeRelease(key string, state int) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	treeAdd(key, ancestors(key), state, -1)
+	close(tree.changed)
+	tree.changed = make(chan struct{})
+}
+
+// treeRestore records a lock replayed from the log without checking it
+func treeRestore(key string, state int) {
+	tree.Lock()
+	defer tree.Unlock()
+
+	treeAdd(key, ancestors(key), state, 1)
+}
+
+// treeChanged returns a channel closed on the next release anywhere in the
+// tree, a waiter takes it before trying so it cannot miss a wakeup
+func treeChanged() <-chan struct{} {
+	tree.Lock()
+	defer tree.Unlock()
+
+	return tree.changed
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// heldKey is one key write locked by a multi-key transaction
+type heldKey struct {
+	Key          string `json:"key"`
+	LockID       string `json:"lockId"`
+	FencingToken int64  `json:"fencingToken"`
+}
+
+// txns maps a multi-key transaction id to the locks it still holds. lock
+// order is shard mutex before txns
+var txns = struct {
+	sync.Mutex
+	m map[string]map[lockRef]bool
+}{m: map[string]map[lockRef]bool{}}
+
+// attachTxn adds a granted lock to transaction id. caller must hold the
+// shard mutex of ref.key
+func attachTxn(id string, ref lockRef) {
+	txns.Lock()
+	defer txns.Unlock()
+
+	if txns.m[id] == nil {
+		txns.m[id] = map[lockRef]bool{}
+	}
+	txns.m[id][ref] = true
+}
+
+// detachTxn drops a released lock from transaction id, the transaction is
+// gone along with its last lock. caller must hold the shard mutex of ref.key
+func detachTxn(id string, ref lockRef) {
+	txns.Lock()
+	defer txns.Unlock()
+
+	if locks := txns.m[id]; locks != nil {
+		delete(locks, ref)
+		if len(locks) == 0 {
+			delete(txns.m, id)
+		}
+	}
+}
+
+// lockMulti write locks every one of keys, which must be sorted and
+// distinct, or none of them. the shards involved are locked in index order
+// so two transactions never wait on each other while holding a shard. with
+// wait > 0 it parks until all keys are free, wait elapses or ctx is done,
+// queued on every key like a blocking lock so -fair serves it in turn.
+// it returns the transaction id and its locks in key order, "" if the keys
+// could not all be locked or deadlock if waiting for them would never end
+func lockMulti(ctx context.Context, keys []string, opts lockOptions, wait time.Duration) (string, []heldKey) {
+	var involved []int
+	for _, key := range keys {
+		if i := shardIndex(key); !slices.Contains(involved, i) {
+			involved = append(involved, i)
+		}
+	}
+	slices.Sort(involved)
+	lockAll := func() {
+		for _, i := range involved {
+			shards[i].mu.Lock()
+		}
+	}
+	unlockAll := func() {
+		for _, i := range involved {
+			shards[i].mu.Unlock()
+		}
+	}
+	// a ticket per key once the transaction waits, tickets[i] for keys[i]
+	var tickets []*ticket
+	// dequeue gives up the tickets, caller must hold the shards
+	dequeue := func() {
+		for i, t := range tickets {
+			shardFor(keys[i]).locks[keys[i]].dequeue(t)
+		}
+	}
+	// giveUp dequeues the tickets and drops the waiter ch on blocked
+	giveUp := func(blocked *lockCounter, ch chan struct{}) {
+		lockAll()
+		blocked.dropWaiter(ch)
+		dequeue()
+		unlockAll()
+	}
+
+	var timer *time.Timer
+	if wait > 0 {
+		timer = time.NewTimer(wait)
+		defer timer.Stop()
+	}
+	who := opts.identity()
+	for {
+		var treeCh <-chan struct{}
+		if hierarchical {
+			treeCh = treeChanged()
+		}
+		lockAll()
+		if closedForLocks() {
+			dequeue()
+			unlockAll()
+			return "", nil
+		}
+		var blocked *lockCounter
+		for i, key := range keys {
+			var t *ticket
+			if tickets != nil {
+				t = tickets[i]
+			}
+			counter := shardFor(key).getCounter(key)
+			if counter.state != 0 || !counter.admit(t, 1) ||
+				(hierarchical && !treeFits(key, 1)) {
+				blocked = counter
+				break
+			}
+		}
+		if blocked == nil {
+			txn, held := grantMulti(keys, opts)
+			dequeue()
+			unlockAll()
+			return txn, held
+		}
+		if timer == nil {
+			unlockAll()
+			return "", nil
+		}
+		if tickets == nil {
+			for _, key := range keys {
+				t := shardFor(key).getCounter(key).enqueue(1, opts.priority)
+				t.principal, t.owner, t.addr = opts.principal, opts.owner, opts.addr
+				tickets = append(tickets, t)
+			}
+		}
+		ch := make(chan struct{})
+		blocked.waiters = append(blocked.waiters, ch)
+		unlockAll()
+
+		s := shardFor(blocked.key)
+		unwait := func() {}
+		if len(who) != 0 {
+			unwait = waitFor(who, blocked.key)
+			if deadlocked(who, blocked.key) {
+				unwait()
+				giveUp(blocked, ch)
+				return deadlock, nil
+			}
+		}
+		select {
+		case <-ch:
+		case <-treeCh:
+			s.mu.Lock()
+			blocked.dropWaiter(ch)
+			s.mu.Unlock()
+		case <-timer.C:
+			unwait()
+			giveUp(blocked, ch)
+			return "", nil
+		case <-ctx.Done():
+			unwait()
+			giveUp(blocked, ch)
+			return "", nil
+		}
+		unwait()
+	}
+}
+
+// grantMulti grants the write lock on every one of keys under a new
+// transaction id, undoing the grants made so far if one fails. caller must
+// hold the shard mutex of every key
+func grantMulti(keys []string, opts lockOptions) (string, []heldKey) {
+	opts.txn = newID()
+	held := make([]heldKey, 0, len(keys))
+	for _, key := range keys {
+		counter := shardFor(key).getCounter(key)
+		id := counter.grant(1, opts)
+		if len(id) == 0 {
+			for _, k := range held {
+				shardFor(k.Key).locks[k.Key].release(k.LockID, eventReleased)
+			}
+			return "", nil
+		}
+		held = append(held, heldKey{Key: key, LockID: id, FencingToken: counter.fence})
+	}
+	return opts.txn, held
+}
+
+// unlockMulti releases every lock still held by transaction id of
+// namespace ns, it returns false if there is no such transaction
+func unlockMulti(ns, id string) bool {
+	txns.Lock()
+	locks := txns.m[id]
+	for ref := range locks {
+		if keyNS, _ := splitKey(ref.key); keyNS != ns {
+			locks = nil
+		}
+		break
+	}
+	if locks != nil {
+		delete(txns.m, id)
+	}
+	txns.Unlock()
+
+	if locks == nil {
+		return false
+	}
+	for ref := range locks {
+		s := shardFor(ref.key)
+		s.mu.Lock()
+		if counter := s.locks[ref.key]; counter != nil {
+			if h := counter.lockID[ref.id]; h != nil && h.txn == id {
+				counter.release(ref.id, eventReleased)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// lockMultiJSON posts /lock-multi for keys and decodes its reply
+func lockMultiJSON(t *testing.T, keys ...string) (int, reply) {
+	t.Helper()
+	target := "/lock-multi?"
+	for _, key := range keys {
+		target += "key=" + key + "&"
+	}
+	r := httptest.NewRequest(http.MethodPost, target, nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	lockMultiHandler(w, r)
+	var rep reply
+	json.NewDecoder(w.Body).Decode(&rep)
+	return w.Code, rep
+}
+
+func TestLockMulti(t *testing.T) {
+	t.Cleanup(func() {
+		for _, key := range []string{"txn/a", "txn/b", "txn/c"} {
+			forceUnlock(key, "test")
+		}
+	})
+	code, rep := lockMultiJSON(t, "txn/b", "txn/a", "txn/b")
+	if code != http.StatusOK || len(rep.Txn) == 0 || len(rep.Locks) != 2 {
+		t.Fatalf("lock-multi: %d %+v", code, rep)
+	}
+	if rep.Locks[0].Key != "txn/a" || rep.Locks[1].Key != "txn/b" || rep.Locks[1].FencingToken <= rep.Locks[0].FencingToken {
+		t.Errorf("locks %+v, want txn/a and txn/b granted in key order", rep.Locks)
+	}
+
+	// all or nothing: txn/b is held so txn/c is left alone
+	if code, _ := lockMultiJSON(t, "txn/b", "txn/c"); code != http.StatusConflict {
+		t.Errorf("lock-multi on a held key: %d, want %d", code, http.StatusConflict)
+	}
+	if l, _, _ := lockStatus("txn/c"); l.state != 0 {
+		t.Error("txn/c was locked by a transaction that failed")
+	}
+
+	w := httptest.NewRecorder()
+	unlockMultiHandler(w, httptest.NewRequest(http.MethodPost, "/unlock-multi?txn="+rep.Txn, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlock-multi: %d", w.Code)
+	}
+	for _, key := range []string{"txn/a", "txn/b"} {
+		if l, _, _ := lockStatus(key); l.state != 0 {
+			t.Errorf("%s still locked after unlock-multi", key)
+		}
+	}
+	w = httptest.NewRecorder()
+	unlockMultiHandler(w, httptest.NewRequest(http.MethodPost, "/unlock-multi?txn="+rep.Txn, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unlock-multi of an ended transaction: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestLockMultiFair(t *testing.T) {
+	fair.Store(true)
+	t.Cleanup(func() {
+		fair.Store(false)
+		for _, key := range []string{"txn/f", "txn/g"} {
+			forceUnlock(key, "test")
+		}
+	})
+	held, _ := store.lock("txn/g", lockOptions{})
+	type multi struct {
+		txn  string
+		held []heldKey
+	}
+	done := make(chan multi, 1)
+	go func() {
+		txn, held := lockMulti(context.Background(), []string{"txn/f", "txn/g"}, lockOptions{owner: "multi"}, 5*time.Second)
+		done <- multi{txn, held}
+	}()
+	waitQueued(t, "txn/f", 1)
+	waitQueued(t, "txn/g", 1)
+	// under -fair a lock arriving after the transaction waits behind it
+	if id, _ := store.lock("txn/f", lockOptions{}); len(id) != 0 {
+		t.Fatal("a lock on txn/f went past the transaction queued for it")
+	}
+	granted := make(chan grant, 1)
+	waitInBackground("txn/g", lockOptions{owner: "late"}, granted)
+	waitQueued(t, "txn/g", 2)
+
+	store.unlock("txn/g", held)
+	got := <-done
+	if len(got.txn) == 0 || len(got.held) != 2 {
+		t.Fatalf("lock-multi queued first got %+v, want both keys", got)
+	}
+	if q := queueOf("txn/f", time.Now()); len(q) != 0 {
+		t.Errorf("txn/f queue after the grant: %+v", q)
+	}
+	unlockMulti("", got.txn)
+	if late := <-granted; len(late.id) == 0 {
+		t.Error("the later waiter on txn/g was not served after the transaction")
+	} else {
+		store.unlock("txn/g", late.id)
+	}
+
+	// a transaction that gives up leaves no ticket behind
+	held, _ = store.lock("txn/g", lockOptions{})
+	if txn, _ := lockMulti(context.Background(), []string{"txn/f", "txn/g"}, lockOptions{}, 10*time.Millisecond); len(txn) != 0 {
+		t.Fatal("lock-multi was granted a held key")
+	}
+	if q := queueOf("txn/f", time.Now()); len(q) != 0 {
+		t.Errorf("txn/f queue after lock-multi timed out: %+v", q)
+	}
+	store.unlock("txn/g", held)
+}
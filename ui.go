@@ -0,0 +1,121 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// uiPage is the admin dashboard, a single page that polls /admin/state
+// and calls /force-unlock and /renew with the api key typed into it
+//
+//go:embed ui/index.html
+var uiPage []byte
+
+// hot spots listed by /admin/state
+const uiHotKeys = 20
+
+// queuedKey is a key with blocked requests or write intents queued on it
+type queuedKey struct {
+	Key    string `json:"key"`
+	Queued int    `json:"queued"`
+	Mode   string `json:"mode"`
+}
+
+// hotKey counts the lock requests refused on a key since the start
+type hotKey struct {
+	Key       string `json:"key"`
+	Contended uint64 `json:"contended"`
+}
+
+// sessionInfo is a live session as /admin/state lists it
+type sessionInfo struct {
+	ID      string    `json:"id"`
+	TTL     string    `json:"ttl"`
+	Expires time.Time `json:"expires"`
+	Locks   int       `json:"locks"`
+}
+
+// listQueues returns the keys of namespace ns that requests are queued
+// on, longest queue first
+func listQueues(ns string) []queuedKey {
+	queues := []queuedKey{}
+	for _, s := range shards {
+		s.mu.Lock()
+		for key, counter := range s.locks {
+			if keyNS, _ := splitKey(key); keyNS != ns || len(counter.queue) == 0 {
+				continue
+			}
+			queues = append(queues, queuedKey{Key: clientKey(key), Queued: len(counter.queue), Mode: stateName(counter.state)})
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].Queued != queues[j].Queued {
+			return queues[i].Queued > queues[j].Queued
+		}
+		return queues[i].Key < queues[j].Key
+	})
+	return queues
+}
+
+// hotKeys returns the n most contended keys of namespace ns
+func hotKeys(ns string, n int) []hotKey {
+	metrics.mu.Lock()
+	hot := []hotKey{}
+	for stored, count := range metrics.contention {
+		if keyNS, key := splitKey(stored); keyNS == ns {
+			hot = append(hot, hotKey{Key: key, Contended: count})
+		}
+	}
+	metrics.mu.Unlock()
+
+	sort.Slice(hot, func(i, j int) bool {
+		if hot[i].Contended != hot[j].Contended {
+			return hot[i].Contended > hot[j].Contended
+		}
+		return hot[i].Key < hot[j].Key
+	})
+	return hot[:min(n, len(hot))]
+}
+
+// listSessions returns the live sessions, soonest to expire first
+func listSessions() []sessionInfo {
+	sessions.Lock()
+	list := []sessionInfo{}
+	for id, sess := range sessions.m {
+		list = append(list, sessionInfo{ID: id, TTL: sess.ttl.String(), Expires: sess.expiry.UTC(), Locks: len(sess.locks)})
+	}
+	sessions.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Expires.Before(list[j].Expires) })
+	return list
+}
+
+// adminStateHandler answers GET /admin/state with everything the dashboard
+// shows for the namespace of the request as JSON: held locks, the queues
+// of waiting requests, the most contended keys and the sessions
+func adminStateHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	ns := requestNamespace(r)
+	locks, _ := listLocks(keyFilter{ns: ns, prefix: scopeKey(ns, "")}, "", maxListLimit)
+	writeJSON(w, 0, struct {
+		Locks    []lockEntry   `json:"locks"`
+		Queues   []queuedKey   `json:"queues"`
+		Hot      []hotKey      `json:"hot"`
+		Sessions []sessionInfo `json:"sessions"`
+	}{lockEntries(locks, time.Now()), listQueues(ns), hotKeys(ns, uiHotKeys), listSessions()})
+}
+
+// uiHandler serves the dashboard page, which carries no data of its own
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(uiPage)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// with -unix-socket the api is also served on a unix domain socket, for a
+// sidecar on the same host that should not need a tcp port. who may
+// connect is up to the socket file: the server gives it -unix-socket-mode
+// and the -unix-socket-group, a process needs write permission on it to
+// connect. the socket speaks plain http whatever -tls-cert says, api keys
+// and the acl apply as on the tcp port
+
+// serveUnix serves s on the unix socket at path, created with the octal
+// permissions mode and owned by group unless it is empty. shutting s down
+// closes it with the tcp listener, removing the socket
+func serveUnix(s *http.Server, path, mode, group string, maxConns int) error {
+	m, err := parseFileMode(mode)
+	if err != nil {
+		return fmt.Errorf("-unix-socket-mode: %v", err)
+	}
+	l, err := listenUnix(path, m, group)
+	if err != nil {
+		return fmt.Errorf("-unix-socket: %v", err)
+	}
+	go func() {
+		// plain http whatever the tls config of s
+		if err := s.Serve(newLimitListener(l, maxConns)); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+// listenUnix listens on the unix socket at path with mode and, unless
+// group is empty, owned by group. a socket left behind by an earlier run
+// is replaced, any other file at path is an error
+func listenUnix(path string, mode fs.FileMode, group string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		// a server still listening there answers, a stale socket refuses
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	gid := -1
+	if len(group) != 0 {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("group %s has no numeric id", group)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// the socket has the umask's permissions until here, a directory only
+	// the allowed users may enter closes that gap
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if gid != -1 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// parseFileMode parses an octal permission mode such as 0660
+func parseFileMode(s string) (fs.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("%q is not an octal permission mode", s)
+	}
+	return fs.FileMode(mode), nil
+}
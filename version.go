@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// apiVersions are the api versions this server answers, oldest first. a
+// change existing clients would trip over, like JSON request bodies or
+// new semantics for a route, ships as a new version under /vN/ while the
+// older versions keep answering as they did
+var apiVersions = []int{1}
+
+// legacyVersion is the version the unversioned routes answer unless the
+// client asks for another with versionHeader
+const legacyVersion = 1
+
+// versionHeader carries the version a request was answered as, and on an
+// unversioned route the version the client asks for
+const versionHeader = "Lockserver-Api-Version"
+
+var errVersion = failure{code: "unsupported_version", status: http.StatusBadRequest}
+
+type versionKey struct{}
+
+// apiVersion returns the api version r is answered as, for handlers whose
+// behaviour differs between versions
+func apiVersion(r *http.Request) int {
+	if v, ok := r.Context().Value(versionKey{}).(int); ok {
+		return v
+	}
+	return legacyVersion
+}
+
+// versioned serves handler as api version v
+func versioned(v int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(versionHeader, strconv.Itoa(v))
+		handler(w, r.WithContext(context.WithValue(r.Context(), versionKey{}, v)))
+	}
+}
+
+// legacy serves the unversioned route path as legacyVersion, or as the
+// version the request's versionHeader names, and links to the versioned
+// route clients should move to
+func legacy(path string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := legacyVersion
+		if asked := r.Header.Get(versionHeader); len(asked) != 0 {
+			var err error
+			if v, err = strconv.Atoi(asked); err != nil || !slices.Contains(apiVersions, v) {
+				f := errVersion
+				f.text = fmt.Sprintf("unsupported api version %q, this server answers %s", asked, versionList())
+				replyFailure(w, r, f)
+				return
+			}
+		}
+		w.Header().Set("Link", fmt.Sprintf(`</v%d%s>; rel="successor-version"`, v, path))
+		versioned(v, handler)(w, r)
+	}
+}
+
+func versionList() string {
+	names := make([]string, len(apiVersions))
+	for i, v := range apiVersions {
+		names[i] = strconv.Itoa(v)
+	}
+	return strings.Join(names, ", ")
+}
+
+// postOr serves POST requests with post and every other method with other,
+// for paths two apis share
+func postOr(post, other http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			post(w, r)
+			return
+		}
+		other(w, r)
+	}
+}
+
+// versionsHandler answers GET /versions with the api versions served, one
+// per line, and the one the unversioned routes default to
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if wantsJSON(r) {
+		writeJSON(w, 0, struct {
+			Versions []int `json:"versions"`
+			Legacy   int   `json:"legacy"`
+		}{apiVersions, legacyVersion})
+		return
+	}
+	for _, v := range apiVersions {
+		fmt.Fprintf(w, "v%d\n", v)
+	}
+	fmt.Fprintf(w, "legacy v%d\n", legacyVersion)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+)
+
+// a key's version is the fencing token of the last write lock on it to
+// end, by release or downgrade, 0 for a key never write locked. tokens
+// only grow, so a version never comes back for a key: a client can read
+// it, work without holding the lock and commit by taking the write lock
+// with if-version=, which is refused if anybody wrote in between
+
+// versionFloor is the version of the keys not in the lock table, the
+// highest version of those dropped from it. a key dropped while idle may
+// fail a check it would have passed, never pass one it should have failed
+var versionFloor atomic.Int64
+
+var errStaleVersion = failure{code: "stale_version", text: "key was written since that version", status: http.StatusConflict}
+
+// keyVersionHeader carries the version of the key a lock was granted on
+const keyVersionHeader = "Key-Version"
+
+// keyVersion returns the version of path
+func keyVersion(path string) int64 {
+	s := shardFor(path)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counter := s.locks[path]
+	if counter == nil {
+		return versionFloor.Load()
+	}
+	return counter.version
+}
+
+// versionParam reads if-version= into opts, it returns false if the value
+// is malformed
+func versionParam(query url.Values, opts *lockOptions) bool {
+	v := query.Get("if-version")
+	if len(v) == 0 {
+		return true
+	}
+	var err error
+	if opts.ifVersion, err = strconv.ParseInt(v, 10, 64); err != nil || opts.ifVersion < 0 {
+		return false
+	}
+	opts.checkVersion = true
+	return true
+}
+
+// versionHandler answers GET /version?key=PATH with the version of PATH,
+// JSON clients get {"status": "success", "version": N}
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	path, ok := keyParam(r, r.URL.Query())
+	if !ok {
+		replyFailure(w, r, errBadRequest)
+		return
+	}
+	v := keyVersion(path)
+	w.Header().Set(keyVersionHeader, strconv.FormatInt(v, 10))
+	if wantsJSON(r) {
+		writeJSON(w, 0, reply{Status: "success", Version: &v})
+		return
+	}
+	fmt.Fprintf(w, "%d\n", v)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// walRecord is one line of the write-ahead log
+type walRecord struct {
+	// "grant", "renew", "hold", "upgrade", "downgrade", "release", "session",
+	// "endsession", "version", "value", "unset", "count" or "next", the
+	// latter records nextFence so fencing tokens are not reused once
+	// compaction has dropped their grants. "version" records the version
+	// of a key in a snapshot, "value" sets the value of a key and "unset"
+	// deletes it, "count" sets the counter of a key
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	ID    walID  `json:"id,omitempty"`
+	State int    `json:"state,omitempty"`
+	// lease deadline in unix nanoseconds, 0 if the lock has no ttl
+	Expiry int64 `json:"expiry,omitempty"`
+	// fencing token of a write grant, on "next" records the next token
+	Fence int64 `json:"fence,omitempty"`
+	// grant time in unix nanoseconds
+	Acquired  int64  `json:"acquired,omitempty"`
+	Principal string `json:"principal,omitempty"`
+	Session   string `json:"session,omitempty"`
+	// session heartbeat ttl in nanoseconds
+	TTL   int64  `json:"ttl,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	// hold count of a reentrant lock, absent means 1
+	Holds int `json:"holds,omitempty"`
+	// multi-key transaction of a grant
+	Txn walID `json:"txn,omitempty"`
+	// client address of a grant
+	Addr string `json:"addr,omitempty"`
+	// purpose and labels of a grant
+	Purpose string            `json:"purpose,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// key version of a "version" record, versionFloor on a "next" record
+	Version int64 `json:"version,omitempty"`
+	// the value of a "value" record, absent for an empty one
+	Value []byte `json:"value,omitempty"`
+	// the counter of a "count" record, absent for 0
+	Count int64 `json:"count,omitempty"`
+	// fencing epoch of a "next" record, see failover.go
+	Epoch int64 `json:"epoch,omitempty"`
+}
+
+// walID is a lock or transaction id in the log. logs written before ids
+// were random tokens hold plain numbers, they are read back as their
+// decimal strings which is what clients send for them
+type walID string
+
+func (id *walID) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		*id = walID(strconv.FormatInt(n, 10))
+		return nil
+	}
+	return json.Unmarshal(b, (*string)(id))
+}
+
+func grantRecord(key, id string, state int, h *holder, fence int64) walRecord {
+	rec := walRecord{Op: "grant", Key: key, ID: walID(id), State: state, Fence: fence,
+		Acquired: h.acquired.UnixNano(), Principal: h.principal, Session: h.session, Owner: h.owner, Txn: walID(h.txn),
+		Addr: h.addr, Purpose: h.purpose, Labels: h.labels}
+	if h.holds > 1 {
+		rec.Holds = h.holds
+	}
+	if !h.expiry.IsZero() {
+		rec.Expiry = h.expiry.UnixNano()
+	}
+	return rec
+}
+
+// walLog is an append-only log of every grant and release, replayed on
+// startup so held locks survive a restart. a nil *walLog logs nothing.
+// lock order is shard mutex before sessions before mu
+type walLog struct {
+	// serializes appends from the shards
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// the length of the log up to its last whole record
+	size int64
+	// the error of the latest append, nil once one succeeds again
+	err error
+	// set once the log can't be trusted to hold what was appended, every
+	// append after fails with err
+	broken bool
+	// set by close, the compactor is gone
+	closed bool
+	// the log is compacted once it grows past compactAt and twice the
+	// size it had after the last compaction, 0 never compacts while
+	// serving. base is that size
+	compactAt, base int64
+	// wakes the compactor, nil if there is none
+	compacting chan struct{}
+}
+
+// wal is the log in use, nil if persistence is disabled. it is set once at
+// startup before any request is served
+var wal *walLog
+
+// openWAL replays the log at path into the lock table, compacts it down to
+// the locks that are still held and opens it for appending. once it grows
+// past compactAt bytes it is compacted again in the background, 0 leaves
+// it to grow until the next start. it must be called before the server
+// starts handling requests
+func openWAL(path string, compactAt int64) (*walLog, error) {
+	if err := replayWAL(path); err != nil {
+		return nil, err
+	}
+	if err := compactWAL(path); err != nil {
+		return nil, err
+	}
+	f, size, err := appendTo(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &walLog{path: path, f: f, size: size, compactAt: compactAt, base: size}
+	if compactAt > 0 {
+		l.compacting = make(chan struct{}, 1)
+		go func() {
+			for range l.compacting {
+				l.compact()
+			}
+		}()
+	}
+	return l, nil
+}
+
+// appendTo opens the log at path for appending and returns its length
+func appendTo(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// replayWAL applies every record of the log at path to the lock table, a
+// missing log is an empty one. a bad record is only forgiven at the end of
+// the log, where a crash mid-write leaves it torn: with whole records
+// after it the log is corrupt and replaying around the hole would hand out
+// locks that are held, so it fails
+func replayWAL(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(bytes.TrimSpace(b)) == 0 {
+			if err == io.EOF {
+				return nil
+			}
+			continue
+		}
+		var rec walRecord
+		if bad := json.Unmarshal(b, &rec); bad != nil {
+			if next := wholeRecordAfter(in); next != 0 {
+				return fmt.Errorf("%s:%d: bad record followed by whole ones from line %d: %v", path, line, line+next, bad)
+			}
+			// a torn final record, everything before it is intact
+			slog.Warn("wal replay stopped at torn final record", "line", line, "err", bad)
+			return nil
+		}
+		applyRecord(rec)
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// wholeRecordAfter counts the lines read up to the next whole record in
+// in, 0 if there is none
+func wholeRecordAfter(in *bufio.Reader) int {
+	for n := 1; ; n++ {
+		b, err := in.ReadBytes('\n')
+		var rec walRecord
+		if len(bytes.TrimSpace(b)) != 0 && json.Unmarshal(b, &rec) == nil {
+			return n
+		}
+		if err != nil {
+			return 0
+		}
+	}
+}
+
+// applyRecord replays one log record into the lock table, before any
+// request is served or, on a follower, under the lock the leader logged it
+// under
+func applyRecord(rec walRecord) {
+	if rec.Op == "next" {
+		raise(&nextFence, rec.Fence)
+		raise(&versionFloor, rec.Version)
+		raise(&epoch, rec.Epoch)
+		return
+	}
+	id := string(rec.ID)
+	switch rec.Op {
+	case "session":
+		// heartbeats are not logged, a replayed session gets a full
+		// ttl from now to reconnect
+		ttl := time.Duration(rec.TTL)
+		sessions.m[rec.Session] = &session{ttl: ttl, expiry: time.Now().Add(ttl), locks: map[lockRef]bool{}}
+		return
+	case "endsession":
+		delete(sessions.m, rec.Session)
+		return
+	case "count":
+		setCount(shardFor(rec.Key), rec.Key, rec.Count)
+		return
+	}
+	counter := shardFor(rec.Key).getCounter(rec.Key)
+	switch rec.Op {
+	case "grant":
+		counter.state = strongest(counter.state, rec.State)
+		h := &holder{mode: rec.State, acquired: time.Unix(0, rec.Acquired), principal: rec.Principal, session: rec.Session,
+			owner: rec.Owner, holds: max(rec.Holds, 1), txn: string(rec.Txn), addr: rec.Addr, purpose: rec.Purpose,
+			labels: rec.Labels}
+		if rec.Expiry != 0 {
+			h.expiry = time.Unix(0, rec.Expiry)
+			scheduleExpiry(rec.Key, id, h.expiry, false)
+		}
+		counter.lockID[id] = h
+		nsRestore(rec.Key)
+		clientRestore(h.quotaClient())
+		if hierarchical {
+			treeRestore(rec.Key, rec.State)
+		}
+		if len(h.session) != 0 {
+			attachLock(h.session, lockRef{rec.Key, id})
+		}
+		if len(h.txn) != 0 {
+			attachTxn(h.txn, lockRef{rec.Key, id})
+		}
+		if rec.Fence != 0 {
+			counter.fence = rec.Fence
+			raise(&nextFence, rec.Fence+1)
+		}
+	case "hold":
+		if h := counter.lockID[id]; h != nil {
+			h.holds = rec.Holds
+		}
+	case "upgrade":
+		counter.state = 1
+		if h := counter.lockID[id]; h != nil {
+			h.mode = 1
+		}
+		counter.fence = rec.Fence
+		raise(&nextFence, rec.Fence+1)
+		if hierarchical {
+			treeRelease(rec.Key, 2)
+			treeRestore(rec.Key, 1)
+		}
+	case "version":
+		counter.version = rec.Version
+	case "value":
+		counter.value = append([]byte{}, rec.Value...)
+	case "unset":
+		counter.value = nil
+	case "downgrade":
+		counter.state = 2
+		counter.version = counter.fence
+		if h := counter.lockID[id]; h != nil {
+			h.mode = 2
+		}
+		if hierarchical {
+			treeDowngrade(rec.Key)
+		}
+	case "renew":
+		if h := counter.lockID[id]; h != nil {
+			h.expiry = time.Unix(0, rec.Expiry)
+			scheduleExpiry(rec.Key, id, h.expiry, false)
+		}
+	case "release":
+		counter.forget(id)
+	}
+}
+
+// forget drops the lockID id of counter on replay of its release, undoing
+// what its grant record restored. unlike release it logs nothing and
+// counts, audits and publishes nothing: that happened when it was released
+func (counter *lockCounter) forget(id string) {
+	h := counter.lockID[id]
+	if h == nil {
+		return
+	}
+	if len(h.session) != 0 {
+		detachLock(h.session, lockRef{counter.key, id})
+	}
+	if len(h.txn) != 0 {
+		detachTxn(h.txn, lockRef{counter.key, id})
+	}
+	if hierarchical {
+		treeRelease(counter.key, h.mode)
+	}
+	unreserve(counter.key, h.quotaClient())
+	delete(counter.lockID, id)
+	if len(counter.lockID) == 0 && counter.state == 1 {
+		counter.version = counter.fence
+	}
+	counter.state = 0
+	for _, h := range counter.lockID {
+		counter.state = strongest(counter.state, h.mode)
+	}
+	counter.wakeup()
+}
+
+// compact swaps the log for a snapshot of the lock table once it has grown
+// past its threshold. every shard and the sessions are locked meanwhile,
+// so nothing is granted or released between the snapshot and the swap and
+// requests wait for the snapshot to be written and synced. a failed
+// compaction leaves the old log in place to grow on
+func (l *walLog) compact() {
+	for _, s := range shards {
+		s.mu.Lock()
+	}
+	sessions.Lock()
+	l.mu.Lock()
+	defer func() {
+		l.mu.Unlock()
+		sessions.Unlock()
+		for _, s := range shards {
+			s.mu.Unlock()
+		}
+	}()
+	if l.broken || !l.oversized() {
+		return
+	}
+	if err := compactWAL(l.path); err != nil {
+		slog.Error("wal compaction failed, the log grows on", "err", err)
+		return
+	}
+	f, size, err := appendTo(l.path)
+	if err != nil {
+		// the log on disk is the snapshot, what is appended to the old
+		// one would be lost on restart
+		l.err, l.broken = err, true
+		slog.Error("wal can't be reopened after compaction, every write fails from now on", "err", err)
+		return
+	}
+	l.f.Close()
+	slog.Info("wal compacted", "from", l.size, "to", size)
+	l.f, l.size, l.base = f, size, size
+}
+
+// oversized reports whether the log is due for compaction. caller must
+// hold l.mu
+func (l *walLog) oversized() bool {
+	return l.compactAt > 0 && !l.closed && l.size > max(l.compactAt, 2*l.base)
+}
+
+// compactWAL rewrites the log at path so it only holds grants for the locks
+// currently held. the caller keeps the table from changing meanwhile
+func compactWAL(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory dir so a rename into it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeSnapshot writes the records that rebuild the lock table as it is: the
+// next fencing token, the sessions, the key versions, values and counters
+// and a grant per held lockID. the caller keeps the table from changing meanwhile
+func writeSnapshot(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(epochRecord()); err != nil {
+		return err
+	}
+	for id, sess := range sessions.m {
+		if err := enc.Encode(walRecord{Op: "session", Session: id, TTL: int64(sess.ttl)}); err != nil {
+			return err
+		}
+	}
+	for _, s := range shards {
+		for key, count := range s.counts {
+			if err := enc.Encode(walRecord{Op: "count", Key: key, Count: count}); err != nil {
+				return err
+			}
+		}
+		for key, counter := range s.locks {
+			if counter.version != versionFloor.Load() {
+				if err := enc.Encode(walRecord{Op: "version", Key: key, Version: counter.version}); err != nil {
+					return err
+				}
+			}
+			if counter.value != nil {
+				if err := enc.Encode(valueRecord(key, counter.value)); err != nil {
+					return err
+				}
+			}
+			for id, h := range counter.lockID {
+				var fence int64
+				if counter.state == 1 {
+					fence = counter.fence
+				}
+				if err := enc.Encode(grantRecord(key, id, h.mode, h, fence)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// append writes rec and syncs it to disk before returning. a record that
+// fails to write is cut off again so the next one starts on a clean line,
+// if that fails too or the sync fails, after which the kernel may have
+// dropped what it could not write, the log is broken for good
+func (l *walLog) append(rec walRecord) error {
+	if l == nil {
+		replicate(rec)
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.broken {
+		return l.err
+	}
+	b, _ := json.Marshal(rec)
+	if _, l.err = l.f.Write(append(b, '\n')); l.err != nil {
+		if err := l.f.Truncate(l.size); err != nil {
+			l.broken = true
+			slog.Error("wal can't be repaired, every write fails from now on", "err", err)
+		}
+		return l.err
+	}
+	if l.err = l.f.Sync(); l.err != nil {
+		l.broken = true
+		slog.Error("wal sync failed, every write fails from now on", "err", l.err)
+		return l.err
+	}
+	l.size += int64(len(b)) + 1
+	if l.oversized() {
+		// the compactor needs the shard mutexes the caller may hold
+		select {
+		case l.compacting <- struct{}{}:
+		default:
+		}
+	}
+	// followers only hear of what is logged
+	replicate(rec)
+	return nil
+}
+
+// failing returns the error of the latest append, nil if it succeeded
+func (l *walLog) failing() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *walLog) grant(key, id string, state int, h *holder, fence int64) error {
+	return l.append(grantRecord(key, id, state, h, fence))
+}
+
+func (l *walLog) renew(key, id string, deadline time.Time) error {
+	return l.append(walRecord{Op: "renew", Key: key, ID: walID(id), Expiry: deadline.UnixNano()})
+}
+
+func (l *walLog) createSession(id string, ttl time.Duration) error {
+	return l.append(walRecord{Op: "session", Session: id, TTL: int64(ttl)})
+}
+
+func (l *walLog) endSession(id string) error {
+	return l.append(walRecord{Op: "endsession", Session: id})
+}
+
+func (l *walLog) hold(key, id string, holds int) error {
+	return l.append(walRecord{Op: "hold", Key: key, ID: walID(id), Holds: holds})
+}
+
+func (l *walLog) upgrade(key, id string, fence int64) error {
+	return l.append(walRecord{Op: "upgrade", Key: key, ID: walID(id), Fence: fence})
+}
+
+func (l *walLog) downgrade(key, id string) error {
+	return l.append(walRecord{Op: "downgrade", Key: key, ID: walID(id)})
+}
+
+// valueRecord sets the value of key, or deletes it if value is nil
+func valueRecord(key string, value []byte) walRecord {
+	if value == nil {
+		return walRecord{Op: "unset", Key: key}
+	}
+	return walRecord{Op: "value", Key: key, Value: value}
+}
+
+func (l *walLog) putValue(key string, value []byte) error {
+	return l.append(valueRecord(key, value))
+}
+
+func (l *walLog) setCount(key string, count int64) error {
+	return l.append(walRecord{Op: "count", Key: key, Count: count})
+}
+
+func (l *walLog) release(key, id string) error {
+	return l.append(walRecord{Op: "release", Key: key, ID: walID(id)})
+}
+
+// close syncs and closes the log and stops its compactor, appends after it
+// fail
+func (l *walLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.compacting != nil {
+		close(l.compacting)
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeWAL writes a log of records to a temporary file, then tail, and
+// returns its path
+func writeWAL(t *testing.T, tail string, records ...walRecord) string {
+	t.Helper()
+	var b strings.Builder
+	for _, rec := range records {
+		line, _ := json.Marshal(rec)
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	b.WriteString(tail)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// replayed opens the log at path and cleans up the locks and session it
+// restores
+func replayed(t *testing.T, path string, keys ...string) (*walLog, error) {
+	t.Helper()
+	return replayedCompacting(t, path, 0, keys...)
+}
+
+// replayedCompacting is replayed for a log compacted past compactAt bytes
+func replayedCompacting(t *testing.T, path string, compactAt int64, keys ...string) (*walLog, error) {
+	t.Helper()
+	l, err := openWAL(path, compactAt)
+	t.Cleanup(func() {
+		l.close()
+		for _, key := range keys {
+			forceUnlock(key, "test")
+		}
+		delete(sessions.m, "wal-s")
+	})
+	return l, err
+}
+
+func TestWALReplayCompact(t *testing.T) {
+	sub := subscribe("", []string{"wal/a", "wal/b"}, nil)
+	defer unsubscribe(sub)
+	path := writeWAL(t, "",
+		walRecord{Op: "session", Session: "wal-s", TTL: int64(sessionTTL.Load())},
+		walRecord{Op: "grant", Key: "wal/a", ID: "a1", State: 1, Fence: 7, Session: "wal-s"},
+		walRecord{Op: "grant", Key: "wal/b", ID: "b1", State: 2, Session: "wal-s"},
+		walRecord{Op: "release", Key: "wal/b", ID: "b1"},
+	)
+	if _, err := replayed(t, path, "wal/a", "wal/b"); err != nil {
+		t.Fatal(err)
+	}
+	if l, _, fence := lockStatus("wal/a"); l.state != 1 || fence != 7 {
+		t.Errorf("wal/a: state %d fence %d, want write lock 7", l.state, fence)
+	}
+	if l, _, _ := lockStatus("wal/b"); l.state != 0 {
+		t.Errorf("wal/b: state %d after its release was replayed", l.state)
+	}
+	if locks := sessions.m["wal-s"].locks; len(locks) != 1 || !locks[lockRef{"wal/a", "a1"}] {
+		t.Errorf("session locks %v, want only wal/a", locks)
+	}
+	select {
+	case ev := <-sub.ch:
+		t.Errorf("replay published %s of %s", ev.Type, ev.Key)
+	default:
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	grants := map[string]bool{}
+	for in := bufio.NewScanner(f); in.Scan(); {
+		var rec walRecord
+		if err := json.Unmarshal(in.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		switch rec.Op {
+		case "grant":
+			grants[rec.Key] = true
+		case "release":
+			t.Errorf("compacted log holds a release of %s", rec.Key)
+		}
+	}
+	if len(grants) != 1 || !grants["wal/a"] {
+		t.Errorf("compacted log grants %v, want only wal/a", grants)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	path := writeWAL(t, `{"op":"grant","key":"wal/c","id":"c2","st`,
+		walRecord{Op: "grant", Key: "wal/c", ID: "c1", State: 1, Fence: 3},
+	)
+	if _, err := replayed(t, path, "wal/c"); err != nil {
+		t.Fatalf("torn final record: %v", err)
+	}
+	if l, _, _ := lockStatus("wal/c"); len(l.ids) != 1 {
+		t.Errorf("wal/c held by %v, want c1 alone", l.ids)
+	}
+}
+
+func TestWALCorrupt(t *testing.T) {
+	path := writeWAL(t, "", walRecord{Op: "grant", Key: "wal/d", ID: "d1", State: 1, Fence: 3})
+	good, _ := json.Marshal(walRecord{Op: "grant", Key: "wal/e", ID: "e1", State: 1, Fence: 4})
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString("{\"op\":\"release\",\"key\n")
+	f.Write(append(good, '\n'))
+	f.Close()
+	if _, err := replayed(t, path, "wal/d", "wal/e"); err == nil {
+		t.Fatal("a bad record followed by a whole one was replayed")
+	}
+}
+
+// logged reads the records of the log at path
+func logged(t *testing.T, path string) []walRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []walRecord
+	for in := bufio.NewScanner(f); in.Scan(); {
+		var rec walRecord
+		if err := json.Unmarshal(in.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestWALCompactWhileServing(t *testing.T) {
+	path := writeWAL(t, "")
+	l, err := replayedCompacting(t, path, 4096, "wal/g", "wal/h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal = l
+	t.Cleanup(func() { wal = nil })
+	start := l.base
+	held, _ := store.lock("wal/h", lockOptions{})
+	for range 100 {
+		id, _ := store.lock("wal/g", lockOptions{})
+		store.unlock("wal/g", id)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		base := l.base
+		l.mu.Unlock()
+		if base != start {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the log was not compacted past 4096 bytes")
+		}
+	}
+	// appends go on to the compacted log, which kept the held lock
+	again, _ := store.lock("wal/g", lockOptions{})
+	recs := logged(t, path)
+	grants := map[string]bool{}
+	for _, rec := range recs {
+		if rec.Op == "grant" {
+			grants[string(rec.ID)] = true
+		}
+	}
+	if !grants[held] || !grants[again] {
+		t.Errorf("compacted log grants %v, want %s and %s among them", grants, held, again)
+	}
+	if len(recs) >= 200 {
+		t.Errorf("%d records after 200 were appended and the log was compacted", len(recs))
+	}
+}
+
+// fullWAL returns a log on a disk with no room left, every write to it
+// fails. the test is skipped where there is no /dev/full
+func fullWAL(t *testing.T) *walLog {
+	t.Helper()
+	f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no /dev/full")
+	}
+	l := &walLog{f: f}
+	t.Cleanup(func() { l.close() })
+	return l
+}
+
+func TestWALBroken(t *testing.T) {
+	l := fullWAL(t)
+	if err := l.release("wal/f", "f1"); err == nil {
+		t.Fatal("a write to a full disk succeeded")
+	}
+	if l.failing() == nil {
+		t.Error("the log is not failing after a write failed")
+	}
+	if !l.broken {
+		t.Error("a log that could not be cut back is not broken")
+	}
+}
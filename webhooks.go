@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// webhooks POST lock events to urls configured with -webhooks, e.g. to
+// page someone when a critical lock is force-released or expires. each
+// url has a queue and a goroutine of its own delivering its events in
+// order, with retries. a url that can't keep up loses events rather than
+// holding up the lock table
+
+// how many events a webhook may have waiting before new ones are dropped
+const webhookBuffer = 1024
+
+// how often a delivery is tried, waiting webhookBackoff before the second
+// attempt and twice as long before each further one
+const (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+)
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the body under the
+// -webhook-secret, as "sha256=HEX"
+const webhookSignatureHeader = "Lockserver-Signature"
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhook is one line of the -webhooks file: the events of the kinds in
+// events, or every kind if it is empty, on the keys rule covers are
+// posted to url
+type webhook struct {
+	rule   aclRule
+	url    string
+	events map[string]bool
+	queue  chan lockEvent
+}
+
+type webhookSet struct {
+	hooks []*webhook
+}
+
+// webhooks is the set loaded from -webhooks, nil for none. it is swapped
+// under the broker mutex so publish never sends to a closed queue
+var webhooks atomic.Pointer[webhookSet]
+
+// webhookSecret signs the deliveries, empty leaves them unsigned
+var webhookSecret atomic.Pointer[[]byte]
+
+// webhookPayload is the body of a delivery, the event as /ws sends it with
+// the namespace of its key
+type webhookPayload struct {
+	Namespace string `json:"namespace,omitempty"`
+	lockEvent
+}
+
+// loadWebhooks reads a file with one "PATTERN URL [EVENT[,EVENT...]]" hook
+// per line. PATTERN is a key, a prefix ending in * or * for every key, as
+// the clients of any namespace know it. EVENT is an event type such as
+// granted, released, expired or force-released, without any every event
+// is posted. blank lines and lines starting with # are ignored
+func loadWebhooks(path string) (*webhookSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	set := &webhookSet{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: want PATTERN URL [EVENTS]", path, line)
+		}
+		u, err := url.Parse(fields[1])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("%s:%d: bad url %q", path, line, fields[1])
+		}
+		hook := &webhook{url: fields[1], events: map[string]bool{}}
+		if prefix, ok := strings.CutSuffix(fields[0], "*"); ok {
+			hook.rule.prefix = prefix
+		} else {
+			hook.rule.prefix, hook.rule.exact = fields[0], true
+		}
+		if len(fields) == 3 {
+			for _, name := range strings.Split(fields[2], ",") {
+				if !eventTypes[name] {
+					return nil, fmt.Errorf("%s:%d: unknown event %q", path, line, name)
+				}
+				hook.events[name] = true
+			}
+		}
+		set.hooks = append(set.hooks, hook)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// loadSecret reads a shared secret, such as the HMAC key of the webhook
+// deliveries, from path without surrounding white space
+func loadSecret(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(b)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s: empty secret", path)
+	}
+	return secret, nil
+}
+
+// setWebhooks puts set in place of the webhooks in use, whose queues are
+// closed once they are no longer fed: their goroutines deliver what is
+// queued and exit
+func setWebhooks(set *webhookSet) {
+	if set != nil {
+		for _, hook := range set.hooks {
+			hook.queue = make(chan lockEvent, webhookBuffer)
+			go hook.deliver()
+		}
+	}
+	broker.Lock()
+	old := webhooks.Swap(set)
+	broker.Unlock()
+	if old != nil {
+		for _, hook := range old.hooks {
+			close(hook.queue)
+		}
+	}
+}
+
+// notifyWebhooks queues ev for every webhook wanting it without blocking.
+// caller must hold the broker mutex
+func notifyWebhooks(ev lockEvent) {
+	set := webhooks.Load()
+	if set == nil {
+		return
+	}
+	key := clientKey(ev.Key)
+	for _, hook := range set.hooks {
+		if !hook.rule.covers(key, false) || (len(hook.events) != 0 && !hook.events[ev.Type]) {
+			continue
+		}
+		select {
+		case hook.queue <- ev:
+		default:
+			slog.Warn("webhook queue full, event dropped", "url", hook.url, "type", ev.Type, "key", key)
+		}
+	}
+}
+
+// deliver posts the queued events one at a time until the queue is closed
+func (hook *webhook) deliver() {
+	for ev := range hook.queue {
+		ns, key := splitKey(ev.Key)
+		ev.Key = key
+		body, _ := json.Marshal(webhookPayload{Namespace: ns, lockEvent: ev})
+		backoff := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := hook.post(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				slog.Error("webhook delivery failed", "url", hook.url, "type", ev.Type, "key", key, "err", err)
+				break
+			}
+			slog.Debug("webhook delivery failed, retrying", "url", hook.url, "attempt", attempt, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post sends one delivery, an error for anything but a 2xx answer
+func (hook *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := webhookSecret.Load(); secret != nil && len(*secret) != 0 {
+		mac := hmac.New(sha256.New, *secret)
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("answered %s", resp.Status)
+	}
+	return nil
+}